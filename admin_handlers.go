@@ -0,0 +1,308 @@
+package shopping
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// HandleAdminGetProducts lists every product in the catalog
+func (s *Service) HandleAdminGetProducts(w http.ResponseWriter, r *http.Request) {
+	products, err := s.dao.GetProducts()
+	if err != nil {
+		s.writeError(w, errInternalServerError.msg("dao.GetProducts: "+err.Error()))
+		return
+	}
+	s.writeJSON(w, struct {
+		Products Products `json:"products"`
+	}{Products: products})
+}
+
+// HandleAdminCreateProduct adds a product to the catalog, it gets the next free ID when it has none
+func (s *Service) HandleAdminCreateProduct(w http.ResponseWriter, r *http.Request) {
+	product := &Product{}
+	if err := json.NewDecoder(r.Body).Decode(product); err != nil {
+		s.writeError(w, invalidProduct(fmt.Errorf("failed to decode req: %v", err)))
+		return
+	}
+	product.Available = 0
+	if err := s.checkProduct(product); err != nil {
+		s.writeError(w, invalidProduct(err))
+		return
+	}
+	if err := s.dao.CreateProduct(product); err != nil {
+		s.writeError(w, toError(err, "dao.CreateProduct"))
+		return
+	}
+	product.Available = product.Stock
+	s.writeJSON(w, struct {
+		Product *Product `json:"product"`
+	}{Product: product})
+}
+
+// HandleAdminReplaceProduct overwrites every field of a product, the stock can't go below what's held in carts.
+// Wishlists are told when it's back in stock.
+func (s *Service) HandleAdminReplaceProduct(w http.ResponseWriter, r *http.Request) {
+	id, idErr := productID(r)
+	if idErr != nil {
+		s.writeError(w, idErr)
+		return
+	}
+	req := &Product{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		s.writeError(w, invalidProduct(fmt.Errorf("failed to decode req: %v", err)))
+		return
+	}
+	if req.ID != 0 && req.ID != id {
+		s.writeError(w, errBadRequestInvalidProduct.msg("the ID of a product can't change"))
+		return
+	}
+
+	var before *Product
+	product, err := s.dao.UpdateProduct(id, func(p *Product) error {
+		before = p.copy()
+		*p = Product{ID: id, Type: req.Type, Name: req.Name, Stock: req.Stock, Price: req.Price}
+		if err := s.checkProduct(p); err != nil {
+			return invalidProduct(err)
+		}
+		return nil
+	})
+	if err != nil {
+		s.writeError(w, toError(err, "dao.UpdateProduct"))
+		return
+	}
+	s.notifyBackInStock(before, product)
+	s.writeJSON(w, struct {
+		Product *Product `json:"product"`
+	}{Product: product})
+}
+
+// HandleAdminUpdateProduct changes only the fields sent, restock adds to the stock,
+// or takes from it when negative, so it's safe while the product is being sold.
+// The stock can't go below what's held in carts. Wishlists are told when it's back in stock.
+func (s *Service) HandleAdminUpdateProduct(w http.ResponseWriter, r *http.Request) {
+	id, idErr := productID(r)
+	if idErr != nil {
+		s.writeError(w, idErr)
+		return
+	}
+	req := struct {
+		Type    *int    `json:"type,omitempty"`
+		Name    *string `json:"name,omitempty"`
+		Price   *Money  `json:"price,omitempty"`
+		Stock   *int    `json:"stock,omitempty"`
+		Restock int     `json:"restock,omitempty"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, invalidProduct(fmt.Errorf("failed to decode req: %v", err)))
+		return
+	}
+
+	var before *Product
+	product, err := s.dao.UpdateProduct(id, func(p *Product) error {
+		before = p.copy()
+		if req.Type != nil {
+			p.Type = *req.Type
+		}
+		if req.Name != nil {
+			p.Name = *req.Name
+		}
+		if req.Price != nil {
+			p.Price = *req.Price
+		}
+		if req.Stock != nil {
+			p.Stock = *req.Stock
+		}
+		p.Stock += req.Restock
+		if err := s.checkProduct(p); err != nil {
+			return invalidProduct(err)
+		}
+		return nil
+	})
+	if err != nil {
+		s.writeError(w, toError(err, "dao.UpdateProduct"))
+		return
+	}
+	s.notifyBackInStock(before, product)
+	s.writeJSON(w, struct {
+		Product *Product `json:"product"`
+	}{Product: product})
+}
+
+// HandleAdminDeleteProduct removes a product from the catalog and releases the stock held of it,
+// carts that have it can't be bought until it's removed from them
+func (s *Service) HandleAdminDeleteProduct(w http.ResponseWriter, r *http.Request) {
+	id, idErr := productID(r)
+	if idErr != nil {
+		s.writeError(w, idErr)
+		return
+	}
+	if err := s.dao.DeleteProduct(id); err != nil {
+		s.writeError(w, toError(err, "dao.DeleteProduct"))
+		return
+	}
+	s.writeJSON(w, struct {
+		ID int `json:"id"`
+	}{ID: id})
+}
+
+// productID reads the product ID from the path
+func productID(r *http.Request) (int, *Error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return 0, errProductNotFound.msg("invalid product id: " + err.Error())
+	}
+	return id, nil
+}
+
+// invalidProduct returns a bad request telling the client why the product was rejected
+func invalidProduct(err error) *Error {
+	e := errBadRequestInvalidProduct.msg(err.Error())
+	e.Details = err.Error()
+	return e
+}
+
+// HandleAdminGetPromotions lists every promotion, disabled and inactive ones included
+func (s *Service) HandleAdminGetPromotions(w http.ResponseWriter, r *http.Request) {
+	promotions, err := s.dao.GetPromotions()
+	if err != nil {
+		s.writeError(w, errInternalServerError.msg("dao.GetPromotions: "+err.Error()))
+		return
+	}
+	s.writeJSON(w, struct {
+		Promotions Promotions `json:"promotions"`
+	}{Promotions: promotions})
+}
+
+// HandleAdminCreatePromotion adds a promotion, it gets the next free ID when it has none
+// and applies from the next checkout
+func (s *Service) HandleAdminCreatePromotion(w http.ResponseWriter, r *http.Request) {
+	promotion := &Promotion{}
+	if err := json.NewDecoder(r.Body).Decode(promotion); err != nil {
+		s.writeError(w, invalidPromotion(fmt.Errorf("failed to decode req: %v", err)))
+		return
+	}
+	if checkErr := s.checkNewPromotion(promotion); checkErr != nil {
+		s.writeError(w, checkErr)
+		return
+	}
+	if err := s.dao.CreatePromotion(promotion); err != nil {
+		s.writeError(w, toError(err, "dao.CreatePromotion"))
+		return
+	}
+	s.writeJSON(w, struct {
+		Promotion *Promotion `json:"promotion"`
+	}{Promotion: promotion})
+}
+
+// HandleAdminReplacePromotion overwrites a promotion
+func (s *Service) HandleAdminReplacePromotion(w http.ResponseWriter, r *http.Request) {
+	id, idErr := promotionID(r)
+	if idErr != nil {
+		s.writeError(w, idErr)
+		return
+	}
+	req := &Promotion{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		s.writeError(w, invalidPromotion(fmt.Errorf("failed to decode req: %v", err)))
+		return
+	}
+	if req.ID != 0 && req.ID != id {
+		s.writeError(w, errBadRequestInvalidPromotion.msg("the ID of a promotion can't change"))
+		return
+	}
+	req.ID = id
+	if checkErr := s.checkNewPromotion(req); checkErr != nil {
+		s.writeError(w, checkErr)
+		return
+	}
+	s.updatePromotion(w, id, replacePromotion(req))
+}
+
+// HandleAdminEnablePromotion lets a disabled promotion apply again
+func (s *Service) HandleAdminEnablePromotion(w http.ResponseWriter, r *http.Request) {
+	s.setPromotionDisabled(w, r, false)
+}
+
+// HandleAdminDisablePromotion stops a promotion from applying without deleting it
+func (s *Service) HandleAdminDisablePromotion(w http.ResponseWriter, r *http.Request) {
+	s.setPromotionDisabled(w, r, true)
+}
+
+func (s *Service) setPromotionDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	id, idErr := promotionID(r)
+	if idErr != nil {
+		s.writeError(w, idErr)
+		return
+	}
+	s.updatePromotion(w, id, func(p *Promotion) error {
+		p.Disabled = disabled
+		return nil
+	})
+}
+
+func (s *Service) updatePromotion(w http.ResponseWriter, id int, fn func(*Promotion) error) {
+	promotion, err := s.dao.UpdatePromotion(id, fn)
+	if err != nil {
+		s.writeError(w, toError(err, "dao.UpdatePromotion"))
+		return
+	}
+	s.writeJSON(w, struct {
+		Promotion *Promotion `json:"promotion"`
+	}{Promotion: promotion})
+}
+
+// HandleAdminDeletePromotion removes a promotion, orders keep a copy of the promotions applied to them
+func (s *Service) HandleAdminDeletePromotion(w http.ResponseWriter, r *http.Request) {
+	id, idErr := promotionID(r)
+	if idErr != nil {
+		s.writeError(w, idErr)
+		return
+	}
+	if err := s.dao.DeletePromotion(id); err != nil {
+		s.writeError(w, toError(err, "dao.DeletePromotion"))
+		return
+	}
+	s.writeJSON(w, struct {
+		ID int `json:"id"`
+	}{ID: id})
+}
+
+// promotionID reads the promotion ID from the path
+func promotionID(r *http.Request) (int, *Error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return 0, errPromotionNotFound.msg("invalid promotion id: " + err.Error())
+	}
+	return id, nil
+}
+
+// invalidPromotion returns a bad request telling the client why the promotion was rejected
+func invalidPromotion(err error) *Error {
+	e := errBadRequestInvalidPromotion.msg(err.Error())
+	e.Details = err.Error()
+	return e
+}
+
+// HandleAdminUnlockUser forgets the failed logins of a user so they can log in again straight away,
+// failures counted against IP addresses are kept
+func (s *Service) HandleAdminUnlockUser(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+	_, err := s.dao.GetUser(username)
+	if err == errUserNotFound {
+		s.writeError(w, errNoSuchUser.msg("unlock unknown user: "+username))
+		return
+	}
+	if err != nil {
+		s.writeError(w, errInternalServerError.msg("dao.GetUser: "+err.Error()))
+		return
+	}
+	if err := s.dao.ClearLoginFailures(userLockoutKey(username)); err != nil {
+		s.writeError(w, errInternalServerError.msg("dao.ClearLoginFailures: "+err.Error()))
+		return
+	}
+	s.writeJSON(w, struct{}{})
+}
@@ -0,0 +1,121 @@
+package shopping
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// productRequest returns a request for the admin endpoints of product id
+func productRequest(method string, id string, body string) *http.Request {
+	r := httptest.NewRequest(method, "/v1/admin/products/"+id, strings.NewReader(body))
+	return mux.SetURLVars(r, map[string]string{"id": id})
+}
+
+func TestAdminProductCurrencyWithoutRates(t *testing.T) {
+	s := newTestService(t, NewMemory())
+	eur := `"price": {"amount": 2000, "currency": "EUR"}`
+
+	w := serve(s.HandleAdminCreateProduct, httptest.NewRequest(http.MethodPost, "/v1/admin/products", strings.NewReader(`{"type": 7, "name": "Sock", "stock": 1, `+eur+`}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("create: status %d, want 400: %s", w.Code, w.Body)
+	}
+	w = serve(s.HandleAdminReplaceProduct, productRequest(http.MethodPut, "1", `{"type": 1, "name": "Belt", "stock": 1, `+eur+`}`))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("replace: status %d, want 400: %s", w.Code, w.Body)
+	}
+	w = serve(s.HandleAdminUpdateProduct, productRequest(http.MethodPatch, "1", `{`+eur+`}`))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("update: status %d, want 400: %s", w.Code, w.Body)
+	}
+}
+
+func TestAdminRestockBelowHeld(t *testing.T) {
+	for _, tt := range testDAOs {
+		t.Run(tt.name, func(t *testing.T) {
+			dao := tt.new(t)
+			s := newTestService(t, dao, SetStockHold(time.Hour))
+			user := &User{Username: "shopper"}
+			if err := dao.CreateUser(user); err != nil {
+				t.Fatal(err)
+			}
+			// 4 of the 10 belts are held
+			if err := s.holdStock(dao, user.ID, 1, 4); err != nil {
+				t.Fatal(err)
+			}
+
+			belt := func(stock string) string {
+				return `{"type": 1, "name": "Belt", "stock": ` + stock + `, "price": {"amount": 2000, "currency": "USD"}}`
+			}
+			for _, req := range []struct {
+				handler http.HandlerFunc
+				method  string
+				body    string
+			}{
+				{s.HandleAdminUpdateProduct, http.MethodPatch, `{"restock": -7}`},
+				{s.HandleAdminUpdateProduct, http.MethodPatch, `{"stock": 2}`},
+				{s.HandleAdminUpdateProduct, http.MethodPatch, `{"stock": 10, "restock": -7}`},
+				{s.HandleAdminReplaceProduct, http.MethodPut, belt("3")},
+			} {
+				if w := serve(req.handler, productRequest(req.method, "1", req.body)); w.Code != http.StatusBadRequest {
+					t.Errorf("%s %s: status %d, want 400: %s", req.method, req.body, w.Code, w.Body)
+				}
+			}
+			products, err := dao.GetProducts()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p := products[1]; p.Stock != 10 || p.Available != 6 {
+				t.Errorf("belts have stock %d and %d available after rejected updates, want 10 and 6", p.Stock, p.Available)
+			}
+
+			if w := serve(s.HandleAdminReplaceProduct, productRequest(http.MethodPut, "1", belt("5"))); w.Code != http.StatusOK {
+				t.Errorf("PUT stock 5: status %d, want 200: %s", w.Code, w.Body)
+			}
+			if w := serve(s.HandleAdminUpdateProduct, productRequest(http.MethodPatch, "1", `{"stock": 3, "restock": 1}`)); w.Code != http.StatusOK {
+				t.Errorf("PATCH stock 3 and restock 1: status %d, want 200: %s", w.Code, w.Body)
+			}
+			if w := serve(s.HandleAdminUpdateProduct, productRequest(http.MethodPatch, "1", `{"restock": -1}`)); w.Code != http.StatusBadRequest {
+				t.Errorf("PATCH restock -1: status %d, want 400: %s", w.Code, w.Body)
+			}
+			products, err = dao.GetProducts()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p := products[1]; p.Stock != 4 || p.Available != 0 {
+				t.Errorf("belts have stock %d and %d available, want 4 and 0", p.Stock, p.Available)
+			}
+		})
+	}
+}
+
+func TestAdminMalformedBody(t *testing.T) {
+	s := newTestService(t, NewMemory())
+	promotionRequest := func(method string, id string, body string) *http.Request {
+		r := httptest.NewRequest(method, "/v1/admin/promotions/"+id, strings.NewReader(body))
+		return mux.SetURLVars(r, map[string]string{"id": id})
+	}
+	for _, tt := range []struct {
+		name    string
+		handler http.HandlerFunc
+		request func(method string, id string, body string) *http.Request
+		method  string
+		id      string
+	}{
+		{"create product", s.HandleAdminCreateProduct, productRequest, http.MethodPost, ""},
+		{"replace product", s.HandleAdminReplaceProduct, productRequest, http.MethodPut, "1"},
+		{"update product", s.HandleAdminUpdateProduct, productRequest, http.MethodPatch, "1"},
+		{"create promotion", s.HandleAdminCreatePromotion, promotionRequest, http.MethodPost, ""},
+		{"replace promotion", s.HandleAdminReplacePromotion, promotionRequest, http.MethodPut, "1"},
+	} {
+		for _, body := range []string{`{"name": `, `{"name": 1}`, `[]`} {
+			if w := serve(tt.handler, tt.request(tt.method, tt.id, body)); w.Code != http.StatusBadRequest {
+				t.Errorf("%s with %s: status %d, want 400: %s", tt.name, body, w.Code, w.Body)
+			}
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package shopping
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// maxCarts is how many carts a user can have, the active one included
+	maxCarts = 10
+	// defaultMaxLineQuantity is how many units of a product a cart can have unless the service is given another
+	// number, named carts don't hold stock so nothing else limits them
+	defaultMaxLineQuantity = 10000
+)
+
+var cartNamePattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// checkCartName fails when name can't be the name of a cart
+func checkCartName(name string) *Error {
+	if !cartNamePattern.MatchString(name) {
+		return errBadRequestInvalidCartName.msg("cart names must be 1 to 32 lower case letters, digits, dashes or underscores: " + name)
+	}
+	return nil
+}
+
+// namedCart returns the cart with the name, creating it when create is set and the user can have one more
+func namedCart(carts map[string]*Cart, name string, create bool) (*Cart, error) {
+	if c, ok := carts[name]; ok {
+		return c, nil
+	}
+	if !create {
+		return nil, errCartNotFound.msg("no cart named " + name)
+	}
+	if len(carts) >= maxCarts {
+		return nil, errBadRequestTooManyCarts.msg(fmt.Sprintf("users can't have more than %d carts", maxCarts))
+	}
+	c := &Cart{Name: name, Products: CartLines{}}
+	carts[name] = c
+	return c, nil
+}
+
+// newCartLine returns a line with quantity units of the product at its current name and price
+func newCartLine(p *Product, quantity int) *CartLine {
+	return &CartLine{ProductID: p.ID, ProductType: p.Type, ProductName: p.Name, Quantity: quantity, UnitPrice: p.Price}
+}
+
+// add adds the units of line to the cart, the line in the cart takes the name and price of line.
+// It fails when the cart would have more than max units of the product.
+func (c *Cart) add(line *CartLine, max int) (*CartLine, error) {
+	if line.Quantity < 1 {
+		return nil, errBadRequestInvalidQuantity.msg("quantity must be at least 1")
+	}
+	added := *line
+	if current, ok := c.Products[line.ProductID]; ok {
+		added.Quantity += current.Quantity
+	}
+	if added.Quantity > max {
+		return nil, errBadRequestInvalidQuantity.msg(fmt.Sprintf("carts can't have more than %d units of a product", max))
+	}
+	c.Products[line.ProductID] = &added
+	return &added, nil
+}
+
+// remove takes up to quantity units of the product out of the cart and returns how many are left
+func (c *Cart) remove(productID, quantity int) int {
+	line, ok := c.Products[productID]
+	if !ok {
+		return 0
+	}
+	if quantity >= line.Quantity {
+		delete(c.Products, productID)
+		return 0
+	}
+	if quantity > 0 {
+		line.Quantity -= quantity
+	}
+	return line.Quantity
+}
+
+// moveCartItems moves quantity units of the product between two of the user's carts, all of them when quantity is 0.
+// Units moved to the active cart must be in stock and are held, the ones moved out of it stop being held.
+// Moved units take the current price of the product unless it was removed from the catalog.
+func (s *Service) moveCartItems(dao CartDAO, userID int, carts map[string]*Cart, from, to string, product *Product, productID, quantity int) error {
+	src, err := namedCart(carts, from, false)
+	if err != nil {
+		return err
+	}
+	line := src.Products[productID]
+	if line == nil || line.Quantity == 0 {
+		return errBadRequestNotInCart.msg(fmt.Sprintf("product %d isn't in cart %s", productID, from))
+	}
+	if quantity == 0 {
+		quantity = line.Quantity
+	}
+	if quantity < 0 || quantity > line.Quantity {
+		return errBadRequestInvalidQuantity.msg(fmt.Sprintf("cart %s has %d units of product %d", from, line.Quantity, productID))
+	}
+	dst, err := namedCart(carts, to, true)
+	if err != nil {
+		return err
+	}
+
+	moved := *line
+	moved.Quantity = quantity
+	if product != nil {
+		moved = *newCartLine(product, quantity)
+	}
+	left := src.remove(productID, quantity)
+	added, err := dst.add(&moved, s.maxLineQuantity)
+	if err != nil {
+		return err
+	}
+
+	if to == CartNameActive {
+		if product == nil {
+			return errBadRequestProductNotFound.msg(fmt.Sprintf("product %d was removed from the catalog", productID))
+		}
+		if added.Quantity > product.Stock {
+			return errBadRequestNotEnoughStock.msg("not enough stock")
+		}
+		if err := s.holdStock(dao, userID, productID, added.Quantity); err != nil {
+			return err
+		}
+	}
+	if from == CartNameActive {
+		if err := s.holdStock(dao, userID, productID, left); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notifyBackInStock tells the users with the product in their wishlist that it's back when it was out of stock before
+// the update, failures are logged as the update has already been made
+func (s *Service) notifyBackInStock(before, after *Product) {
+	if len(s.hooks) == 0 || before == nil || after == nil || before.Stock > 0 || after.Stock <= 0 {
+		return
+	}
+	wishlists, err := s.dao.GetCartsWithProduct(CartNameWishlist, after.ID)
+	if err != nil {
+		log.WithError(err).WithField("product", after.ID).Errorln("failed to get the wishlists of a product back in stock")
+		return
+	}
+	now := s.now().UTC()
+	for _, wishlist := range wishlists {
+		s.emit(&Event{Type: EventBackInStock, UserID: wishlist.UserID, Product: after.copy(), At: now})
+	}
+}
+
+// UnmarshalJSON reads the lines of a cart, carts stored before lines had quantities hold a list with an item for every
+// unit of a product and the line takes the name and price of the first one
+func (l *CartLines) UnmarshalJSON(data []byte) error {
+	raw := map[int]json.RawMessage{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	lines := CartLines{}
+	for id, value := range raw {
+		line := &CartLine{}
+		if bytes.HasPrefix(bytes.TrimSpace(value), []byte("[")) {
+			units := []*CartProduct{}
+			if err := json.Unmarshal(value, &units); err != nil {
+				return err
+			}
+			if len(units) == 0 {
+				continue
+			}
+			line = &CartLine{ProductType: units[0].ProductType, ProductName: units[0].ProductName, Quantity: len(units), UnitPrice: units[0].UnitPrice}
+		} else if err := json.Unmarshal(value, line); err != nil {
+			return err
+		}
+		if line.Quantity < 1 {
+			continue
+		}
+		line.ProductID = id
+		lines[id] = line
+	}
+	*l = lines
+	return nil
+}
+
+// UnmarshalJSON reads a checkout or order line, lines stored before they had quantities are a single unit
+func (p *CartProduct) UnmarshalJSON(data []byte) error {
+	type cartProduct CartProduct // avoids calling UnmarshalJSON recursively
+	v := cartProduct{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*p = CartProduct(v)
+	if p.Quantity == 0 {
+		p.Quantity = 1
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package shopping
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCartMoveItemHolds(t *testing.T) {
+	const later = "later"
+	for _, tt := range testDAOs {
+		t.Run(tt.name, func(t *testing.T) {
+			dao := tt.new(t)
+			s := newTestService(t, dao, SetStockHold(time.Hour))
+			belt := testCatalog()[0]
+			user, other := &User{Username: "shopper"}, &User{Username: "other"}
+			for _, u := range []*User{user, other} {
+				if err := dao.CreateUser(u); err != nil {
+					t.Fatal(err)
+				}
+			}
+			hold := func(u *User, quantity int) {
+				t.Helper()
+				_, err := dao.UpdateCart(u.ID, func(dao CartDAO, cart *Cart) error {
+					cart.Products[belt.ID] = newCartLine(belt, quantity)
+					return s.holdStock(dao, u.ID, belt.ID, quantity)
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			move := func(from, to string, quantity int) int {
+				body := fmt.Sprintf(`{"from": %q, "to": %q, "product_id": %d, "quantity": %d}`, from, to, belt.ID, quantity)
+				return serve(s.HandleCartMoveItem, asUser(httptest.NewRequest(http.MethodPost, "/v1/carts/move", strings.NewReader(body)), user)).Code
+			}
+			// check compares the belts in the user's carts and the belts available to everyone with the ones wanted
+			check := func(step string, active, saved, available int) {
+				t.Helper()
+				carts, err := dao.GetCarts(user.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				quantity := func(name string) int {
+					for _, c := range carts {
+						if c.Name == name && c.Products[belt.ID] != nil {
+							return c.Products[belt.ID].Quantity
+						}
+					}
+					return 0
+				}
+				products, err := dao.GetProducts()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if quantity(CartNameActive) != active || quantity(later) != saved || products[belt.ID].Available != available {
+					t.Errorf("%s: %d belts in the cart, %d saved for later and %d available, want %d, %d and %d",
+						step, quantity(CartNameActive), quantity(later), products[belt.ID].Available, active, saved, available)
+				}
+			}
+
+			hold(user, 3)
+			if code := move(CartNameActive, later, 2); code != http.StatusOK {
+				t.Fatalf("save 2 for later: status %d", code)
+			}
+			check("saved 2 for later", 1, 2, 9)
+			if code := move(later, CartNameActive, 0); code != http.StatusOK {
+				t.Fatalf("move every belt back: status %d", code)
+			}
+			check("moved every belt back", 3, 0, 7)
+			if code := move(CartNameActive, later, 0); code != http.StatusOK {
+				t.Fatalf("save every belt for later: status %d", code)
+			}
+			check("saved every belt for later", 0, 3, 10)
+
+			// someone else holds all but one of the belts in the meantime
+			hold(other, 9)
+			if code := move(later, CartNameActive, 0); code == http.StatusOK {
+				t.Error("moved 3 belts to the cart with only 1 available")
+			}
+			check("failed to move 3 belts back", 0, 3, 1)
+			if code := move(later, CartNameActive, 1); code != http.StatusOK {
+				t.Fatalf("move the last belt available back: status %d", code)
+			}
+			check("moved the last belt available back", 1, 2, 0)
+		})
+	}
+}
+
+func TestBackInStockEvents(t *testing.T) {
+	for _, tt := range testDAOs {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			events := []*Event{}
+			dao := tt.new(t)
+			s := newTestService(t, dao, AddEventHook(func(e *Event) {
+				mu.Lock()
+				defer mu.Unlock()
+				events = append(events, e)
+			}))
+			shoe := testCatalog()[4]
+			const later = "later"
+			// two users wish for the shoe, another one saved it for later
+			carts := map[string]string{"wisher": CartNameWishlist, "another wisher": CartNameWishlist, "saver": later}
+			wishers := map[int]bool{}
+			for username, name := range carts {
+				u := &User{Username: username}
+				if err := dao.CreateUser(u); err != nil {
+					t.Fatal(err)
+				}
+				if name == CartNameWishlist {
+					wishers[u.ID] = true
+				}
+				_, err := dao.UpdateCarts(u.ID, func(dao CartDAO, carts map[string]*Cart) error {
+					carts[name] = &Cart{Products: CartLines{shoe.ID: newCartLine(shoe, 1)}}
+					return nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			update := func(body string) []*Event {
+				t.Helper()
+				mu.Lock()
+				events = events[:0]
+				mu.Unlock()
+				if w := serve(s.HandleAdminUpdateProduct, productRequest(http.MethodPatch, "5", body)); w.Code != http.StatusOK {
+					t.Fatalf("%s: status %d: %s", body, w.Code, w.Body)
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				return append([]*Event{}, events...)
+			}
+
+			if got := update(`{"stock": 0}`); len(got) != 0 {
+				t.Errorf("selling out: %d events, want none", len(got))
+			}
+			if got := update(`{"restock": 0}`); len(got) != 0 {
+				t.Errorf("restocking nothing: %d events, want none", len(got))
+			}
+			got := update(`{"restock": 2}`)
+			told := map[int]int{}
+			for _, e := range got {
+				told[e.UserID]++
+				if e.Type != EventBackInStock || e.Product == nil || e.Product.ID != shoe.ID || e.Product.Stock != 2 {
+					t.Errorf("restocking: event %+v, want the shoe back in stock with 2 units", e)
+				}
+			}
+			if len(got) != len(wishers) {
+				t.Errorf("restocking: %d events, want one for each of the %d wishers", len(got), len(wishers))
+			}
+			for id := range wishers {
+				if told[id] != 1 {
+					t.Errorf("restocking: wisher %d was told %d times, want once", id, told[id])
+				}
+			}
+			if got := update(`{"restock": 3}`); len(got) != 0 {
+				t.Errorf("restocking again: %d events, want none", len(got))
+			}
+
+			// only the first of restocks made at the same time finds the shoe sold out
+			update(`{"stock": 0}`)
+			mu.Lock()
+			events = events[:0]
+			mu.Unlock()
+			var wg sync.WaitGroup
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if w := serve(s.HandleAdminUpdateProduct, productRequest(http.MethodPatch, "5", `{"restock": 1}`)); w.Code != http.StatusOK {
+						t.Errorf("parallel restock: status %d: %s", w.Code, w.Body)
+					}
+				}()
+			}
+			wg.Wait()
+			mu.Lock()
+			defer mu.Unlock()
+			if len(events) != len(wishers) {
+				t.Errorf("parallel restocks: %d events, want one for each of the %d wishers", len(events), len(wishers))
+			}
+		})
+	}
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/jaimemartinez88/api.shopping"
 )
@@ -14,83 +16,228 @@ type HTTP struct {
 	ListenPort string `json:"listen_port,omitempty"`
 }
 
+// Storage config, Type can be "memory" (default), "file" or "sql"
+type Storage struct {
+	Type          string `json:"type,omitempty"`
+	DataDir       string `json:"data_dir,omitempty"`       // directory used by the file storage
+	SnapshotEvery int    `json:"snapshot_every,omitempty"` // journal entries between snapshots for the file storage
+	SQLDriver     string `json:"sql_driver,omitempty"`     // database/sql driver used by the sql storage
+	SQLDSN        string `json:"sql_dsn,omitempty"`        // data source name used by the sql storage
+}
+
+// Tokens config for the access tokens handed out on login
+type Tokens struct {
+	Minutes              int `json:"minutes,omitempty"`                // how long access tokens last, a day by default
+	RefreshDays          int `json:"refresh_days,omitempty"`           // how long refresh tokens last, 30 by default
+	GuestCartDays        int `json:"guest_cart_days,omitempty"`        // how long the carts of guests last, 7 by default
+	SweepIntervalSeconds int `json:"sweep_interval_seconds,omitempty"` // how often expired tokens are deleted
+}
+
+// Holds config for setting stock aside when items are added to a cart
+type Holds struct {
+	Minutes              int `json:"minutes,omitempty"`                // how long stock is held, 0 disables holds
+	SweepIntervalSeconds int `json:"sweep_interval_seconds,omitempty"` // how often expired holds are released
+}
+
+// Carts config for the carts of users
+type Carts struct {
+	MaxLineQuantity int `json:"max_line_quantity,omitempty"` // most units of a product a cart can have, 10000 by default
+}
+
+// Events config for telling users about events such as products in their wishlist coming back in stock,
+// events are always logged
+type Events struct {
+	WebhookURL string `json:"webhook_url,omitempty"` // every event is POSTed as JSON to it when set
+}
+
+// Shipping config for the fee charged on every cart
+type Shipping struct {
+	Fee *shopping.Money `json:"fee,omitempty"` // in the base currency, shipping is free when not set
+}
+
 var config = struct {
-	Environment string                `json:"environment,omitempty"`
-	HTTP        *HTTP                 `json:"http,omitempty"`
-	Products    []*shopping.Product   `json:"products,omitempty"`
-	Promotions  []*shopping.Promotion `json:"discounts,omitempty"`
-	Users       []*shopping.User      `json:"users,omitempty"`
+	Environment string                  `json:"environment,omitempty"`
+	HTTP        *HTTP                   `json:"http,omitempty"`
+	Storage     *Storage                `json:"storage,omitempty"`
+	Holds       *Holds                  `json:"holds,omitempty"`
+	Carts       *Carts                  `json:"carts,omitempty"`
+	Tokens      *Tokens                 `json:"tokens,omitempty"`
+	Lockout     *shopping.LockoutConfig `json:"lockout,omitempty"`  // failed logins are limited with the defaults when it isn't set
+	JWT         *shopping.JWTConfig     `json:"jwt,omitempty"`      // access tokens are opaque and stored when it isn't set
+	OIDC        *shopping.OIDCConfig    `json:"oidc,omitempty"`     // single sign-on is disabled when it isn't set
+	FakeIdP     bool                    `json:"fake_idp,omitempty"` // serves a stand-in identity provider at the oidc issuer, for development only
+	Events      *Events                 `json:"events,omitempty"`
+	Shipping    *Shipping               `json:"shipping,omitempty"`
+	Currency    *shopping.ExchangeRates `json:"currency,omitempty"` // base currency of the catalog and rates to other currencies
+	Products    []*shopping.Product     `json:"products,omitempty"`
+	Promotions  []*shopping.Promotion   `json:"discounts,omitempty"`
+	Coupons     []*shopping.Coupon      `json:"coupons,omitempty"`
+	Users       []*shopping.User        `json:"users,omitempty"`
 }{
 	Environment: "local",
 	HTTP: &HTTP{
 		ListenPort: os.Getenv("PORT"),
 	},
+	Storage: &Storage{
+		Type:      "memory",
+		DataDir:   "data",
+		SQLDriver: "sqlite3",
+		SQLDSN:    "file:shopping.db?_txlock=immediate&_busy_timeout=5000&_foreign_keys=1",
+	},
+	Holds: &Holds{
+		Minutes:              15,
+		SweepIntervalSeconds: 60,
+	},
+	Tokens: &Tokens{
+		Minutes:              24 * 60,
+		RefreshDays:          30,
+		SweepIntervalSeconds: 600,
+	},
+	Currency: &shopping.ExchangeRates{
+		Base: "USD",
+		Rates: map[string]float64{
+			"EUR": 0.92,
+			"GBP": 0.79,
+			"JPY": 149.5,
+		},
+	},
 	Products: []*shopping.Product{
 		&shopping.Product{
 			ID:    1,
 			Type:  1,
 			Name:  "Belt",
 			Stock: 10,
-			Price: 20,
+			Price: shopping.Money{Amount: 2000, Currency: "USD"},
 		},
 		&shopping.Product{
 			ID:    2,
 			Type:  2,
 			Name:  "Shirt",
 			Stock: 5,
-			Price: 60,
+			Price: shopping.Money{Amount: 6000, Currency: "USD"},
 		},
 		&shopping.Product{
 			ID:    3,
 			Type:  3,
 			Name:  "Suit",
 			Stock: 2,
-			Price: 200,
+			Price: shopping.Money{Amount: 20000, Currency: "USD"},
 		},
 		&shopping.Product{
 			ID:    4,
 			Type:  4,
 			Name:  "Trouser",
 			Stock: 4,
-			Price: 70,
+			Price: shopping.Money{Amount: 7000, Currency: "USD"},
 		},
 		&shopping.Product{
 			ID:    5,
 			Type:  5,
 			Name:  "Shoe",
 			Stock: 1,
-			Price: 120,
+			Price: shopping.Money{Amount: 12000, Currency: "USD"},
 		},
 		&shopping.Product{
 			ID:    6,
 			Type:  6,
 			Name:  "Tie",
 			Stock: 8,
-			Price: 20,
+			Price: shopping.Money{Amount: 2000, Currency: "USD"},
 		},
 	},
 	Promotions: []*shopping.Promotion{
 		&shopping.Promotion{
-			ProductType:         4, // trouser
-			QuantityForDiscount: 2,
-			ProductsDiscounted:  []int{1, 5}, // belts + shoes
-			Discount:            15,
+			ID:   1,
+			Name: "15% off belts and shoes when buying 2 trousers",
+			Conditions: []*shopping.Condition{
+				{Type: shopping.ConditionQuantity, ProductType: 4, MinQuantity: 2}, // trousers
+			},
+			Action: &shopping.Action{
+				Type:         shopping.ActionPercentOff,
+				ProductTypes: []int{1, 5}, // belts + shoes
+				Percent:      15,
+			},
+		},
+		&shopping.Promotion{
+			ID:   2,
+			Name: "shirts after the second one cost 45",
+			Conditions: []*shopping.Condition{
+				{Type: shopping.ConditionQuantity, ProductType: 2, MinQuantity: 2}, // shirts
+			},
+			Action: &shopping.Action{
+				Type:         shopping.ActionFixedPrice,
+				ProductTypes: []int{2},
+				Amount:       &shopping.Money{Amount: 4500, Currency: "USD"},
+				Skip:         2,
+			},
+		},
+		&shopping.Promotion{
+			ID:   3,
+			Name: "50% off ties when buying 3 shirts",
+			Conditions: []*shopping.Condition{
+				{Type: shopping.ConditionQuantity, ProductType: 2, MinQuantity: 3}, // shirts
+			},
+			Action: &shopping.Action{
+				Type:         shopping.ActionPercentOff,
+				ProductTypes: []int{6}, // ties
+				Percent:      50,
+			},
+		},
+		&shopping.Promotion{
+			ID:   4,
+			Name: "10% off everything with WELCOME10",
+			Conditions: []*shopping.Condition{
+				{Type: shopping.ConditionCoupon, Code: "WELCOME10"},
+			},
+			Action: &shopping.Action{
+				Type:    shopping.ActionPercentOff,
+				Percent: 10,
+			},
 		},
 		&shopping.Promotion{
-			ProductType:             2, // shirt
-			QuantityForSpecialPrice: 2,
-			SpecialPrice:            45,
-			ProductsDiscounted:      []int{6}, // shirt
-			QuantityForDiscount:     3,
-			Discount:                50,
+			ID:       5,
+			Name:     "10% off orders over 300",
+			Stacking: shopping.StackingBestForCustomer,
+			Conditions: []*shopping.Condition{
+				{Type: shopping.ConditionSubtotal, MinSubtotal: &shopping.Money{Amount: 30000, Currency: "USD"}},
+			},
+			Action: &shopping.Action{
+				Type:    shopping.ActionCartPercentOff,
+				Percent: 10,
+			},
+		},
+		&shopping.Promotion{
+			ID:       6,
+			Name:     "50 off when you spend 500",
+			Stacking: shopping.StackingBestForCustomer,
+			Conditions: []*shopping.Condition{
+				{Type: shopping.ConditionSubtotal, MinSubtotal: &shopping.Money{Amount: 50000, Currency: "USD"}},
+			},
+			Action: &shopping.Action{
+				Type:   shopping.ActionCartFixedOff,
+				Amount: &shopping.Money{Amount: 5000, Currency: "USD"},
+			},
+		},
+	},
+	Coupons: []*shopping.Coupon{
+		&shopping.Coupon{
+			Code:        "WELCOME10",
+			Description: "10% off your first order over 50",
+			MaxPerUser:  1,
+			MinSpend:    &shopping.Money{Amount: 5000, Currency: "USD"},
 		},
 	},
 	Users: []*shopping.User{
 		&shopping.User{
 			ID:       1,
 			Username: "test",
-			Password: "test",
-			Token:    "rfBd56ti2S",
+			Password: "$2a$10$Cy0zLitaqPpltzbll2Wzu.xw56jNh6Ab7HLFeBNiFrSeJMH5WXXsK", // test
+		},
+		&shopping.User{
+			ID:       2,
+			Username: "admin",
+			Password: "$2a$10$UwZhNDintIDzvZLL/6qY4uE6BGCmUVnF.nsh5oqf6pqnNFNPK9ho2", // admin
+			Roles:    []shopping.Role{shopping.RoleAdmin},
 		},
 	},
 }
@@ -114,8 +261,98 @@ func loadConfig(location string) {
 		log.Fatalln("Couldn't open ", location)
 	}
 
+	// prices without a currency are in the base currency so it has to be known before reading them
+	currency, err := readExchangeRates(raw)
+	if err != nil {
+		log.Fatalln("Couldn't understand currency config in", location, "-", err)
+	}
+	if currency != nil && currency.Base != "" {
+		shopping.DefaultCurrency = strings.ToUpper(currency.Base)
+	}
+
 	err = json.Unmarshal(raw, &config)
 	if err != nil {
 		log.Fatalln("Couldn't understand config in", location, "-", err)
 	}
 }
+
+// hashConfigPasswords replaces the passwords in plain text of the users in the config file with their hash,
+// the rest of the file is kept as it is apart from the order of its keys
+func hashConfigPasswords(location string) {
+	raw, err := ioutil.ReadFile(location)
+	if err != nil {
+		log.Fatalln("Couldn't open", location)
+	}
+	file := map[string]json.RawMessage{}
+	if err := json.Unmarshal(raw, &file); err != nil {
+		log.Fatalln("Couldn't understand config in", location, "-", err)
+	}
+	users := []map[string]json.RawMessage{}
+	if err := json.Unmarshal(file["users"], &users); err != nil && file["users"] != nil {
+		log.Fatalln("Couldn't understand users in", location, "-", err)
+	}
+
+	hashed := 0
+	for _, u := range users {
+		user := &shopping.User{}
+		if err := json.Unmarshal(u["password"], &user.Password); err != nil && u["password"] != nil {
+			log.Fatalln("Couldn't understand password in", location, "-", err)
+		}
+		n, err := shopping.HashPasswords([]*shopping.User{user})
+		if err != nil {
+			log.Fatalln("Couldn't hash passwords -", err)
+		}
+		if n == 0 {
+			continue
+		}
+		u["password"], _ = json.Marshal(user.Password)
+		hashed++
+	}
+	if hashed == 0 {
+		log.Println("No passwords in plain text in", location)
+		return
+	}
+
+	file["users"], _ = json.Marshal(users)
+	data, _ := json.MarshalIndent(file, "", "  ")
+	info, err := os.Stat(location)
+	if err != nil {
+		log.Fatalln("Couldn't open", location)
+	}
+	// written next to the config and renamed so the config is never left half written
+	tmp := location + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), info.Mode()); err != nil {
+		log.Fatalln("Couldn't write to", tmp)
+	}
+	if err := os.Rename(tmp, location); err != nil {
+		log.Fatalln("Couldn't replace", location, "-", err)
+	}
+	log.Printf("Hashed the passwords of %d users in %s\n", hashed, location)
+}
+
+// readExchangeRates reads only the currency section of a config file
+func readExchangeRates(raw []byte) (*shopping.ExchangeRates, error) {
+	c := struct {
+		Currency *shopping.ExchangeRates `json:"currency"`
+	}{}
+	if err := json.Unmarshal(raw, &c); err != nil {
+		return nil, err
+	}
+	return c.Currency, nil
+}
+
+// reloadExchangeRates reads the exchange rates from the config file again and hands them to the service
+func reloadExchangeRates(location string, service *shopping.Service) error {
+	raw, err := ioutil.ReadFile(location)
+	if err != nil {
+		return err
+	}
+	rates, err := readExchangeRates(raw)
+	if err != nil {
+		return err
+	}
+	if rates == nil {
+		return fmt.Errorf("no currency config in %s", location)
+	}
+	return service.SetExchangeRates(rates)
+}
@@ -7,12 +7,18 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	shopping "github.com/jaimemartinez88/api.shopping"
+	"github.com/jaimemartinez88/api.shopping/fakeidp"
+	_ "github.com/mattn/go-sqlite3" // registers the sqlite3 driver for the sql storage
 	log "github.com/sirupsen/logrus"
 )
 
@@ -27,13 +33,17 @@ var (
 	corsAllowedDomains = handlers.AllowedOrigins([]string{
 		"*",
 	})
-	corsAllowedMethods = handlers.AllowedMethods([]string{http.MethodGet, http.MethodPut, http.MethodPost, http.MethodDelete, http.MethodOptions})
+	corsAllowedMethods = handlers.AllowedMethods([]string{http.MethodGet, http.MethodPut, http.MethodPost, http.MethodPatch, http.MethodDelete, http.MethodOptions})
 )
 
 func main() {
 	// flag handling
 	defaultLocation := flag.String("default", "", "location to write a default configuration to (this will overwrite an existing file at this location)")
 	configLocation := flag.String("config", "", "JSON config file to load")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [migrate|hash-passwords]\n\nmigrate applies pending schema migrations to the sql storage and exits\nhash-passwords hashes the passwords in plain text of the users in the config file and exits\n\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 
 	flag.Parse()
 	log.SetFormatter(&log.TextFormatter{ForceColors: true, FullTimestamp: true})
@@ -50,21 +60,99 @@ func main() {
 		loadConfig(*configLocation)
 	}
 
-	dao := shopping.NewMemory()
-	service := shopping.New(
-		shopping.SetDAO(dao),
-	)
+	switch flag.Arg(0) {
+	case "":
+	case "migrate":
+		migrate(config.Storage)
+		os.Exit(0)
+	case "hash-passwords":
+		if *configLocation == "" {
+			log.Fatalln("hash-passwords needs a config file")
+		}
+		hashConfigPasswords(*configLocation)
+		os.Exit(0)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
 
-	if err := service.InitInventory(config.Products); err != nil {
-		log.WithError(err).Fatalln("failed to set inventory")
+	dao, restored := newDAO(config.Storage)
+	holds := config.Holds
+	if holds == nil {
+		holds = &Holds{}
+	}
+	options := []shopping.Option{
+		shopping.SetDAO(dao),
+		shopping.SetStockHold(time.Duration(holds.Minutes) * time.Minute),
+	}
+	tokens := config.Tokens
+	if tokens == nil {
+		tokens = &Tokens{}
+	}
+	if tokens.Minutes > 0 {
+		options = append(options, shopping.SetTokenTTL(time.Duration(tokens.Minutes)*time.Minute))
+	}
+	if tokens.RefreshDays > 0 {
+		options = append(options, shopping.SetRefreshTokenTTL(time.Duration(tokens.RefreshDays)*24*time.Hour))
+	}
+	if tokens.GuestCartDays > 0 {
+		options = append(options, shopping.SetGuestCartTTL(time.Duration(tokens.GuestCartDays)*24*time.Hour))
+	}
+	if config.Carts != nil && config.Carts.MaxLineQuantity > 0 {
+		options = append(options, shopping.SetMaxLineQuantity(config.Carts.MaxLineQuantity))
 	}
-	if err := service.InitPromotions(config.Promotions); err != nil {
-		log.WithError(err).Fatalln("failed to set discounts")
+	if config.Lockout != nil {
+		options = append(options, shopping.SetLockout(config.Lockout))
 	}
-	if err := service.InitUsers(config.Users); err != nil {
-		log.WithError(err).Fatalln("failed to set discounts")
+	if config.JWT != nil {
+		options = append(options, shopping.SetJWT(config.JWT))
+	}
+	if config.OIDC != nil {
+		options = append(options, shopping.SetOIDC(config.OIDC))
+	}
+	if config.Currency != nil {
+		options = append(options, shopping.SetCurrencies(config.Currency))
+	}
+	if config.Shipping != nil && config.Shipping.Fee != nil {
+		options = append(options, shopping.SetShipping(*config.Shipping.Fee))
+	}
+	options = append(options, shopping.AddEventHook(shopping.LogEvents))
+	if config.Events != nil && config.Events.WebhookURL != "" {
+		options = append(options, shopping.AddEventHook(shopping.WebhookEvents(config.Events.WebhookURL)))
+	}
+	service := shopping.New(options...)
+
+	if !restored { // persisted data takes precedence over the config
+		if err := service.InitInventory(config.Products); err != nil {
+			log.WithError(err).Fatalln("failed to set inventory")
+		}
+		if err := service.InitPromotions(config.Promotions); err != nil {
+			log.WithError(err).Fatalln("failed to set discounts")
+		}
+		if err := service.InitCoupons(config.Coupons); err != nil {
+			log.WithError(err).Fatalln("failed to set coupons")
+		}
+		if err := service.InitUsers(config.Users); err != nil {
+			log.WithError(err).Fatalln("failed to set discounts")
+		}
 	}
 	service.PrintDAO()
+	if holds.Minutes > 0 {
+		interval := time.Duration(holds.SweepIntervalSeconds) * time.Second
+		if interval <= 0 {
+			interval = time.Minute
+		}
+		go service.SweepExpiredHolds(interval, nil)
+	}
+	tokenSweep := time.Duration(tokens.SweepIntervalSeconds) * time.Second
+	if tokenSweep <= 0 {
+		tokenSweep = 10 * time.Minute
+	}
+	go service.SweepExpiredTokens(tokenSweep, nil)
+	go service.SweepLoginFailures(tokenSweep, nil)
+	if *configLocation != "" && config.Currency != nil {
+		go reloadOnHangup(*configLocation, service)
+	}
 	r := mux.NewRouter()
 	r.Use(service.LoggingMiddleware)
 	r.NotFoundHandler = http.HandlerFunc(service.HandleNotFound)
@@ -74,16 +162,64 @@ func main() {
 	v1 := r.PathPrefix("/v1/shopping").Subrouter()
 
 	v1.HandleFunc("/login", service.HandleLogin).Methods(http.MethodPost)
+	v1.HandleFunc("/register", service.HandleRegister).Methods(http.MethodPost)
+	v1.HandleFunc("/token/refresh", service.HandleRefreshToken).Methods(http.MethodPost)
+	if config.OIDC != nil {
+		v1.HandleFunc("/oidc/login", service.HandleOIDCLogin).Methods(http.MethodGet)
+		v1.HandleFunc("/oidc/callback", service.HandleOIDCCallback).Methods(http.MethodGet)
+	}
+	if config.FakeIdP {
+		mountFakeIdP(r, config.OIDC)
+	}
 	v1.HandleFunc("/products", service.HandleGetProducts).Methods(http.MethodGet)
 	v1.HandleFunc("/promotions", service.HandleGetPromotions).Methods(http.MethodGet)
+	v1.HandleFunc("/cart/guest", service.HandleCreateGuestCart).Methods(http.MethodPost)
+	// the cart also takes the cart tokens of guests. Its middleware wraps each handler since a subrouter that doesn't
+	// match stops the middlewares of the ones after it from running.
+	cartAccess := func(h http.HandlerFunc) http.Handler { return service.ValidateCartAccess(h) }
+	v1.Handle("/cart", cartAccess(service.HandleGetCart)).Methods(http.MethodGet)
+	v1.Handle("/cart/add", cartAccess(service.HandleCartAddItem)).Methods(http.MethodPost)
+	v1.Handle("/cart/remove", cartAccess(service.HandleCartRemoveItem)).Methods(http.MethodPost)
+	v1.Handle("/cart/clear", cartAccess(service.HandleCartClear)).Methods(http.MethodPost)
+	v1.Handle("/cart/coupon", cartAccess(service.HandleCartApplyCoupon)).Methods(http.MethodPost)
+	v1.Handle("/cart/coupon", cartAccess(service.HandleCartRemoveCoupon)).Methods(http.MethodDelete)
+	v1.Handle("/cart/checkout", cartAccess(service.HandleCartCheckout)).Methods(http.MethodGet)
 	v1Secure := v1.NewRoute().Subrouter()
 	v1Secure.Use(service.ValidateAccessToken)
-	v1Secure.HandleFunc("/cart", service.HandleGetCart).Methods(http.MethodGet)
-	v1Secure.HandleFunc("/cart/add", service.HandleCartAddItem).Methods(http.MethodPost)
-	v1Secure.HandleFunc("/cart/remove", service.HandleCartRemoveItem).Methods(http.MethodPost)
-	v1Secure.HandleFunc("/cart/clear", service.HandleCartClear).Methods(http.MethodPost)
-	v1Secure.HandleFunc("/cart/checkout", service.HandleCartCheckout).Methods(http.MethodGet)
+	v1Secure.HandleFunc("/logout", service.HandleLogout).Methods(http.MethodPost)
 	v1Secure.HandleFunc("/cart/buy", service.HandleCartBuy).Methods(http.MethodPost)
+	v1Secure.HandleFunc("/orders", service.HandleGetOrders).Methods(http.MethodGet)
+	v1Secure.HandleFunc("/orders/{id}", service.HandleGetOrder).Methods(http.MethodGet)
+	v1Secure.HandleFunc("/carts", service.HandleGetCarts).Methods(http.MethodGet)
+	v1Secure.HandleFunc("/carts/move", service.HandleCartMoveItem).Methods(http.MethodPost)
+	v1Secure.HandleFunc("/carts/{name}", service.HandleGetNamedCart).Methods(http.MethodGet)
+	v1Secure.HandleFunc("/carts/{name}", service.HandleDeleteNamedCart).Methods(http.MethodDelete)
+	v1Secure.HandleFunc("/carts/{name}/add", service.HandleNamedCartAddItem).Methods(http.MethodPost)
+	v1Secure.HandleFunc("/carts/{name}/remove", service.HandleNamedCartRemoveItem).Methods(http.MethodPost)
+	v1Merchandiser := v1Secure.NewRoute().Subrouter()
+	v1Merchandiser.Use(service.RequireRoles(shopping.RoleMerchandiser))
+	v1Merchandiser.HandleFunc("/promotions/simulate", service.HandleSimulatePromotions).Methods(http.MethodPost)
+
+	admin := r.PathPrefix("/v1/admin").Subrouter()
+	admin.Use(service.ValidateAccessToken)
+	adminProducts := admin.PathPrefix("/products").Subrouter()
+	adminProducts.Use(service.RequireRoles(shopping.RoleAdmin))
+	adminProducts.HandleFunc("", service.HandleAdminGetProducts).Methods(http.MethodGet)
+	adminProducts.HandleFunc("", service.HandleAdminCreateProduct).Methods(http.MethodPost)
+	adminProducts.HandleFunc("/{id}", service.HandleAdminReplaceProduct).Methods(http.MethodPut)
+	adminProducts.HandleFunc("/{id}", service.HandleAdminUpdateProduct).Methods(http.MethodPatch)
+	adminProducts.HandleFunc("/{id}", service.HandleAdminDeleteProduct).Methods(http.MethodDelete)
+	adminUsers := admin.PathPrefix("/users").Subrouter()
+	adminUsers.Use(service.RequireRoles(shopping.RoleAdmin))
+	adminUsers.HandleFunc("/{username}/unlock", service.HandleAdminUnlockUser).Methods(http.MethodPost)
+	adminPromotions := admin.PathPrefix("/promotions").Subrouter()
+	adminPromotions.Use(service.RequireRoles(shopping.RoleMerchandiser))
+	adminPromotions.HandleFunc("", service.HandleAdminGetPromotions).Methods(http.MethodGet)
+	adminPromotions.HandleFunc("", service.HandleAdminCreatePromotion).Methods(http.MethodPost)
+	adminPromotions.HandleFunc("/{id}", service.HandleAdminReplacePromotion).Methods(http.MethodPut)
+	adminPromotions.HandleFunc("/{id}", service.HandleAdminDeletePromotion).Methods(http.MethodDelete)
+	adminPromotions.HandleFunc("/{id}/enable", service.HandleAdminEnablePromotion).Methods(http.MethodPost)
+	adminPromotions.HandleFunc("/{id}/disable", service.HandleAdminDisablePromotion).Methods(http.MethodPost)
 
 	handler := handlers.CORS(corsAllowedHeaders, corsAllowedDomains, corsAllowedMethods)(r)
 	port := config.HTTP.ListenPort
@@ -102,3 +238,97 @@ func main() {
 	}
 
 }
+
+// newDAO creates the DAO described by the storage config
+// and reports if it already holds data from a previous run
+func newDAO(storage *Storage) (shopping.DAO, bool) {
+	if storage == nil {
+		storage = &Storage{}
+	}
+	switch storage.Type {
+	case "", "memory":
+		return shopping.NewMemory(), false
+	case "file":
+		dao, err := shopping.NewFile(storage.DataDir, storage.SnapshotEvery)
+		if err != nil {
+			log.WithError(err).Fatalln("failed to open file storage in", storage.DataDir)
+		}
+		return dao, dao.Restored()
+	case "sql":
+		dao := openSQL(storage)
+		pending, err := dao.PendingMigrations()
+		if err != nil {
+			log.WithError(err).Fatalln("failed to read sql schema version")
+		}
+		if pending {
+			log.Fatalln("sql schema is out of date, run", os.Args[0], "migrate")
+		}
+		empty, err := dao.Empty()
+		if err != nil {
+			log.WithError(err).Fatalln("failed to read sql storage")
+		}
+		return dao, !empty
+	}
+	log.Fatalln("unknown storage type", storage.Type)
+	return nil, false
+}
+
+// migrate brings the sql storage schema up to date
+func migrate(storage *Storage) {
+	if storage == nil || storage.Type != "sql" {
+		log.Fatalln("migrate is only available for the sql storage")
+	}
+	dao := openSQL(storage)
+	defer dao.Close()
+
+	if err := dao.Migrate(); err != nil {
+		log.WithError(err).Fatalln("failed to migrate sql storage")
+	}
+	version, err := dao.SchemaVersion()
+	if err != nil {
+		log.WithError(err).Fatalln("failed to read sql schema version")
+	}
+	log.Infof("sql schema is at version %d", version)
+}
+
+// reloadOnHangup reloads the exchange rates from the config file every time the process gets a SIGHUP
+func reloadOnHangup(location string, service *shopping.Service) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		if err := reloadExchangeRates(location, service); err != nil {
+			log.WithError(err).Errorln("failed to reload exchange rates from", location)
+			continue
+		}
+		log.Infoln("reloaded exchange rates from", location)
+	}
+}
+
+// mountFakeIdP serves the stand-in identity provider at the path of the oidc issuer
+func mountFakeIdP(r *mux.Router, c *shopping.OIDCConfig) {
+	if c == nil {
+		log.Fatalln("fake_idp needs the oidc config")
+	}
+	issuer, err := url.Parse(c.Issuer)
+	if err != nil {
+		log.WithError(err).Fatalln("invalid oidc issuer")
+	}
+	prefix := strings.TrimSuffix(issuer.Path, "/")
+	if prefix == "" || strings.HasPrefix(prefix+"/", "/v1/") || prefix == "/healthcheck" {
+		log.Fatalln("fake_idp needs an oidc issuer with a path of its own, e.g. http://localhost:8080/fakeidp")
+	}
+	idp, err := fakeidp.New(c.Issuer, c.ClientID, c.ClientSecret, c.RedirectURL)
+	if err != nil {
+		log.WithError(err).Fatalln("failed to start the fake identity provider")
+	}
+	log.Warnln("serving a fake identity provider at", c.Issuer, "anyone can sign in as anyone, never enable it in production")
+	r.PathPrefix(prefix + "/").Handler(http.StripPrefix(prefix, idp))
+}
+
+func openSQL(storage *Storage) *shopping.SQL {
+	dao, err := shopping.NewSQL(storage.SQLDriver, storage.SQLDSN)
+	if err != nil {
+		log.WithError(err).Fatalln("failed to open sql storage")
+	}
+	return dao
+}
@@ -0,0 +1,54 @@
+package shopping
+
+import (
+	"fmt"
+	"strings"
+)
+
+// InitCoupons calls DAO to load the coupons from config
+func (s *Service) InitCoupons(coupons []*Coupon) error {
+	base := s.baseCurrency()
+	for _, c := range coupons {
+		if strings.TrimSpace(c.Code) == "" {
+			return fmt.Errorf("coupon without code")
+		}
+		if c.MaxRedemptions < 0 || c.MaxPerUser < 0 {
+			return fmt.Errorf("coupon %s has a negative redemption limit", c.Code)
+		}
+		if c.MinSpend != nil && c.MinSpend.Currency != base {
+			return fmt.Errorf("coupon %s has a min_spend in %s instead of the base currency %s", c.Code, c.MinSpend.Currency, base)
+		}
+	}
+	return s.dao.SetCoupons(coupons)
+}
+
+// checkCoupon makes sure the user can redeem the coupon on a cart costing subtotal before discounts
+// and returns the coupon with its code in upper case
+func (s *Service) checkCoupon(code string, userID int, subtotal Money) (*Coupon, error) {
+	coupon, err := s.dao.GetCoupon(code)
+	if err != nil {
+		if err == errCouponNotFound {
+			return nil, errCouponNotFound.msg("coupon " + strings.ToUpper(code) + " doesn't exist")
+		}
+		return nil, toError(err, "dao.GetCoupon")
+	}
+	if coupon.ExpiresAt != nil && !s.now().Before(*coupon.ExpiresAt) {
+		return nil, errBadRequestCouponExpired.msg("coupon " + coupon.Code + " expired on " + coupon.ExpiresAt.UTC().Format("2006-01-02 15:04 MST"))
+	}
+	if coupon.MinSpend != nil && subtotal.Amount < coupon.MinSpend.Amount {
+		return nil, errBadRequestCouponMinSpend.msg("coupon " + coupon.Code + " needs a cart of at least " + coupon.MinSpend.String())
+	}
+	if coupon.MaxRedemptions > 0 && coupon.Redeemed >= coupon.MaxRedemptions {
+		return nil, errConflictCouponLimit.msg("coupon " + coupon.Code + " reached its redemption limit")
+	}
+	if coupon.MaxPerUser > 0 {
+		redeemed, err := s.dao.CountRedemptions(coupon.Code, userID)
+		if err != nil {
+			return nil, toError(err, "dao.CountRedemptions")
+		}
+		if redeemed >= coupon.MaxPerUser {
+			return nil, errConflictCouponLimit.msg("coupon " + coupon.Code + " reached its limit for the user")
+		}
+	}
+	return coupon, nil
+}
@@ -0,0 +1,215 @@
+package shopping
+
+import (
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+)
+
+// currencyHeader can be used instead of the currency query parameter to choose the currency of prices in a response
+const currencyHeader = "X-Currency"
+
+// ExchangeRates converts amounts between the base currency of the catalog and the currencies it's sold in,
+// Rates holds how many units of each currency one unit of the base currency buys
+type ExchangeRates struct {
+	Base  string             `json:"base"`
+	Rates map[string]float64 `json:"rates,omitempty"`
+}
+
+// validate normalises currency codes to upper case and checks every rate is usable
+func (e *ExchangeRates) validate() error {
+	e.Base = strings.ToUpper(e.Base)
+	if len(e.Base) != 3 {
+		return fmt.Errorf("invalid base currency %q", e.Base)
+	}
+	rates := make(map[string]float64, len(e.Rates))
+	for currency, rate := range e.Rates {
+		currency = strings.ToUpper(currency)
+		if len(currency) != 3 {
+			return fmt.Errorf("invalid currency %q", currency)
+		}
+		if rate <= 0 {
+			return fmt.Errorf("rate for %s must be positive", currency)
+		}
+		rates[currency] = rate
+	}
+	rates[e.Base] = 1
+	e.Rates = rates
+	return nil
+}
+
+// rate returns how many units of currency one unit of the base currency buys
+func (e *ExchangeRates) rate(currency string) (*big.Rat, bool) {
+	rate, ok := e.Rates[currency]
+	if !ok {
+		return nil, false
+	}
+	return new(big.Rat).SetFloat64(rate), true
+}
+
+// Convert returns m in currency rounded half away from zero to the minor unit of currency
+func (e *ExchangeRates) Convert(m Money, currency string) (Money, error) {
+	if m.Currency == currency || m.Currency == "" {
+		return Money{Amount: m.Amount, Currency: currency}, nil
+	}
+	from, ok := e.rate(m.Currency)
+	if !ok {
+		return Money{}, fmt.Errorf("no exchange rate for %s", m.Currency)
+	}
+	to, ok := e.rate(currency)
+	if !ok {
+		return Money{}, fmt.Errorf("no exchange rate for %s", currency)
+	}
+	// amount / 10^decimals(from) / rate(from) * rate(to) * 10^decimals(to)
+	amount := new(big.Rat).SetInt64(m.Amount)
+	amount.Mul(amount, to)
+	amount.Quo(amount, from)
+	amount.Mul(amount, new(big.Rat).SetFrac(pow10(Decimals(currency)), pow10(Decimals(m.Currency))))
+	return Money{Amount: roundRat(amount), Currency: currency}, nil
+}
+
+// exchangeRates returns the rates in use, nil when the catalog is only sold in one currency
+func (s *Service) exchangeRates() *ExchangeRates {
+	s.ratesMu.RLock()
+	defer s.ratesMu.RUnlock()
+	return s.rates
+}
+
+// baseCurrency returns the currency the catalog is priced in, the base of the exchange rates or the DefaultCurrency
+// without them. Prices, promotion amounts, coupon minimum spends and shipping must all be in it so amounts can always
+// be added up.
+func (s *Service) baseCurrency() string {
+	if rates := s.exchangeRates(); rates != nil {
+		return rates.Base
+	}
+	return DefaultCurrency
+}
+
+// SetExchangeRates replaces the exchange rates in use, it can be called while the service is running
+func (s *Service) SetExchangeRates(rates *ExchangeRates) error {
+	if rates == nil {
+		return fmt.Errorf("exchange rates can't be nil")
+	}
+	r := &ExchangeRates{Base: rates.Base, Rates: rates.Rates}
+	if err := r.validate(); err != nil {
+		return err
+	}
+	s.ratesMu.Lock()
+	defer s.ratesMu.Unlock()
+	if s.rates != nil && s.rates.Base != r.Base {
+		return fmt.Errorf("base currency can't change from %s to %s", s.rates.Base, r.Base)
+	}
+	s.rates = r
+	return nil
+}
+
+// requestedCurrency returns the currency asked for with the currency query parameter or the X-Currency header,
+// an empty string means prices are returned as stored
+func (s *Service) requestedCurrency(r *http.Request) (string, *Error) {
+	currency := r.URL.Query().Get("currency")
+	if currency == "" {
+		currency = r.Header.Get(currencyHeader)
+	}
+	if currency == "" {
+		return "", nil
+	}
+	currency = strings.ToUpper(currency)
+	rates := s.exchangeRates()
+	if rates == nil {
+		return "", errBadRequestUnsupportedCurrency.msg("no exchange rates configured, asked for " + currency)
+	}
+	if _, ok := rates.Rates[currency]; !ok {
+		return "", errBadRequestUnsupportedCurrency.msg("no exchange rate for " + currency)
+	}
+	return currency, nil
+}
+
+// convertProducts converts the price of every product to currency
+func (s *Service) convertProducts(products Products, currency string) error {
+	if currency == "" {
+		return nil
+	}
+	rates := s.exchangeRates()
+	for _, p := range products {
+		price, err := rates.Convert(p.Price, currency)
+		if err != nil {
+			return err
+		}
+		p.Price = price
+	}
+	return nil
+}
+
+// convertCart converts the prices of a cart to currency, each line and adjustment is converted and rounded on its own
+// and the totals are added up from the converted lines so they always match
+func (s *Service) convertCart(cart *Cart, currency string) error {
+	if currency == "" {
+		return nil
+	}
+	rates := s.exchangeRates()
+	convertLine := func(p *CartProduct) error {
+		unit, err := rates.Convert(p.UnitPrice, currency)
+		if err != nil {
+			return err
+		}
+		discounted, err := rates.Convert(p.DiscountedPrice, currency)
+		if err != nil {
+			return err
+		}
+		p.UnitPrice = unit
+		p.DiscountedPrice = discounted
+		p.DiscountAmount = Money{Currency: currency}
+		if p.Discount || p.SpecialPrice {
+			p.DiscountAmount = unit.Sub(discounted)
+		}
+		return nil
+	}
+
+	for _, line := range cart.Products {
+		unit, err := rates.Convert(line.UnitPrice, currency)
+		if err != nil {
+			return err
+		}
+		line.UnitPrice = unit
+	}
+	for _, p := range cart.Checkout {
+		if err := convertLine(p); err != nil {
+			return err
+		}
+	}
+	for _, a := range cart.Adjustments {
+		amount, err := rates.Convert(a.Amount, currency)
+		if err != nil {
+			return err
+		}
+		a.Amount = amount
+	}
+	cart.TotalPrice, cart.TotalDiscount = Money{Currency: currency}, Money{Currency: currency}
+	if len(cart.Checkout) > 0 {
+		total, discount := calculateTotalPrice(cart.Checkout, cart.Adjustments)
+		cart.TotalPrice = cart.TotalPrice.Add(total)
+		cart.TotalDiscount = cart.TotalDiscount.Add(discount)
+	}
+	return nil
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+// roundRat rounds r half away from zero to an integer
+func roundRat(r *big.Rat) int64 {
+	num := new(big.Int).Set(r.Num())
+	den := r.Denom()
+	neg := num.Sign() < 0
+	num.Abs(num)
+	// (2*num + den) / (2*den)
+	num.Mul(num, big.NewInt(2))
+	num.Add(num, den)
+	q := num.Quo(num, new(big.Int).Mul(den, big.NewInt(2)))
+	if neg {
+		q.Neg(q)
+	}
+	return q.Int64()
+}
@@ -0,0 +1,117 @@
+package shopping
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExchangeRatesConvert(t *testing.T) {
+	rates := &ExchangeRates{Base: "usd", Rates: map[string]float64{"eur": 0.9, "jpy": 150, "kwd": 0.3, "gbp": 0.5}}
+	if err := rates.validate(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		m        Money
+		currency string
+		want     Money
+		err      bool
+	}{
+		{name: "to another currency", m: Money{Amount: 2000, Currency: "USD"}, currency: "EUR", want: Money{Amount: 1800, Currency: "EUR"}},
+		{name: "half a cent up", m: Money{Amount: 5, Currency: "USD"}, currency: "GBP", want: Money{Amount: 3, Currency: "GBP"}},
+		{name: "half a cent away from zero", m: Money{Amount: -5, Currency: "USD"}, currency: "GBP", want: Money{Amount: -3, Currency: "GBP"}},
+		{name: "to a currency without decimals", m: Money{Amount: 1999, Currency: "USD"}, currency: "JPY", want: Money{Amount: 2999, Currency: "JPY"}},
+		{name: "from a currency without decimals", m: Money{Amount: 150, Currency: "JPY"}, currency: "USD", want: Money{Amount: 100, Currency: "USD"}},
+		{name: "to a currency with 3 decimals", m: Money{Amount: 1000, Currency: "USD"}, currency: "KWD", want: Money{Amount: 3000, Currency: "KWD"}},
+		{name: "between currencies other than the base", m: Money{Amount: 1000, Currency: "EUR"}, currency: "JPY", want: Money{Amount: 1667, Currency: "JPY"}},
+		{name: "same currency", m: Money{Amount: 1234, Currency: "EUR"}, currency: "EUR", want: Money{Amount: 1234, Currency: "EUR"}},
+		{name: "no currency", m: Money{Amount: 1234}, currency: "JPY", want: Money{Amount: 1234, Currency: "JPY"}},
+		{name: "no rate to", m: Money{Amount: 1000, Currency: "USD"}, currency: "CHF", err: true},
+		{name: "no rate from", m: Money{Amount: 1000, Currency: "CHF"}, currency: "USD", err: true},
+	}
+	for _, tt := range tests {
+		got, err := rates.Convert(tt.m, tt.currency)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: converted to %+v, want an error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: Convert(%+v, %s) = %+v, %v, want %+v", tt.name, tt.m, tt.currency, got, err, tt.want)
+		}
+	}
+}
+
+func TestConvertCartAddsUpConvertedLines(t *testing.T) {
+	s := newTestService(t, NewMemory())
+	if err := s.SetExchangeRates(&ExchangeRates{Base: "USD", Rates: map[string]float64{"JPY": 151.37}}); err != nil {
+		t.Fatal(err)
+	}
+	usd := func(amount int64) Money { return Money{Amount: amount, Currency: "USD"} }
+	cart := &Cart{
+		Products: CartLines{1: {ProductID: 1, Quantity: 3, UnitPrice: usd(2000)}},
+		Checkout: []*CartProduct{
+			{ProductID: 1, Quantity: 3, UnitPrice: usd(2000), DiscountAmount: usd(0), DiscountedPrice: usd(2000)},
+			{ProductID: 2, Quantity: 1, UnitPrice: usd(6000), Discount: true, DiscountAmount: usd(900), DiscountedPrice: usd(5100)},
+		},
+		Adjustments: []*Adjustment{{Type: AdjustmentShipping, Amount: usd(500)}},
+	}
+	if err := s.convertCart(cart, "JPY"); err != nil {
+		t.Fatal(err)
+	}
+
+	// each amount is rounded on its own: 3027.4, 9082.2, 7719.87 and 756.85 yen
+	jpy := func(amount int64) Money { return Money{Amount: amount, Currency: "JPY"} }
+	if got := cart.Products[1].UnitPrice; got != jpy(3027) {
+		t.Errorf("cart line costs %+v, want 3027 JPY", got)
+	}
+	belt, shirt := cart.Checkout[0], cart.Checkout[1]
+	if belt.UnitPrice != jpy(3027) || belt.DiscountedPrice != jpy(3027) || belt.DiscountAmount != jpy(0) {
+		t.Errorf("belt = %+v, want 3027 JPY without a discount", belt)
+	}
+	if shirt.UnitPrice != jpy(9082) || shirt.DiscountedPrice != jpy(7720) || shirt.DiscountAmount != jpy(1362) {
+		t.Errorf("shirt = %+v, want 9082 JPY discounted by 1362 to 7720", shirt)
+	}
+	if got := cart.Adjustments[0].Amount; got != jpy(757) {
+		t.Errorf("shipping costs %+v, want 757 JPY", got)
+	}
+	// 3*3027 + 9082 + 757 - 1362, not the 17559 yen the 116 USD total converts to
+	if cart.TotalPrice != jpy(17558) || cart.TotalDiscount != jpy(1362) {
+		t.Errorf("cart totals %+v discounted by %+v, want 17558 JPY discounted by 1362", cart.TotalPrice, cart.TotalDiscount)
+	}
+}
+
+func TestRequestedCurrency(t *testing.T) {
+	s := newTestService(t, NewMemory())
+	request := func(query, header string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/v1/products"+query, nil)
+		if header != "" {
+			r.Header.Set(currencyHeader, header)
+		}
+		return r
+	}
+	if _, err := s.requestedCurrency(request("?currency=eur", "")); err == nil {
+		t.Error("a currency was accepted without exchange rates")
+	}
+	if err := s.SetExchangeRates(&ExchangeRates{Base: "USD", Rates: map[string]float64{"EUR": 0.9, "JPY": 150}}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		query, header, want string
+		err                 bool
+	}{
+		{want: ""},
+		{query: "?currency=eur", want: "EUR"},
+		{header: "jpy", want: "JPY"},
+		{query: "?currency=EUR", header: "JPY", want: "EUR"},
+		{query: "?currency=chf", err: true},
+	}
+	for _, tt := range tests {
+		got, err := s.requestedCurrency(request(tt.query, tt.header))
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("currency %q with header %q = %q, %v, want %q", tt.query, tt.header, got, err, tt.want)
+		}
+	}
+}
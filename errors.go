@@ -1,23 +1,99 @@
 package shopping
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"sort"
 )
 
 var (
 	errInternalServerError = &Error{Code: http.StatusInternalServerError, Message: "Something went wrong :("}
 	errMissingAccessToken  = &Error{Code: http.StatusUnauthorized, Message: "Missing access token"}
+	errInvalidAccessToken  = &Error{Code: http.StatusUnauthorized, Message: "Invalid or expired access token"}
+	errInvalidRefreshToken = &Error{Code: http.StatusUnauthorized, Message: "Invalid or expired refresh token"}
+	errInvalidCartToken    = &Error{Code: http.StatusUnauthorized, Message: "Invalid or expired cart token"}
+	errForbidden           = &Error{Code: http.StatusForbidden, Message: "Not allowed"}
 
 	errInvalidUsernameOrPassowrd = &Error{Code: http.StatusUnauthorized, Message: "Invalid username or password"}
+	errTooManyLogins             = &Error{Code: http.StatusTooManyRequests, Message: "Too many failed logins, try again later"}
 	errBadRequestNotEnoughStock  = &Error{Code: http.StatusBadRequest, Message: "Not enough stock for that product"}
+	errBadRequestEmptyCart       = &Error{Code: http.StatusBadRequest, Message: "Cart is empty"}
+	errOrderNotFound             = &Error{Code: http.StatusNotFound, Message: "Order not found"}
+	errConflictNotEnoughStock    = &Error{Code: http.StatusConflict, Message: "Not enough stock for some products"}
+
+	errCartNotFound              = &Error{Code: http.StatusNotFound, Message: "Cart not found"}
+	errBadRequestInvalidCartName = &Error{Code: http.StatusBadRequest, Message: "Invalid cart name"}
+	errBadRequestTooManyCarts    = &Error{Code: http.StatusBadRequest, Message: "Too many carts"}
+	errBadRequestInvalidQuantity = &Error{Code: http.StatusBadRequest, Message: "Invalid quantity"}
+	errBadRequestNotInCart       = &Error{Code: http.StatusBadRequest, Message: "Product isn't in the cart"}
+
+	errBadRequestUnsupportedCurrency = &Error{Code: http.StatusBadRequest, Message: "Currency not supported"}
+
+	errCouponNotFound           = &Error{Code: http.StatusNotFound, Message: "Coupon not found"}
+	errBadRequestCouponExpired  = &Error{Code: http.StatusBadRequest, Message: "Coupon has expired"}
+	errBadRequestCouponMinSpend = &Error{Code: http.StatusBadRequest, Message: "Cart doesn't reach the minimum spend of the coupon"}
+	errConflictCouponLimit      = &Error{Code: http.StatusConflict, Message: "Coupon can't be redeemed any more times"}
+
+	errBadRequestInvalidPromotion = &Error{Code: http.StatusBadRequest, Message: "Invalid promotion"}
+	errBadRequestProductNotFound  = &Error{Code: http.StatusBadRequest, Message: "Product doesn't exist"}
+
+	errProductNotFound          = &Error{Code: http.StatusNotFound, Message: "Product not found"}
+	errBadRequestInvalidProduct = &Error{Code: http.StatusBadRequest, Message: "Invalid product"}
+	errConflictProductExists    = &Error{Code: http.StatusConflict, Message: "A product with that ID already exists"}
+
+	errPromotionNotFound       = &Error{Code: http.StatusNotFound, Message: "Promotion not found"}
+	errConflictPromotionExists = &Error{Code: http.StatusConflict, Message: "A promotion with that ID already exists"}
+
+	errBadRequestInvalidUsername = &Error{Code: http.StatusBadRequest, Message: "Invalid username"}
+	errBadRequestWeakPassword    = &Error{Code: http.StatusBadRequest, Message: "Password isn't strong enough"}
+	errConflictUsernameTaken     = &Error{Code: http.StatusConflict, Message: "Username is already taken"}
+	errConflictSubjectTaken      = &Error{Code: http.StatusConflict, Message: "A user is already linked to that identity"}
+	errNoSuchUser                = &Error{Code: http.StatusNotFound, Message: "User not found"}
+
+	errOIDCNotConfigured          = &Error{Code: http.StatusNotFound, Message: "Single sign-on isn't enabled"}
+	errBadRequestInvalidOIDCState = &Error{Code: http.StatusBadRequest, Message: "Single sign-on expired or was started elsewhere, try again"}
+	errOIDCLoginFailed            = &Error{Code: http.StatusUnauthorized, Message: "Single sign-on failed"}
+	errBadGatewayIdentityProvider = &Error{Code: http.StatusBadGateway, Message: "Identity provider is unavailable"}
+)
+
+var (
+	// errUserNotFound is returned by the DAO when there's no user with the username or ID
+	errUserNotFound = errors.New("user not found")
+	// errAccessTokenNotFound is returned by the DAO when there's no access token with the hash
+	errAccessTokenNotFound = errors.New("access token not found")
 )
 
 // Error describes custom error that can be used for logging and to write the response inside the handler
 type Error struct {
-	message string // msg used for logging purposes
-	Code    int    `json:"code,omitempty"`
-	Message string `json:"message,omitempty"`
+	message string      // msg used for logging purposes
+	base    *Error      // shared error above it was copied from with msg, so errors.Is matches copies
+	Code    int         `json:"code,omitempty"`
+	Message string      `json:"message,omitempty"`
+	Details interface{} `json:"details,omitempty"` // extra information for the client about the error
+}
+
+// StockShortage describes a product that doesn't have enough stock for a request
+type StockShortage struct {
+	ProductID int `json:"product_id"`
+	Requested int `json:"requested"`
+	Available int `json:"available"`
+}
+
+// notEnoughStock returns a conflict error listing the products that are short
+func notEnoughStock(shortages []*StockShortage) *Error {
+	sort.Slice(shortages, func(i, j int) bool { return shortages[i].ProductID < shortages[j].ProductID })
+	err := errConflictNotEnoughStock.msg(fmt.Sprintf("%d products short", len(shortages)))
+	err.Details = shortages
+	return err
+}
+
+// stockBelowHeld returns a bad request for a product that would be left with less stock than is held in carts
+func stockBelowHeld(id, stock, held int) *Error {
+	message := fmt.Sprintf("product %d can't have %d units in stock with %d held in carts", id, stock, held)
+	err := errBadRequestInvalidProduct.msg(message)
+	err.Details = message
+	return err
 }
 
 // Error implements error interface
@@ -25,7 +101,26 @@ func (e *Error) Error() string {
 	return fmt.Sprintf("code: %d message: %s", e.Code, e.Message)
 }
 
+// msg returns a copy of e with the log message set so the shared errors above are never mutated
 func (e *Error) msg(m string) *Error {
-	e.message = m
-	return e
+	err := *e
+	err.message = m
+	if e.base == nil {
+		err.base = e
+	}
+	return &err
+}
+
+// Is reports if e is target or a copy of it made with msg
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && (e == t || e.base == t)
+}
+
+// toError keeps errors of type *Error as they are, anything else is an internal error
+func toError(err error, prefix string) *Error {
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+	return errInternalServerError.msg(prefix + ": " + err.Error())
 }
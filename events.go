@@ -0,0 +1,77 @@
+package shopping
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const webhookTimeout = 10 * time.Second
+
+// EventType names what happened
+type EventType string
+
+const (
+	// EventBackInStock is a product in a user's wishlist that was out of stock and has been restocked
+	EventBackInStock EventType = "back_in_stock"
+)
+
+// Event is something a user may want to be told about, hooks decide how to tell them
+type Event struct {
+	Type    EventType `json:"type"`
+	UserID  int       `json:"user_id"`
+	Product *Product  `json:"product,omitempty"`
+	At      time.Time `json:"at"`
+}
+
+// EventHook is called with every event, it must not block as it runs while handling the request that caused it
+type EventHook func(*Event)
+
+// emit passes the event to every hook
+func (s *Service) emit(e *Event) {
+	for _, hook := range s.hooks {
+		hook(e)
+	}
+}
+
+// LogEvents is a hook that logs every event
+func LogEvents(e *Event) {
+	entry := log.WithField("type", e.Type).WithField("user", e.UserID)
+	if e.Product != nil {
+		entry = entry.WithField("product", e.Product.ID)
+	}
+	entry.Infoln("event")
+}
+
+// WebhookEvents returns a hook that POSTs every event as JSON to url in the background, failures are only logged
+func WebhookEvents(url string) EventHook {
+	client := &http.Client{Timeout: webhookTimeout}
+	return func(e *Event) {
+		body, err := json.Marshal(e)
+		if err != nil {
+			log.WithError(err).WithField("type", e.Type).Errorln("failed to encode event")
+			return
+		}
+		go func() {
+			if err := postEvent(client, url, body); err != nil {
+				log.WithError(err).WithField("type", e.Type).WithField("user", e.UserID).Errorln("failed to send event to webhook")
+			}
+		}()
+	}
+}
+
+func postEvent(client *http.Client, url string, body []byte) error {
+	res, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,342 @@
+// Package fakeidp is an OpenID Connect identity provider to try single sign-on without a real one. It signs in anyone
+// with the username they type, or the login_hint of the request, so it must never be exposed in production.
+package fakeidp
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	codeTTL    = time.Minute
+	idTokenTTL = 5 * time.Minute
+	keyBits    = 2048
+)
+
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9._@-]{1,64}$`)
+
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Fake identity provider</title></head>
+<body>
+<h1>Sign in to {{.}}</h1>
+<form method="post">
+<label>Username <input name="username" autofocus></label>
+<button type="submit">Sign in</button>
+</form>
+</body>
+</html>
+`))
+
+// grant is an authorization code waiting to be exchanged for an ID token
+type grant struct {
+	username    string
+	nonce       string
+	challenge   string
+	redirectURI string
+	expiresAt   time.Time
+}
+
+// Provider serves the discovery document, authorization, token and JWKS endpoints of an identity provider with a single
+// client, it signs ID tokens with an RSA key generated when it's created
+type Provider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	key          *rsa.PrivateKey
+	keyID        string
+	now          func() time.Time
+
+	mu    sync.Mutex
+	codes map[string]*grant
+}
+
+// New returns a provider reachable at issuer for the client with the given credentials and callback
+func New(issuer, clientID, clientSecret, redirectURL string) (*Provider, error) {
+	if clientID == "" || redirectURL == "" {
+		return nil, errors.New("fake identity provider needs a client id and a redirect url")
+	}
+	key, err := rsa.GenerateKey(rand.Reader, keyBits)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(key.N.Bytes())
+	return &Provider{
+		issuer:       strings.TrimSuffix(issuer, "/"),
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		redirectURL:  redirectURL,
+		key:          key,
+		keyID:        hex.EncodeToString(sum[:8]),
+		now:          time.Now,
+		codes:        map[string]*grant{},
+	}, nil
+}
+
+// ServeHTTP routes requests to the endpoints, paths are relative to the issuer so mount it with http.StripPrefix
+// when the issuer has a path
+func (p *Provider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch strings.TrimSuffix(r.URL.Path, "/") {
+	case "/.well-known/openid-configuration":
+		p.handleDiscovery(w, r)
+	case "/authorize":
+		p.handleAuthorize(w, r)
+	case "/token":
+		p.handleToken(w, r)
+	case "/jwks":
+		p.handleJWKS(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (p *Provider) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                p.issuer,
+		"authorization_endpoint":                p.issuer + "/authorize",
+		"token_endpoint":                        p.issuer + "/token",
+		"jwks_uri":                              p.issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"scopes_supported":                      []string{"openid", "profile"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"claims_supported":                      []string{"iss", "sub", "aud", "exp", "iat", "nonce", "preferred_username"},
+	})
+}
+
+// handleAuthorize signs in the user named by login_hint, or the one typed in the login page, and sends them back to
+// the client with an authorization code
+func (p *Provider) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	// errors about the client or where to send the user back can't be redirected
+	if query.Get("client_id") != p.clientID {
+		http.Error(w, "unknown client_id", http.StatusBadRequest)
+		return
+	}
+	if query.Get("redirect_uri") != p.redirectURL {
+		http.Error(w, "redirect_uri isn't registered", http.StatusBadRequest)
+		return
+	}
+
+	fail := func(code, description string) {
+		back, _ := url.Parse(p.redirectURL)
+		values := back.Query()
+		values.Set("error", code)
+		values.Set("error_description", description)
+		values.Set("state", query.Get("state"))
+		back.RawQuery = values.Encode()
+		http.Redirect(w, r, back.String(), http.StatusFound)
+	}
+	if query.Get("response_type") != "code" {
+		fail("unsupported_response_type", "only the code flow is supported")
+		return
+	}
+	if !strings.Contains(" "+query.Get("scope")+" ", " openid ") {
+		fail("invalid_scope", "the openid scope is required")
+		return
+	}
+	if query.Get("code_challenge") == "" || query.Get("code_challenge_method") != "S256" {
+		fail("invalid_request", "a S256 code_challenge is required")
+		return
+	}
+
+	username := query.Get("login_hint")
+	if r.Method == http.MethodPost {
+		username = r.PostFormValue("username")
+	}
+	if username == "" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		loginPage.Execute(w, p.clientID)
+		return
+	}
+	if !usernamePattern.MatchString(username) {
+		fail("access_denied", "invalid username")
+		return
+	}
+
+	code, err := randomString()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p.mu.Lock()
+	now := p.now()
+	for c, g := range p.codes {
+		if now.After(g.expiresAt) {
+			delete(p.codes, c)
+		}
+	}
+	p.codes[code] = &grant{
+		username:    username,
+		nonce:       query.Get("nonce"),
+		challenge:   query.Get("code_challenge"),
+		redirectURI: query.Get("redirect_uri"),
+		expiresAt:   now.Add(codeTTL),
+	}
+	p.mu.Unlock()
+
+	back, _ := url.Parse(p.redirectURL)
+	values := back.Query()
+	values.Set("code", code)
+	values.Set("state", query.Get("state"))
+	back.RawQuery = values.Encode()
+	http.Redirect(w, r, back.String(), http.StatusFound)
+}
+
+// handleToken exchanges an authorization code for an ID token, each code can only be used once
+func (p *Provider) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, tokenError("invalid_request", "use POST"))
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeJSON(w, http.StatusBadRequest, tokenError("invalid_request", err.Error()))
+		return
+	}
+	if !p.authenticateClient(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="fakeidp"`)
+		writeJSON(w, http.StatusUnauthorized, tokenError("invalid_client", "wrong client credentials"))
+		return
+	}
+	if r.PostFormValue("grant_type") != "authorization_code" {
+		writeJSON(w, http.StatusBadRequest, tokenError("unsupported_grant_type", "only authorization_code is supported"))
+		return
+	}
+
+	p.mu.Lock()
+	g, ok := p.codes[r.PostFormValue("code")]
+	delete(p.codes, r.PostFormValue("code"))
+	p.mu.Unlock()
+	now := p.now()
+	if !ok || now.After(g.expiresAt) {
+		writeJSON(w, http.StatusBadRequest, tokenError("invalid_grant", "unknown or expired code"))
+		return
+	}
+	if r.PostFormValue("redirect_uri") != g.redirectURI {
+		writeJSON(w, http.StatusBadRequest, tokenError("invalid_grant", "redirect_uri doesn't match the authorization request"))
+		return
+	}
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(g.challenge)) != 1 {
+		writeJSON(w, http.StatusBadRequest, tokenError("invalid_grant", "code_verifier doesn't match the code_challenge"))
+		return
+	}
+
+	idToken, err := p.sign(map[string]interface{}{
+		"iss":                p.issuer,
+		"sub":                subject(g.username),
+		"aud":                p.clientID,
+		"iat":                now.Unix(),
+		"exp":                now.Add(idTokenTTL).Unix(),
+		"nonce":              g.nonce,
+		"preferred_username": g.username,
+	})
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, tokenError("server_error", err.Error()))
+		return
+	}
+	accessToken, err := randomString()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, tokenError("server_error", err.Error()))
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(idTokenTTL / time.Second),
+		"id_token":     idToken,
+	})
+}
+
+// authenticateClient accepts the client credentials with HTTP Basic or in the form
+func (p *Provider) authenticateClient(r *http.Request) bool {
+	id, secret, ok := r.BasicAuth()
+	if ok {
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		id, secret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+	return id == p.clientID && subtle.ConstantTimeCompare([]byte(secret), []byte(p.clientSecret)) == 1
+}
+
+func (p *Provider) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": p.keyID,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+		}},
+	})
+}
+
+// sign returns an RS256 JWT with the claims
+func (p *Provider) sign(claims map[string]interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": p.keyID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// subject is the stable ID of a username, it stays the same across restarts unlike the signing key
+func subject(username string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(username)))
+	return hex.EncodeToString(sum[:16])
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func tokenError(code, description string) map[string]string {
+	return map[string]string{"error": code, "error_description": description}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("json.Marshal: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(js)
+}
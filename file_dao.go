@@ -0,0 +1,1314 @@
+package shopping
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	journalFile  = "journal.log"
+	snapshotFile = "snapshot.json"
+
+	defaultSnapshotEvery = 1000
+
+	opSetProductInventory = "set_product_inventory"
+	opUpdateProducts      = "update_products"
+	opReserveStock        = "reserve_stock"
+	opReleaseStock        = "release_stock"
+	opHoldStock           = "hold_stock"
+	opReleaseHolds        = "release_holds"
+	opReleaseExpiredHolds = "release_expired_holds"
+	opSetPromotions       = "set_promotions"
+	opSetUser             = "set_user"
+	opSetCart             = "set_cart"
+	opSetCarts            = "set_carts"
+	opDeleteCart          = "delete_cart"
+	opCreateOrder         = "create_order"
+	opSetCoupons          = "set_coupons"
+	opCreateProduct       = "create_product"
+	opUpdateProduct       = "update_product"
+	opDeleteProduct       = "delete_product"
+	opCreatePromotion     = "create_promotion"
+	opUpdatePromotion     = "update_promotion"
+	opDeletePromotion     = "delete_promotion"
+	opCreateUser          = "create_user"
+	opCreateAccessToken   = "create_access_token"
+	opRevokeAccessToken   = "revoke_access_token"
+	opDeleteExpiredTokens = "delete_expired_access_tokens"
+
+	opCreateRefreshToken         = "create_refresh_token"
+	opRotateRefreshToken         = "rotate_refresh_token"
+	opRevokeRefreshTokens        = "revoke_refresh_tokens"
+	opDeleteExpiredRefreshTokens = "delete_expired_refresh_tokens"
+
+	opCreateGuest         = "create_guest"
+	opDeleteGuest         = "delete_guest"
+	opDeleteExpiredGuests = "delete_expired_guests"
+
+	opRecordLoginFailure       = "record_login_failure"
+	opReserveLoginAttempt      = "reserve_login_attempt"
+	opReleaseLoginAttempt      = "release_login_attempt"
+	opClearLoginFailures       = "clear_login_failures"
+	opDeleteStaleLoginFailures = "delete_stale_login_failures"
+
+	opCartUpdate = "cart_update"
+)
+
+// File implements DAO interface persisting all data to a local directory.
+// Every change is appended to a journal before it is applied in memory, except cart updates which are applied as fn
+// makes them and appended as one entry at the end, and the full state is written to a snapshot every so often so the
+// journal can be truncated.
+// On start up the last snapshot is loaded and the journal is replayed on top of it.
+type File struct {
+	*Memory
+
+	dir           string
+	snapshotEvery int // number of journal entries before writing a new snapshot
+	restored      bool
+
+	mu      sync.Mutex // guards the journal and serialises writes
+	journal *os.File
+	entries int
+	seq     int64 // of the last entry written to the journal, it carries on across snapshots
+}
+
+type journalEntry struct {
+	Seq  int64           `json:"seq,omitempty"` // only set on top level entries, journals written before had none
+	Op   string          `json:"op"`
+	Data json.RawMessage `json:"data"`
+}
+
+// fileSnapshot is the state in memory and the seq of the last journal entry in it
+type fileSnapshot struct {
+	memoryState
+	Seq int64 `json:"seq,omitempty"`
+}
+
+type journalReserveStock struct {
+	UserID     int         `json:"user_id"`
+	Quantities map[int]int `json:"quantities"`
+}
+
+type journalRevokeToken struct {
+	Hash string    `json:"hash"`
+	At   time.Time `json:"at"`
+}
+
+type journalRotateRefreshToken struct {
+	Hash string        `json:"hash"`
+	Next *RefreshToken `json:"next"`
+}
+
+type journalCreateGuest struct {
+	User  *User        `json:"user"`
+	Token *AccessToken `json:"token"`
+}
+
+type journalDeleteCart struct {
+	UserID int    `json:"user_id"`
+	Name   string `json:"name"`
+}
+
+type journalLoginFailure struct {
+	Key        string        `json:"key"`
+	At         time.Time     `json:"at"`
+	ResetAfter time.Duration `json:"reset_after"`
+}
+
+type journalLoginAttempt struct {
+	Keys       []string      `json:"keys"`
+	At         time.Time     `json:"at"`
+	ResetAfter time.Duration `json:"reset_after"`
+}
+
+// allowLoginAttempt is the check of login attempts replayed from the journal, they were allowed when first made
+func allowLoginAttempt([]*LoginFailures) error {
+	return nil
+}
+
+// NewFile opens or creates a file DAO in dir, snapshotEvery <= 0 uses a default value
+func NewFile(dir string, snapshotEvery int) (*File, error) {
+	if snapshotEvery <= 0 {
+		snapshotEvery = defaultSnapshotEvery
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	f := &File{
+		Memory:        NewMemory(),
+		dir:           dir,
+		snapshotEvery: snapshotEvery,
+	}
+	if err := f.loadSnapshot(); err != nil {
+		return nil, fmt.Errorf("load snapshot: %v", err)
+	}
+	if err := f.replayJournal(); err != nil {
+		return nil, fmt.Errorf("replay journal: %v", err)
+	}
+
+	journal, err := os.OpenFile(filepath.Join(dir, journalFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	f.journal = journal
+	if err := f.hashPasswords(); err != nil {
+		return nil, fmt.Errorf("hash passwords: %v", err)
+	}
+	return f, nil
+}
+
+// hashPasswords hashes the passwords stored in plain text before passwords were hashed
+func (f *File) hashPasswords() error {
+	f.Memory.mu.RLock()
+	users := []*User{}
+	for _, u := range f.Memory.Users {
+		users = append(users, u.copy())
+	}
+	f.Memory.mu.RUnlock()
+
+	for _, u := range users {
+		if u.Password == "" || isPasswordHash(u.Password) {
+			continue
+		}
+		hash, err := hashPassword(u.Password)
+		if err != nil {
+			return fmt.Errorf("user %s: %v", u.Username, err)
+		}
+		u.Password = hash
+		if err := f.SetUser(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Restored reports if any data was found in the data directory when the DAO was opened
+func (f *File) Restored() bool {
+	return f.restored
+}
+
+// Close writes a final snapshot and closes the journal
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.snapshot(); err != nil {
+		return err
+	}
+	return f.journal.Close()
+}
+
+// SetProductInventory saves inventory and records it in the journal
+func (f *File) SetProductInventory(products []*Product) error {
+	return f.write(opSetProductInventory, products, func() error {
+		return f.Memory.SetProductInventory(products)
+	})
+}
+
+// UpdateProducts updates inventory and records it in the journal
+func (f *File) UpdateProducts(products Products) error {
+	if len(products) == 0 {
+		return errors.New("products empty")
+	}
+	return f.write(opUpdateProducts, products, func() error {
+		return f.Memory.UpdateProducts(products)
+	})
+}
+
+// CreateProduct adds a product and records it in the journal
+func (f *File) CreateProduct(product *Product) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// the ID has to be assigned before writing to the journal so replaying gives the same result
+	f.Memory.mu.RLock()
+	if product.ID == 0 {
+		product.ID = f.Memory.nextProductID()
+	}
+	_, exists := f.Memory.Products[product.ID]
+	f.Memory.mu.RUnlock()
+	if exists {
+		return errConflictProductExists.msg(fmt.Sprintf("product %d already exists", product.ID))
+	}
+	return f.writeLocked(opCreateProduct, product, func() error {
+		return f.Memory.CreateProduct(product)
+	})
+}
+
+// UpdateProduct applies fn to the product and records the result in the journal
+func (f *File) UpdateProduct(id int, fn func(*Product) error) (*Product, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// the journal holds the product after fn so replaying doesn't depend on fn
+	f.Memory.mu.RLock()
+	p, ok := f.Memory.Products[id]
+	held := 0
+	if ok {
+		p = p.copy()
+		held = f.Memory.held(id, 0)
+		p.Available = p.Stock - held
+	}
+	f.Memory.mu.RUnlock()
+	if !ok {
+		return nil, errProductNotFound
+	}
+	if err := fn(p); err != nil {
+		return nil, err
+	}
+	if p.Stock < held {
+		return nil, stockBelowHeld(id, p.Stock, held)
+	}
+	p.ID = id
+
+	var updated *Product
+	err := f.writeLocked(opUpdateProduct, p, func() error {
+		var err error
+		updated, err = f.Memory.UpdateProduct(id, replaceProduct(p))
+		return err
+	})
+	return updated, err
+}
+
+// DeleteProduct removes a product and the stock held of it and records it in the journal
+func (f *File) DeleteProduct(id int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.Memory.mu.RLock()
+	_, exists := f.Memory.Products[id]
+	f.Memory.mu.RUnlock()
+	if !exists {
+		return errProductNotFound
+	}
+	return f.writeLocked(opDeleteProduct, id, func() error {
+		return f.Memory.DeleteProduct(id)
+	})
+}
+
+// ReserveStock decrements the stock of all products or none of them and records it in the journal
+func (f *File) ReserveStock(userID int, quantities map[int]int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// every change goes through f.mu so the stock can't change between checking and writing
+	f.Memory.mu.RLock()
+	err := f.Memory.checkStock(userID, quantities)
+	f.Memory.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	return f.writeLocked(opReserveStock, journalReserveStock{UserID: userID, Quantities: quantities}, func() error {
+		return f.Memory.ReserveStock(userID, quantities)
+	})
+}
+
+// ReleaseStock increments the stock of the products and records it in the journal
+func (f *File) ReleaseStock(quantities map[int]int) error {
+	return f.write(opReleaseStock, quantities, func() error {
+		return f.Memory.ReleaseStock(quantities)
+	})
+}
+
+// HoldStock replaces the user's hold on a product and records it in the journal
+func (f *File) HoldStock(hold *StockHold) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if hold.Quantity > 0 {
+		f.Memory.mu.RLock()
+		err := f.Memory.checkStock(hold.UserID, map[int]int{hold.ProductID: hold.Quantity})
+		f.Memory.mu.RUnlock()
+		if err != nil {
+			return err
+		}
+	}
+	return f.writeLocked(opHoldStock, hold, func() error {
+		return f.Memory.HoldStock(hold)
+	})
+}
+
+// ReleaseHolds removes all the holds of a user and records it in the journal
+func (f *File) ReleaseHolds(userID int) error {
+	return f.write(opReleaseHolds, userID, func() error {
+		return f.Memory.ReleaseHolds(userID)
+	})
+}
+
+// ReleaseExpiredHolds removes holds that expire before now and records it in the journal
+// only when there is something to remove
+func (f *File) ReleaseExpiredHolds(now time.Time) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.Memory.expiredHolds(now) == 0 {
+		return 0, nil
+	}
+	released := 0
+	err := f.writeLocked(opReleaseExpiredHolds, now, func() error {
+		var err error
+		released, err = f.Memory.ReleaseExpiredHolds(now)
+		return err
+	})
+	return released, err
+}
+
+// SetPromotions saves promotions and records them in the journal
+func (f *File) SetPromotions(promotions []*Promotion) error {
+	return f.write(opSetPromotions, promotions, func() error {
+		return f.Memory.SetPromotions(promotions)
+	})
+}
+
+// CreatePromotion adds a promotion and records it in the journal
+func (f *File) CreatePromotion(promotion *Promotion) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// the ID has to be assigned before writing to the journal so replaying gives the same result
+	f.Memory.mu.RLock()
+	if promotion.ID == 0 {
+		promotion.ID = f.Memory.nextPromotionID()
+	}
+	_, exists := f.Memory.Promotions[promotion.ID]
+	f.Memory.mu.RUnlock()
+	if exists {
+		return errConflictPromotionExists.msg(fmt.Sprintf("promotion %d already exists", promotion.ID))
+	}
+	return f.writeLocked(opCreatePromotion, promotion, func() error {
+		return f.Memory.CreatePromotion(promotion)
+	})
+}
+
+// UpdatePromotion applies fn to the promotion and records the result in the journal
+func (f *File) UpdatePromotion(id int, fn func(*Promotion) error) (*Promotion, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// the journal holds the promotion after fn so replaying doesn't depend on fn
+	f.Memory.mu.RLock()
+	p, ok := f.Memory.Promotions[id]
+	if ok {
+		p = p.copy()
+	}
+	f.Memory.mu.RUnlock()
+	if !ok {
+		return nil, errPromotionNotFound
+	}
+	if err := fn(p); err != nil {
+		return nil, err
+	}
+	p.ID = id
+
+	var updated *Promotion
+	err := f.writeLocked(opUpdatePromotion, p, func() error {
+		var err error
+		updated, err = f.Memory.UpdatePromotion(id, replacePromotion(p))
+		return err
+	})
+	return updated, err
+}
+
+// DeletePromotion removes a promotion and records it in the journal
+func (f *File) DeletePromotion(id int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.Memory.mu.RLock()
+	_, exists := f.Memory.Promotions[id]
+	f.Memory.mu.RUnlock()
+	if !exists {
+		return errPromotionNotFound
+	}
+	return f.writeLocked(opDeletePromotion, id, func() error {
+		return f.Memory.DeletePromotion(id)
+	})
+}
+
+// SetUsers saves every user and records them in the journal
+func (f *File) SetUsers(users []*User) error {
+	for _, user := range users {
+		if err := f.SetUser(user); err != nil {
+			return err
+		}
+	}
+	if len(users) == 0 {
+		return errors.New("user array is empty")
+	}
+	return nil
+}
+
+// SetUser saves a user and records it in the journal
+func (f *File) SetUser(user *User) error {
+	return f.write(opSetUser, user, func() error {
+		return f.Memory.SetUser(user)
+	})
+}
+
+// CreateUser adds a user unless the ID or username is taken and records it in the journal
+func (f *File) CreateUser(user *User) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// the ID has to be assigned before writing to the journal so replaying gives the same result
+	f.Memory.mu.RLock()
+	err := f.Memory.checkNewUser(user)
+	f.Memory.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	return f.writeLocked(opCreateUser, user, func() error {
+		return f.Memory.CreateUser(user)
+	})
+}
+
+// CreateGuest adds a guest with its cart and the session of its cart token and records it in the journal
+func (f *File) CreateGuest(user *User, token *AccessToken) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// the ID has to be assigned before writing to the journal so replaying gives the same result
+	user.Guest = true
+	f.Memory.mu.RLock()
+	err := f.Memory.checkNewUser(user)
+	f.Memory.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	token.UserID = user.ID
+	return f.writeLocked(opCreateGuest, journalCreateGuest{User: user, Token: token}, func() error {
+		return f.Memory.CreateGuest(user, token)
+	})
+}
+
+// DeleteGuest removes a guest with its cart, stock holds and sessions and records it in the journal
+func (f *File) DeleteGuest(id int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	user, err := f.Memory.GetUserByID(id)
+	if err != nil {
+		return err
+	}
+	if !user.Guest {
+		return errUserNotFound
+	}
+	return f.writeLocked(opDeleteGuest, id, func() error {
+		return f.Memory.DeleteGuest(id)
+	})
+}
+
+// DeleteExpiredGuests removes the guests without sessions lasting until now and records it in the journal
+// only when there is something to remove
+func (f *File) DeleteExpiredGuests(now time.Time) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.Memory.expiredGuests(now)) == 0 {
+		return 0, nil
+	}
+	deleted := 0
+	err := f.writeLocked(opDeleteExpiredGuests, now, func() error {
+		var err error
+		deleted, err = f.Memory.DeleteExpiredGuests(now)
+		return err
+	})
+	return deleted, err
+}
+
+// CreateAccessToken saves a new session and records it in the journal
+func (f *File) CreateAccessToken(token *AccessToken) error {
+	return f.write(opCreateAccessToken, token, func() error {
+		return f.Memory.CreateAccessToken(token)
+	})
+}
+
+// RevokeAccessToken marks a session as revoked and records it in the journal
+func (f *File) RevokeAccessToken(hash string, at time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, err := f.Memory.GetAccessToken(hash); err != nil {
+		return err
+	}
+	return f.writeLocked(opRevokeAccessToken, journalRevokeToken{Hash: hash, At: at}, func() error {
+		return f.Memory.RevokeAccessToken(hash, at)
+	})
+}
+
+// DeleteExpiredAccessTokens removes sessions that expire before now and records it in the journal
+// only when there is something to remove
+func (f *File) DeleteExpiredAccessTokens(now time.Time) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.Memory.expiredAccessTokens(now) == 0 {
+		return 0, nil
+	}
+	deleted := 0
+	err := f.writeLocked(opDeleteExpiredTokens, now, func() error {
+		var err error
+		deleted, err = f.Memory.DeleteExpiredAccessTokens(now)
+		return err
+	})
+	return deleted, err
+}
+
+// CreateRefreshToken saves a new refresh token and records it in the journal
+func (f *File) CreateRefreshToken(token *RefreshToken) error {
+	return f.write(opCreateRefreshToken, token, func() error {
+		return f.Memory.CreateRefreshToken(token)
+	})
+}
+
+// RotateRefreshToken marks the token as used and saves next in its family recording it in the journal,
+// a token used twice revokes its family
+func (f *File) RotateRefreshToken(hash string, next *RefreshToken) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// the outcome has to be known before writing to the journal so replaying gives the same result
+	f.Memory.mu.RLock()
+	t, err := f.Memory.refreshToken(hash)
+	reused := false
+	if err == nil {
+		reused, err = t.checkRotation(next.IssuedAt)
+	}
+	f.Memory.mu.RUnlock()
+	if reused {
+		// a token exchanged twice is never rotated, only the revocation of its family is recorded
+		revoke := journalRevokeToken{Hash: hash, At: next.IssuedAt}
+		if revokeErr := f.writeLocked(opRevokeRefreshTokens, revoke, func() error {
+			return f.Memory.RevokeRefreshTokens(hash, next.IssuedAt)
+		}); revokeErr != nil {
+			return revokeErr
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	next.UserID = t.UserID
+	next.Family = t.Family
+	return f.writeLocked(opRotateRefreshToken, journalRotateRefreshToken{Hash: hash, Next: next}, func() error {
+		return f.Memory.RotateRefreshToken(hash, next)
+	})
+}
+
+// RevokeRefreshTokens revokes the family of the token with the hash and records it in the journal
+func (f *File) RevokeRefreshTokens(hash string, at time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.Memory.mu.RLock()
+	_, err := f.Memory.refreshToken(hash)
+	f.Memory.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	return f.writeLocked(opRevokeRefreshTokens, journalRevokeToken{Hash: hash, At: at}, func() error {
+		return f.Memory.RevokeRefreshTokens(hash, at)
+	})
+}
+
+// DeleteExpiredRefreshTokens removes refresh tokens that expire before now and records it in the journal
+// only when there is something to remove
+func (f *File) DeleteExpiredRefreshTokens(now time.Time) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.Memory.expiredRefreshTokens(now) == 0 {
+		return 0, nil
+	}
+	deleted := 0
+	err := f.writeLocked(opDeleteExpiredRefreshTokens, now, func() error {
+		var err error
+		deleted, err = f.Memory.DeleteExpiredRefreshTokens(now)
+		return err
+	})
+	return deleted, err
+}
+
+// ReserveLoginAttempt counts a failed login under every key unless check fails with the failures so far and records
+// it in the journal only when it's counted
+func (f *File) ReserveLoginAttempt(keys []string, at time.Time, resetAfter time.Duration, check func([]*LoginFailures) error) ([]*LoginFailures, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// failures only change while holding f.mu so checking them before writing to the journal is enough
+	f.Memory.mu.RLock()
+	err := check(f.Memory.loginFailures(keys))
+	f.Memory.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	var failures []*LoginFailures
+	err = f.writeLocked(opReserveLoginAttempt, journalLoginAttempt{Keys: keys, At: at, ResetAfter: resetAfter}, func() error {
+		var err error
+		failures, err = f.Memory.ReserveLoginAttempt(keys, at, resetAfter, allowLoginAttempt)
+		return err
+	})
+	return failures, err
+}
+
+// ReleaseLoginAttempt takes back a failed login under the key and records it in the journal
+func (f *File) ReleaseLoginAttempt(key string) error {
+	return f.write(opReleaseLoginAttempt, key, func() error {
+		return f.Memory.ReleaseLoginAttempt(key)
+	})
+}
+
+// ClearLoginFailures forgets the failed logins under the key and records it in the journal
+// only when there is something to forget
+func (f *File) ClearLoginFailures(key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.Memory.hasLoginFailures(key) {
+		return nil
+	}
+	return f.writeLocked(opClearLoginFailures, key, func() error {
+		return f.Memory.ClearLoginFailures(key)
+	})
+}
+
+// DeleteStaleLoginFailures removes the failures whose last one was before the given time and records it in the
+// journal only when there is something to remove
+func (f *File) DeleteStaleLoginFailures(before time.Time) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.Memory.staleLoginFailures(before) == 0 {
+		return 0, nil
+	}
+	deleted := 0
+	err := f.writeLocked(opDeleteStaleLoginFailures, before, func() error {
+		var err error
+		deleted, err = f.Memory.DeleteStaleLoginFailures(before)
+		return err
+	})
+	return deleted, err
+}
+
+// SetCart saves a cart and records it in the journal
+func (f *File) SetCart(cart *Cart) error {
+	return f.write(opSetCart, cart, func() error {
+		return f.Memory.SetCart(cart)
+	})
+}
+
+// UpdateCart applies fn to the user's cart and saves the result with the changes fn made in a single journal entry.
+// Cart updates hold f.mu all along so they're serialised with every other write.
+func (f *File) UpdateCart(userID int, fn func(CartDAO, *Cart) error) (*Cart, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tx := f.beginCartTx()
+	cart, err := tx.UpdateCart(userID, fn)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.commit(); err != nil {
+		return nil, err
+	}
+	return cart, nil
+}
+
+// UpdateCarts applies fn to the user's carts and saves all of them with the changes fn made in a single journal entry
+func (f *File) UpdateCarts(userID int, fn func(CartDAO, map[string]*Cart) error) (map[string]*Cart, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tx := f.beginCartTx()
+	carts, err := f.Memory.cartsByName(userID)
+	if err == nil {
+		err = fn(tx, carts)
+	}
+	if err == nil {
+		err = tx.saveCarts(userID, carts)
+	}
+	if err != nil {
+		tx.rollback(0)
+		return nil, err
+	}
+	if err := tx.commit(); err != nil {
+		return nil, err
+	}
+	return carts, nil
+}
+
+// fileCartTx is the CartDAO UpdateCart and UpdateCarts give fn, changes are applied in memory as they're made and
+// written to the journal in a single entry when the update is committed. It must only be used while holding f.mu
+type fileCartTx struct {
+	f       *File
+	mem     *memoryCartTx
+	entries []journalEntry // one for each change undone by mem
+}
+
+func (f *File) beginCartTx() *fileCartTx {
+	return &fileCartTx{f: f, mem: f.Memory.beginCartTx(nil)}
+}
+
+// record applies a change in memory and keeps op for the journal, v is encoded once the change is applied
+func (tx *fileCartTx) record(op string, v interface{}, apply func() error) error {
+	if err := apply(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		tx.rollback(len(tx.entries))
+		return err
+	}
+	tx.entries = append(tx.entries, journalEntry{Op: op, Data: data})
+	return nil
+}
+
+// rollback undoes the changes made after the first n of them
+func (tx *fileCartTx) rollback(n int) {
+	tx.mem.rollback(n)
+	tx.entries = tx.entries[:n]
+}
+
+// commit writes the changes to the journal, or undoes them when it can't
+func (tx *fileCartTx) commit() error {
+	err := tx.f.writeLocked(opCartUpdate, tx.entries, func() error { return nil })
+	if err != nil {
+		tx.rollback(0)
+	}
+	return err
+}
+
+// UpdateCart applies fn to the user's cart and saves it, undoing what fn changed when it fails
+func (tx *fileCartTx) UpdateCart(userID int, fn func(CartDAO, *Cart) error) (*Cart, error) {
+	n := len(tx.entries)
+	cart, err := tx.f.Memory.GetCartByUserID(userID)
+	if err == nil {
+		err = fn(tx, cart)
+	}
+	if err == nil {
+		err = tx.record(opSetCart, cart, func() error { return tx.mem.saveCart(cart) })
+	}
+	if err != nil {
+		tx.rollback(n)
+		return nil, err
+	}
+	return cart, nil
+}
+
+func (tx *fileCartTx) saveCarts(userID int, carts map[string]*Cart) error {
+	// the carts are encoded with the IDs they're given when saved so replaying gives the same result
+	var list []*Cart
+	return tx.record(opSetCarts, &list, func() error {
+		var err error
+		list, err = tx.mem.saveCarts(userID, carts)
+		return err
+	})
+}
+
+func (tx *fileCartTx) ReserveStock(userID int, quantities map[int]int) error {
+	return tx.record(opReserveStock, journalReserveStock{UserID: userID, Quantities: quantities}, func() error {
+		return tx.mem.ReserveStock(userID, quantities)
+	})
+}
+
+func (tx *fileCartTx) ReleaseStock(quantities map[int]int) error {
+	return tx.record(opReleaseStock, quantities, func() error {
+		return tx.mem.ReleaseStock(quantities)
+	})
+}
+
+func (tx *fileCartTx) HoldStock(hold *StockHold) error {
+	return tx.record(opHoldStock, hold, func() error {
+		return tx.mem.HoldStock(hold)
+	})
+}
+
+func (tx *fileCartTx) ReleaseHolds(userID int) error {
+	return tx.record(opReleaseHolds, userID, func() error {
+		return tx.mem.ReleaseHolds(userID)
+	})
+}
+
+// CreateOrder is recorded with the ID it's given so replaying gives the same result
+func (tx *fileCartTx) CreateOrder(order *Order) error {
+	return tx.record(opCreateOrder, order, func() error {
+		return tx.mem.CreateOrder(order)
+	})
+}
+
+func (tx *fileCartTx) DeleteGuest(id int) error {
+	return tx.record(opDeleteGuest, id, func() error {
+		return tx.mem.DeleteGuest(id)
+	})
+}
+
+// DeleteCart removes the user's cart with the name and records it in the journal
+func (f *File) DeleteCart(userID int, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.Memory.mu.RLock()
+	exists := f.Memory.namedCart(userID, name) != nil
+	f.Memory.mu.RUnlock()
+	if !exists {
+		return errCartNotFound
+	}
+	return f.writeLocked(opDeleteCart, journalDeleteCart{UserID: userID, Name: name}, func() error {
+		return f.Memory.DeleteCart(userID, name)
+	})
+}
+
+// CreateOrder saves a new order, empties the user's active cart and records both in a single journal entry
+func (f *File) CreateOrder(order *Order) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// the ID has to be assigned before writing to the journal so replaying gives the same result
+	f.Memory.mu.RLock()
+	err := f.Memory.checkRedemption(order)
+	if order.ID == 0 {
+		order.ID = len(f.Memory.Orders) + 1
+	}
+	f.Memory.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	return f.writeLocked(opCreateOrder, order, func() error {
+		return f.Memory.CreateOrder(order)
+	})
+}
+
+// SetCoupons saves coupons and records them in the journal
+func (f *File) SetCoupons(coupons []*Coupon) error {
+	return f.write(opSetCoupons, coupons, func() error {
+		return f.Memory.SetCoupons(coupons)
+	})
+}
+
+// write appends op to the journal and then applies it in memory
+func (f *File) write(op string, v interface{}, apply func() error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.writeLocked(op, v, apply)
+}
+
+// writeLocked must be called while holding f.mu
+func (f *File) writeLocked(op string, v interface{}, apply func() error) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(journalEntry{Seq: f.seq + 1, Op: op, Data: data})
+	if err != nil {
+		return err
+	}
+	info, err := f.journal.Stat()
+	if err != nil {
+		return err
+	}
+
+	// an entry that isn't written in full or changes nothing is taken out so the journal only has entries that
+	// replay cleanly
+	_, err = f.journal.Write(append(line, '\n'))
+	if err == nil {
+		err = f.journal.Sync()
+	}
+	if err == nil {
+		err = apply()
+	}
+	if err != nil {
+		if terr := f.journal.Truncate(info.Size()); terr != nil {
+			log.WithError(terr).Errorln("file DAO: failed to remove a journal entry that wasn't applied")
+		}
+		return err
+	}
+
+	f.seq++
+	f.entries++
+	if f.entries >= f.snapshotEvery {
+		if err := f.snapshot(); err != nil {
+			// the journal still has every entry so nothing is lost, try again on the next write
+			log.WithError(err).Errorln("file DAO: failed to write snapshot")
+		}
+	}
+	return nil
+}
+
+// snapshot must be called while holding f.mu. The snapshot has the seq of the last journal entry in it, a crash
+// before the journal is truncated leaves entries behind that are skipped when it's replayed.
+func (f *File) snapshot() error {
+	data, err := json.Marshal(fileSnapshot{memoryState: *f.Memory.state(), Seq: f.seq})
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(f.dir, snapshotFile+".tmp")
+	if err := writeFileSync(tmp, data); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(f.dir, snapshotFile)); err != nil {
+		return err
+	}
+	if err := syncDir(f.dir); err != nil {
+		return err
+	}
+	if err := f.journal.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.journal.Seek(0, 0); err != nil {
+		return err
+	}
+	f.entries = 0
+	return nil
+}
+
+func (f *File) loadSnapshot() error {
+	data, err := ioutil.ReadFile(filepath.Join(f.dir, snapshotFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	snapshot := &fileSnapshot{}
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		return err
+	}
+	f.Memory.load(&snapshot.memoryState)
+	f.seq = snapshot.Seq
+	f.restored = true
+	return nil
+}
+
+func (f *File) replayJournal() error {
+	data, err := ioutil.ReadFile(filepath.Join(f.dir, journalFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	valid := 0 // bytes of the journal holding complete entries
+	snapshotSeq, seq := f.seq, int64(0)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for scanner.Scan() {
+		entry := journalEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// a crash in the middle of a write leaves a partial last line behind, everything before it is valid
+			log.WithError(err).Warnln("file DAO: discarding incomplete journal entry")
+			break
+		}
+		// entries written before they had a seq follow on from the one before them
+		if entry.Seq == 0 {
+			entry.Seq = seq + 1
+		}
+		seq = entry.Seq
+		// entries up to the seq of the snapshot are already in it, a crash kept the journal from being truncated
+		if seq > snapshotSeq {
+			if err := f.replay(entry); err != nil {
+				// replaying starts from the same state the entry was first applied to, so it failed back then too
+				// and changed nothing. Journals written before failed entries were taken out can still have them
+				log.WithError(err).WithField("op", entry.Op).Warnln("file DAO: skipping journal entry that fails to apply")
+			}
+			f.seq = seq
+		}
+		valid += len(scanner.Bytes()) + 1
+		f.entries++
+		f.restored = true
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	switch {
+	case valid < len(data):
+		return os.Truncate(filepath.Join(f.dir, journalFile), int64(valid))
+	case valid > len(data):
+		// the last entry is complete but its new line never made it to disk
+		return ioutil.WriteFile(filepath.Join(f.dir, journalFile), append(data, '\n'), 0600)
+	}
+	return nil
+}
+
+func (f *File) replay(entry journalEntry) error {
+	switch entry.Op {
+	case opSetProductInventory:
+		products := []*Product{}
+		if err := json.Unmarshal(entry.Data, &products); err != nil {
+			return err
+		}
+		return f.Memory.SetProductInventory(products)
+	case opUpdateProducts:
+		products := Products{}
+		if err := json.Unmarshal(entry.Data, &products); err != nil {
+			return err
+		}
+		return f.Memory.UpdateProducts(products)
+	case opReserveStock:
+		reserve := journalReserveStock{}
+		if err := json.Unmarshal(entry.Data, &reserve); err != nil {
+			return err
+		}
+		return f.Memory.ReserveStock(reserve.UserID, reserve.Quantities)
+	case opReleaseStock:
+		quantities := map[int]int{}
+		if err := json.Unmarshal(entry.Data, &quantities); err != nil {
+			return err
+		}
+		return f.Memory.ReleaseStock(quantities)
+	case opHoldStock:
+		hold := &StockHold{}
+		if err := json.Unmarshal(entry.Data, hold); err != nil {
+			return err
+		}
+		return f.Memory.HoldStock(hold)
+	case opReleaseHolds:
+		var userID int
+		if err := json.Unmarshal(entry.Data, &userID); err != nil {
+			return err
+		}
+		return f.Memory.ReleaseHolds(userID)
+	case opReleaseExpiredHolds:
+		var now time.Time
+		if err := json.Unmarshal(entry.Data, &now); err != nil {
+			return err
+		}
+		_, err := f.Memory.ReleaseExpiredHolds(now)
+		return err
+	case opSetPromotions:
+		promotions := []*Promotion{}
+		if err := json.Unmarshal(entry.Data, &promotions); err != nil {
+			return err
+		}
+		// entries written before promotion rules are converted the same way the config is
+		return f.Memory.SetPromotions(upgradePromotions(promotions))
+	case opSetUser:
+		user := &User{}
+		if err := json.Unmarshal(entry.Data, user); err != nil {
+			return err
+		}
+		return f.Memory.SetUser(user)
+	case opCreateUser:
+		user := &User{}
+		if err := json.Unmarshal(entry.Data, user); err != nil {
+			return err
+		}
+		return f.Memory.CreateUser(user)
+	case opCreateAccessToken:
+		token := &AccessToken{}
+		if err := json.Unmarshal(entry.Data, token); err != nil {
+			return err
+		}
+		return f.Memory.CreateAccessToken(token)
+	case opRevokeAccessToken:
+		revoke := journalRevokeToken{}
+		if err := json.Unmarshal(entry.Data, &revoke); err != nil {
+			return err
+		}
+		return f.Memory.RevokeAccessToken(revoke.Hash, revoke.At)
+	case opDeleteExpiredTokens:
+		var now time.Time
+		if err := json.Unmarshal(entry.Data, &now); err != nil {
+			return err
+		}
+		_, err := f.Memory.DeleteExpiredAccessTokens(now)
+		return err
+	case opCreateRefreshToken:
+		token := &RefreshToken{}
+		if err := json.Unmarshal(entry.Data, token); err != nil {
+			return err
+		}
+		return f.Memory.CreateRefreshToken(token)
+	case opRotateRefreshToken:
+		rotate := journalRotateRefreshToken{}
+		if err := json.Unmarshal(entry.Data, &rotate); err != nil {
+			return err
+		}
+		return f.Memory.RotateRefreshToken(rotate.Hash, rotate.Next)
+	case opRevokeRefreshTokens:
+		revoke := journalRevokeToken{}
+		if err := json.Unmarshal(entry.Data, &revoke); err != nil {
+			return err
+		}
+		return f.Memory.RevokeRefreshTokens(revoke.Hash, revoke.At)
+	case opDeleteExpiredRefreshTokens:
+		var now time.Time
+		if err := json.Unmarshal(entry.Data, &now); err != nil {
+			return err
+		}
+		_, err := f.Memory.DeleteExpiredRefreshTokens(now)
+		return err
+	case opCreateGuest:
+		guest := journalCreateGuest{}
+		if err := json.Unmarshal(entry.Data, &guest); err != nil {
+			return err
+		}
+		return f.Memory.CreateGuest(guest.User, guest.Token)
+	case opDeleteGuest:
+		var id int
+		if err := json.Unmarshal(entry.Data, &id); err != nil {
+			return err
+		}
+		return f.Memory.DeleteGuest(id)
+	case opDeleteExpiredGuests:
+		var now time.Time
+		if err := json.Unmarshal(entry.Data, &now); err != nil {
+			return err
+		}
+		_, err := f.Memory.DeleteExpiredGuests(now)
+		return err
+	case opRecordLoginFailure:
+		failure := journalLoginFailure{}
+		if err := json.Unmarshal(entry.Data, &failure); err != nil {
+			return err
+		}
+		_, err := f.Memory.ReserveLoginAttempt([]string{failure.Key}, failure.At, failure.ResetAfter, allowLoginAttempt)
+		return err
+	case opReserveLoginAttempt:
+		attempt := journalLoginAttempt{}
+		if err := json.Unmarshal(entry.Data, &attempt); err != nil {
+			return err
+		}
+		_, err := f.Memory.ReserveLoginAttempt(attempt.Keys, attempt.At, attempt.ResetAfter, allowLoginAttempt)
+		return err
+	case opReleaseLoginAttempt:
+		var key string
+		if err := json.Unmarshal(entry.Data, &key); err != nil {
+			return err
+		}
+		return f.Memory.ReleaseLoginAttempt(key)
+	case opClearLoginFailures:
+		var key string
+		if err := json.Unmarshal(entry.Data, &key); err != nil {
+			return err
+		}
+		return f.Memory.ClearLoginFailures(key)
+	case opDeleteStaleLoginFailures:
+		var before time.Time
+		if err := json.Unmarshal(entry.Data, &before); err != nil {
+			return err
+		}
+		_, err := f.Memory.DeleteStaleLoginFailures(before)
+		return err
+	case opSetCart:
+		cart := &Cart{}
+		if err := json.Unmarshal(entry.Data, cart); err != nil {
+			return err
+		}
+		return f.Memory.SetCart(cart)
+	case opSetCarts:
+		carts := []*Cart{}
+		if err := json.Unmarshal(entry.Data, &carts); err != nil {
+			return err
+		}
+		return f.Memory.setCarts(carts)
+	case opDeleteCart:
+		del := journalDeleteCart{}
+		if err := json.Unmarshal(entry.Data, &del); err != nil {
+			return err
+		}
+		return f.Memory.DeleteCart(del.UserID, del.Name)
+	case opCreateOrder:
+		order := &Order{}
+		if err := json.Unmarshal(entry.Data, order); err != nil {
+			return err
+		}
+		return f.Memory.CreateOrder(order)
+	case opCreateProduct:
+		product := &Product{}
+		if err := json.Unmarshal(entry.Data, product); err != nil {
+			return err
+		}
+		return f.Memory.CreateProduct(product)
+	case opUpdateProduct:
+		product := &Product{}
+		if err := json.Unmarshal(entry.Data, product); err != nil {
+			return err
+		}
+		// journals written before the stock was checked against holds can have less, replaying saves it as it was
+		return f.Memory.UpdateProducts(Products{product.ID: product})
+	case opDeleteProduct:
+		var id int
+		if err := json.Unmarshal(entry.Data, &id); err != nil {
+			return err
+		}
+		return f.Memory.DeleteProduct(id)
+	case opCreatePromotion:
+		promotion := &Promotion{}
+		if err := json.Unmarshal(entry.Data, promotion); err != nil {
+			return err
+		}
+		return f.Memory.CreatePromotion(promotion)
+	case opUpdatePromotion:
+		promotion := &Promotion{}
+		if err := json.Unmarshal(entry.Data, promotion); err != nil {
+			return err
+		}
+		_, err := f.Memory.UpdatePromotion(promotion.ID, replacePromotion(promotion))
+		return err
+	case opDeletePromotion:
+		var id int
+		if err := json.Unmarshal(entry.Data, &id); err != nil {
+			return err
+		}
+		return f.Memory.DeletePromotion(id)
+	case opSetCoupons:
+		coupons := []*Coupon{}
+		if err := json.Unmarshal(entry.Data, &coupons); err != nil {
+			return err
+		}
+		return f.Memory.SetCoupons(coupons)
+	case opCartUpdate:
+		entries := []journalEntry{}
+		if err := json.Unmarshal(entry.Data, &entries); err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := f.replay(e); err != nil {
+				return fmt.Errorf("%s: %v", e.Op, err)
+			}
+		}
+		return nil
+	}
+	return errors.New("unknown journal operation")
+}
+
+func writeFileSync(name string, data []byte) error {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir makes a file renamed into dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		d.Close()
+		return err
+	}
+	return d.Close()
+}
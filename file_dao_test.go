@@ -0,0 +1,215 @@
+package shopping
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// tempDir returns a directory that is removed when the test ends
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "api.shopping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestFileReopensAfterFailedWrite(t *testing.T) {
+	dir := tempDir(t)
+	f, err := NewFile(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SetProductInventory([]*Product{}); err == nil {
+		t.Fatal("an empty inventory was saved")
+	}
+	if err := f.SetProductInventory(testCatalog()); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.ReserveStock(1, map[int]int{5: 2}); err == nil {
+		t.Fatal("2 shoes were reserved with 1 in stock")
+	}
+	// no snapshot, the journal alone is replayed
+	if err := f.journal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	journal, err := ioutil.ReadFile(filepath.Join(dir, journalFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(journal, []byte("\n")); n != 1 {
+		t.Errorf("journal has %d entries, want only the inventory", n)
+	}
+
+	f, err = NewFile(dir, 0)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	products, err := f.GetProducts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(products) != 6 || products[5].Stock != 1 {
+		t.Errorf("reopened with %d products and %d shoes, want 6 and 1", len(products), products[5].Stock)
+	}
+}
+
+func TestFileSkipsFailedEntriesInOldJournals(t *testing.T) {
+	dir := tempDir(t)
+	journal := `{"op":"set_product_inventory","data":[]}` + "\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, journalFile), []byte(journal), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFile(dir, 0); err != nil {
+		t.Errorf("open: %v", err)
+	}
+}
+
+func TestFileCreateOrderEmptiesTheCart(t *testing.T) {
+	dir := tempDir(t)
+	f, err := NewFile(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &User{Username: "shopper"}
+	if err := f.CreateUser(user); err != nil {
+		t.Fatal(err)
+	}
+	cart, err := f.GetCartByUserID(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cart.Products = testCart(map[int]int{1: 2}).Products
+	if err := f.SetCart(cart); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.CreateOrder(&Order{UserID: user.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.journal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = NewFile(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cart, err = f.GetCartByUserID(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cart.empty() {
+		t.Errorf("cart has %d lines after the order, want none", len(cart.Products))
+	}
+}
+
+func TestFileSkipsEntriesInTheSnapshot(t *testing.T) {
+	dir := tempDir(t)
+	f, err := NewFile(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &User{Username: "shopper"}
+	if err := f.CreateUser(user); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SetProductInventory(testCatalog()); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SetCoupons([]*Coupon{{Code: "TWICE", MaxRedemptions: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err = NewFile(dir, 0)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if err := f.ReserveStock(user.ID, map[int]int{1: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.CreateOrder(&Order{UserID: user.ID, Coupon: "twice"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a crash after writing the snapshot keeps the journal from being truncated
+	journal, err := ioutil.ReadFile(filepath.Join(dir, journalFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, journalFile), journal, 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err = NewFile(dir, 0)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if err := f.ReserveStock(user.ID, map[int]int{1: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.journal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = NewFile(dir, 0)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	products, err := f.GetProducts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if products[1].Stock != 7 {
+		t.Errorf("%d belts in stock, want 7", products[1].Stock)
+	}
+	if coupon, err := f.GetCoupon("twice"); err != nil || coupon.Redeemed != 1 {
+		t.Errorf("coupon = %+v, %v, want it redeemed once", coupon, err)
+	}
+}
+
+func TestFileUpdateCartWritesOneEntry(t *testing.T) {
+	dir := tempDir(t)
+	f, err := NewFile(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &User{Username: "shopper"}
+	if err := f.CreateUser(user); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SetProductInventory(testCatalog()); err != nil {
+		t.Fatal(err)
+	}
+	entries := func() int {
+		journal, err := ioutil.ReadFile(filepath.Join(dir, journalFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bytes.Count(journal, []byte("\n"))
+	}
+	before := entries()
+
+	_, err = f.UpdateCart(user.ID, func(dao CartDAO, cart *Cart) error {
+		cart.add(&CartLine{ProductID: 1, Quantity: 2}, defaultMaxLineQuantity)
+		if err := dao.HoldStock(&StockHold{UserID: user.ID, ProductID: 1, Quantity: 2, ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+			return err
+		}
+		return dao.ReserveStock(user.ID, map[int]int{3: 1})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := entries() - before; n != 1 {
+		t.Errorf("UpdateCart wrote %d journal entries, want 1", n)
+	}
+}
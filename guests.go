@@ -0,0 +1,162 @@
+package shopping
+
+import (
+	"sort"
+	"time"
+)
+
+// cartTokenHeader carries the cart token of a guest, it's used instead of the Authorization header
+const cartTokenHeader = "X-Cart-Token"
+
+// defaultGuestCartTTL is how long guest carts last unless the service is given another duration
+const defaultGuestCartTTL = 7 * 24 * time.Hour
+
+// createGuest creates a guest with an empty cart and returns the cart token to hand out
+func (s *Service) createGuest() (string, *AccessToken, *User, error) {
+	token, err := newAccessToken()
+	if err != nil {
+		return "", nil, nil, err
+	}
+	now := s.now().UTC()
+	session := &AccessToken{
+		Hash:      hashAccessToken(token),
+		IssuedAt:  now,
+		ExpiresAt: now.Add(s.guestTTL),
+	}
+	// the colon keeps guest usernames apart from the ones that can be registered
+	user := &User{Username: "guest:" + session.Hash[:16]}
+	if err := s.dao.CreateGuest(user, session); err != nil {
+		return "", nil, nil, err
+	}
+	return token, session, user, nil
+}
+
+// authenticateGuest returns the guest of a cart token, failing if it's unknown, has expired or isn't a guest's
+func (s *Service) authenticateGuest(token string) (*User, *Error) {
+	if isJWT(token) {
+		return nil, errInvalidCartToken.msg("cart tokens are never JWTs")
+	}
+	session, err := s.checkAccessToken(token)
+	if err != nil {
+		return nil, errInvalidCartToken.msg(err.message)
+	}
+	user, getErr := s.dao.GetUserByID(session.UserID)
+	if getErr == errUserNotFound {
+		return nil, errInvalidCartToken.msg("guest of the cart token doesn't exist")
+	}
+	if getErr != nil {
+		return nil, errInternalServerError.msg("dao.GetUserByID: " + getErr.Error())
+	}
+	if !user.Guest {
+		return nil, errInvalidCartToken.msg("access token sent as a cart token")
+	}
+	return user, nil
+}
+
+// mergeGuestCart moves the items in the cart of the guest with the cart token to the user's cart and deletes the
+// guest. Items that would take the user's cart over the stock available are left out and returned as shortages, the
+// coupon of the guest is kept when the user's cart has none.
+func (s *Service) mergeGuestCart(user *User, cartToken string) ([]*StockShortage, *Error) {
+	guest, authErr := s.authenticateGuest(cartToken)
+	if authErr != nil {
+		return nil, authErr
+	}
+	products, err := s.dao.GetProducts()
+	if err != nil {
+		return nil, errInternalServerError.msg("dao.GetProducts: " + err.Error())
+	}
+
+	shortages := []*StockShortage{}
+	_, err = s.dao.UpdateCart(user.ID, func(dao CartDAO, cart *Cart) error {
+		// the guest's cart is read while both carts are locked, so a login merging it at the same time waits and
+		// then fails to find it
+		_, err := dao.UpdateCart(guest.ID, func(dao CartDAO, guestCart *Cart) error {
+			// the stock the guest held is released for the user to hold
+			if err := dao.ReleaseHolds(guest.ID); err != nil {
+				return toError(err, "dao.ReleaseHolds")
+			}
+			ids := make([]int, 0, len(guestCart.Products))
+			for id := range guestCart.Products {
+				ids = append(ids, id)
+			}
+			sort.Ints(ids)
+			for _, id := range ids {
+				line := guestCart.Products[id]
+				current := 0
+				if c := cart.Products[id]; c != nil {
+					current = c.Quantity
+				}
+				merged := s.mergeQuantity(dao, user.ID, products[id], current, current+line.Quantity)
+				if merged > current {
+					if _, err := cart.add(newCartLine(products[id], merged-current), s.maxLineQuantity); err != nil {
+						return err
+					}
+				}
+				if merged < current+line.Quantity {
+					shortages = append(shortages, &StockShortage{ProductID: id, Requested: current + line.Quantity, Available: merged})
+				}
+			}
+			if cart.Coupon == "" {
+				cart.Coupon = guestCart.Coupon
+			}
+			return nil
+		})
+		if err != nil {
+			return toError(err, "dao.UpdateCart")
+		}
+		// deleted last so the guest is kept with its cart and holds when anything before fails
+		if err := dao.DeleteGuest(guest.ID); err != nil {
+			return toError(err, "dao.DeleteGuest")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, toError(err, "dao.UpdateCart")
+	}
+	return shortages, nil
+}
+
+// mergeQuantity returns how many units of the product the user's cart can have, from current up to wanted, and
+// holds them when holds are enabled
+func (s *Service) mergeQuantity(dao CartDAO, userID int, p *Product, current, wanted int) int {
+	if p == nil {
+		return current // the product was removed from the catalog
+	}
+	if wanted > p.Stock {
+		wanted = p.Stock
+	}
+	if wanted > s.maxLineQuantity {
+		wanted = s.maxLineQuantity
+	}
+	if wanted <= current {
+		return current
+	}
+	err := s.holdStock(dao, userID, p.ID, wanted)
+	if err == nil {
+		return wanted
+	}
+	// someone else holds part of the stock, take what's left
+	available, ok := shortageAvailable(err, p.ID)
+	if !ok || available <= current || s.holdStock(dao, userID, p.ID, available) != nil {
+		return current
+	}
+	return available
+}
+
+// shortageAvailable returns the stock available of the product when err is a stock shortage
+func shortageAvailable(err error, productID int) (int, bool) {
+	e, ok := err.(*Error)
+	if !ok {
+		return 0, false
+	}
+	shortages, ok := e.Details.([]*StockShortage)
+	if !ok {
+		return 0, false
+	}
+	for _, shortage := range shortages {
+		if shortage.ProductID == productID {
+			return shortage.Available, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,183 @@
+package shopping
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// failingCartDAO calls before ahead of UpdateCart when set, and fails deleting guests in UpdateCart while fail is set
+// so it fails after making every other change
+type failingCartDAO struct {
+	DAO
+	before func()
+	fail   bool
+}
+
+func (d *failingCartDAO) UpdateCart(userID int, fn func(CartDAO, *Cart) error) (*Cart, error) {
+	if d.before != nil {
+		d.before()
+	}
+	return d.DAO.UpdateCart(userID, func(dao CartDAO, cart *Cart) error {
+		if d.fail {
+			dao = failingGuestDAO{dao}
+		}
+		return fn(dao, cart)
+	})
+}
+
+type failingGuestDAO struct {
+	CartDAO
+}
+
+func (d failingGuestDAO) DeleteGuest(id int) error {
+	return errors.New("failed to delete the guest")
+}
+
+func TestMergeGuestCartUndoesItselfWhenItFails(t *testing.T) {
+	dao := NewMemory()
+	failing := &failingCartDAO{DAO: dao}
+	s := newTestService(t, failing, SetStockHold(time.Hour))
+	belt := testCatalog()[0]
+	hold := func(userID, quantity int) {
+		t.Helper()
+		_, err := dao.UpdateCart(userID, func(dao CartDAO, cart *Cart) error {
+			cart.Products[belt.ID] = newCartLine(belt, quantity)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.holdStock(dao, userID, belt.ID, quantity); err != nil {
+			t.Fatal(err)
+		}
+	}
+	held := func(userID int) int {
+		if h := dao.Holds[userID][belt.ID]; h != nil {
+			return h.Quantity
+		}
+		return 0
+	}
+	inCart := func(userID int) int {
+		t.Helper()
+		cart, err := dao.GetCartByUserID(userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line := cart.Products[belt.ID]; line != nil {
+			return line.Quantity
+		}
+		return 0
+	}
+
+	user := &User{Username: "shopper"}
+	if err := dao.CreateUser(user); err != nil {
+		t.Fatal(err)
+	}
+	hold(user.ID, 2)
+	token, _, guest, err := s.createGuest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hold(guest.ID, 3)
+
+	failing.fail = true
+	if _, err := s.mergeGuestCart(user, token); err == nil {
+		t.Fatal("merging the guest cart didn't fail")
+	}
+	if n := held(user.ID); n != 2 {
+		t.Errorf("user holds %d belts after the failed merge, want 2", n)
+	}
+	if n := held(guest.ID); n != 3 {
+		t.Errorf("guest holds %d belts after the failed merge, want 3", n)
+	}
+	if n := inCart(user.ID); n != 2 {
+		t.Errorf("user's cart has %d belts after the failed merge, want 2", n)
+	}
+	if n := inCart(guest.ID); n != 3 {
+		t.Errorf("guest's cart has %d belts after the failed merge, want 3", n)
+	}
+
+	// another login merges the guest between authenticating it and merging its cart
+	failing.fail = false
+	token, _, guest, err = s.createGuest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hold(guest.ID, 3)
+	failing.before = func() {
+		if err := dao.DeleteGuest(guest.ID); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := s.mergeGuestCart(user, token); err == nil {
+		t.Fatal("merging a deleted guest's cart didn't fail")
+	}
+	if n := held(user.ID); n != 2 {
+		t.Errorf("user holds %d belts after merging a deleted guest, want 2", n)
+	}
+}
+
+func TestMergeGuestCart(t *testing.T) {
+	for _, tt := range testDAOs {
+		t.Run(tt.name, func(t *testing.T) {
+			dao := tt.new(t)
+			s := newTestService(t, dao, SetStockHold(time.Hour))
+			belt, shoe := testCatalog()[0], testCatalog()[4]
+			add := func(userID int, p *Product, quantity int) {
+				t.Helper()
+				_, err := dao.UpdateCart(userID, func(dao CartDAO, cart *Cart) error {
+					cart.Products[p.ID] = newCartLine(p, quantity)
+					return s.holdStock(dao, userID, p.ID, quantity)
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			user := &User{Username: "shopper"}
+			if err := dao.CreateUser(user); err != nil {
+				t.Fatal(err)
+			}
+			add(user.ID, belt, 2)
+			token, _, guest, err := s.createGuest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			add(guest.ID, belt, 3)
+			// the only shoe is held by the guest until the merge releases it for the user
+			add(guest.ID, shoe, 1)
+			if _, err := dao.UpdateCart(guest.ID, func(dao CartDAO, cart *Cart) error {
+				cart.Coupon = "WELCOME"
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			shortages, mergeErr := s.mergeGuestCart(user, token)
+			if mergeErr != nil || len(shortages) != 0 {
+				t.Fatalf("merge = %v, %v, want no shortages", shortages, mergeErr)
+			}
+			cart, err := dao.GetCartByUserID(user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cart.Products[belt.ID] == nil || cart.Products[belt.ID].Quantity != 5 || cart.Products[shoe.ID] == nil || cart.Coupon != "WELCOME" {
+				t.Errorf("merged cart %+v, want 5 belts, a shoe and the guest's coupon", cart)
+			}
+			if _, err := dao.GetUserByID(guest.ID); err != errUserNotFound {
+				t.Errorf("guest after the merge: %v, want %v", err, errUserNotFound)
+			}
+			products, err := dao.GetProducts()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if products[belt.ID].Available != 5 || products[shoe.ID].Available != 0 {
+				t.Errorf("%d belts and %d shoes available after the merge, want 5 and 0", products[belt.ID].Available, products[shoe.ID].Available)
+			}
+			if _, err := s.mergeGuestCart(user, token); err == nil {
+				t.Error("the guest cart was merged twice")
+			}
+		})
+	}
+}
@@ -2,18 +2,18 @@ package shopping
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
-	"math/rand"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
 )
 
-var (
-	letterRunes = []rune("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ") // pool of numbers and letters to generate random code
-
-)
-
 // HandleHealthcheck responds with an empty JSON object
 func (s *Service) HandleHealthcheck(w http.ResponseWriter, r *http.Request) {
 	s.writeJSON(w, struct{}{})
@@ -24,7 +24,8 @@ func (s *Service) HandleNotFound(w http.ResponseWriter, r *http.Request) {
 	s.writeError(w, &Error{Code: http.StatusNotFound, Message: r.RequestURI + " not found"})
 }
 
-// HandleLogin validates credentials for a user
+// HandleLogin validates credentials for a user and hands out an access token that expires after a while,
+// the cart of a guest whose cart token is sent in the X-Cart-Token header is merged into the user's cart
 func (s *Service) HandleLogin(w http.ResponseWriter, r *http.Request) {
 	username, password, ok := r.BasicAuth()
 	if !ok {
@@ -32,45 +33,279 @@ func (s *Service) HandleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	attempt := newLoginAttempt(username, r)
+	if wait, err := s.reserveLoginAttempt(attempt); err != nil {
+		if wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(wait)))
+		}
+		s.writeError(w, err)
+		return
+	}
+
 	user, err := s.dao.GetUser(username)
+	if err == errUserNotFound {
+		checkPasswordWithoutUser(password)
+		// unknown usernames are counted too so lockouts don't tell which ones exist
+		s.logLoginFailure(attempt)
+		s.writeError(w, errInvalidUsernameOrPassowrd.msg("User not found: "+username))
+		return
+	}
 	if err != nil {
+		// the password wasn't checked so the attempt isn't a failure
+		s.releaseLoginAttempt(attempt)
 		s.writeError(w, errInternalServerError.msg("dao.GetUser: "+err.Error()))
 		return
 	}
 
-	if user == nil {
-		s.writeError(w, errInvalidUsernameOrPassowrd.msg("User not found: "+username))
+	ok, upgrade := checkPassword(user, password)
+	if !ok {
+		s.logLoginFailure(attempt)
+		s.writeError(w, errInvalidUsernameOrPassowrd.msg("Incorrect password"))
 		return
 	}
-	if password != user.Password {
-		s.writeError(w, errInvalidUsernameOrPassowrd.msg("Incorrect password"))
+	if err := s.clearLoginFailures(attempt); err != nil {
+		s.writeError(w, err)
 		return
 	}
+	if upgrade {
+		hash, err := hashPassword(password)
+		if err != nil {
+			s.writeError(w, errInternalServerError.msg("hashPassword: "+err.Error()))
+			return
+		}
+		user.Password = hash
+		if err := s.dao.SetUser(user); err != nil {
+			s.writeError(w, errInternalServerError.msg("dao.SetUser: "+err.Error()))
+			return
+		}
+	}
 
-	token := rand10letterString()
-	user.Token = token
-
-	if err := s.dao.SetUser(user); err != nil {
-		s.writeError(w, errInternalServerError.msg("dao.SetUser: "+err.Error()))
+	tokens, err := s.issueTokens(user)
+	if err != nil {
+		s.writeError(w, errInternalServerError.msg("issueTokens: "+err.Error()))
 		return
 	}
 	// init a cart if it's empty
 	if _, err := s.dao.GetCartByUserID(user.ID); err != nil {
-		s.dao.SetCart(&Cart{UserID: user.ID, Products: map[int][]*CartProduct{}})
+		s.dao.SetCart(&Cart{UserID: user.ID, Products: CartLines{}})
+	}
+
+	res := struct {
+		*tokenPair
+		CartShortages []*StockShortage `json:"cart_shortages,omitempty"` // items of the guest cart left out for lack of stock
+	}{tokenPair: tokens}
+	if cartToken := r.Header.Get(cartTokenHeader); cartToken != "" {
+		// logging in matters more than the guest cart, e.g. one merged already
+		shortages, err := s.mergeGuestCart(user, cartToken)
+		if err != nil {
+			log.WithError(err).WithField("error-message", err.message).WithField("user", user.ID).Warnln("failed to merge guest cart")
+		}
+		res.CartShortages = shortages
+	}
+	s.writeJSON(w, res)
+}
+
+// HandleCreateGuestCart gives a shopper who hasn't logged in a cart, the cart token returned is sent in the
+// X-Cart-Token header to use it and to merge it into the user's cart on login
+func (s *Service) HandleCreateGuestCart(w http.ResponseWriter, r *http.Request) {
+	token, session, user, err := s.createGuest()
+	if err != nil {
+		s.writeError(w, toError(err, "createGuest"))
+		return
+	}
+	cart, err := s.dao.GetCartByUserID(user.ID)
+	if err != nil {
+		s.writeError(w, errInternalServerError.msg("dao.GetCartByUserID: "+err.Error()))
+		return
+	}
+	s.writeJSON(w, struct {
+		CartToken string    `json:"cart_token"`
+		ExpiresAt time.Time `json:"expires_at"`
+		Cart      *Cart     `json:"cart"`
+	}{CartToken: token, ExpiresAt: session.ExpiresAt, Cart: cart})
+}
+
+// HandleRefreshToken exchanges the refresh token in the body for a new access token and refresh token,
+// the refresh token can't be used again
+func (s *Service) HandleRefreshToken(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		RefreshToken string `json:"refresh_token"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, errInternalServerError.msg("failed to decode req: "+err.Error()))
+		return
+	}
+	if req.RefreshToken == "" {
+		s.writeError(w, errInvalidRefreshToken.msg("missing refresh token"))
+		return
+	}
+	tokens, err := s.refreshTokens(req.RefreshToken)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	s.writeJSON(w, tokens)
+}
+
+// HandleLogout revokes the access token of the request and the refresh token in the body, if any, along with every
+// refresh token rotated from the same login. JWTs can't be revoked and stay valid until they expire.
+func (s *Service) HandleLogout(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		RefreshToken string `json:"refresh_token"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		s.writeError(w, errInternalServerError.msg("failed to decode req: "+err.Error()))
+		return
+	}
+	now := s.now().UTC()
+	if session, ok := r.Context().Value(ctxAccessToken).(*AccessToken); ok {
+		if err := s.dao.RevokeAccessToken(session.Hash, now); err != nil {
+			s.writeError(w, toError(err, "dao.RevokeAccessToken"))
+			return
+		}
+	}
+	if req.RefreshToken != "" {
+		if err := s.dao.RevokeRefreshTokens(hashAccessToken(req.RefreshToken), now); err != nil {
+			s.writeError(w, toError(err, "dao.RevokeRefreshTokens"))
+			return
+		}
+	}
+	s.writeJSON(w, struct{}{})
+}
+
+// HandleOIDCLogin sends the user to the identity provider to sign in, the state, nonce and PKCE verifier of the login
+// are kept in a cookie only the callback gets back
+func (s *Service) HandleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if s.oidc == nil {
+		s.writeError(w, errOIDCNotConfigured.msg("oidc login without oidc config"))
+		return
+	}
+	login, err := newOIDCLogin()
+	if err != nil {
+		s.writeError(w, errInternalServerError.msg("newOIDCLogin: "+err.Error()))
+		return
+	}
+	location, err := s.oidc.authCodeURL(login.state, login.nonce, login.verifier)
+	if err != nil {
+		s.writeError(w, errBadGatewayIdentityProvider.msg("oidc.authCodeURL: "+err.Error()))
+		return
+	}
+	http.SetCookie(w, s.oidcCookie(login.String(), r.TLS != nil))
+	http.Redirect(w, r, location, http.StatusFound)
+}
+
+// HandleOIDCCallback finishes signing in with the identity provider, the authorization code is exchanged for an ID
+// token and the user it names is created the first time they sign in. It hands out tokens like HandleLogin.
+func (s *Service) HandleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if s.oidc == nil {
+		s.writeError(w, errOIDCNotConfigured.msg("oidc callback without oidc config"))
+		return
+	}
+	var login *oidcLogin
+	if cookie, err := r.Cookie(oidcLoginCookie); err == nil {
+		login, _ = parseOIDCLogin(cookie.Value)
+	}
+	// the login can only be finished once
+	http.SetCookie(w, s.oidcCookie("", r.TLS != nil))
+	query := r.URL.Query()
+	if login == nil || subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(login.state)) != 1 {
+		s.writeError(w, errBadRequestInvalidOIDCState.msg("oidc state doesn't match the login cookie"))
+		return
+	}
+	if idpErr := query.Get("error"); idpErr != "" {
+		s.writeError(w, errOIDCLoginFailed.msg("identity provider: "+idpErr+" "+query.Get("error_description")))
+		return
+	}
+	code := query.Get("code")
+	if code == "" {
+		s.writeError(w, errOIDCLoginFailed.msg("oidc callback without code"))
+		return
+	}
+
+	idToken, err := s.oidc.exchange(code, login.verifier)
+	if _, rejected := err.(*oidcError); rejected {
+		s.writeError(w, errOIDCLoginFailed.msg("oidc.exchange: "+err.Error()))
+		return
+	}
+	if err != nil {
+		s.writeError(w, errBadGatewayIdentityProvider.msg("oidc.exchange: "+err.Error()))
+		return
+	}
+	claims, err := s.oidc.verify(idToken, login.nonce, s.now())
+	if err != nil {
+		s.writeError(w, errOIDCLoginFailed.msg("oidc.verify: "+err.Error()))
+		return
+	}
+	user, err := s.oidcUser(claims)
+	if err != nil {
+		s.writeError(w, toError(err, "oidcUser"))
+		return
+	}
+
+	tokens, err := s.issueTokens(user)
+	if err != nil {
+		s.writeError(w, errInternalServerError.msg("issueTokens: "+err.Error()))
+		return
+	}
+	s.writeJSON(w, tokens)
+}
+
+// HandleRegister creates a customer with the username and password in the body,
+// the password is checked against the password policy and only its hash is stored
+func (s *Service) HandleRegister(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, errInternalServerError.msg("failed to decode req: "+err.Error()))
+		return
+	}
+
+	if err := checkUsername(req.Username); err != nil {
+		e := errBadRequestInvalidUsername.msg(err.Error())
+		e.Details = err.Error()
+		s.writeError(w, e)
+		return
+	}
+	if reasons := checkPasswordPolicy(req.Username, req.Password); len(reasons) > 0 {
+		e := errBadRequestWeakPassword.msg(strings.Join(reasons, ", "))
+		e.Details = reasons
+		s.writeError(w, e)
+		return
+	}
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		s.writeError(w, errInternalServerError.msg("hashPassword: "+err.Error()))
+		return
 	}
 
+	user := &User{Username: req.Username, Password: hash}
+	if err := s.dao.CreateUser(user); err != nil {
+		s.writeError(w, toError(err, "dao.CreateUser"))
+		return
+	}
 	s.writeJSON(w, struct {
-		Token string `json:"token"`
-	}{Token: token})
+		User *User `json:"user"`
+	}{User: &User{ID: user.ID, Username: user.Username}})
 }
 
 // HandleGetProducts gets a list of products
 func (s *Service) HandleGetProducts(w http.ResponseWriter, r *http.Request) {
+	currency, currencyErr := s.requestedCurrency(r)
+	if currencyErr != nil {
+		s.writeError(w, currencyErr)
+		return
+	}
 	products, err := s.dao.GetProducts()
 	if err != nil {
 		s.writeError(w, errInternalServerError.msg("dao.GetCartByUserID: "+err.Error()))
 		return
 	}
+	if err := s.convertProducts(products, currency); err != nil {
+		s.writeError(w, errInternalServerError.msg("s.convertProducts: "+err.Error()))
+		return
+	}
 	res := struct {
 		Products Products `json:"products"`
 	}{
@@ -79,21 +314,113 @@ func (s *Service) HandleGetProducts(w http.ResponseWriter, r *http.Request) {
 	s.writeJSON(w, res)
 }
 
-// HandleGetPromotions gets a list of promotions
+// HandleGetPromotions gets a list of the promotions active now,
+// the ones that will be active later are listed too with ?upcoming=true
 func (s *Service) HandleGetPromotions(w http.ResponseWriter, r *http.Request) {
 	promos, err := s.dao.GetPromotions()
 	if err != nil {
 		s.writeError(w, errInternalServerError.msg("dao.GetCartByUserID: "+err.Error()))
 		return
 	}
+	now := s.now()
+	active, upcoming := Promotions{}, Promotions{}
+	for id, p := range promos {
+		if p.Disabled {
+			continue
+		}
+		if p.Schedule.activeAt(now) {
+			active[id] = p
+		} else if p.Schedule.upcomingAt(now) {
+			upcoming[id] = p
+		}
+	}
 	res := struct {
 		Promotions Promotions `json:"promotions"`
+		Upcoming   Promotions `json:"upcoming,omitempty"`
 	}{
-		Promotions: promos,
+		Promotions: active,
+	}
+	if withUpcoming, _ := strconv.ParseBool(r.URL.Query().Get("upcoming")); withUpcoming {
+		res.Upcoming = upcoming
 	}
 	s.writeJSON(w, res)
 }
 
+// HandleSimulatePromotions prices a hypothetical basket without touching any cart or stock.
+// The promotions in the request replace the stored ones when given, at, segments and coupon
+// set when the basket is priced, the segments of the customer and the coupon code in the cart.
+// Coupon limits aren't checked, the code only meets coupon conditions.
+func (s *Service) HandleSimulatePromotions(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Items []struct {
+			ProductID int `json:"product_id"`
+			Quantity  int `json:"quantity"`
+		} `json:"items"`
+		Promotions []*Promotion `json:"promotions,omitempty"`
+		At         *time.Time   `json:"at,omitempty"`
+		Segments   []string     `json:"segments,omitempty"`
+		Coupon     string       `json:"coupon,omitempty"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, errInternalServerError.msg("failed to decode req: "+err.Error()))
+		return
+	}
+	currency, currencyErr := s.requestedCurrency(r)
+	if currencyErr != nil {
+		s.writeError(w, currencyErr)
+		return
+	}
+
+	promotions, err := s.dao.GetPromotions()
+	if err != nil {
+		s.writeError(w, errInternalServerError.msg("dao.GetPromotions: "+err.Error()))
+		return
+	}
+	if req.Promotions != nil {
+		candidates, err := s.preparePromotions(req.Promotions)
+		if err != nil {
+			s.writeError(w, invalidPromotion(err))
+			return
+		}
+		promotions = Promotions{}
+		for _, p := range candidates {
+			promotions[p.ID] = p
+		}
+	}
+	products, err := s.dao.GetProducts()
+	if err != nil {
+		s.writeError(w, errInternalServerError.msg("dao.GetProducts: "+err.Error()))
+		return
+	}
+
+	cart := &Cart{Coupon: strings.ToUpper(strings.TrimSpace(req.Coupon)), Products: CartLines{}}
+	for _, item := range req.Items {
+		p := products[item.ProductID]
+		if p == nil {
+			s.writeError(w, errBadRequestProductNotFound.msg("product "+strconv.Itoa(item.ProductID)+" doesn't exist"))
+			return
+		}
+		if _, err := cart.add(newCartLine(p, item.Quantity), s.maxLineQuantity); err != nil {
+			s.writeError(w, toError(err, "cart.add"))
+			return
+		}
+	}
+	now := s.now()
+	if req.At != nil {
+		now = *req.At
+	}
+
+	applied := s.calculatePromotions(cart, &User{Segments: req.Segments}, promotions, now)
+	if err := s.convertCart(cart, currency); err != nil {
+		s.writeError(w, errInternalServerError.msg("s.convertCart: "+err.Error()))
+		return
+	}
+	s.writeJSON(w, struct {
+		Cart       *Cart        `json:"cart"`
+		Promotions []*Promotion `json:"promotions"` // applied, in evaluation order
+	}{Cart: cart, Promotions: applied})
+}
+
 // HandleGetCart gets the latest shopping cart information for a user
 func (s *Service) HandleGetCart(w http.ResponseWriter, r *http.Request) {
 	user, ctxErr := getUserFromContext(r.Context())
@@ -101,12 +428,21 @@ func (s *Service) HandleGetCart(w http.ResponseWriter, r *http.Request) {
 		s.writeError(w, ctxErr)
 		return
 	}
+	currency, currencyErr := s.requestedCurrency(r)
+	if currencyErr != nil {
+		s.writeError(w, currencyErr)
+		return
+	}
 
 	cart, err := s.dao.GetCartByUserID(user.ID)
 	if err != nil {
 		s.writeError(w, errInternalServerError.msg("dao.GetCartByUserID: "+err.Error()))
 		return
 	}
+	if err := s.convertCart(cart, currency); err != nil {
+		s.writeError(w, errInternalServerError.msg("s.convertCart: "+err.Error()))
+		return
+	}
 	s.writeJSON(w, struct {
 		Cart *Cart `json:"cart"`
 	}{Cart: cart})
@@ -129,11 +465,6 @@ func (s *Service) HandleCartAddItem(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cart, err := s.dao.GetCartByUserID(user.ID)
-	if err != nil {
-		s.writeError(w, errInternalServerError.msg("dao.GetCartByUserID: "+err.Error()))
-		return
-	}
 	products, err := s.dao.GetProducts()
 	if err != nil {
 		s.writeError(w, errInternalServerError.msg("dao.GetProducts: "+err.Error()))
@@ -148,21 +479,19 @@ func (s *Service) HandleCartAddItem(w http.ResponseWriter, r *http.Request) {
 		s.writeError(w, errBadRequestNotEnoughStock.msg("not enough stock"))
 		return
 	}
-	for i := 0; i < req.Quantity; i++ {
-		cart.Products[req.ProductID] = append(cart.Products[req.ProductID], &CartProduct{
-			ProductType: p.Type,
-			ProductName: p.Name,
-			UnitPrice:   p.Price,
-		})
-	}
-	if len(cart.Products[req.ProductID]) > p.Stock {
-		cart.Products[req.ProductID] = append(cart.Products[req.ProductID][:0], cart.Products[req.ProductID][1:]...)
-		s.writeError(w, errBadRequestNotEnoughStock.msg("not enough stock"))
-		return
-	}
 
-	if err := s.dao.SetCart(cart); err != nil {
-		s.writeError(w, errInternalServerError.msg("dao.SetCart: "+err.Error()))
+	cart, err := s.dao.UpdateCart(user.ID, func(dao CartDAO, cart *Cart) error {
+		line, err := cart.add(newCartLine(p, req.Quantity), s.maxLineQuantity)
+		if err != nil {
+			return err
+		}
+		if line.Quantity > p.Stock {
+			return errBadRequestNotEnoughStock.msg("not enough stock")
+		}
+		return s.holdStock(dao, user.ID, req.ProductID, line.Quantity)
+	})
+	if err != nil {
+		s.writeError(w, toError(err, "dao.UpdateCart"))
 		return
 	}
 	s.writeJSON(w, struct {
@@ -187,31 +516,35 @@ func (s *Service) HandleCartRemoveItem(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cart, err := s.dao.GetCartByUserID(user.ID)
+	cart, err := s.dao.UpdateCart(user.ID, func(dao CartDAO, cart *Cart) error {
+		return s.holdStock(dao, user.ID, req.ProductID, cart.remove(req.ProductID, req.Quantity))
+	})
 	if err != nil {
-		s.writeError(w, errInternalServerError.msg("dao.GetCartByUserID: "+err.Error()))
+		s.writeError(w, toError(err, "dao.UpdateCart"))
 		return
 	}
-	for i := 0; i < req.Quantity; i++ {
-		if len(cart.Products[req.ProductID]) < 2 {
-			cart.Products[req.ProductID] = []*CartProduct{}
-		} else {
-			cart.Products[req.ProductID] = append(cart.Products[req.ProductID][:0], cart.Products[req.ProductID][1:]...)
-		}
+	s.writeJSON(w, struct {
+		Cart *Cart `json:"cart"`
+	}{Cart: cart})
+}
+
+// HandleCartClear removes all items from a cart
+func (s *Service) HandleCartClear(w http.ResponseWriter, r *http.Request) {
+	user, ctxErr := getUserFromContext(r.Context())
+	if ctxErr != nil {
+		s.writeError(w, ctxErr)
+		return
 	}
-	// reset all promotions
-	for _, products := range cart.Products {
-		for _, product := range products {
-			product.Discount = false
-			product.SpecialPrice = false
-			product.DiscountAmount = 0
-			product.DiscountPercentage = 0
-			product.DiscountedPrice = 0
 
+	cart, err := s.dao.UpdateCart(user.ID, func(dao CartDAO, cart *Cart) error {
+		if err := dao.ReleaseHolds(user.ID); err != nil {
+			return errInternalServerError.msg("dao.ReleaseHolds: " + err.Error())
 		}
-	}
-	if err := s.dao.SetCart(cart); err != nil {
-		s.writeError(w, errInternalServerError.msg("dao.SetCart: "+err.Error()))
+		cart.clear()
+		return nil
+	})
+	if err != nil {
+		s.writeError(w, toError(err, "dao.UpdateCart"))
 		return
 	}
 	s.writeJSON(w, struct {
@@ -219,24 +552,53 @@ func (s *Service) HandleCartRemoveItem(w http.ResponseWriter, r *http.Request) {
 	}{Cart: cart})
 }
 
-// HandleCartClear removes all items from a cart
-func (s *Service) HandleCartClear(w http.ResponseWriter, r *http.Request) {
+// HandleCartApplyCoupon enters a coupon code in the cart, its promotions apply from the next checkout
+func (s *Service) HandleCartApplyCoupon(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Code string `json:"code"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, errInternalServerError.msg("failed to decode req: "+err.Error()))
+		return
+	}
+
 	user, ctxErr := getUserFromContext(r.Context())
 	if ctxErr != nil {
 		s.writeError(w, ctxErr)
 		return
 	}
 
-	cart, err := s.dao.GetCartByUserID(user.ID)
+	cart, err := s.dao.UpdateCart(user.ID, func(dao CartDAO, cart *Cart) error {
+		coupon, err := s.checkCoupon(strings.TrimSpace(req.Code), user.ID, cart.subtotal())
+		if err != nil {
+			return err
+		}
+		cart.Coupon = coupon.Code
+		return nil
+	})
 	if err != nil {
-		s.writeError(w, errInternalServerError.msg("dao.GetCartByUserID: "+err.Error()))
+		s.writeError(w, toError(err, "dao.UpdateCart"))
 		return
 	}
-	cart.Products = map[int][]*CartProduct{}
-	cart.Checkout = []*CartProduct{}
+	s.writeJSON(w, struct {
+		Cart *Cart `json:"cart"`
+	}{Cart: cart})
+}
 
-	if err := s.dao.SetCart(cart); err != nil {
-		s.writeError(w, errInternalServerError.msg("dao.SetCart: "+err.Error()))
+// HandleCartRemoveCoupon takes the coupon code out of the cart
+func (s *Service) HandleCartRemoveCoupon(w http.ResponseWriter, r *http.Request) {
+	user, ctxErr := getUserFromContext(r.Context())
+	if ctxErr != nil {
+		s.writeError(w, ctxErr)
+		return
+	}
+
+	cart, err := s.dao.UpdateCart(user.ID, func(dao CartDAO, cart *Cart) error {
+		cart.Coupon = ""
+		return nil
+	})
+	if err != nil {
+		s.writeError(w, toError(err, "dao.UpdateCart"))
 		return
 	}
 	s.writeJSON(w, struct {
@@ -251,25 +613,25 @@ func (s *Service) HandleCartCheckout(w http.ResponseWriter, r *http.Request) {
 		s.writeError(w, ctxErr)
 		return
 	}
-
-	cart, err := s.dao.GetCartByUserID(user.ID)
-	if err != nil {
-		s.writeError(w, errInternalServerError.msg("dao.GetCartByUserID: "+err.Error()))
+	currency, currencyErr := s.requestedCurrency(r)
+	if currencyErr != nil {
+		s.writeError(w, currencyErr)
 		return
 	}
 
-	updatedProducts, err := s.calculatePromotions(cart)
+	cart, err := s.dao.UpdateCart(user.ID, func(dao CartDAO, cart *Cart) error {
+		if _, err := s.priceCart(cart, user); err != nil {
+			return toError(err, "s.priceCart")
+		}
+		return nil
+	})
 	if err != nil {
-		s.writeError(w, errInternalServerError.msg("s.calculatePromotions: "+err.Error()))
+		s.writeError(w, toError(err, "dao.UpdateCart"))
 		return
 	}
-	total, discountedTotal := calculateTotalPrice(updatedProducts)
-	cart.Checkout = updatedProducts
-	cart.TotalPrice = total
-	cart.TotalDiscount = discountedTotal
-
-	if err := s.dao.SetCart(cart); err != nil {
-		s.writeError(w, errInternalServerError.msg("dao.SetCart: "+err.Error()))
+	// the cart is stored in the base currency, only the response is converted
+	if err := s.convertCart(cart, currency); err != nil {
+		s.writeError(w, errInternalServerError.msg("s.convertCart: "+err.Error()))
 		return
 	}
 
@@ -279,37 +641,350 @@ func (s *Service) HandleCartCheckout(w http.ResponseWriter, r *http.Request) {
 	s.writeJSON(w, res)
 }
 
-// HandleCartBuy process items as bought and removes them from inventory
-func (s *Service) HandleCartBuy(w http.ResponseWriter, r *http.Request) {
+// HandleGetCarts lists every cart of the user, the active one and the named ones such as the wishlist
+func (s *Service) HandleGetCarts(w http.ResponseWriter, r *http.Request) {
 	user, ctxErr := getUserFromContext(r.Context())
 	if ctxErr != nil {
 		s.writeError(w, ctxErr)
 		return
 	}
+	currency, currencyErr := s.requestedCurrency(r)
+	if currencyErr != nil {
+		s.writeError(w, currencyErr)
+		return
+	}
 
-	cart, err := s.dao.GetCartByUserID(user.ID)
+	carts, err := s.dao.GetCarts(user.ID)
 	if err != nil {
-		s.writeError(w, errInternalServerError.msg("dao.GetCartByUserID: "+err.Error()))
+		s.writeError(w, toError(err, "dao.GetCarts"))
+		return
+	}
+	for _, cart := range carts {
+		if err := s.convertCart(cart, currency); err != nil {
+			s.writeError(w, errInternalServerError.msg("s.convertCart: "+err.Error()))
+			return
+		}
+	}
+	s.writeJSON(w, struct {
+		Carts []*Cart `json:"carts"`
+	}{Carts: carts})
+}
+
+// HandleGetNamedCart gets one of the user's carts by name
+func (s *Service) HandleGetNamedCart(w http.ResponseWriter, r *http.Request) {
+	user, ctxErr := getUserFromContext(r.Context())
+	if ctxErr != nil {
+		s.writeError(w, ctxErr)
+		return
+	}
+	name, nameErr := cartName(r)
+	if nameErr != nil {
+		s.writeError(w, nameErr)
 		return
 	}
-	inventory, err := s.dao.GetProducts()
+	currency, currencyErr := s.requestedCurrency(r)
+	if currencyErr != nil {
+		s.writeError(w, currencyErr)
+		return
+	}
+
+	carts, err := s.dao.GetCarts(user.ID)
 	if err != nil {
-		s.writeError(w, errInternalServerError.msg("dao.GetCartByUserID: "+err.Error()))
+		s.writeError(w, toError(err, "dao.GetCarts"))
+		return
+	}
+	var cart *Cart
+	for _, c := range carts {
+		if c.Name == name {
+			cart = c
+		}
+	}
+	if cart == nil {
+		s.writeError(w, errCartNotFound.msg("no cart named "+name))
+		return
+	}
+	if err := s.convertCart(cart, currency); err != nil {
+		s.writeError(w, errInternalServerError.msg("s.convertCart: "+err.Error()))
+		return
+	}
+	s.writeJSON(w, struct {
+		Cart *Cart `json:"cart"`
+	}{Cart: cart})
+}
+
+// HandleNamedCartAddItem adds an item to a named cart, which is created when the user doesn't have it yet.
+// Named carts don't hold stock so out of stock products can be added, the active cart works like /cart/add.
+func (s *Service) HandleNamedCartAddItem(w http.ResponseWriter, r *http.Request) {
+	name, nameErr := cartName(r)
+	if nameErr != nil {
+		s.writeError(w, nameErr)
+		return
+	}
+	if name == CartNameActive {
+		s.HandleCartAddItem(w, r)
+		return
+	}
+	req := struct {
+		ProductID int `json:"product_id,omitempty"`
+		Quantity  int `json:"quantity,omitempty"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, errInternalServerError.msg("failed to decode req: "+err.Error()))
+		return
+	}
+
+	user, ctxErr := getUserFromContext(r.Context())
+	if ctxErr != nil {
+		s.writeError(w, ctxErr)
+		return
+	}
+
+	products, err := s.dao.GetProducts()
+	if err != nil {
+		s.writeError(w, errInternalServerError.msg("dao.GetProducts: "+err.Error()))
+		return
+	}
+	p := products[req.ProductID]
+	if p == nil {
+		s.writeError(w, errBadRequestProductNotFound.msg("product "+strconv.Itoa(req.ProductID)+" doesn't exist"))
+		return
+	}
+	if req.Quantity < 1 {
+		s.writeError(w, errBadRequestInvalidQuantity.msg("quantity must be at least 1"))
 		return
 	}
 
-	for productType, products := range cart.Products {
-		inventory[productType].Stock -= len(products)
-		if inventory[productType].Stock < 0 {
-			inventory[productType].Stock = 0
+	carts, err := s.dao.UpdateCarts(user.ID, func(dao CartDAO, carts map[string]*Cart) error {
+		cart, err := namedCart(carts, name, true)
+		if err != nil {
+			return err
 		}
+		_, err = cart.add(newCartLine(p, req.Quantity), s.maxLineQuantity)
+		return err
+	})
+	if err != nil {
+		s.writeError(w, toError(err, "dao.UpdateCarts"))
+		return
 	}
+	s.writeJSON(w, struct {
+		Cart *Cart `json:"cart"`
+	}{Cart: carts[name]})
+}
 
-	if err := s.dao.UpdateProducts(inventory); err != nil {
-		s.writeError(w, errInternalServerError.msg("dao.UpdateProducts: "+err.Error()))
+// HandleNamedCartRemoveItem removes an item from a named cart, the active cart works like /cart/remove
+func (s *Service) HandleNamedCartRemoveItem(w http.ResponseWriter, r *http.Request) {
+	name, nameErr := cartName(r)
+	if nameErr != nil {
+		s.writeError(w, nameErr)
 		return
 	}
-	s.writeJSON(w, struct{}{})
+	if name == CartNameActive {
+		s.HandleCartRemoveItem(w, r)
+		return
+	}
+	req := struct {
+		ProductID int `json:"product_id,omitempty"`
+		Quantity  int `json:"quantity,omitempty"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, errInternalServerError.msg("failed to decode req: "+err.Error()))
+		return
+	}
+
+	user, ctxErr := getUserFromContext(r.Context())
+	if ctxErr != nil {
+		s.writeError(w, ctxErr)
+		return
+	}
+
+	carts, err := s.dao.UpdateCarts(user.ID, func(dao CartDAO, carts map[string]*Cart) error {
+		cart, err := namedCart(carts, name, false)
+		if err != nil {
+			return err
+		}
+		cart.remove(req.ProductID, req.Quantity)
+		return nil
+	})
+	if err != nil {
+		s.writeError(w, toError(err, "dao.UpdateCarts"))
+		return
+	}
+	s.writeJSON(w, struct {
+		Cart *Cart `json:"cart"`
+	}{Cart: carts[name]})
+}
+
+// HandleDeleteNamedCart removes a named cart with its items, the active cart can only be cleared
+func (s *Service) HandleDeleteNamedCart(w http.ResponseWriter, r *http.Request) {
+	user, ctxErr := getUserFromContext(r.Context())
+	if ctxErr != nil {
+		s.writeError(w, ctxErr)
+		return
+	}
+	name, nameErr := cartName(r)
+	if nameErr != nil {
+		s.writeError(w, nameErr)
+		return
+	}
+	if name == CartNameActive {
+		s.writeError(w, errBadRequestInvalidCartName.msg("the active cart can't be deleted"))
+		return
+	}
+
+	if err := s.dao.DeleteCart(user.ID, name); err != nil {
+		s.writeError(w, toError(err, "dao.DeleteCart"))
+		return
+	}
+	s.writeJSON(w, struct {
+		Name string `json:"name"`
+	}{Name: name})
+}
+
+// HandleCartMoveItem moves units of a product between two of the user's carts, e.g. to save them for later or to buy
+// what's in the wishlist. Every unit moves when quantity is 0 and the cart moved to is created if needed.
+func (s *Service) HandleCartMoveItem(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		From      string `json:"from"`
+		To        string `json:"to"`
+		ProductID int    `json:"product_id"`
+		Quantity  int    `json:"quantity,omitempty"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, errInternalServerError.msg("failed to decode req: "+err.Error()))
+		return
+	}
+	for _, name := range []string{req.From, req.To} {
+		if err := checkCartName(name); err != nil {
+			s.writeError(w, err)
+			return
+		}
+	}
+	if req.From == req.To {
+		s.writeError(w, errBadRequestInvalidCartName.msg("items can't be moved to the cart they're in"))
+		return
+	}
+
+	user, ctxErr := getUserFromContext(r.Context())
+	if ctxErr != nil {
+		s.writeError(w, ctxErr)
+		return
+	}
+	products, err := s.dao.GetProducts()
+	if err != nil {
+		s.writeError(w, errInternalServerError.msg("dao.GetProducts: "+err.Error()))
+		return
+	}
+
+	carts, err := s.dao.UpdateCarts(user.ID, func(dao CartDAO, carts map[string]*Cart) error {
+		return s.moveCartItems(dao, user.ID, carts, req.From, req.To, products[req.ProductID], req.ProductID, req.Quantity)
+	})
+	if err != nil {
+		s.writeError(w, toError(err, "dao.UpdateCarts"))
+		return
+	}
+	s.writeJSON(w, struct {
+		From *Cart `json:"from"`
+		To   *Cart `json:"to"`
+	}{From: carts[req.From], To: carts[req.To]})
+}
+
+// HandleCartBuy process items as bought, removes them from inventory and records the order
+func (s *Service) HandleCartBuy(w http.ResponseWriter, r *http.Request) {
+	user, ctxErr := getUserFromContext(r.Context())
+	if ctxErr != nil {
+		s.writeError(w, ctxErr)
+		return
+	}
+
+	var order *Order
+	_, err := s.dao.UpdateCart(user.ID, func(dao CartDAO, cart *Cart) error {
+		if cart.empty() {
+			return errBadRequestEmptyCart.msg("nothing to buy")
+		}
+		applied, err := s.priceCart(cart, user)
+		if err != nil {
+			return toError(err, "s.priceCart")
+		}
+
+		quantities := cart.quantities()
+		if err := dao.ReserveStock(user.ID, quantities); err != nil {
+			return toError(err, "dao.ReserveStock")
+		}
+
+		now := s.now().UTC()
+		order = &Order{
+			UserID:        user.ID,
+			Lines:         cart.Checkout,
+			Adjustments:   cart.Adjustments,
+			Promotions:    applied,
+			Coupon:        cart.Coupon,
+			TotalPrice:    cart.TotalPrice,
+			TotalDiscount: cart.TotalDiscount,
+			Status:        OrderStatusCompleted,
+			CreatedAt:     now,
+			UpdatedAt:     now,
+		}
+		// the stock reserved is given back with the rest of the update when the order fails
+		if err := dao.CreateOrder(order); err != nil {
+			return toError(err, "dao.CreateOrder")
+		}
+
+		// the stored cart was emptied with the order, even if saving this copy fails it can't be bought twice
+		cart.clear()
+		return nil
+	})
+	if err != nil {
+		s.writeError(w, toError(err, "dao.UpdateCart"))
+		return
+	}
+	s.writeJSON(w, struct {
+		Order *Order `json:"order"`
+	}{Order: order})
+}
+
+// HandleGetOrders gets the purchase history of a user
+func (s *Service) HandleGetOrders(w http.ResponseWriter, r *http.Request) {
+	user, ctxErr := getUserFromContext(r.Context())
+	if ctxErr != nil {
+		s.writeError(w, ctxErr)
+		return
+	}
+
+	orders, err := s.dao.GetOrdersByUserID(user.ID)
+	if err != nil {
+		s.writeError(w, toError(err, "dao.GetOrdersByUserID"))
+		return
+	}
+	s.writeJSON(w, struct {
+		Orders []*Order `json:"orders"`
+	}{Orders: orders})
+}
+
+// HandleGetOrder gets a single order made by the user
+func (s *Service) HandleGetOrder(w http.ResponseWriter, r *http.Request) {
+	user, ctxErr := getUserFromContext(r.Context())
+	if ctxErr != nil {
+		s.writeError(w, ctxErr)
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		s.writeError(w, errOrderNotFound.msg("invalid order id: "+err.Error()))
+		return
+	}
+	order, err := s.dao.GetOrder(id)
+	if err != nil {
+		s.writeError(w, toError(err, "dao.GetOrder"))
+		return
+	}
+	if order.UserID != user.ID { // don't leak other users' orders
+		s.writeError(w, errOrderNotFound.msg("order belongs to another user"))
+		return
+	}
+	s.writeJSON(w, struct {
+		Order *Order `json:"order"`
+	}{Order: order})
 }
 
 func (s *Service) writeError(w http.ResponseWriter, e *Error) {
@@ -333,12 +1008,13 @@ func (s *Service) writeJSON(w http.ResponseWriter, i interface{}) {
 	w.Write(js)
 }
 
-func rand10letterString() string {
-	b := make([]rune, 10)
-	for i := range b {
-		b[i] = letterRunes[rand.Intn(len(letterRunes))]
+// cartName returns the name of the cart in the path
+func cartName(r *http.Request) (string, *Error) {
+	name := mux.Vars(r)["name"]
+	if err := checkCartName(name); err != nil {
+		return "", err
 	}
-	return string(b)
+	return name, nil
 }
 
 func getUserFromContext(ctx context.Context) (*User, *Error) {
@@ -0,0 +1,352 @@
+package shopping
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestService returns a service with the spec catalog and promotions stored in dao
+func newTestService(t *testing.T, dao DAO, options ...Option) *Service {
+	t.Helper()
+	s := New(append([]Option{SetDAO(dao)}, options...)...)
+	if err := s.InitInventory(testCatalog()); err != nil {
+		t.Fatal(err)
+	}
+	promotions := []*Promotion{}
+	for _, p := range testPromotions() {
+		promotions = append(promotions, p)
+	}
+	if err := s.InitPromotions(promotions); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// asUser returns the request as made by user once authenticated
+func asUser(r *http.Request, user *User) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), ctxUser, user))
+}
+
+// serve calls handler with the request and returns the response
+func serve(handler http.HandlerFunc, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestSimulatePromotions(t *testing.T) {
+	s := newTestService(t, NewMemory())
+	body := `{"items": [{"product_id": 2, "quantity": 3}, {"product_id": 6, "quantity": 2}]}`
+	w := serve(s.HandleSimulatePromotions, httptest.NewRequest(http.MethodPost, "/v1/shopping/promotions/simulate", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	res := struct {
+		Cart       *Cart        `json:"cart"`
+		Promotions []*Promotion `json:"promotions"`
+	}{}
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Cart.TotalPrice.Amount != 18500 || len(res.Promotions) != 2 {
+		t.Errorf("total %v with %d promotions, want 185.00 USD with 2", res.Cart.TotalPrice, len(res.Promotions))
+	}
+}
+
+func TestSimulateCandidatePromotionsInAnotherCurrency(t *testing.T) {
+	for _, action := range []string{
+		`{"type": "fixed_off", "amount": {"amount": 500, "currency": "EUR"}}`,
+		`{"type": "fixed_price", "amount": {"amount": 500, "currency": "EUR"}}`,
+		`{"type": "cart_fixed_off", "amount": {"amount": 500, "currency": "EUR"}}`,
+	} {
+		for _, options := range [][]Option{nil, {SetCurrencies(&ExchangeRates{Base: "USD", Rates: map[string]float64{"EUR": 0.92}})}} {
+			s := newTestService(t, NewMemory(), options...)
+			body := `{"items": [{"product_id": 2, "quantity": 1}], "promotions": [{"id": 1, "action": ` + action + `}]}`
+			w := serve(s.HandleSimulatePromotions, httptest.NewRequest(http.MethodPost, "/v1/shopping/promotions/simulate", strings.NewReader(body)))
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("%s with rates %t: status %d, want 400: %s", action, options != nil, w.Code, w.Body)
+			}
+		}
+	}
+}
+
+func TestMaxLineQuantity(t *testing.T) {
+	dao := NewMemory()
+	s := newTestService(t, dao, SetMaxLineQuantity(3))
+	user := &User{Username: "shopper"}
+	if err := dao.CreateUser(user); err != nil {
+		t.Fatal(err)
+	}
+	add := func(quantity string) int {
+		r := httptest.NewRequest(http.MethodPost, "/v1/shopping/cart/add", strings.NewReader(`{"product_id": 1, "quantity": `+quantity+`}`))
+		return serve(s.HandleCartAddItem, asUser(r, user)).Code
+	}
+
+	if code := add("2"); code != http.StatusOK {
+		t.Errorf("adding 2 belts: status %d, want 200", code)
+	}
+	if code := add("2"); code != http.StatusBadRequest {
+		t.Errorf("adding 2 more belts: status %d, want 400", code)
+	}
+	if code := add("1"); code != http.StatusOK {
+		t.Errorf("adding the third belt: status %d, want 200", code)
+	}
+}
+
+func TestBuyShortStock(t *testing.T) {
+	for _, tt := range testDAOs {
+		t.Run(tt.name, func(t *testing.T) {
+			dao := tt.new(t)
+			s := newTestService(t, dao)
+			user := &User{Username: "shopper"}
+			if err := dao.CreateUser(user); err != nil {
+				t.Fatal(err)
+			}
+			// the cart was filled when there was more stock: 3 suits and 2 shoes with 2 and 1 left
+			cart, err := dao.GetCartByUserID(user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cart.Products = testCart(map[int]int{1: 1, 3: 3, 5: 2}).Products
+			if err := dao.SetCart(cart); err != nil {
+				t.Fatal(err)
+			}
+
+			w := serve(s.HandleCartBuy, asUser(httptest.NewRequest(http.MethodPost, "/v1/shopping/cart/buy", nil), user))
+			if w.Code != http.StatusConflict {
+				t.Fatalf("status %d, want 409: %s", w.Code, w.Body)
+			}
+			res := struct {
+				Details []*StockShortage `json:"details"`
+			}{}
+			if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+				t.Fatal(err)
+			}
+			want := []StockShortage{{ProductID: 3, Requested: 3, Available: 2}, {ProductID: 5, Requested: 2, Available: 1}}
+			if len(res.Details) != len(want) {
+				t.Fatalf("shortages = %d, want %d", len(res.Details), len(want))
+			}
+			for i, shortage := range res.Details {
+				if *shortage != want[i] {
+					t.Errorf("shortage %d = %+v, want %+v", i, shortage, want[i])
+				}
+			}
+
+			products, err := dao.GetProducts()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range testCatalog() {
+				if products[p.ID].Stock != p.Stock {
+					t.Errorf("%s has stock %d, want %d", p.Name, products[p.ID].Stock, p.Stock)
+				}
+			}
+			if cart, err := dao.GetCartByUserID(user.ID); err != nil || len(cart.Products) != 3 {
+				t.Errorf("cart = %+v, %v, want it kept", cart, err)
+			}
+			if orders, err := dao.GetOrdersByUserID(user.ID); err != nil || len(orders) != 0 {
+				t.Errorf("%d orders, %v, want none", len(orders), err)
+			}
+		})
+	}
+}
+
+func TestStockHoldsExpire(t *testing.T) {
+	for _, tt := range testDAOs {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			now := time.Now()
+			clock := func() time.Time {
+				mu.Lock()
+				defer mu.Unlock()
+				return now
+			}
+			dao := tt.new(t)
+			s := newTestService(t, dao, SetStockHold(time.Minute), SetClock(clock))
+			alice, bob := &User{Username: "alice"}, &User{Username: "bob"}
+			for _, user := range []*User{alice, bob} {
+				if err := dao.CreateUser(user); err != nil {
+					t.Fatal(err)
+				}
+			}
+			add := func(user *User, quantity string) int {
+				r := httptest.NewRequest(http.MethodPost, "/v1/shopping/cart/add", strings.NewReader(`{"product_id": 1, "quantity": `+quantity+`}`))
+				return serve(s.HandleCartAddItem, asUser(r, user)).Code
+			}
+			available := func() int {
+				t.Helper()
+				w := serve(s.HandleGetProducts, httptest.NewRequest(http.MethodGet, "/v1/products", nil))
+				res := struct {
+					Products Products `json:"products"`
+				}{}
+				if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+					t.Fatal(err)
+				}
+				return res.Products[1].Available
+			}
+
+			if code := add(alice, "3"); code != http.StatusOK {
+				t.Fatalf("alice adding 3 belts: status %d", code)
+			}
+			if n := available(); n != 7 {
+				t.Errorf("%d belts available with 3 held by alice, want 7", n)
+			}
+			if code := add(bob, "8"); code != http.StatusConflict {
+				t.Errorf("bob adding 8 belts: status %d, want 409", code)
+			}
+
+			mu.Lock()
+			now = now.Add(2 * time.Minute)
+			mu.Unlock()
+			stop := make(chan struct{})
+			done := make(chan struct{})
+			go func() {
+				s.SweepExpiredHolds(10*time.Millisecond, stop)
+				close(done)
+			}()
+			for deadline := time.Now().Add(5 * time.Second); available() != 10; time.Sleep(10 * time.Millisecond) {
+				if time.Now().After(deadline) {
+					t.Fatal("the expired hold of alice was never released")
+				}
+			}
+			close(stop)
+			<-done
+
+			if code := add(bob, "8"); code != http.StatusOK {
+				t.Errorf("bob adding 8 belts once alice's hold expired: status %d, want 200", code)
+			}
+			if n := available(); n != 2 {
+				t.Errorf("%d belts available with 8 held by bob, want 2", n)
+			}
+		})
+	}
+}
+
+func TestCartCoupons(t *testing.T) {
+	for _, tt := range testDAOs {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+			clock := func() time.Time {
+				mu.Lock()
+				defer mu.Unlock()
+				return now
+			}
+			dao := tt.new(t)
+			s := newTestService(t, dao, SetClock(clock))
+			expired, tomorrow := now.Add(-time.Hour), now.AddDate(0, 0, 1)
+			err := s.InitCoupons([]*Coupon{
+				{Code: "EXPIRED", ExpiresAt: &expired},
+				{Code: "TODAY", ExpiresAt: &tomorrow},
+				{Code: "BIG", MinSpend: &Money{Amount: 10000, Currency: "USD"}},
+				{Code: "MINE", MaxPerUser: 1},
+				{Code: "ONCE", MaxRedemptions: 1},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			alice, bob := &User{Username: "alice"}, &User{Username: "bob"}
+			for _, user := range []*User{alice, bob} {
+				if err := dao.CreateUser(user); err != nil {
+					t.Fatal(err)
+				}
+			}
+			fill := func(user *User) {
+				t.Helper()
+				cart, err := dao.GetCartByUserID(user.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				cart.Products = testCart(map[int]int{2: 1}).Products
+				if err := dao.SetCart(cart); err != nil {
+					t.Fatal(err)
+				}
+			}
+			apply := func(user *User, code string) *httptest.ResponseRecorder {
+				r := httptest.NewRequest(http.MethodPost, "/v1/shopping/cart/coupon", strings.NewReader(`{"code": "`+code+`"}`))
+				return serve(s.HandleCartApplyCoupon, asUser(r, user))
+			}
+			buy := func(user *User) *httptest.ResponseRecorder {
+				return serve(s.HandleCartBuy, asUser(httptest.NewRequest(http.MethodPost, "/v1/shopping/cart/buy", nil), user))
+			}
+			is := func(w *httptest.ResponseRecorder, want *Error) bool {
+				return w.Code == want.Code && strings.Contains(w.Body.String(), want.Message)
+			}
+
+			// a shirt costs 60
+			fill(alice)
+			for code, want := range map[string]*Error{"MISSING": errCouponNotFound, "EXPIRED": errBadRequestCouponExpired, "BIG": errBadRequestCouponMinSpend} {
+				if w := apply(alice, code); !is(w, want) {
+					t.Errorf("applying %s: status %d: %s, want %d %q", code, w.Code, w.Body, want.Code, want.Message)
+				}
+			}
+
+			// the coupon expires between entering it and buying
+			if w := apply(alice, "today"); w.Code != http.StatusOK {
+				t.Fatalf("applying TODAY: status %d: %s", w.Code, w.Body)
+			}
+			mu.Lock()
+			now = now.AddDate(0, 0, 2)
+			mu.Unlock()
+			if w := buy(alice); !is(w, errBadRequestCouponExpired) {
+				t.Errorf("buying with an expired coupon: status %d: %s", w.Code, w.Body)
+			}
+
+			// each user can redeem MINE once
+			if w := apply(alice, "mine"); w.Code != http.StatusOK {
+				t.Fatalf("applying MINE: status %d: %s", w.Code, w.Body)
+			}
+			if w := buy(alice); w.Code != http.StatusOK {
+				t.Fatalf("buying with MINE: status %d: %s", w.Code, w.Body)
+			}
+			fill(alice)
+			if w := apply(alice, "mine"); !is(w, errConflictCouponLimit) {
+				t.Errorf("applying MINE again: status %d: %s", w.Code, w.Body)
+			}
+			fill(bob)
+			if w := apply(bob, "mine"); w.Code != http.StatusOK {
+				t.Errorf("bob applying MINE: status %d: %s", w.Code, w.Body)
+			}
+
+			// both enter ONCE while nobody has redeemed it and buy at the same time, the limit is checked again
+			for _, user := range []*User{alice, bob} {
+				if w := apply(user, "once"); w.Code != http.StatusOK {
+					t.Fatalf("%s applying ONCE: status %d: %s", user.Username, w.Code, w.Body)
+				}
+			}
+			results := make(chan *httptest.ResponseRecorder, 2)
+			for _, user := range []*User{alice, bob} {
+				go func(user *User) { results <- buy(user) }(user)
+			}
+			bought := 0
+			for i := 0; i < 2; i++ {
+				w := <-results
+				switch {
+				case w.Code == http.StatusOK:
+					bought++
+				case !is(w, errConflictCouponLimit):
+					t.Errorf("racing buy: status %d: %s", w.Code, w.Body)
+				}
+			}
+			if bought != 1 {
+				t.Errorf("%d buys with ONCE went through, want 1", bought)
+			}
+			if coupon, err := dao.GetCoupon("once"); err != nil || coupon.Redeemed != 1 {
+				t.Errorf("ONCE = %+v, %v, want it redeemed once", coupon, err)
+			}
+			products, err := dao.GetProducts()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stock := products[2].Stock; stock != 3 {
+				t.Errorf("%d shirts in stock after 2 buys, want 3", stock)
+			}
+		})
+	}
+}
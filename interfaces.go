@@ -1,5 +1,7 @@
 package shopping
 
+import "time"
+
 // DAO is the Data Access Object interface
 // that will describe the way to read/write from a data service
 //e.g. a Database or in-memory
@@ -8,16 +10,136 @@ type DAO interface {
 	SetPromotions([]*Promotion) error
 	SetUsers([]*User) error
 
+	// GetProducts returns every product, the catalog can be empty
 	GetProducts() (Products, error)
+	// UpdateProducts saves the products, the ones missing from the map are kept
 	UpdateProducts(Products) error
+	// CreateProduct must give the product the next free ID when it has none
+	// and fail if another product has its ID
+	CreateProduct(product *Product) error
+	// UpdateProduct must apply fn and save the product atomically, fn must not call the DAO.
+	// fn gets the product with Available set so it can tell how much stock is held,
+	// nothing is saved if fn leaves less stock than is held.
+	UpdateProduct(id int, fn func(*Product) error) (*Product, error)
+	// DeleteProduct removes the product and any stock held of it
+	DeleteProduct(id int) error
+	// ReserveStock must decrement the stock of every product by the quantity requested, keyed by product ID,
+	// as a single operation. Stock held by other users is not available, holds of the user are consumed.
+	// If any product is short nothing is changed and the error lists the shortages.
+	ReserveStock(userID int, quantities map[int]int) error
+	// ReleaseStock gives back stock that was reserved but not used
+	ReleaseStock(quantities map[int]int) error
+
+	// HoldStock must replace the user's hold on the product, a hold with no quantity removes it.
+	// It fails listing the shortage if the product doesn't have enough stock without other users' holds.
+	HoldStock(hold *StockHold) error
+	ReleaseHolds(userID int) error
+	// ReleaseExpiredHolds removes holds expiring before now and returns how many were removed
+	ReleaseExpiredHolds(now time.Time) (int, error)
 
+	// GetPromotions returns every promotion, disabled ones included
 	GetPromotions() (Promotions, error)
+	// CreatePromotion must give the promotion the next free ID when it has none
+	// and fail if another promotion has its ID
+	CreatePromotion(promotion *Promotion) error
+	// UpdatePromotion must apply fn and save the promotion atomically, fn must not call the DAO
+	UpdatePromotion(id int, fn func(*Promotion) error) (*Promotion, error)
+	DeletePromotion(id int) error
+
+	SetCoupons([]*Coupon) error
+	// GetCoupon returns the coupon with the number of times it has been redeemed, codes are case insensitive
+	GetCoupon(code string) (*Coupon, error)
+	// CountRedemptions returns how many times the user has redeemed the coupon
+	CountRedemptions(code string, userID int) (int, error)
 
 	SetUser(user *User) error
+	// CreateUser must give the user the next free ID when it has none, fail if another user has its ID, username
+	// or subject and give the user an empty cart
+	CreateUser(user *User) error
+	// GetUser returns errUserNotFound when no user has the username
 	GetUser(username string) (*User, error)
-	GetUserByToken(token string) (*User, error)
+	// GetUserByID returns errUserNotFound when no user has the ID
+	GetUserByID(id int) (*User, error)
+	// GetUserBySubject returns errUserNotFound when no user has the subject of the identity provider
+	GetUserBySubject(subject string) (*User, error)
+	// CreateGuest must create the guest like CreateUser and store the session of its cart token for it as a single
+	// operation
+	CreateGuest(user *User, token *AccessToken) error
+	// DeleteGuest removes a guest with its cart, stock holds and sessions,
+	// it returns errUserNotFound when there's no guest with the ID
+	DeleteGuest(id int) error
+	// DeleteExpiredGuests removes the guests without sessions lasting until now like DeleteGuest
+	// and returns how many were removed
+	DeleteExpiredGuests(now time.Time) (int, error)
+
+	// CreateAccessToken stores a new session, sessions are looked up by the hash of their token
+	CreateAccessToken(token *AccessToken) error
+	// GetAccessToken returns errAccessTokenNotFound when no session has the hash
+	GetAccessToken(hash string) (*AccessToken, error)
+	// RevokeAccessToken marks the session as revoked at the given time
+	RevokeAccessToken(hash string, at time.Time) error
+	// DeleteExpiredAccessTokens removes sessions expiring before now and returns how many were removed
+	DeleteExpiredAccessTokens(now time.Time) (int, error)
+
+	CreateRefreshToken(token *RefreshToken) error
+	// RotateRefreshToken must mark the token with the hash as used and store next with the user and family of that
+	// token as a single operation. It fails with errInvalidRefreshToken when the token doesn't exist, is revoked or
+	// expired at next.IssuedAt, or was used before, in which case every token of its family is revoked.
+	RotateRefreshToken(hash string, next *RefreshToken) error
+	// RevokeRefreshTokens revokes the token with the hash and every other token of its family
+	RevokeRefreshTokens(hash string, at time.Time) error
+	// DeleteExpiredRefreshTokens removes tokens expiring before now and returns how many were removed
+	DeleteExpiredRefreshTokens(now time.Time) (int, error)
+
+	// GetLoginFailures returns the failed logins counted under the key, with a count of 0 when there are none
+	GetLoginFailures(key string) (*LoginFailures, error)
+	// ReserveLoginAttempt must, as a single operation, call check with the failures counted under the keys and,
+	// unless it fails, count a failed login under every key so concurrent logins can't all get past check. A count
+	// starts over when the last failure was resetAfter ago or longer. It returns the new counts in the order of keys.
+	ReserveLoginAttempt(keys []string, at time.Time, resetAfter time.Duration, check func([]*LoginFailures) error) ([]*LoginFailures, error)
+	// ReleaseLoginAttempt takes back a failed login counted under the key by ReserveLoginAttempt
+	ReleaseLoginAttempt(key string) error
+	// ClearLoginFailures forgets the failed logins under the key
+	ClearLoginFailures(key string) error
+	// DeleteStaleLoginFailures removes the failures whose last one was before the given time and returns how many
+	// were removed
+	DeleteStaleLoginFailures(before time.Time) (int, error)
 
 	GetCart(id int) (*Cart, error)
+	// GetCartByUserID returns the active cart of the user
 	GetCartByUserID(userID int) (*Cart, error)
 	SetCart(cart *Cart) error
+	// UpdateCart must apply fn and save the user's active cart atomically. fn makes its other changes through the
+	// CartDAO it's given so they're saved with the cart, or undone with it when fn or saving the cart fails.
+	UpdateCart(userID int, fn func(CartDAO, *Cart) error) (*Cart, error)
+	// GetCarts returns every cart of the user, the active one and the named ones, sorted by ID
+	GetCarts(userID int) ([]*Cart, error)
+	// UpdateCarts must apply fn to the carts of the user by name and save them all atomically, carts fn adds to the
+	// map are created for the user. Updates are serialised with UpdateCart and save or undo the changes of fn like it.
+	UpdateCarts(userID int, fn func(CartDAO, map[string]*Cart) error) (map[string]*Cart, error)
+	// DeleteCart removes the user's cart with the name, it returns errCartNotFound when there's none
+	DeleteCart(userID int, name string) error
+	// GetCartsWithProduct returns the carts with the name that have the product
+	GetCartsWithProduct(name string, productID int) ([]*Cart, error)
+
+	// CreateOrder must assign a new ID to the order and empty the active cart of its user. When the order has a coupon
+	// it must check the coupon's redemption limits and record the redemption, failing if a limit has been reached.
+	// All of it is a single operation so a cart that was bought can't be bought again.
+	CreateOrder(order *Order) error
+	GetOrder(id int) (*Order, error)
+	// GetOrdersByUserID returns orders sorted from oldest to newest
+	GetOrdersByUserID(userID int) ([]*Order, error)
+}
+
+// CartDAO is what fn can change while UpdateCart or UpdateCarts hold the user's carts. Its changes are saved with the
+// carts, or undone with them when fn or saving fails, and the carts of other users it updates stay locked until then.
+type CartDAO interface {
+	// UpdateCart updates another user's cart as part of the same update, fn failing only undoes its own changes
+	UpdateCart(userID int, fn func(CartDAO, *Cart) error) (*Cart, error)
+	ReserveStock(userID int, quantities map[int]int) error
+	ReleaseStock(quantities map[int]int) error
+	HoldStock(hold *StockHold) error
+	ReleaseHolds(userID int) error
+	CreateOrder(order *Order) error
+	DeleteGuest(id int) error
 }
@@ -0,0 +1,196 @@
+package shopping
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+const (
+	// JWTHS256 signs access tokens with HMAC SHA-256 and a shared secret
+	JWTHS256 = "HS256"
+	// JWTEdDSA signs access tokens with an Ed25519 private key
+	JWTEdDSA = "EdDSA"
+)
+
+const (
+	minJWTSecretBytes = 32
+	ed25519SeedSize   = 32
+	defaultJWTTTL     = 15 * time.Minute
+)
+
+// JWTConfig makes the service hand out signed JWTs as access tokens, they're checked without looking them up so
+// several instances can share them as long as they have the same keys
+type JWTConfig struct {
+	Algorithm  string `json:"algorithm"`             // HS256 or EdDSA
+	Secret     string `json:"secret,omitempty"`      // base64 HS256 key of at least 32 bytes
+	PrivateKey string `json:"private_key,omitempty"` // base64 Ed25519 seed of 32 bytes or private key of 64 bytes
+	Issuer     string `json:"issuer,omitempty"`      // iss claim, checked when set
+	Minutes    int    `json:"minutes,omitempty"`     // how long tokens last, 15 by default as they can't be revoked
+}
+
+// jwtClaims are the claims of the access tokens handed out, the subject is the user ID
+type jwtClaims struct {
+	Issuer    string `json:"iss,omitempty"`
+	Subject   string `json:"sub"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	Username  string `json:"username,omitempty"`
+}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+}
+
+// jwtSigner signs and verifies access tokens with the keys of a JWTConfig
+type jwtSigner struct {
+	algorithm string
+	secret    []byte
+	private   ed25519.PrivateKey
+	public    ed25519.PublicKey
+	issuer    string
+	ttl       time.Duration
+}
+
+func newJWTSigner(c *JWTConfig) (*jwtSigner, error) {
+	j := &jwtSigner{algorithm: c.Algorithm, issuer: c.Issuer, ttl: defaultJWTTTL}
+	if c.Minutes < 0 {
+		return nil, errors.New("jwt minutes can't be negative")
+	}
+	if c.Minutes > 0 {
+		j.ttl = time.Duration(c.Minutes) * time.Minute
+	}
+	switch c.Algorithm {
+	case JWTHS256:
+		secret, err := base64.StdEncoding.DecodeString(c.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("invalid jwt secret: %v", err)
+		}
+		if len(secret) < minJWTSecretBytes {
+			return nil, fmt.Errorf("jwt secret must be at least %d bytes", minJWTSecretBytes)
+		}
+		j.secret = secret
+	case JWTEdDSA:
+		key, err := base64.StdEncoding.DecodeString(c.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid jwt private key: %v", err)
+		}
+		switch len(key) {
+		case ed25519SeedSize:
+			// the key is derived from the 32 bytes read, the same way it's done from a random seed
+			_, j.private, err = ed25519.GenerateKey(bytes.NewReader(key))
+			if err != nil {
+				return nil, fmt.Errorf("invalid jwt private key: %v", err)
+			}
+		case ed25519.PrivateKeySize:
+			j.private = ed25519.PrivateKey(key)
+		default:
+			return nil, fmt.Errorf("jwt private key must be %d or %d bytes", ed25519SeedSize, ed25519.PrivateKeySize)
+		}
+		j.public = j.private.Public().(ed25519.PublicKey)
+	default:
+		return nil, fmt.Errorf("unknown jwt algorithm %q, use %s or %s", c.Algorithm, JWTHS256, JWTEdDSA)
+	}
+	return j, nil
+}
+
+// sign returns a token for the user that expires after the signer's ttl
+func (j *jwtSigner) sign(user *User, now time.Time) (string, time.Time, error) {
+	expiresAt := now.Add(j.ttl)
+	header, err := json.Marshal(jwtHeader{Algorithm: j.algorithm, Type: "JWT"})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	claims, err := json.Marshal(jwtClaims{
+		Issuer:    j.issuer,
+		Subject:   strconv.Itoa(user.ID),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expiresAt.Unix(),
+		Username:  user.Username,
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(j.signature(signed)), expiresAt, nil
+}
+
+func (j *jwtSigner) signature(signed string) []byte {
+	if j.algorithm == JWTEdDSA {
+		return ed25519.Sign(j.private, []byte(signed))
+	}
+	mac := hmac.New(sha256.New, j.secret)
+	mac.Write([]byte(signed))
+	return mac.Sum(nil)
+}
+
+// verify checks the token was signed with the signer's key and algorithm and hasn't expired,
+// it returns the ID of the user it was issued to
+func (j *jwtSigner) verify(token string, now time.Time) (int, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return 0, errors.New("malformed jwt")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return 0, fmt.Errorf("malformed jwt signature: %v", err)
+	}
+
+	header := jwtHeader{}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return 0, fmt.Errorf("malformed jwt header: %v", err)
+	}
+	// the algorithm is never taken from the token so it can't pick a weaker one, e.g. none
+	if header.Algorithm != j.algorithm {
+		return 0, fmt.Errorf("jwt signed with %q instead of %s", header.Algorithm, j.algorithm)
+	}
+	signed := parts[0] + "." + parts[1]
+	valid := false
+	if j.algorithm == JWTEdDSA {
+		valid = ed25519.Verify(j.public, []byte(signed), signature)
+	} else {
+		valid = hmac.Equal(signature, j.signature(signed))
+	}
+	if !valid {
+		return 0, errors.New("invalid jwt signature")
+	}
+
+	claims := jwtClaims{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return 0, fmt.Errorf("malformed jwt claims: %v", err)
+	}
+	if j.issuer != "" && claims.Issuer != j.issuer {
+		return 0, fmt.Errorf("jwt issued by %q instead of %q", claims.Issuer, j.issuer)
+	}
+	if now.Unix() >= claims.ExpiresAt {
+		return 0, fmt.Errorf("jwt expired at %s", time.Unix(claims.ExpiresAt, 0).UTC().Format(time.RFC3339))
+	}
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return 0, fmt.Errorf("invalid jwt subject %q", claims.Subject)
+	}
+	return userID, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// isJWT reports if token is a JWT rather than an opaque access token, those never have dots
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
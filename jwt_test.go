@@ -0,0 +1,164 @@
+package shopping
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testJWTConfigs have a key of every algorithm
+var testJWTConfigs = map[string]*JWTConfig{
+	JWTHS256: {Algorithm: JWTHS256, Secret: base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))},
+	JWTEdDSA: {Algorithm: JWTEdDSA, PrivateKey: base64.StdEncoding.EncodeToString([]byte("fedcba9876543210fedcba9876543210"))},
+}
+
+func newTestJWTSigner(t *testing.T, c *JWTConfig) *jwtSigner {
+	t.Helper()
+	j, err := newJWTSigner(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return j
+}
+
+func TestJWTRoundTrip(t *testing.T) {
+	now := time.Unix(1760000000, 0)
+	for algorithm, c := range testJWTConfigs {
+		j := newTestJWTSigner(t, c)
+		token, expiresAt, err := j.sign(&User{ID: 7, Username: "shopper"}, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !isJWT(token) || !expiresAt.Equal(now.Add(defaultJWTTTL)) {
+			t.Errorf("%s: signed %q expiring at %s", algorithm, token, expiresAt)
+		}
+		if id, err := j.verify(token, now); err != nil || id != 7 {
+			t.Errorf("%s: verify = %d, %v, want 7", algorithm, id, err)
+		}
+		if id, err := j.verify(token, expiresAt.Add(-time.Second)); err != nil || id != 7 {
+			t.Errorf("%s: verify a second before it expires = %d, %v, want 7", algorithm, id, err)
+		}
+		if _, err := j.verify(token, expiresAt); err == nil {
+			t.Errorf("%s: expired token was accepted", algorithm)
+		}
+	}
+}
+
+func TestJWTRejects(t *testing.T) {
+	now := time.Unix(1760000000, 0)
+	user := &User{ID: 7, Username: "shopper"}
+	encode := func(v interface{}) string {
+		data, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+
+	for algorithm, c := range testJWTConfigs {
+		j := newTestJWTSigner(t, c)
+		parts := strings.Split(mustSign(t, c, user, now), ".")
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		signature[0] ^= 1
+		claims := jwtClaims{}
+		if err := decodeJWTPart(parts[1], &claims); err != nil {
+			t.Fatal(err)
+		}
+		claims.Subject = "1"
+
+		other := JWTHS256
+		if algorithm == JWTHS256 {
+			other = JWTEdDSA
+		}
+		otherParts := strings.Split(mustSign(t, testJWTConfigs[other], user, now), ".")
+		issued := *c
+		issued.Issuer = "another shop"
+
+		tokens := map[string]string{
+			"tampered signature": parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString(signature),
+			"tampered claims":    parts[0] + "." + encode(claims) + "." + parts[2],
+			"no signature":       parts[0] + "." + parts[1] + ".",
+			"other algorithm":    strings.Join(otherParts, "."),
+			"header of another":  otherParts[0] + "." + parts[1] + "." + parts[2],
+			"unsigned":           encode(jwtHeader{Algorithm: "none", Type: "JWT"}) + "." + parts[1] + ".",
+			"malformed":          parts[0] + "." + parts[1],
+		}
+		if j.public != nil {
+			// signed with HMAC using the public key as the secret, accepted if the algorithm was taken from the token
+			tokens["key confusion"] = mustSign(t, &JWTConfig{Algorithm: JWTHS256, Secret: base64.StdEncoding.EncodeToString(j.public)}, user, now)
+		}
+		for name, token := range tokens {
+			if _, err := j.verify(token, now); err == nil {
+				t.Errorf("%s: %s token was accepted", algorithm, name)
+			}
+		}
+
+		// the issuer is only checked when the signer has one
+		if _, err := newTestJWTSigner(t, &issued).verify(strings.Join(parts, "."), now); err == nil {
+			t.Errorf("%s: token without the issuer was accepted", algorithm)
+		}
+	}
+}
+
+// mustSign returns a token for user signed with the keys of c
+func mustSign(t *testing.T, c *JWTConfig, user *User, now time.Time) string {
+	t.Helper()
+	token, _, err := newTestJWTSigner(t, c).sign(user, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestJWTConfig(t *testing.T) {
+	for name, c := range map[string]*JWTConfig{
+		"unknown algorithm": {Algorithm: "RS256"},
+		"short secret":      {Algorithm: JWTHS256, Secret: base64.StdEncoding.EncodeToString([]byte("short"))},
+		"secret not base64": {Algorithm: JWTHS256, Secret: "not base64!"},
+		"short private key": {Algorithm: JWTEdDSA, PrivateKey: base64.StdEncoding.EncodeToString([]byte("short"))},
+		"negative minutes":  {Algorithm: JWTHS256, Secret: testJWTConfigs[JWTHS256].Secret, Minutes: -1},
+	} {
+		if _, err := newJWTSigner(c); err == nil {
+			t.Errorf("%s: config was accepted", name)
+		}
+	}
+}
+
+func TestJWTAccessTokens(t *testing.T) {
+	var mu sync.Mutex
+	now := time.Now()
+	clock := func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	dao := NewMemory()
+	s := newTestService(t, dao, SetClock(clock), SetJWT(testJWTConfigs[JWTEdDSA]))
+	user := &User{Username: "shopper"}
+	if err := dao.CreateUser(user); err != nil {
+		t.Fatal(err)
+	}
+	pair, err := s.issueTokens(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isJWT(pair.Token) {
+		t.Fatalf("access token %q isn't a JWT", pair.Token)
+	}
+	status := func(token string) int {
+		w := httptest.NewRecorder()
+		protect(s, RoleCustomer).ServeHTTP(w, authorized(token))
+		return w.Code
+	}
+	if code := status(pair.Token); code != http.StatusOK {
+		t.Errorf("JWT: status %d, want 200", code)
+	}
+	mu.Lock()
+	now = now.Add(defaultJWTTTL)
+	mu.Unlock()
+	if code := status(pair.Token); code != http.StatusUnauthorized {
+		t.Errorf("expired JWT: status %d, want 401", code)
+	}
+}
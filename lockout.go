@@ -0,0 +1,240 @@
+package shopping
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultLockoutThreshold   = 5
+	defaultLockoutIPThreshold = 20
+	defaultLockoutBackoff     = time.Second
+	defaultLockoutDuration    = 15 * time.Minute
+	defaultLockoutReset       = time.Hour
+
+	// maxBackoffShift stops the backoff from overflowing, it's capped by the lockout duration long before
+	maxBackoffShift = 30
+)
+
+// LockoutConfig slows down guessing passwords. Every failed login of a username makes its next one wait twice as long
+// as the previous one and enough failures lock it out for a while. An IP address is slowed down the same way once it
+// has failed more than threshold times. Fields left at 0 take the default values.
+type LockoutConfig struct {
+	Threshold      int `json:"threshold,omitempty"`       // failed logins of a username before it's locked out, 5 by default
+	IPThreshold    int `json:"ip_threshold,omitempty"`    // failed logins from an IP address before it's locked out, 20 by default
+	BackoffSeconds int `json:"backoff_seconds,omitempty"` // wait after the first failure, 1 by default
+	Minutes        int `json:"minutes,omitempty"`         // how long a lockout lasts, and the longest wait, 15 by default
+	ResetMinutes   int `json:"reset_minutes,omitempty"`   // failures are forgotten this long after the last one, 60 by default
+}
+
+// lockoutPolicy is a LockoutConfig with the defaults filled in
+type lockoutPolicy struct {
+	threshold   int
+	ipThreshold int
+	backoff     time.Duration
+	duration    time.Duration
+	reset       time.Duration
+}
+
+var defaultLockoutPolicy = lockoutPolicy{
+	threshold:   defaultLockoutThreshold,
+	ipThreshold: defaultLockoutIPThreshold,
+	backoff:     defaultLockoutBackoff,
+	duration:    defaultLockoutDuration,
+	reset:       defaultLockoutReset,
+}
+
+func newLockoutPolicy(c *LockoutConfig) (lockoutPolicy, error) {
+	p := defaultLockoutPolicy
+	if c.Threshold < 0 || c.IPThreshold < 0 || c.BackoffSeconds < 0 || c.Minutes < 0 || c.ResetMinutes < 0 {
+		return p, errors.New("lockout settings can't be negative")
+	}
+	if c.Threshold > 0 {
+		p.threshold = c.Threshold
+	}
+	if c.IPThreshold > 0 {
+		p.ipThreshold = c.IPThreshold
+	}
+	if c.BackoffSeconds > 0 {
+		p.backoff = time.Duration(c.BackoffSeconds) * time.Second
+	}
+	if c.Minutes > 0 {
+		p.duration = time.Duration(c.Minutes) * time.Minute
+	}
+	if c.ResetMinutes > 0 {
+		p.reset = time.Duration(c.ResetMinutes) * time.Minute
+	}
+	if p.ipThreshold <= p.threshold {
+		return p, fmt.Errorf("lockout ip_threshold (%d) must be higher than threshold (%d)", p.ipThreshold, p.threshold)
+	}
+	if p.reset < p.duration {
+		return p, fmt.Errorf("lockout reset_minutes (%s) can't be shorter than minutes (%s)", p.reset, p.duration)
+	}
+	return p, nil
+}
+
+// wait returns how long to wait from now before trying to log in again after the failures, the first free failures
+// don't make anyone wait and threshold failures lock out
+func (p lockoutPolicy) wait(f *LoginFailures, free, threshold int, now time.Time) time.Duration {
+	if f.Count <= free || now.Sub(f.Last) >= p.reset {
+		return 0
+	}
+	wait := p.duration
+	if f.Count < threshold {
+		shift := uint(f.Count - free - 1)
+		if shift > maxBackoffShift {
+			shift = maxBackoffShift
+		}
+		if backoff := p.backoff << shift; backoff < wait {
+			wait = backoff
+		}
+	}
+	return f.Last.Add(wait).Sub(now)
+}
+
+// loginAttempt is who is trying to log in, failures are counted both by username and by IP address
+type loginAttempt struct {
+	username string
+	ip       string
+	failures []*LoginFailures // of the username and the IP address once the attempt is reserved
+}
+
+func newLoginAttempt(username string, r *http.Request) *loginAttempt {
+	return &loginAttempt{username: username, ip: clientIP(r)}
+}
+
+func userLockoutKey(username string) string {
+	return "user:" + username
+}
+
+func (a *loginAttempt) userKey() string {
+	return userLockoutKey(a.username)
+}
+
+func (a *loginAttempt) ipKey() string {
+	return "ip:" + a.ip
+}
+
+// clientIP is the address the request comes from, IPv6 addresses are cut to their /64 network as anyone gets a whole
+// one of those
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if ip.To4() == nil {
+		return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+	}
+	return ip.String()
+}
+
+// errLoginWait stops a login attempt from being reserved
+var errLoginWait = errors.New("login has to wait")
+
+// reserveLoginAttempt fails with a 429 when the username or the IP address has to wait before trying again, it returns
+// how long. Otherwise the attempt is counted as a failure up front in the same operation, so parallel guesses can't all
+// get past the check before any of them fails, and clearLoginFailures takes it back if the password is right. It must
+// be called before checking the password so a locked out username can't be guessed.
+func (s *Service) reserveLoginAttempt(a *loginAttempt) (time.Duration, *Error) {
+	now := s.now().UTC()
+	var wait time.Duration
+	failures, err := s.dao.ReserveLoginAttempt([]string{a.userKey(), a.ipKey()}, now, s.lockout.reset, func(failures []*LoginFailures) error {
+		wait = s.lockout.wait(failures[0], 0, s.lockout.threshold, now)
+		// an address only waits once it has failed more than a username can, so users sharing it aren't slowed down
+		// by someone else's typos
+		if ipWait := s.lockout.wait(failures[1], s.lockout.threshold, s.lockout.ipThreshold, now); ipWait > wait {
+			wait = ipWait
+		}
+		if wait > 0 {
+			return errLoginWait
+		}
+		return nil
+	})
+	if err == errLoginWait {
+		return wait, tooManyLogins(wait, fmt.Sprintf("login of %s from %s has to wait %s", a.username, a.ip, wait))
+	}
+	if err != nil {
+		return 0, errInternalServerError.msg("dao.ReserveLoginAttempt: " + err.Error())
+	}
+	a.failures = failures
+	return 0, nil
+}
+
+// logLoginFailure logs when a failed login, already counted by reserveLoginAttempt, locks out the username or the
+// IP address
+func (s *Service) logLoginFailure(a *loginAttempt) {
+	if a.failures[0].Count == s.lockout.threshold {
+		log.WithField("username", a.username).WithField("ip", a.ip).Warnln("username locked out after failed logins")
+	}
+	if a.failures[1].Count == s.lockout.ipThreshold {
+		log.WithField("ip", a.ip).Warnln("ip address locked out after failed logins")
+	}
+}
+
+// clearLoginFailures forgets the failures of the username after it logs in and takes back the attempt reserved for
+// the IP address, its other failures are kept so logging in to one account doesn't allow more guesses on others
+func (s *Service) clearLoginFailures(a *loginAttempt) *Error {
+	if err := s.dao.ClearLoginFailures(a.userKey()); err != nil {
+		return errInternalServerError.msg("dao.ClearLoginFailures: " + err.Error())
+	}
+	if err := s.dao.ReleaseLoginAttempt(a.ipKey()); err != nil {
+		return errInternalServerError.msg("dao.ReleaseLoginAttempt: " + err.Error())
+	}
+	return nil
+}
+
+// releaseLoginAttempt takes back the attempt reserved for both the username and the IP address when the password
+// couldn't be checked, failing to is only logged as the login has already failed
+func (s *Service) releaseLoginAttempt(a *loginAttempt) {
+	for _, key := range []string{a.userKey(), a.ipKey()} {
+		if err := s.dao.ReleaseLoginAttempt(key); err != nil {
+			log.WithError(err).WithField("key", key).Errorln("failed to release login attempt")
+		}
+	}
+}
+
+// tooManyLogins returns a 429 telling the client how many seconds to wait in its details
+func tooManyLogins(wait time.Duration, message string) *Error {
+	e := errTooManyLogins.msg(message)
+	e.Details = struct {
+		RetryAfter int `json:"retry_after"`
+	}{RetryAfter: retryAfterSeconds(wait)}
+	return e
+}
+
+// retryAfterSeconds rounds wait up to whole seconds so clients never retry too early
+func retryAfterSeconds(wait time.Duration) int {
+	return int(math.Ceil(wait.Seconds()))
+}
+
+// SweepLoginFailures deletes failed logins that are old enough to be forgotten every interval until stop is closed
+func (s *Service) SweepLoginFailures(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			deleted, err := s.dao.DeleteStaleLoginFailures(s.now().UTC().Add(-s.lockout.reset))
+			if err != nil {
+				log.WithError(err).Errorln("failed to delete stale login failures")
+				continue
+			}
+			if deleted > 0 {
+				log.WithField("deleted", deleted).Infoln("deleted stale login failures")
+			}
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package shopping
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// loginRequest returns a login request with basic auth from the address
+func loginRequest(username, password, remoteAddr string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/v1/login", nil)
+	r.SetBasicAuth(username, password)
+	r.RemoteAddr = remoteAddr
+	return r
+}
+
+// newLoginService returns a service storing in dao with a user called shopper
+func newLoginService(t *testing.T, dao DAO) *Service {
+	t.Helper()
+	s := newTestService(t, dao)
+	hash, err := hashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dao.CreateUser(&User{Username: "shopper", Password: hash}); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestParallelLoginGuesses(t *testing.T) {
+	for name, dao := range map[string]func(t *testing.T) DAO{
+		"memory": func(t *testing.T) DAO { return NewMemory() },
+		"file": func(t *testing.T) DAO {
+			f, err := NewFile(tempDir(t), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return f
+		},
+	} {
+		s := newLoginService(t, dao(t))
+		codes := make(chan int, 20)
+		wg := sync.WaitGroup{}
+		for i := 0; i < cap(codes); i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				codes <- serve(s.HandleLogin, loginRequest("shopper", "wrong guess", "192.0.2.1:1234")).Code
+			}()
+		}
+		wg.Wait()
+		close(codes)
+
+		checked := 0
+		for code := range codes {
+			switch code {
+			case http.StatusUnauthorized:
+				checked++
+			case http.StatusTooManyRequests:
+			default:
+				t.Errorf("%s: status %d", name, code)
+			}
+		}
+		// the first guess makes the username wait a second, every other one comes in before that
+		if checked != 1 {
+			t.Errorf("%s: %d of %d parallel guesses were checked, want 1", name, checked, cap(codes))
+		}
+	}
+}
+
+func TestLoginTakesBackItsAttempt(t *testing.T) {
+	dao := NewMemory()
+	s := newLoginService(t, dao)
+	w := serve(s.HandleLogin, loginRequest("shopper", "correct horse", "192.0.2.1:1234"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	for _, key := range []string{userLockoutKey("shopper"), "ip:192.0.2.1"} {
+		f, err := dao.GetLoginFailures(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Count != 0 {
+			t.Errorf("%s has %d failures after logging in, want 0", key, f.Count)
+		}
+	}
+}
+
+// failingUserDAO fails to get any user
+type failingUserDAO struct {
+	DAO
+}
+
+func (d *failingUserDAO) GetUser(username string) (*User, error) {
+	return nil, errors.New("storage unavailable")
+}
+
+func TestLoginReleasesItsAttemptWhenUsersFail(t *testing.T) {
+	dao := NewMemory()
+	s := newLoginService(t, &failingUserDAO{DAO: dao})
+	for i := 0; i < 3; i++ {
+		w := serve(s.HandleLogin, loginRequest("shopper", "correct horse", "192.0.2.1:1234"))
+		if w.Code != http.StatusInternalServerError {
+			t.Fatalf("status %d: %s, want 500", w.Code, w.Body)
+		}
+	}
+	for _, key := range []string{userLockoutKey("shopper"), "ip:192.0.2.1"} {
+		f, err := dao.GetLoginFailures(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Count != 0 {
+			t.Errorf("%s has %d failures after the storage failed, want 0", key, f.Count)
+		}
+	}
+}
@@ -2,30 +2,71 @@ package shopping
 
 import (
 	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 // Memory implements DAO interface for the Shopping Service
+// it is safe for concurrent use, values are copied in and out so callers never share state with the store
 type Memory struct {
-	Users      Users
-	Carts      map[int]*Cart
-	Products   Products
-	Promotions Promotions
+	Users         Users
+	Carts         map[int]*Cart
+	Products      Products
+	Promotions    Promotions
+	Orders        map[int]*Order
+	Holds         map[int]map[int]*StockHold // by user ID and product ID
+	Coupons       map[string]*Coupon         // by code
+	Redemptions   []*CouponRedemption
+	AccessTokens  map[string]*AccessToken   // by hash
+	RefreshTokens map[string]*RefreshToken  // by hash
+	LoginFailures map[string]*LoginFailures // by key
+
+	mu        sync.RWMutex // guards all the maps above
+	cartLocks userLocks    // serialises updates on each user's cart only
+}
+
+// memoryState is the serialisable representation of everything held in Memory
+type memoryState struct {
+	Users         Users               `json:"users"`
+	Carts         map[int]*Cart       `json:"carts"`
+	Products      Products            `json:"products"`
+	Promotions    Promotions          `json:"promotions"`
+	Orders        map[int]*Order      `json:"orders"`
+	Holds         []*StockHold        `json:"holds"`
+	Coupons       map[string]*Coupon  `json:"coupons"`
+	Redemptions   []*CouponRedemption `json:"redemptions"`
+	AccessTokens  []*AccessToken      `json:"access_tokens"`
+	RefreshTokens []*RefreshToken     `json:"refresh_tokens"`
+	LoginFailures []*LoginFailures    `json:"login_failures"`
 }
 
 // NewMemory initialises in-memory DAO for the shopping API
 func NewMemory() *Memory {
 	return &Memory{
-		Users:      Users{},
-		Carts:      map[int]*Cart{},
-		Products:   Products{},
-		Promotions: Promotions{},
+		Users:         Users{},
+		Carts:         map[int]*Cart{},
+		Products:      Products{},
+		Promotions:    Promotions{},
+		Orders:        map[int]*Order{},
+		Holds:         map[int]map[int]*StockHold{},
+		Coupons:       map[string]*Coupon{},
+		Redemptions:   []*CouponRedemption{},
+		AccessTokens:  map[string]*AccessToken{},
+		RefreshTokens: map[string]*RefreshToken{},
+		LoginFailures: map[string]*LoginFailures{},
 	}
 }
 
 // SetProductInventory saves inventory in a map
 func (d *Memory) SetProductInventory(products []*Product) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
 	for _, product := range products {
-		d.Products[product.ID] = product
+		d.Products[product.ID] = product.copy()
 	}
 	if len(d.Products) == 0 {
 		return errors.New("product inventory is empty")
@@ -33,10 +74,13 @@ func (d *Memory) SetProductInventory(products []*Product) error {
 	return nil
 }
 
-// SetPromotions saves promotions in a map, promotions could be empty
+// SetPromotions saves promotions in a map by ID, promotions could be empty
 func (d *Memory) SetPromotions(promotions []*Promotion) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
 	for _, promotion := range promotions {
-		d.Promotions[promotion.ProductType] = promotion
+		d.Promotions[promotion.ID] = promotion.copy()
 	}
 	return nil
 }
@@ -46,88 +90,1459 @@ func (d *Memory) SetUsers(users []*User) error {
 	for _, user := range users {
 		d.SetUser(user)
 	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
 	if len(d.Users) == 0 {
 		return errors.New("user array is empty")
 	}
 	return nil
 }
 
-// GetProducts returns product inventory from memory
+// GetProducts returns a copy of the product inventory from memory
 func (d *Memory) GetProducts() (Products, error) {
-	if len(d.Products) == 0 {
-		return nil, errors.New("no products found")
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	products := d.Products.copy()
+	for id, p := range products {
+		p.Available = p.Stock - d.held(id, 0)
 	}
-	return d.Products, nil
+	return products, nil
 
 }
 
-// UpdateProducts updates inventory in memory
+// UpdateProducts saves every product in the inventory, the ones missing from it are kept
 func (d *Memory) UpdateProducts(products Products) error {
 	if len(products) == 0 {
 		return errors.New("products empty")
 	}
-	d.Products = products
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for id, p := range products.copy() {
+		d.Products[id] = p
+	}
+	return nil
+}
+
+// CreateProduct adds a product, it gets the next free ID when it has none
+func (d *Memory) CreateProduct(product *Product) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if product.ID == 0 {
+		product.ID = d.nextProductID()
+	}
+	if _, ok := d.Products[product.ID]; ok {
+		return errConflictProductExists.msg(fmt.Sprintf("product %d already exists", product.ID))
+	}
+	d.Products[product.ID] = product.copy()
+	return nil
+}
+
+// UpdateProduct applies fn to a copy of the product and saves the result unless it has less stock than is held
+func (d *Memory) UpdateProduct(id int, fn func(*Product) error) (*Product, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	p, ok := d.Products[id]
+	if !ok {
+		return nil, errProductNotFound
+	}
+	held := d.held(id, 0)
+	updated := p.copy()
+	updated.Available = updated.Stock - held
+	if err := fn(updated); err != nil {
+		return nil, err
+	}
+	if updated.Stock < held {
+		return nil, stockBelowHeld(id, updated.Stock, held)
+	}
+	updated.ID = id
+	d.Products[id] = updated
+
+	product := updated.copy()
+	product.Available = product.Stock - held
+	return product, nil
+}
+
+// DeleteProduct removes a product and the stock held of it
+func (d *Memory) DeleteProduct(id int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.Products[id]; !ok {
+		return errProductNotFound
+	}
+	delete(d.Products, id)
+	for userID, holds := range d.Holds {
+		delete(holds, id)
+		if len(holds) == 0 {
+			delete(d.Holds, userID)
+		}
+	}
+	return nil
+}
+
+// nextProductID must be called while holding d.mu
+func (d *Memory) nextProductID() int {
+	id := 0
+	for productID := range d.Products {
+		if productID > id {
+			id = productID
+		}
+	}
+	return id + 1
+}
+
+// ReserveStock decrements the stock of all products or none of them
+func (d *Memory) ReserveStock(userID int, quantities map[int]int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.reserveStock(userID, quantities)
+	return err
+}
+
+// reserveStock must be called while holding d.mu, it returns the function undoing it
+func (d *Memory) reserveStock(userID int, quantities map[int]int) (func(), error) {
+	if err := d.checkStock(userID, quantities); err != nil {
+		return nil, err
+	}
+	restoreHolds := d.keepHolds(userID)
+	for id, quantity := range quantities {
+		d.Products[id].Stock -= quantity
+		delete(d.Holds[userID], id)
+	}
+	return func() {
+		d.releaseStock(quantities)
+		restoreHolds()
+	}, nil
+}
+
+// ReleaseStock increments the stock of the products
+func (d *Memory) ReleaseStock(quantities map[int]int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.releaseStock(quantities)
+	return nil
+}
+
+// releaseStock must be called while holding d.mu, it returns the function undoing it
+func (d *Memory) releaseStock(quantities map[int]int) func() {
+	for id, quantity := range quantities {
+		if p, ok := d.Products[id]; ok {
+			p.Stock += quantity
+		}
+	}
+	return func() {
+		for id, quantity := range quantities {
+			if p, ok := d.Products[id]; ok {
+				p.Stock -= quantity
+			}
+		}
+	}
+}
+
+// HoldStock replaces the user's hold on a product
+func (d *Memory) HoldStock(hold *StockHold) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.holdStock(hold)
+	return err
+}
+
+// holdStock must be called while holding d.mu, it returns the function undoing it
+func (d *Memory) holdStock(hold *StockHold) (func(), error) {
+	restoreHolds := d.keepHolds(hold.UserID)
+	if hold.Quantity <= 0 {
+		delete(d.Holds[hold.UserID], hold.ProductID)
+		return restoreHolds, nil
+	}
+	if err := d.checkStock(hold.UserID, map[int]int{hold.ProductID: hold.Quantity}); err != nil {
+		return nil, err
+	}
+	if d.Holds[hold.UserID] == nil {
+		d.Holds[hold.UserID] = map[int]*StockHold{}
+	}
+	h := *hold
+	d.Holds[hold.UserID][hold.ProductID] = &h
+	return restoreHolds, nil
+}
+
+// ReleaseHolds removes all the holds of a user
+func (d *Memory) ReleaseHolds(userID int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.releaseHolds(userID)
+	return nil
+}
+
+// releaseHolds must be called while holding d.mu, it returns the function undoing it
+func (d *Memory) releaseHolds(userID int) func() {
+	restoreHolds := d.keepHolds(userID)
+	delete(d.Holds, userID)
+	return restoreHolds
+}
+
+// keepHolds copies the user's holds and returns the function putting them back, leaving out the ones of products
+// deleted since. Both must be called while holding d.mu
+func (d *Memory) keepHolds(userID int) func() {
+	kept := map[int]*StockHold{}
+	for id, h := range d.Holds[userID] {
+		hold := *h
+		kept[id] = &hold
+	}
+	return func() {
+		holds := map[int]*StockHold{}
+		for id, h := range kept {
+			if _, ok := d.Products[id]; ok {
+				holds[id] = h
+			}
+		}
+		if len(holds) == 0 {
+			delete(d.Holds, userID)
+			return
+		}
+		d.Holds[userID] = holds
+	}
+}
+
+// ReleaseExpiredHolds removes holds that expire before now
+func (d *Memory) ReleaseExpiredHolds(now time.Time) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	released := 0
+	for userID, holds := range d.Holds {
+		for productID, h := range holds {
+			if h.ExpiresAt.Before(now) {
+				delete(holds, productID)
+				released++
+			}
+		}
+		if len(holds) == 0 {
+			delete(d.Holds, userID)
+		}
+	}
+	return released, nil
+}
+
+// expiredHolds counts the holds that expire before now
+func (d *Memory) expiredHolds(now time.Time) int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	expired := 0
+	for _, holds := range d.Holds {
+		for _, h := range holds {
+			if h.ExpiresAt.Before(now) {
+				expired++
+			}
+		}
+	}
+	return expired
+}
+
+// held returns the quantity of a product held by everyone except the given user,
+// it must be called while holding d.mu
+func (d *Memory) held(productID, exceptUserID int) int {
+	held := 0
+	for userID, holds := range d.Holds {
+		if h, ok := holds[productID]; ok && userID != exceptUserID {
+			held += h.Quantity
+		}
+	}
+	return held
+}
+
+// checkStock must be called while holding d.mu
+func (d *Memory) checkStock(userID int, quantities map[int]int) error {
+	shortages := []*StockShortage{}
+	for id, quantity := range quantities {
+		available := 0
+		if p, ok := d.Products[id]; ok {
+			available = p.Stock - d.held(id, userID)
+		}
+		if quantity > available {
+			shortages = append(shortages, &StockShortage{ProductID: id, Requested: quantity, Available: available})
+		}
+	}
+	if len(shortages) > 0 {
+		return notEnoughStock(shortages)
+	}
 	return nil
 }
 
 // GetPromotions from memory
 func (d *Memory) GetPromotions() (Promotions, error) {
-	if len(d.Promotions) == 0 {
-		return nil, errors.New("no promotions found")
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.Promotions.copy(), nil
+}
+
+// CreatePromotion adds a promotion, it gets the next free ID when it has none
+func (d *Memory) CreatePromotion(promotion *Promotion) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if promotion.ID == 0 {
+		promotion.ID = d.nextPromotionID()
 	}
-	return d.Promotions, nil
+	if _, ok := d.Promotions[promotion.ID]; ok {
+		return errConflictPromotionExists.msg(fmt.Sprintf("promotion %d already exists", promotion.ID))
+	}
+	d.Promotions[promotion.ID] = promotion.copy()
+	return nil
 }
 
-// SetUser saves data in memory
+// UpdatePromotion applies fn to a copy of the promotion and saves the result
+func (d *Memory) UpdatePromotion(id int, fn func(*Promotion) error) (*Promotion, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	p, ok := d.Promotions[id]
+	if !ok {
+		return nil, errPromotionNotFound
+	}
+	updated := p.copy()
+	if err := fn(updated); err != nil {
+		return nil, err
+	}
+	updated.ID = id
+	d.Promotions[id] = updated
+	return updated.copy(), nil
+}
+
+// DeletePromotion removes a promotion
+func (d *Memory) DeletePromotion(id int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.Promotions[id]; !ok {
+		return errPromotionNotFound
+	}
+	delete(d.Promotions, id)
+	return nil
+}
+
+// nextPromotionID must be called while holding d.mu
+func (d *Memory) nextPromotionID() int {
+	id := 0
+	for promotionID := range d.Promotions {
+		if promotionID > id {
+			id = promotionID
+		}
+	}
+	return id + 1
+}
+
+// SetUser saves data in memory, a cart is created for the user if they don't have one yet
 func (d *Memory) SetUser(user *User) error {
-	cartID := len(d.Carts) + 1
-	c := &Cart{
-		ID:       cartID,
-		UserID:   user.ID,
-		Products: map[int][]*CartProduct{},
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.setUser(user)
+	return nil
+}
+
+// setUser saves the user and gives it a cart if it has none, d.mu must be held
+func (d *Memory) setUser(user *User) {
+	if d.cartByUserID(user.ID) == nil {
+		cartID := d.nextCartID()
+		d.Carts[cartID] = &Cart{
+			ID:       cartID,
+			UserID:   user.ID,
+			Name:     CartNameActive,
+			Products: CartLines{},
+		}
+	}
+	d.Users[user.ID] = user.copy()
+}
+
+// CreateUser adds a user with its cart unless the ID or username is taken
+func (d *Memory) CreateUser(user *User) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.checkNewUser(user); err != nil {
+		return err
+	}
+	d.setUser(user)
+	return nil
+}
+
+// checkNewUser gives the user the next free ID when it has none and checks the ID, username and subject aren't taken,
+// it must be called while holding d.mu
+func (d *Memory) checkNewUser(user *User) error {
+	if user.ID == 0 {
+		user.ID = d.nextUserID()
+	}
+	if _, ok := d.Users[user.ID]; ok {
+		return errConflictUsernameTaken.msg(fmt.Sprintf("user %d already exists", user.ID))
+	}
+	for _, u := range d.Users {
+		if u.Username == user.Username {
+			return errConflictUsernameTaken.msg("username taken: " + user.Username)
+		}
+		if user.Subject != "" && u.Subject == user.Subject {
+			return errConflictSubjectTaken.msg("subject taken: " + user.Subject)
+		}
 	}
-	d.SetCart(c)
-	d.Users[user.ID] = user
 	return nil
 }
 
+// nextCartID must be called while holding d.mu
+func (d *Memory) nextCartID() int {
+	id := 0
+	for cartID := range d.Carts {
+		if cartID > id {
+			id = cartID
+		}
+	}
+	return id + 1
+}
+
+// nextUserID must be called while holding d.mu
+func (d *Memory) nextUserID() int {
+	id := 0
+	for userID := range d.Users {
+		if userID > id {
+			id = userID
+		}
+	}
+	return id + 1
+}
+
 // GetUser by username
 func (d *Memory) GetUser(username string) (*User, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
 	for _, u := range d.Users {
 		if u.Username == username {
-			return u, nil
+			return u.copy(), nil
 		}
 	}
-	return nil, errors.New("user not found")
+	return nil, errUserNotFound
 }
 
-// GetUserByToken finds user associated to token
-func (d *Memory) GetUserByToken(token string) (*User, error) {
+// GetUserByID finds a user by ID
+func (d *Memory) GetUserByID(id int) (*User, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	u, ok := d.Users[id]
+	if !ok {
+		return nil, errUserNotFound
+	}
+	return u.copy(), nil
+}
+
+// GetUserBySubject finds a user by the subject of the identity provider
+func (d *Memory) GetUserBySubject(subject string) (*User, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
 	for _, u := range d.Users {
-		if u.Token == token {
-			return u, nil
+		if subject != "" && u.Subject == subject {
+			return u.copy(), nil
+		}
+	}
+	return nil, errUserNotFound
+}
+
+// CreateGuest adds a guest with its cart and the session of its cart token
+func (d *Memory) CreateGuest(user *User, token *AccessToken) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	user.Guest = true
+	if err := d.checkNewUser(user); err != nil {
+		return err
+	}
+	d.setUser(user)
+	token.UserID = user.ID
+	d.AccessTokens[token.Hash] = token.copy()
+	return nil
+}
+
+// DeleteGuest removes a guest with its cart, stock holds and sessions
+func (d *Memory) DeleteGuest(id int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.deleteGuest(id)
+	return err
+}
+
+// deleteGuest must be called while holding d.mu, it returns the function undoing it
+func (d *Memory) deleteGuest(id int) (func(), error) {
+	if u, ok := d.Users[id]; !ok || !u.Guest {
+		return nil, errUserNotFound
+	}
+	return d.deleteUser(id), nil
+}
+
+// expiredGuests returns the IDs of the guests without sessions lasting until now
+func (d *Memory) expiredGuests(now time.Time) []int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.expiredGuestsLocked(now)
+}
+
+// expiredGuestsLocked must be called while holding d.mu
+func (d *Memory) expiredGuestsLocked(now time.Time) []int {
+	active := map[int]bool{}
+	for _, t := range d.AccessTokens {
+		if !t.ExpiresAt.Before(now) {
+			active[t.UserID] = true
+		}
+	}
+	ids := []int{}
+	for id, u := range d.Users {
+		if u.Guest && !active[id] {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// DeleteExpiredGuests removes the guests without sessions lasting until now
+func (d *Memory) DeleteExpiredGuests(now time.Time) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ids := d.expiredGuestsLocked(now)
+	for _, id := range ids {
+		d.deleteUser(id)
+	}
+	return len(ids), nil
+}
+
+// deleteUser removes a user with its carts, stock holds and sessions and returns the function putting them back
+// unless the ID has been taken since. Both must be called while holding d.mu
+func (d *Memory) deleteUser(id int) func() {
+	user := d.Users[id]
+	delete(d.Users, id)
+	carts := []*Cart{}
+	for cartID, c := range d.Carts {
+		if c.UserID == id {
+			carts = append(carts, c)
+			delete(d.Carts, cartID)
+		}
+	}
+	restoreHolds := d.releaseHolds(id)
+	accessTokens := []*AccessToken{}
+	for hash, t := range d.AccessTokens {
+		if t.UserID == id {
+			accessTokens = append(accessTokens, t)
+			delete(d.AccessTokens, hash)
+		}
+	}
+	refreshTokens := []*RefreshToken{}
+	for hash, t := range d.RefreshTokens {
+		if t.UserID == id {
+			refreshTokens = append(refreshTokens, t)
+			delete(d.RefreshTokens, hash)
+		}
+	}
+
+	return func() {
+		if _, taken := d.Users[id]; taken {
+			return
+		}
+		d.Users[id] = user
+		for _, c := range carts {
+			d.Carts[c.ID] = c
+		}
+		restoreHolds()
+		for _, t := range accessTokens {
+			d.AccessTokens[t.Hash] = t
+		}
+		for _, t := range refreshTokens {
+			d.RefreshTokens[t.Hash] = t
+		}
+	}
+}
+
+// CreateAccessToken saves a new session
+func (d *Memory) CreateAccessToken(token *AccessToken) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.AccessTokens[token.Hash] = token.copy()
+	return nil
+}
+
+// GetAccessToken finds a session by the hash of its token
+func (d *Memory) GetAccessToken(hash string) (*AccessToken, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	t, ok := d.AccessTokens[hash]
+	if !ok {
+		return nil, errAccessTokenNotFound
+	}
+	return t.copy(), nil
+}
+
+// RevokeAccessToken marks a session as revoked
+func (d *Memory) RevokeAccessToken(hash string, at time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	t, ok := d.AccessTokens[hash]
+	if !ok {
+		return errAccessTokenNotFound
+	}
+	if t.RevokedAt == nil {
+		t.RevokedAt = &at
+	}
+	return nil
+}
+
+// expiredAccessTokens counts the sessions that expire before now
+func (d *Memory) expiredAccessTokens(now time.Time) int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	expired := 0
+	for _, t := range d.AccessTokens {
+		if t.ExpiresAt.Before(now) {
+			expired++
+		}
+	}
+	return expired
+}
+
+// DeleteExpiredAccessTokens removes sessions that expire before now
+func (d *Memory) DeleteExpiredAccessTokens(now time.Time) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	deleted := 0
+	for hash, t := range d.AccessTokens {
+		if t.ExpiresAt.Before(now) {
+			delete(d.AccessTokens, hash)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// CreateRefreshToken saves a new refresh token
+func (d *Memory) CreateRefreshToken(token *RefreshToken) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.RefreshTokens[token.Hash] = token.copy()
+	return nil
+}
+
+// RotateRefreshToken marks the token as used and saves next in its family,
+// a token used twice revokes its family
+func (d *Memory) RotateRefreshToken(hash string, next *RefreshToken) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	t, err := d.checkRotation(hash, next)
+	if err != nil {
+		return err
+	}
+	usedAt := next.IssuedAt
+	t.UsedAt = &usedAt
+	d.RefreshTokens[next.Hash] = next.copy()
+	return nil
+}
+
+// checkRotation returns the token with the hash and gives next its user and family if it can be rotated,
+// it revokes the family of a token used twice. It must be called while holding d.mu.
+func (d *Memory) checkRotation(hash string, next *RefreshToken) (*RefreshToken, error) {
+	t, err := d.refreshToken(hash)
+	if err != nil {
+		return nil, err
+	}
+	reused, err := t.checkRotation(next.IssuedAt)
+	if reused {
+		d.revokeFamily(t.Family, next.IssuedAt)
+	}
+	if err != nil {
+		return nil, err
+	}
+	next.UserID = t.UserID
+	next.Family = t.Family
+	return t, nil
+}
+
+// RevokeRefreshTokens revokes the family of the token with the hash
+func (d *Memory) RevokeRefreshTokens(hash string, at time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	t, err := d.refreshToken(hash)
+	if err != nil {
+		return err
+	}
+	d.revokeFamily(t.Family, at)
+	return nil
+}
+
+// refreshToken must be called while holding d.mu
+func (d *Memory) refreshToken(hash string) (*RefreshToken, error) {
+	t, ok := d.RefreshTokens[hash]
+	if !ok {
+		return nil, errInvalidRefreshToken.msg("unknown refresh token")
+	}
+	return t, nil
+}
+
+// revokeFamily must be called while holding d.mu
+func (d *Memory) revokeFamily(family string, at time.Time) {
+	for _, t := range d.RefreshTokens {
+		if t.Family == family && t.RevokedAt == nil {
+			revokedAt := at
+			t.RevokedAt = &revokedAt
+		}
+	}
+}
+
+// expiredRefreshTokens counts the refresh tokens that expire before now
+func (d *Memory) expiredRefreshTokens(now time.Time) int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	expired := 0
+	for _, t := range d.RefreshTokens {
+		if t.ExpiresAt.Before(now) {
+			expired++
+		}
+	}
+	return expired
+}
+
+// DeleteExpiredRefreshTokens removes refresh tokens that expire before now
+func (d *Memory) DeleteExpiredRefreshTokens(now time.Time) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	deleted := 0
+	for hash, t := range d.RefreshTokens {
+		if t.ExpiresAt.Before(now) {
+			delete(d.RefreshTokens, hash)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// GetLoginFailures returns the failed logins counted under the key
+func (d *Memory) GetLoginFailures(key string) (*LoginFailures, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	failures := LoginFailures{Key: key}
+	if f, ok := d.LoginFailures[key]; ok {
+		failures = *f
+	}
+	return &failures, nil
+}
+
+// ReserveLoginAttempt counts a failed login under every key unless check fails with the failures so far
+func (d *Memory) ReserveLoginAttempt(keys []string, at time.Time, resetAfter time.Duration, check func([]*LoginFailures) error) ([]*LoginFailures, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := check(d.loginFailures(keys)); err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		f, ok := d.LoginFailures[key]
+		if !ok {
+			f = &LoginFailures{Key: key}
+			d.LoginFailures[key] = f
+		}
+		f.record(at, resetAfter)
+	}
+	return d.loginFailures(keys), nil
+}
+
+// loginFailures returns copies of the failures under the keys, it must be called while holding d.mu
+func (d *Memory) loginFailures(keys []string) []*LoginFailures {
+	failures := []*LoginFailures{}
+	for _, key := range keys {
+		f := LoginFailures{Key: key}
+		if existing, ok := d.LoginFailures[key]; ok {
+			f = *existing
+		}
+		failures = append(failures, &f)
+	}
+	return failures
+}
+
+// ReleaseLoginAttempt takes back a failed login under the key
+func (d *Memory) ReleaseLoginAttempt(key string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	f, ok := d.LoginFailures[key]
+	if !ok {
+		return nil
+	}
+	f.Count--
+	if f.Count <= 0 {
+		delete(d.LoginFailures, key)
+	}
+	return nil
+}
+
+// ClearLoginFailures forgets the failed logins under the key
+func (d *Memory) ClearLoginFailures(key string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.LoginFailures, key)
+	return nil
+}
+
+// hasLoginFailures reports if there are failures under the key
+func (d *Memory) hasLoginFailures(key string) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	_, ok := d.LoginFailures[key]
+	return ok
+}
+
+// staleLoginFailures counts the failures whose last one was before the given time
+func (d *Memory) staleLoginFailures(before time.Time) int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	stale := 0
+	for _, f := range d.LoginFailures {
+		if f.Last.Before(before) {
+			stale++
 		}
 	}
-	return nil, errors.New("user not found")
+	return stale
+}
+
+// DeleteStaleLoginFailures removes the failures whose last one was before the given time
+func (d *Memory) DeleteStaleLoginFailures(before time.Time) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	deleted := 0
+	for key, f := range d.LoginFailures {
+		if f.Last.Before(before) {
+			delete(d.LoginFailures, key)
+			deleted++
+		}
+	}
+	return deleted, nil
 }
 
 // GetCart using its id
 func (d *Memory) GetCart(id int) (*Cart, error) {
-	return d.Carts[id], nil
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.Carts[id].copy(), nil
 }
 
-// GetCartByUserID find cart corresponding to user ID
+// GetCartByUserID find the active cart corresponding to user ID
 func (d *Memory) GetCartByUserID(userID int) (*Cart, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	c := d.cartByUserID(userID)
+	if c == nil {
+		return nil, errors.New("cart not found")
+	}
+	return c.copy(), nil
+}
+
+// SetCart Saves cart data, carts without a name are the active cart
+func (d *Memory) SetCart(cart *Cart) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.setCart(cart)
+	return nil
+}
+
+// setCart must be called while holding d.mu, it returns the function undoing it
+func (d *Memory) setCart(cart *Cart) func() {
+	c := cart.copy()
+	if c.Name == "" {
+		c.Name = CartNameActive
+	}
+	kept := d.Carts[c.ID].copy()
+	d.Carts[c.ID] = c
+	return func() {
+		if kept == nil {
+			delete(d.Carts, c.ID)
+			return
+		}
+		d.Carts[c.ID] = kept
+	}
+}
+
+// UpdateCart applies fn to the user's cart and saves the result.
+// Updates to the same cart are serialised while other users' carts can be updated concurrently.
+// If fn returns an error the cart is left untouched, the changes fn made are undone and the error is returned as is.
+func (d *Memory) UpdateCart(userID int, fn func(CartDAO, *Cart) error) (*Cart, error) {
+	tx := d.beginCartTx(&d.cartLocks)
+	defer tx.end()
+
+	return tx.UpdateCart(userID, fn)
+}
+
+// GetCarts returns a copy of every cart of the user sorted by ID
+func (d *Memory) GetCarts(userID int) ([]*Cart, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	carts := []*Cart{}
 	for _, c := range d.Carts {
 		if c.UserID == userID {
-			return c, nil
+			carts = append(carts, c.copy())
 		}
 	}
-	return nil, errors.New("cart not found")
+	sort.Slice(carts, func(i, j int) bool { return carts[i].ID < carts[j].ID })
+	return carts, nil
 }
 
-// SetCart Saves cart data
-func (d *Memory) SetCart(cart *Cart) error {
-	d.Carts[cart.ID] = cart
+// UpdateCarts applies fn to copies of the user's carts by name and saves all of them,
+// carts added to the map get the next free IDs
+func (d *Memory) UpdateCarts(userID int, fn func(CartDAO, map[string]*Cart) error) (map[string]*Cart, error) {
+	tx := d.beginCartTx(&d.cartLocks)
+	defer tx.end()
+
+	tx.lock(userID)
+	carts, err := d.cartsByName(userID)
+	if err == nil {
+		err = fn(tx, carts)
+	}
+	if err == nil {
+		_, err = tx.saveCarts(userID, carts)
+	}
+	if err != nil {
+		tx.rollback(0)
+		return nil, err
+	}
+	return carts, nil
+}
+
+// setCarts saves the carts at once
+func (d *Memory) setCarts(carts []*Cart) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, c := range carts {
+		d.setCart(c)
+	}
+	return nil
+}
+
+// cartsByName returns a copy of the user's carts keyed by name
+func (d *Memory) cartsByName(userID int) (map[string]*Cart, error) {
+	list, err := d.GetCarts(userID)
+	if err != nil {
+		return nil, err
+	}
+	carts := make(map[string]*Cart, len(list))
+	for _, c := range list {
+		carts[c.Name] = c
+	}
+	return carts, nil
+}
+
+// assignCartIDs gives the carts added to the map the user, their name and the next free IDs in name order so
+// replaying the journal gives the same IDs, it must be called while holding d.mu
+func (d *Memory) assignCartIDs(userID int, carts map[string]*Cart) {
+	names := make([]string, 0, len(carts))
+	for name := range carts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	nextID := d.nextCartID()
+	for _, name := range names {
+		c := carts[name]
+		c.UserID, c.Name = userID, name
+		if c.Products == nil {
+			c.Products = CartLines{}
+		}
+		if c.ID == 0 {
+			c.ID = nextID
+			nextID++
+		}
+	}
+}
+
+// DeleteCart removes the user's cart with the name
+func (d *Memory) DeleteCart(userID int, name string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c := d.namedCart(userID, name)
+	if c == nil {
+		return errCartNotFound
+	}
+	delete(d.Carts, c.ID)
+	return nil
+}
+
+// GetCartsWithProduct returns a copy of the carts with the name that have the product
+func (d *Memory) GetCartsWithProduct(name string, productID int) ([]*Cart, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	carts := []*Cart{}
+	for _, c := range d.Carts {
+		if c.Name == name && c.Products[productID] != nil {
+			carts = append(carts, c.copy())
+		}
+	}
+	sort.Slice(carts, func(i, j int) bool { return carts[i].ID < carts[j].ID })
+	return carts, nil
+}
+
+// CreateOrder saves a new order, redeems its coupon and empties the user's active cart
+func (d *Memory) CreateOrder(order *Order) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.createOrder(order)
+	return err
+}
+
+// createOrder must be called while holding d.mu, it returns the function undoing it
+func (d *Memory) createOrder(order *Order) (func(), error) {
+	if err := d.checkRedemption(order); err != nil {
+		return nil, err
+	}
+	if order.ID == 0 {
+		order.ID = len(d.Orders) + 1
+	}
+	id := order.ID
+	d.Orders[id] = order.copy()
+	if order.Coupon != "" {
+		d.Redemptions = append(d.Redemptions, &CouponRedemption{
+			Code:       strings.ToUpper(order.Coupon),
+			UserID:     order.UserID,
+			OrderID:    id,
+			RedeemedAt: order.CreatedAt,
+		})
+	}
+	c := d.cartByUserID(order.UserID)
+	kept := c.copy()
+	if c != nil {
+		c.clear()
+	}
+
+	return func() {
+		delete(d.Orders, id)
+		for i, r := range d.Redemptions {
+			if r.OrderID == id {
+				d.Redemptions = append(d.Redemptions[:i:i], d.Redemptions[i+1:]...)
+				break
+			}
+		}
+		if kept != nil {
+			d.Carts[kept.ID] = kept
+		}
+	}, nil
+}
+
+// SetCoupons saves coupons by code
+func (d *Memory) SetCoupons(coupons []*Coupon) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, c := range coupons {
+		coupon := c.copy()
+		coupon.Code = strings.ToUpper(coupon.Code)
+		coupon.Redeemed = 0
+		d.Coupons[coupon.Code] = coupon
+	}
+	return nil
+}
+
+// GetCoupon by code
+func (d *Memory) GetCoupon(code string) (*Coupon, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	c, ok := d.Coupons[strings.ToUpper(code)]
+	if !ok {
+		return nil, errCouponNotFound
+	}
+	coupon := c.copy()
+	coupon.Redeemed = d.redemptions(coupon.Code, 0)
+	return coupon, nil
+}
+
+// CountRedemptions of a coupon by a user
+func (d *Memory) CountRedemptions(code string, userID int) (int, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.redemptions(strings.ToUpper(code), userID), nil
+}
+
+// redemptions counts the redemptions of a coupon by the user, or by everyone when userID is 0.
+// It must be called while holding d.mu
+func (d *Memory) redemptions(code string, userID int) int {
+	count := 0
+	for _, r := range d.Redemptions {
+		if r.Code == code && (userID == 0 || r.UserID == userID) {
+			count++
+		}
+	}
+	return count
+}
+
+// checkRedemption fails if the coupon of the order has reached any of its limits,
+// it must be called while holding d.mu
+func (d *Memory) checkRedemption(order *Order) error {
+	if order.Coupon == "" {
+		return nil
+	}
+	code := strings.ToUpper(order.Coupon)
+	coupon, ok := d.Coupons[code]
+	if !ok {
+		return errCouponNotFound.msg("coupon " + code + " doesn't exist")
+	}
+	if coupon.MaxRedemptions > 0 && d.redemptions(code, 0) >= coupon.MaxRedemptions {
+		return errConflictCouponLimit.msg("coupon " + code + " reached its redemption limit")
+	}
+	if coupon.MaxPerUser > 0 && d.redemptions(code, order.UserID) >= coupon.MaxPerUser {
+		return errConflictCouponLimit.msg("coupon " + code + " reached its limit for the user")
+	}
+	return nil
+}
+
+// GetOrder using its id
+func (d *Memory) GetOrder(id int) (*Order, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	o, ok := d.Orders[id]
+	if !ok {
+		return nil, errOrderNotFound
+	}
+	return o.copy(), nil
+}
+
+// GetOrdersByUserID finds all orders made by a user
+func (d *Memory) GetOrdersByUserID(userID int) ([]*Order, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	orders := []*Order{}
+	for _, o := range d.Orders {
+		if o.UserID == userID {
+			orders = append(orders, o.copy())
+		}
+	}
+	sort.Slice(orders, func(i, j int) bool { return orders[i].ID < orders[j].ID })
+	return orders, nil
+}
+
+// state returns a copy of all data held in memory
+func (d *Memory) state() *memoryState {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	state := &memoryState{
+		Users:         Users{},
+		Carts:         map[int]*Cart{},
+		Products:      d.Products.copy(),
+		Promotions:    d.Promotions.copy(),
+		Orders:        map[int]*Order{},
+		Holds:         []*StockHold{},
+		Coupons:       map[string]*Coupon{},
+		Redemptions:   []*CouponRedemption{},
+		AccessTokens:  []*AccessToken{},
+		RefreshTokens: []*RefreshToken{},
+		LoginFailures: []*LoginFailures{},
+	}
+	for _, t := range d.AccessTokens {
+		state.AccessTokens = append(state.AccessTokens, t.copy())
+	}
+	for _, t := range d.RefreshTokens {
+		state.RefreshTokens = append(state.RefreshTokens, t.copy())
+	}
+	for _, f := range d.LoginFailures {
+		failures := *f
+		state.LoginFailures = append(state.LoginFailures, &failures)
+	}
+	for code, c := range d.Coupons {
+		state.Coupons[code] = c.copy()
+	}
+	for _, r := range d.Redemptions {
+		redemption := *r
+		state.Redemptions = append(state.Redemptions, &redemption)
+	}
+	for _, holds := range d.Holds {
+		for _, h := range holds {
+			hold := *h
+			state.Holds = append(state.Holds, &hold)
+		}
+	}
+	for id, o := range d.Orders {
+		state.Orders[id] = o.copy()
+	}
+	for id, u := range d.Users {
+		state.Users[id] = u.copy()
+	}
+	for id, c := range d.Carts {
+		state.Carts[id] = c.copy()
+	}
+	return state
+}
+
+// load replaces all data held in memory with state
+func (d *Memory) load(state *memoryState) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.Users = Users{}
+	d.Carts = map[int]*Cart{}
+	d.Products = Products{}
+	d.Promotions = Promotions{}
+	d.Orders = map[int]*Order{}
+	d.Holds = map[int]map[int]*StockHold{}
+	d.Coupons = map[string]*Coupon{}
+	d.Redemptions = []*CouponRedemption{}
+	d.AccessTokens = map[string]*AccessToken{}
+	for _, t := range state.AccessTokens {
+		d.AccessTokens[t.Hash] = t
+	}
+	d.RefreshTokens = map[string]*RefreshToken{}
+	for _, t := range state.RefreshTokens {
+		d.RefreshTokens[t.Hash] = t
+	}
+	d.LoginFailures = map[string]*LoginFailures{}
+	for _, f := range state.LoginFailures {
+		d.LoginFailures[f.Key] = f
+	}
+	for code, c := range state.Coupons {
+		d.Coupons[code] = c
+	}
+	d.Redemptions = append(d.Redemptions, state.Redemptions...)
+	for _, h := range state.Holds {
+		if d.Holds[h.UserID] == nil {
+			d.Holds[h.UserID] = map[int]*StockHold{}
+		}
+		d.Holds[h.UserID][h.ProductID] = h
+	}
+	for id, o := range state.Orders {
+		d.Orders[id] = o
+	}
+	for id, u := range state.Users {
+		d.Users[id] = u
+	}
+	for id, c := range state.Carts {
+		if c.Products == nil {
+			c.Products = CartLines{}
+		}
+		if c.Name == "" {
+			c.Name = CartNameActive
+		}
+		d.Carts[id] = c
+	}
+	for id, p := range state.Products {
+		d.Products[id] = p
+	}
+	// snapshots written before promotion rules hold promotions by product type
+	promotions := make([]*Promotion, 0, len(state.Promotions))
+	for _, p := range state.Promotions {
+		promotions = append(promotions, p)
+	}
+	for _, p := range upgradePromotions(promotions) {
+		d.Promotions[p.ID] = p
+	}
+}
+
+// cartByUserID returns the active cart of the user, it must be called while holding d.mu
+func (d *Memory) cartByUserID(userID int) *Cart {
+	return d.namedCart(userID, CartNameActive)
+}
+
+// namedCart must be called while holding d.mu
+func (d *Memory) namedCart(userID int, name string) *Cart {
+	for _, c := range d.Carts {
+		if c.UserID == userID && c.Name == name {
+			return c
+		}
+	}
 	return nil
 }
+
+// memoryCartTx is the CartDAO UpdateCart and UpdateCarts give fn. Changes are applied as they're made, so other users
+// see them like any other change, and undone in reverse order when the update fails. The carts it updates stay locked
+// until the outermost update ends so nobody else changes them in between.
+type memoryCartTx struct {
+	d      *Memory
+	locks  *userLocks // nil when the caller serialises cart updates itself
+	locked map[int]bool
+	unlock []func()
+	undo   []func() // each one must be called while holding d.mu
+}
+
+func (d *Memory) beginCartTx(locks *userLocks) *memoryCartTx {
+	return &memoryCartTx{d: d, locks: locks, locked: map[int]bool{}}
+}
+
+// lock locks the user's carts until the update ends
+func (tx *memoryCartTx) lock(userID int) {
+	if tx.locks == nil || tx.locked[userID] {
+		return
+	}
+	tx.locked[userID] = true
+	tx.unlock = append(tx.unlock, tx.locks.lock(userID))
+}
+
+// end unlocks the carts, the changes are kept unless they were rolled back
+func (tx *memoryCartTx) end() {
+	for i := len(tx.unlock) - 1; i >= 0; i-- {
+		tx.unlock[i]()
+	}
+	tx.unlock = nil
+}
+
+// rollback undoes the changes made after the first n of them
+func (tx *memoryCartTx) rollback(n int) {
+	tx.d.mu.Lock()
+	defer tx.d.mu.Unlock()
+
+	for i := len(tx.undo) - 1; i >= n; i-- {
+		tx.undo[i]()
+	}
+	tx.undo = tx.undo[:n]
+}
+
+// change makes a change while holding d.mu and keeps the function undoing it
+func (tx *memoryCartTx) change(fn func() (func(), error)) error {
+	tx.d.mu.Lock()
+	defer tx.d.mu.Unlock()
+
+	undo, err := fn()
+	if err != nil {
+		return err
+	}
+	tx.undo = append(tx.undo, undo)
+	return nil
+}
+
+// UpdateCart applies fn to the user's cart and saves it, undoing what fn changed when it fails
+func (tx *memoryCartTx) UpdateCart(userID int, fn func(CartDAO, *Cart) error) (*Cart, error) {
+	tx.lock(userID)
+	n := len(tx.undo)
+	cart, err := tx.d.GetCartByUserID(userID)
+	if err == nil {
+		err = fn(tx, cart)
+	}
+	if err == nil {
+		err = tx.saveCart(cart)
+	}
+	if err != nil {
+		tx.rollback(n)
+		return nil, err
+	}
+	return cart, nil
+}
+
+func (tx *memoryCartTx) saveCart(cart *Cart) error {
+	return tx.change(func() (func(), error) { return tx.d.setCart(cart), nil })
+}
+
+// saveCarts gives the carts added to the map their IDs and saves the user's carts, it returns them sorted by ID
+func (tx *memoryCartTx) saveCarts(userID int, carts map[string]*Cart) ([]*Cart, error) {
+	list := make([]*Cart, 0, len(carts))
+	err := tx.change(func() (func(), error) {
+		tx.d.assignCartIDs(userID, carts)
+		undo := make([]func(), 0, len(carts))
+		for _, c := range carts {
+			list = append(list, c)
+			undo = append(undo, tx.d.setCart(c))
+		}
+		return func() {
+			for _, fn := range undo {
+				fn()
+			}
+		}, nil
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list, err
+}
+
+func (tx *memoryCartTx) ReserveStock(userID int, quantities map[int]int) error {
+	return tx.change(func() (func(), error) { return tx.d.reserveStock(userID, quantities) })
+}
+
+func (tx *memoryCartTx) ReleaseStock(quantities map[int]int) error {
+	return tx.change(func() (func(), error) { return tx.d.releaseStock(quantities), nil })
+}
+
+func (tx *memoryCartTx) HoldStock(hold *StockHold) error {
+	return tx.change(func() (func(), error) { return tx.d.holdStock(hold) })
+}
+
+func (tx *memoryCartTx) ReleaseHolds(userID int) error {
+	return tx.change(func() (func(), error) { return tx.d.releaseHolds(userID), nil })
+}
+
+func (tx *memoryCartTx) CreateOrder(order *Order) error {
+	return tx.change(func() (func(), error) { return tx.d.createOrder(order) })
+}
+
+func (tx *memoryCartTx) DeleteGuest(id int) error {
+	return tx.change(func() (func(), error) { return tx.d.deleteGuest(id) })
+}
+
+// userLocks hands out a mutex per user, the zero value is ready to use.
+// A user's mutex is dropped once nobody holds or waits for it so deleted users and guests don't keep theirs.
+type userLocks struct {
+	mu    sync.Mutex
+	locks map[int]*userLock
+}
+
+type userLock struct {
+	sync.Mutex
+	refs int // holders and waiters, guarded by userLocks.mu
+}
+
+// lock blocks until the user's mutex is acquired and returns the function to release it
+func (l *userLocks) lock(userID int) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = map[int]*userLock{}
+	}
+	m, ok := l.locks[userID]
+	if !ok {
+		m = &userLock{}
+		l.locks[userID] = m
+	}
+	m.refs++
+	l.mu.Unlock()
+
+	m.Lock()
+	return func() {
+		m.Unlock()
+		l.mu.Lock()
+		if m.refs--; m.refs == 0 {
+			delete(l.locks, userID)
+		}
+		l.mu.Unlock()
+	}
+}
@@ -0,0 +1,755 @@
+package shopping
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testDAOs are the storages the DAO tests run against, each call returns an empty one
+var testDAOs = []struct {
+	name string
+	new  func(t *testing.T) DAO
+}{
+	{name: "memory", new: func(t *testing.T) DAO { return NewMemory() }},
+	{name: "file", new: func(t *testing.T) DAO {
+		f, err := NewFile(tempDir(t), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { f.Close() })
+		return f
+	}},
+	{name: "sql", new: func(t *testing.T) DAO { return newTestSQL(t, tempDir(t)) }},
+}
+
+func TestConcurrentShoppers(t *testing.T) {
+	const shoppers, rounds = 8, 5
+	for _, tt := range testDAOs {
+		t.Run(tt.name, func(t *testing.T) {
+			dao := tt.new(t)
+			s := newTestService(t, dao, SetStockHold(time.Hour))
+			users := make([]*User, shoppers)
+			for i := range users {
+				users[i] = &User{Username: fmt.Sprintf("shopper%d", i)}
+				if err := dao.CreateUser(users[i]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// every request can be turned down for lack of stock, but none can fail
+			call := func(handler http.HandlerFunc, user *User, path, body string) {
+				r := asUser(httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)), user)
+				if w := serve(handler, r); w.Code >= http.StatusInternalServerError {
+					t.Errorf("%s for %s: status %d: %s", path, user.Username, w.Code, w.Body)
+				}
+			}
+
+			var wg sync.WaitGroup
+			for _, user := range users {
+				wg.Add(1)
+				go func(user *User) {
+					defer wg.Done()
+					for i := 0; i < rounds; i++ {
+						call(s.HandleCartAddItem, user, "/v1/shopping/cart/add", `{"product_id": 1, "quantity": 1}`)
+						call(s.HandleCartAddItem, user, "/v1/shopping/cart/add", `{"product_id": 6, "quantity": 1}`)
+						call(s.HandleCartCheckout, user, "/v1/shopping/cart/checkout", ``)
+						_, err := dao.UpdateCart(user.ID, func(dao CartDAO, cart *Cart) error {
+							// a unit of each is reserved and given back while the cart is being updated
+							if err := dao.ReserveStock(user.ID, map[int]int{1: 1, 6: 1}); err != nil {
+								return nil // sold out, there's nothing to give back
+							}
+							return dao.ReleaseStock(map[int]int{1: 1, 6: 1})
+						})
+						if err != nil {
+							t.Errorf("UpdateCart for %s: %s", user.Username, err)
+						}
+						if err := dao.HoldStock(&StockHold{UserID: user.ID, ProductID: 4, Quantity: 1, ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+							if _, ok := shortageAvailable(err, 4); !ok {
+								t.Errorf("HoldStock for %s: %s", user.Username, err)
+							}
+						}
+						call(s.HandleCartBuy, user, "/v1/shopping/cart/buy", ``)
+					}
+				}(user)
+			}
+			wg.Wait()
+			if m, ok := dao.(*Memory); ok && len(m.cartLocks.locks) != 0 {
+				t.Errorf("%d cart locks are kept after every update ended", len(m.cartLocks.locks))
+			}
+
+			// what was sold and what's left in stock add up to the catalog
+			sold := map[int]int{}
+			for _, user := range users {
+				orders, err := dao.GetOrdersByUserID(user.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, order := range orders {
+					for _, line := range order.Lines {
+						sold[line.ProductID] += line.Quantity
+					}
+				}
+			}
+			if sold[1] == 0 {
+				t.Error("no belts were sold")
+			}
+			products, err := dao.GetProducts()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range testCatalog() {
+				if stock := products[p.ID].Stock; stock < 0 || stock+sold[p.ID] != p.Stock {
+					t.Errorf("%s: %d sold and %d left, want %d in all", p.Name, sold[p.ID], stock, p.Stock)
+				}
+			}
+		})
+	}
+}
+
+// hasCode reports if err is want or a copy of it made by msg
+func hasCode(err error, want *Error) bool {
+	e, ok := err.(*Error)
+	return ok && e != nil && e.Code == want.Code && e.Message == want.Message
+}
+
+func TestDAOProducts(t *testing.T) {
+	for _, tt := range testDAOs {
+		t.Run(tt.name, func(t *testing.T) {
+			dao := tt.new(t)
+			if err := dao.SetProductInventory(testCatalog()); err != nil {
+				t.Fatal(err)
+			}
+			// holds are made by users 1 and 2
+			for _, username := range []string{"alice", "bob"} {
+				if err := dao.CreateUser(&User{Username: username}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			products, err := dao.GetProducts()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(products) != len(testCatalog()) || products[2].Name != "Shirt" || products[2].Available != 5 {
+				t.Fatalf("GetProducts = %d products with shirt %+v", len(products), products[2])
+			}
+
+			product := &Product{Name: "hat", Stock: 3, Price: Money{Amount: 1500, Currency: "USD"}}
+			if err := dao.CreateProduct(product); err != nil || product.ID != 7 {
+				t.Fatalf("CreateProduct gave ID %d: %v", product.ID, err)
+			}
+			if err := dao.CreateProduct(&Product{ID: 7, Name: "cap"}); !hasCode(err, errConflictProductExists) {
+				t.Errorf("CreateProduct with a taken ID: %v", err)
+			}
+			hat, err := dao.UpdateProduct(7, func(p *Product) error {
+				p.Stock += 2
+				return nil
+			})
+			if err != nil || hat.Stock != 5 || hat.Name != "hat" {
+				t.Errorf("UpdateProduct = %+v, %v", hat, err)
+			}
+			if _, err := dao.UpdateProduct(99, func(*Product) error { return nil }); !hasCode(err, errProductNotFound) {
+				t.Errorf("UpdateProduct of a missing product: %v", err)
+			}
+
+			// holds make stock unavailable to others and are consumed when their user reserves the stock
+			if err := dao.HoldStock(&StockHold{UserID: 1, ProductID: 7, Quantity: 4, ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+				t.Fatal(err)
+			}
+			if err := dao.HoldStock(&StockHold{UserID: 2, ProductID: 7, Quantity: 2, ExpiresAt: time.Now().Add(time.Hour)}); err == nil {
+				t.Error("HoldStock held stock held by another user")
+			}
+			if err := dao.ReserveStock(2, map[int]int{1: 1, 7: 2}); err == nil {
+				t.Error("ReserveStock reserved stock held by another user")
+			}
+			if products, _ := dao.GetProducts(); products[1].Stock != 10 || products[7].Available != 1 {
+				t.Errorf("after a short reservation belt has stock %d and hat %d available", products[1].Stock, products[7].Available)
+			}
+			if err := dao.ReserveStock(1, map[int]int{1: 1, 7: 4}); err != nil {
+				t.Fatal(err)
+			}
+			if err := dao.ReleaseStock(map[int]int{1: 1}); err != nil {
+				t.Fatal(err)
+			}
+			if products, _ := dao.GetProducts(); products[1].Stock != 10 || products[7].Stock != 1 || products[7].Available != 1 {
+				t.Errorf("after reserving belt has stock %d and hat %+v", products[1].Stock, products[7])
+			}
+
+			if err := dao.HoldStock(&StockHold{UserID: 1, ProductID: 2, Quantity: 1, ExpiresAt: time.Now().Add(-time.Minute)}); err != nil {
+				t.Fatal(err)
+			}
+			if err := dao.HoldStock(&StockHold{UserID: 2, ProductID: 2, Quantity: 1, ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+				t.Fatal(err)
+			}
+			if err := dao.HoldStock(&StockHold{UserID: 1, ProductID: 3, Quantity: 1, ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+				t.Fatal(err)
+			}
+			if n, err := dao.ReleaseExpiredHolds(time.Now()); err != nil || n != 1 {
+				t.Errorf("ReleaseExpiredHolds = %d, %v, want 1", n, err)
+			}
+			if err := dao.ReleaseHolds(1); err != nil {
+				t.Fatal(err)
+			}
+			if products, _ := dao.GetProducts(); products[2].Available != 4 || products[3].Available != 2 {
+				t.Errorf("after releasing holds shirt has %d available and suit %d", products[2].Available, products[3].Available)
+			}
+			if err := dao.DeleteProduct(2); err != nil {
+				t.Fatal(err)
+			}
+			if err := dao.DeleteProduct(2); !hasCode(err, errProductNotFound) {
+				t.Errorf("DeleteProduct of a missing product: %v", err)
+			}
+			if err := dao.CreateProduct(&Product{ID: 2, Name: "Shirt", Stock: 1}); err != nil {
+				t.Fatal(err)
+			}
+			if products, _ := dao.GetProducts(); products[2].Available != 1 {
+				t.Errorf("a hold of a deleted product is kept: %d available", products[2].Available)
+			}
+
+			products, _ = dao.GetProducts()
+			products[1].Stock = 20
+			if err := dao.UpdateProducts(Products{1: products[1]}); err != nil {
+				t.Fatal(err)
+			}
+			if products, _ := dao.GetProducts(); products[1].Stock != 20 || products[7] == nil {
+				t.Errorf("after UpdateProducts belt has stock %d and hat is %+v", products[1].Stock, products[7])
+			}
+		})
+	}
+}
+
+func TestDAOPromotions(t *testing.T) {
+	for _, tt := range testDAOs {
+		t.Run(tt.name, func(t *testing.T) {
+			dao := tt.new(t)
+			list := []*Promotion{}
+			for _, p := range testPromotions() {
+				list = append(list, p)
+			}
+			if err := dao.SetPromotions(list); err != nil {
+				t.Fatal(err)
+			}
+			promotions, err := dao.GetPromotions()
+			if err != nil || len(promotions) != len(testPromotions()) {
+				t.Fatalf("GetPromotions = %d promotions, %v", len(promotions), err)
+			}
+			next := 0
+			for id := range promotions {
+				if id > next {
+					next = id
+				}
+			}
+			next++
+
+			promotion := &Promotion{Name: "everything", Action: &Action{Type: ActionPercentOff, Percent: 10}}
+			if err := dao.CreatePromotion(promotion); err != nil || promotion.ID != next {
+				t.Fatalf("CreatePromotion gave ID %d: %v, want %d", promotion.ID, err, next)
+			}
+			if err := dao.CreatePromotion(&Promotion{ID: next, Name: "again"}); !hasCode(err, errConflictPromotionExists) {
+				t.Errorf("CreatePromotion with a taken ID: %v", err)
+			}
+			updated, err := dao.UpdatePromotion(next, func(p *Promotion) error {
+				p.Disabled = true
+				return nil
+			})
+			if err != nil || !updated.Disabled || updated.Name != "everything" {
+				t.Errorf("UpdatePromotion = %+v, %v", updated, err)
+			}
+			if _, err := dao.UpdatePromotion(99, func(*Promotion) error { return nil }); !hasCode(err, errPromotionNotFound) {
+				t.Errorf("UpdatePromotion of a missing promotion: %v", err)
+			}
+			if err := dao.DeletePromotion(next); err != nil {
+				t.Fatal(err)
+			}
+			if err := dao.DeletePromotion(next); !hasCode(err, errPromotionNotFound) {
+				t.Errorf("DeletePromotion of a missing promotion: %v", err)
+			}
+			if promotions, _ := dao.GetPromotions(); promotions[next] != nil {
+				t.Errorf("deleted promotion is still there: %+v", promotions[next])
+			}
+		})
+	}
+}
+
+func TestDAOUsersAndGuests(t *testing.T) {
+	for _, tt := range testDAOs {
+		t.Run(tt.name, func(t *testing.T) {
+			dao := tt.new(t)
+			if err := dao.SetUsers([]*User{{ID: 1, Username: "test", Password: "secret"}}); err != nil {
+				t.Fatal(err)
+			}
+			if err := dao.SetUser(&User{ID: 1, Username: "test", Roles: []Role{RoleAdmin}}); err != nil {
+				t.Fatal(err)
+			}
+			if user, err := dao.GetUserByID(1); err != nil || len(user.Roles) != 1 {
+				t.Errorf("GetUserByID after SetUser = %+v, %v", user, err)
+			}
+			if _, err := dao.GetCartByUserID(1); err != nil {
+				t.Errorf("SetUser didn't give the user a cart: %v", err)
+			}
+
+			user := &User{Username: "alice", Subject: "idp#alice"}
+			if err := dao.CreateUser(user); err != nil || user.ID != 2 {
+				t.Fatalf("CreateUser gave ID %d: %v", user.ID, err)
+			}
+			if err := dao.CreateUser(&User{Username: "alice"}); !hasCode(err, errConflictUsernameTaken) {
+				t.Errorf("CreateUser with a taken username: %v", err)
+			}
+			if err := dao.CreateUser(&User{Username: "bob", Subject: "idp#alice"}); !hasCode(err, errConflictSubjectTaken) {
+				t.Errorf("CreateUser with a taken subject: %v", err)
+			}
+			if found, err := dao.GetUser("alice"); err != nil || found.ID != 2 {
+				t.Errorf("GetUser = %+v, %v", found, err)
+			}
+			if found, err := dao.GetUserBySubject("idp#alice"); err != nil || found.ID != 2 {
+				t.Errorf("GetUserBySubject = %+v, %v", found, err)
+			}
+			for name, err := range map[string]error{
+				"GetUser":          func() error { _, err := dao.GetUser("bob"); return err }(),
+				"GetUserByID":      func() error { _, err := dao.GetUserByID(99); return err }(),
+				"GetUserBySubject": func() error { _, err := dao.GetUserBySubject(""); return err }(),
+				"DeleteGuest":      dao.DeleteGuest(2),
+			} {
+				if err != errUserNotFound {
+					t.Errorf("%s of a missing user or guest: %v", name, err)
+				}
+			}
+
+			now := time.Now()
+			guests := make([]*User, 2)
+			for i := range guests {
+				guests[i] = &User{Username: fmt.Sprintf("guest-%d", i)}
+				token := &AccessToken{Hash: guests[i].Username, IssuedAt: now, ExpiresAt: now.Add(time.Duration(i) * time.Hour)}
+				if err := dao.CreateGuest(guests[i], token); err != nil {
+					t.Fatal(err)
+				}
+				if !guests[i].Guest {
+					t.Errorf("CreateGuest didn't mark %s as a guest", guests[i].Username)
+				}
+				if token, err := dao.GetAccessToken(guests[i].Username); err != nil || token.UserID != guests[i].ID {
+					t.Errorf("session of %s = %+v, %v", guests[i].Username, token, err)
+				}
+			}
+			if err := dao.HoldStock(&StockHold{UserID: guests[0].ID, ProductID: 1, Quantity: 1, ExpiresAt: now.Add(time.Hour)}); err == nil {
+				t.Error("HoldStock held a product that doesn't exist")
+			}
+			if err := dao.DeleteGuest(guests[0].ID); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := dao.GetAccessToken(guests[0].Username); err != errAccessTokenNotFound {
+				t.Errorf("session of a deleted guest: %v", err)
+			}
+			if carts, err := dao.GetCarts(guests[0].ID); err != nil || len(carts) != 0 {
+				t.Errorf("carts of a deleted guest = %d, %v", len(carts), err)
+			}
+			if n, err := dao.DeleteExpiredGuests(now.Add(time.Minute)); err != nil || n != 0 {
+				t.Errorf("DeleteExpiredGuests deleted %d guests with sessions: %v", n, err)
+			}
+			if n, err := dao.DeleteExpiredGuests(now.Add(2 * time.Hour)); err != nil || n != 1 {
+				t.Errorf("DeleteExpiredGuests = %d, %v, want 1", n, err)
+			}
+			if _, err := dao.GetUserByID(guests[1].ID); err != errUserNotFound {
+				t.Errorf("expired guest: %v", err)
+			}
+			if _, err := dao.GetUserByID(2); err != nil {
+				t.Errorf("DeleteExpiredGuests deleted a user: %v", err)
+			}
+		})
+	}
+}
+
+func TestDAOTokens(t *testing.T) {
+	for _, tt := range testDAOs {
+		t.Run(tt.name, func(t *testing.T) {
+			dao := tt.new(t)
+			if err := dao.CreateUser(&User{ID: 1, Username: "alice"}); err != nil {
+				t.Fatal(err)
+			}
+			now := time.Now().UTC().Truncate(time.Second)
+			for i, hash := range []string{"short", "long"} {
+				token := &AccessToken{Hash: hash, UserID: 1, IssuedAt: now, ExpiresAt: now.Add(time.Duration(i+1) * time.Hour)}
+				if err := dao.CreateAccessToken(token); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := dao.RevokeAccessToken("long", now); err != nil {
+				t.Fatal(err)
+			}
+			if token, err := dao.GetAccessToken("long"); err != nil || token.RevokedAt == nil || !token.RevokedAt.Equal(now) {
+				t.Errorf("revoked session = %+v, %v", token, err)
+			}
+			if err := dao.RevokeAccessToken("missing", now); err != errAccessTokenNotFound {
+				t.Errorf("RevokeAccessToken of a missing session: %v", err)
+			}
+			if n, err := dao.DeleteExpiredAccessTokens(now.Add(90 * time.Minute)); err != nil || n != 1 {
+				t.Errorf("DeleteExpiredAccessTokens = %d, %v, want 1", n, err)
+			}
+			if _, err := dao.GetAccessToken("short"); err != errAccessTokenNotFound {
+				t.Errorf("expired session: %v", err)
+			}
+
+			first := &RefreshToken{Hash: "first", UserID: 1, Family: "login", IssuedAt: now, ExpiresAt: now.Add(time.Hour)}
+			if err := dao.CreateRefreshToken(first); err != nil {
+				t.Fatal(err)
+			}
+			second := &RefreshToken{Hash: "second", IssuedAt: now.Add(time.Minute), ExpiresAt: now.Add(2 * time.Hour)}
+			if err := dao.RotateRefreshToken("first", second); err != nil {
+				t.Fatal(err)
+			}
+			if second.UserID != 1 || second.Family != "login" {
+				t.Errorf("rotated token = %+v, want the user and family of the first", second)
+			}
+			if err := dao.RotateRefreshToken("missing", &RefreshToken{Hash: "third", IssuedAt: now}); !hasCode(err, errInvalidRefreshToken) {
+				t.Errorf("RotateRefreshToken of a missing token: %v", err)
+			}
+			other := &RefreshToken{Hash: "other", UserID: 1, Family: "another login", IssuedAt: now, ExpiresAt: now.Add(time.Hour)}
+			if err := dao.CreateRefreshToken(other); err != nil {
+				t.Fatal(err)
+			}
+			if err := dao.RevokeRefreshTokens("first", now); err != nil {
+				t.Fatal(err)
+			}
+			if err := dao.RotateRefreshToken("second", &RefreshToken{Hash: "third", IssuedAt: now.Add(time.Minute)}); !hasCode(err, errInvalidRefreshToken) {
+				t.Errorf("RotateRefreshToken of a revoked family: %v", err)
+			}
+			if err := dao.RotateRefreshToken("other", &RefreshToken{Hash: "other-2", IssuedAt: now.Add(time.Minute), ExpiresAt: now.Add(time.Hour)}); err != nil {
+				t.Errorf("revoking a family revoked another: %v", err)
+			}
+			if n, err := dao.DeleteExpiredRefreshTokens(now.Add(90 * time.Minute)); err != nil || n != 3 {
+				t.Errorf("DeleteExpiredRefreshTokens = %d, %v, want 3", n, err)
+			}
+		})
+	}
+}
+
+func TestDAOLoginFailures(t *testing.T) {
+	for _, tt := range testDAOs {
+		t.Run(tt.name, func(t *testing.T) {
+			dao := tt.new(t)
+			now := time.Now().UTC().Truncate(time.Second)
+			keys := []string{"user:alice", "ip:127.0.0.1"}
+			if f, err := dao.GetLoginFailures(keys[0]); err != nil || f.Count != 0 || f.Key != keys[0] {
+				t.Errorf("GetLoginFailures without failures = %+v, %v", f, err)
+			}
+			allow := func([]*LoginFailures) error { return nil }
+			for i := 0; i < 2; i++ {
+				if _, err := dao.ReserveLoginAttempt(keys, now, time.Hour, allow); err != nil {
+					t.Fatal(err)
+				}
+			}
+			locked := errTooManyLogins.msg("locked out")
+			failures, err := dao.ReserveLoginAttempt(keys, now, time.Hour, func(failures []*LoginFailures) error {
+				if failures[0].Count >= 2 {
+					return locked
+				}
+				return nil
+			})
+			if err != locked || failures != nil {
+				t.Errorf("ReserveLoginAttempt past check = %v, %v", failures, err)
+			}
+			// a count starts over after resetAfter
+			failures, err = dao.ReserveLoginAttempt(keys[1:], now.Add(time.Hour), time.Hour, allow)
+			if err != nil || len(failures) != 1 || failures[0].Count != 1 || !failures[0].Last.Equal(now.Add(time.Hour)) {
+				t.Errorf("ReserveLoginAttempt after resetAfter = %+v, %v", failures, err)
+			}
+
+			if err := dao.ReleaseLoginAttempt(keys[0]); err != nil {
+				t.Fatal(err)
+			}
+			if f, _ := dao.GetLoginFailures(keys[0]); f.Count != 1 {
+				t.Errorf("%s has %d failures after taking one back, want 1", keys[0], f.Count)
+			}
+			if err := dao.ReleaseLoginAttempt("user:nobody"); err != nil {
+				t.Errorf("ReleaseLoginAttempt without failures: %v", err)
+			}
+			if err := dao.ClearLoginFailures(keys[1]); err != nil {
+				t.Fatal(err)
+			}
+			if f, _ := dao.GetLoginFailures(keys[1]); f.Count != 0 {
+				t.Errorf("%s has %d failures after clearing them", keys[1], f.Count)
+			}
+			if n, err := dao.DeleteStaleLoginFailures(now.Add(time.Minute)); err != nil || n != 1 {
+				t.Errorf("DeleteStaleLoginFailures = %d, %v, want 1", n, err)
+			}
+			if f, _ := dao.GetLoginFailures(keys[0]); f.Count != 0 {
+				t.Errorf("%s has %d stale failures", keys[0], f.Count)
+			}
+		})
+	}
+}
+
+func TestDAOCarts(t *testing.T) {
+	for _, tt := range testDAOs {
+		t.Run(tt.name, func(t *testing.T) {
+			dao := tt.new(t)
+			if err := dao.SetProductInventory(testCatalog()); err != nil {
+				t.Fatal(err)
+			}
+			user := &User{Username: "shopper"}
+			if err := dao.CreateUser(user); err != nil {
+				t.Fatal(err)
+			}
+			cart, err := dao.GetCartByUserID(user.ID)
+			if err != nil || cart.Name != CartNameActive || len(cart.Products) != 0 {
+				t.Fatalf("GetCartByUserID = %+v, %v", cart, err)
+			}
+			belt := testCatalog()[0]
+			cart.Products[belt.ID] = newCartLine(belt, 2)
+			if err := dao.SetCart(cart); err != nil {
+				t.Fatal(err)
+			}
+			if saved, err := dao.GetCart(cart.ID); err != nil || saved.Products[belt.ID].Quantity != 2 {
+				t.Errorf("GetCart after SetCart = %+v, %v", saved, err)
+			}
+
+			carts, err := dao.UpdateCarts(user.ID, func(_ CartDAO, carts map[string]*Cart) error {
+				carts[CartNameWishlist] = &Cart{Products: CartLines{belt.ID: newCartLine(belt, 1)}}
+				carts["later"] = &Cart{}
+				return nil
+			})
+			if err != nil || carts[CartNameWishlist].ID == 0 || carts[CartNameWishlist].UserID != user.ID {
+				t.Fatalf("UpdateCarts = %+v, %v", carts, err)
+			}
+			failed := errors.New("failed")
+			if _, err := dao.UpdateCarts(user.ID, func(_ CartDAO, carts map[string]*Cart) error {
+				carts["never"] = &Cart{}
+				return failed
+			}); err != failed {
+				t.Errorf("UpdateCarts = %v, want the error of fn", err)
+			}
+			list, err := dao.GetCarts(user.ID)
+			if err != nil || len(list) != 3 || list[0].Name != CartNameActive || list[1].ID > list[2].ID {
+				t.Errorf("GetCarts = %+v, %v, want the active cart and 2 named ones sorted by ID", list, err)
+			}
+			with, err := dao.GetCartsWithProduct(CartNameWishlist, belt.ID)
+			if err != nil || len(with) != 1 || with[0].ID != carts[CartNameWishlist].ID {
+				t.Errorf("GetCartsWithProduct = %+v, %v", with, err)
+			}
+			if with, _ := dao.GetCartsWithProduct(CartNameWishlist, 2); len(with) != 0 {
+				t.Errorf("GetCartsWithProduct of a product nobody wants = %+v", with)
+			}
+			if err := dao.DeleteCart(user.ID, "later"); err != nil {
+				t.Fatal(err)
+			}
+			if err := dao.DeleteCart(user.ID, "later"); !hasCode(err, errCartNotFound) {
+				t.Errorf("DeleteCart of a missing cart: %v", err)
+			}
+		})
+	}
+}
+
+func TestDAOCouponsAndOrders(t *testing.T) {
+	for _, tt := range testDAOs {
+		t.Run(tt.name, func(t *testing.T) {
+			dao := tt.new(t)
+			users := []*User{{Username: "alice"}, {Username: "bob"}}
+			for _, user := range users {
+				if err := dao.CreateUser(user); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := dao.SetCoupons([]*Coupon{{Code: "welcome", MaxRedemptions: 2, MaxPerUser: 1}}); err != nil {
+				t.Fatal(err)
+			}
+			if coupon, err := dao.GetCoupon("Welcome"); err != nil || coupon.Code != "WELCOME" || coupon.Redeemed != 0 {
+				t.Errorf("GetCoupon = %+v, %v", coupon, err)
+			}
+			if _, err := dao.GetCoupon("missing"); !hasCode(err, errCouponNotFound) {
+				t.Errorf("GetCoupon of a missing coupon: %v", err)
+			}
+
+			now := time.Now().UTC().Truncate(time.Second)
+			buy := func(user *User, coupon string) (*Order, error) {
+				order := &Order{UserID: user.ID, Coupon: coupon, Status: OrderStatusCompleted, CreatedAt: now, UpdatedAt: now}
+				return order, dao.CreateOrder(order)
+			}
+			first, err := buy(users[0], "welcome")
+			if err != nil || first.ID == 0 {
+				t.Fatalf("CreateOrder gave ID %d: %v", first.ID, err)
+			}
+			if _, err := buy(users[0], "WELCOME"); !hasCode(err, errConflictCouponLimit) {
+				t.Errorf("second redemption by the same user: %v", err)
+			}
+			if _, err := buy(users[1], "welcome"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := buy(users[1], "missing"); !hasCode(err, errCouponNotFound) {
+				t.Errorf("CreateOrder with a missing coupon: %v", err)
+			}
+			if coupon, _ := dao.GetCoupon("welcome"); coupon.Redeemed != 2 {
+				t.Errorf("coupon redeemed %d times, want 2", coupon.Redeemed)
+			}
+			if n, err := dao.CountRedemptions("welcome", users[0].ID); err != nil || n != 1 {
+				t.Errorf("CountRedemptions = %d, %v, want 1", n, err)
+			}
+			second, err := buy(users[0], "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if order, err := dao.GetOrder(first.ID); err != nil || order.UserID != users[0].ID || order.Coupon == "" {
+				t.Errorf("GetOrder = %+v, %v", order, err)
+			}
+			if _, err := dao.GetOrder(99); !hasCode(err, errOrderNotFound) {
+				t.Errorf("GetOrder of a missing order: %v", err)
+			}
+			orders, err := dao.GetOrdersByUserID(users[0].ID)
+			if err != nil || len(orders) != 2 || orders[0].ID != first.ID || orders[1].ID != second.ID {
+				t.Errorf("GetOrdersByUserID = %+v, %v", orders, err)
+			}
+		})
+	}
+}
+
+func TestUpdateCartUndoesCallsWhenItFails(t *testing.T) {
+	for _, tt := range testDAOs {
+		t.Run(tt.name, func(t *testing.T) {
+			dao := tt.new(t)
+			if err := dao.SetProductInventory(testCatalog()); err != nil {
+				t.Fatal(err)
+			}
+			if err := dao.SetCoupons([]*Coupon{{Code: "ONCE", MaxRedemptions: 1}}); err != nil {
+				t.Fatal(err)
+			}
+			user := &User{Username: "shopper"}
+			if err := dao.CreateUser(user); err != nil {
+				t.Fatal(err)
+			}
+			guest := &User{Username: "guest"}
+			if err := dao.CreateGuest(guest, &AccessToken{Hash: "guest", ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+				t.Fatal(err)
+			}
+			if err := dao.HoldStock(&StockHold{UserID: guest.ID, ProductID: 2, Quantity: 2, ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+				t.Fatal(err)
+			}
+
+			failed := errors.New("failed")
+			_, err := dao.UpdateCart(user.ID, func(dao CartDAO, cart *Cart) error {
+				if err := dao.HoldStock(&StockHold{UserID: user.ID, ProductID: 1, Quantity: 3, ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+					return err
+				}
+				if err := dao.ReserveStock(user.ID, map[int]int{2: 1, 3: 1}); err != nil {
+					return err
+				}
+				if err := dao.ReleaseStock(map[int]int{3: 1}); err != nil {
+					return err
+				}
+				if err := dao.CreateOrder(&Order{UserID: user.ID, Coupon: "once", CreatedAt: time.Now()}); err != nil {
+					return err
+				}
+				if _, err := dao.UpdateCart(guest.ID, func(dao CartDAO, guestCart *Cart) error {
+					guestCart.add(&CartLine{ProductID: 2, Quantity: 2}, defaultMaxLineQuantity)
+					return dao.ReleaseHolds(guest.ID)
+				}); err != nil {
+					return err
+				}
+				if err := dao.DeleteGuest(guest.ID); err != nil {
+					return err
+				}
+				cart.add(&CartLine{ProductID: 1, Quantity: 3}, defaultMaxLineQuantity)
+				return failed
+			})
+			if err != failed {
+				t.Fatalf("UpdateCart = %v, want %v", err, failed)
+			}
+
+			check := func(dao DAO) {
+				t.Helper()
+				products, err := dao.GetProducts()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if products[1].Available != 10 || products[2].Stock != 5 || products[2].Available != 3 || products[3].Stock != 2 {
+					t.Errorf("%d belts and %d shirts available, %d shirts and %d suits in stock, want 10, 3, 5 and 2",
+						products[1].Available, products[2].Available, products[2].Stock, products[3].Stock)
+				}
+				if cart, err := dao.GetCartByUserID(user.ID); err != nil || !cart.empty() {
+					t.Errorf("cart = %+v, %v, want an empty one", cart, err)
+				}
+				if orders, err := dao.GetOrdersByUserID(user.ID); err != nil || len(orders) != 0 {
+					t.Errorf("%d orders, %v, want none", len(orders), err)
+				}
+				if coupon, err := dao.GetCoupon("once"); err != nil || coupon.Redeemed != 0 {
+					t.Errorf("coupon = %+v, %v, want it never redeemed", coupon, err)
+				}
+				if cart, err := dao.GetCartByUserID(guest.ID); err != nil || !cart.empty() {
+					t.Errorf("guest cart = %+v, %v, want an empty one", cart, err)
+				}
+				if token, err := dao.GetAccessToken("guest"); err != nil || token.UserID != guest.ID {
+					t.Errorf("guest session = %+v, %v", token, err)
+				}
+			}
+			check(dao)
+			if f, ok := dao.(*File); ok {
+				// without a snapshot the journal alone is replayed
+				if err := f.journal.Close(); err != nil {
+					t.Fatal(err)
+				}
+				reopened, err := NewFile(f.dir, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				check(reopened)
+			}
+		})
+	}
+}
+
+func TestUpdateCartKeepsWhatSucceeds(t *testing.T) {
+	for _, tt := range testDAOs {
+		t.Run(tt.name, func(t *testing.T) {
+			dao := tt.new(t)
+			if err := dao.SetProductInventory(testCatalog()); err != nil {
+				t.Fatal(err)
+			}
+			user := &User{Username: "shopper"}
+			if err := dao.CreateUser(user); err != nil {
+				t.Fatal(err)
+			}
+			guest := &User{Username: "guest"}
+			if err := dao.CreateGuest(guest, &AccessToken{Hash: "guest", ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+				t.Fatal(err)
+			}
+
+			failed := errors.New("failed")
+			_, err := dao.UpdateCart(user.ID, func(dao CartDAO, cart *Cart) error {
+				// a failed call only undoes itself
+				if err := dao.ReserveStock(user.ID, map[int]int{1: 1, 5: 2}); err == nil {
+					t.Error("2 shoes were reserved with 1 in stock")
+				}
+				if _, err := dao.UpdateCart(guest.ID, func(dao CartDAO, guestCart *Cart) error {
+					if err := dao.HoldStock(&StockHold{UserID: guest.ID, ProductID: 2, Quantity: 2, ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+						return err
+					}
+					guestCart.add(&CartLine{ProductID: 2, Quantity: 2}, defaultMaxLineQuantity)
+					return failed
+				}); err != failed {
+					t.Errorf("nested UpdateCart = %v, want %v", err, failed)
+				}
+				cart.add(&CartLine{ProductID: 1, Quantity: 3}, defaultMaxLineQuantity)
+				return dao.HoldStock(&StockHold{UserID: user.ID, ProductID: 1, Quantity: 3, ExpiresAt: time.Now().Add(time.Hour)})
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			products, err := dao.GetProducts()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if products[1].Stock != 10 || products[1].Available != 7 || products[2].Available != 5 {
+				t.Errorf("belts have stock %d and %d available and %d shirts are available, want 10, 7 and 5",
+					products[1].Stock, products[1].Available, products[2].Available)
+			}
+			if cart, err := dao.GetCartByUserID(user.ID); err != nil || cart.Products[1] == nil || cart.Products[1].Quantity != 3 {
+				t.Errorf("cart = %+v, %v, want 3 belts", cart, err)
+			}
+			if cart, err := dao.GetCartByUserID(guest.ID); err != nil || !cart.empty() {
+				t.Errorf("guest cart = %+v, %v, want an empty one", cart, err)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package shopping
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"strings"
 
@@ -12,7 +13,8 @@ import (
 type ctxKey string
 
 const (
-	ctxUser ctxKey = "user"
+	ctxUser        ctxKey = "user"
+	ctxAccessToken ctxKey = "access_token"
 )
 
 // LoggingMiddleware outputs requests path and response status,
@@ -35,7 +37,7 @@ func (s *Service) LoggingMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-// ValidateAccessToken middleware and sets token info into context
+// ValidateAccessToken middleware rejects tokens that are unknown, expired or revoked and sets token info into context
 func (s *Service) ValidateAccessToken(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
@@ -55,13 +57,62 @@ func (s *Service) ValidateAccessToken(next http.Handler) http.Handler {
 			s.writeError(w, errMissingAccessToken.msg("ValidateAccessToken.Bearer"))
 			return
 		}
-		user, err := s.dao.GetUserByToken(token)
+		user, session, err := s.authenticate(token)
 		if err != nil {
-			s.writeError(w, errInternalServerError.msg("Couldn't find user for token"))
+			s.writeError(w, err)
+			return
+		}
+		if user.Guest {
+			s.writeError(w, errInvalidAccessToken.msg("cart token of a guest sent as an access token"))
 			return
 		}
 		ctx := context.WithValue(r.Context(), ctxUser, user)
+		if session != nil {
+			ctx = context.WithValue(ctx, ctxAccessToken, session)
+		}
 		next.ServeHTTP(w, r.WithContext(ctx))
 
 	})
 }
+
+// ValidateCartAccess middleware lets through users with an access token, like ValidateAccessToken, and guests with
+// the cart token in the X-Cart-Token header
+func (s *Service) ValidateCartAccess(next http.Handler) http.Handler {
+	validateAccessToken := s.ValidateAccessToken(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			validateAccessToken.ServeHTTP(w, r)
+			return
+		}
+		token := r.Header.Get(cartTokenHeader)
+		if token == "" {
+			s.writeError(w, errMissingAccessToken.msg("ValidateCartAccess.X-Cart-Token"))
+			return
+		}
+		user, err := s.authenticateGuest(token)
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxUser, user)))
+	})
+}
+
+// RequireRoles middleware only lets through users with any of roles,
+// it must run after ValidateAccessToken
+func (s *Service) RequireRoles(roles ...Role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, ctxErr := getUserFromContext(r.Context())
+			if ctxErr != nil {
+				s.writeError(w, ctxErr)
+				return
+			}
+			if !user.hasRole(roles...) {
+				s.writeError(w, errForbidden.msg(fmt.Sprintf("user %d needs any of the roles %v", user.ID, roles)))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
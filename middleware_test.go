@@ -0,0 +1,134 @@
+package shopping
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// protect returns handler behind ValidateAccessToken and RequireRoles with roles, as the router puts it
+func protect(s *Service, roles ...Role) http.Handler {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+	return s.ValidateAccessToken(s.RequireRoles(roles...)(ok))
+}
+
+// authorized returns a request with token as the bearer access token
+func authorized(token string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/v1/admin/products", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func TestRequireRoles(t *testing.T) {
+	dao := NewMemory()
+	s := newTestService(t, dao)
+	tokens := map[string]string{}
+	for _, user := range []*User{
+		{Username: "customer"},
+		{Username: "merchandiser", Roles: []Role{RoleMerchandiser}},
+		{Username: "admin", Roles: []Role{RoleAdmin}},
+	} {
+		if err := dao.CreateUser(user); err != nil {
+			t.Fatal(err)
+		}
+		pair, err := s.issueTokens(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens[user.Username] = pair.Token
+	}
+
+	admin, merchandiser := protect(s, RoleAdmin), protect(s, RoleMerchandiser)
+	tests := []struct {
+		user    string
+		handler http.Handler
+		want    int
+	}{
+		{user: "customer", handler: admin, want: http.StatusForbidden},
+		{user: "customer", handler: merchandiser, want: http.StatusForbidden},
+		{user: "merchandiser", handler: admin, want: http.StatusForbidden},
+		{user: "merchandiser", handler: merchandiser, want: http.StatusOK},
+		{user: "admin", handler: admin, want: http.StatusOK},
+		{user: "admin", handler: merchandiser, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		tt.handler.ServeHTTP(w, authorized(tokens[tt.user]))
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d: %s", tt.user, w.Code, tt.want, w.Body)
+		}
+	}
+}
+
+func TestValidateAccessTokenRejects(t *testing.T) {
+	for _, tt := range testDAOs {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			now := time.Now()
+			clock := func() time.Time {
+				mu.Lock()
+				defer mu.Unlock()
+				return now
+			}
+			dao := tt.new(t)
+			s := newTestService(t, dao, SetClock(clock), SetTokenTTL(time.Hour))
+			user := &User{Username: "shopper"}
+			if err := dao.CreateUser(user); err != nil {
+				t.Fatal(err)
+			}
+			login := func() string {
+				t.Helper()
+				pair, err := s.issueTokens(user)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return pair.Token
+			}
+			guest, _, _, err := s.createGuest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			handler := protect(s, RoleCustomer)
+			status := func(r *http.Request) int {
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, r)
+				return w.Code
+			}
+
+			revoked := login()
+			w := httptest.NewRecorder()
+			s.ValidateAccessToken(http.HandlerFunc(s.HandleLogout)).ServeHTTP(w, authorized(revoked))
+			if w.Code != http.StatusOK {
+				t.Fatalf("logout: status %d: %s", w.Code, w.Body)
+			}
+			expired := login()
+			if code := status(authorized(expired)); code != http.StatusOK {
+				t.Fatalf("token before it expires: status %d, want 200", code)
+			}
+			mu.Lock()
+			now = now.Add(time.Hour)
+			mu.Unlock()
+
+			basic := httptest.NewRequest(http.MethodGet, "/v1/admin/products", nil)
+			basic.SetBasicAuth("shopper", "correct horse")
+			for name, r := range map[string]*http.Request{
+				"no token":         httptest.NewRequest(http.MethodGet, "/v1/admin/products", nil),
+				"basic auth":       basic,
+				"empty token":      authorized(""),
+				"unknown token":    authorized("unknown"),
+				"revoked token":    authorized(revoked),
+				"expired token":    authorized(expired),
+				"guest cart token": authorized(guest),
+			} {
+				if code := status(r); code != http.StatusUnauthorized {
+					t.Errorf("%s: status %d, want 401", name, code)
+				}
+			}
+			if code := status(authorized(login())); code != http.StatusOK {
+				t.Errorf("new token: status %d, want 200", code)
+			}
+		})
+	}
+}
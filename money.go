@@ -0,0 +1,133 @@
+package shopping
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// DefaultCurrency is used for amounts that don't specify a currency,
+// e.g. plain numbers in config files written before prices had a currency
+var DefaultCurrency = "USD"
+
+// minorUnits is the number of decimals of currencies that don't use 2
+var minorUnits = map[string]int{
+	"BHD": 3,
+	"CLP": 0,
+	"ISK": 0,
+	"JOD": 3,
+	"JPY": 0,
+	"KRW": 0,
+	"KWD": 3,
+	"OMR": 3,
+	"TND": 3,
+	"VND": 0,
+}
+
+// Money is an amount in the minor unit of a currency, e.g. cents for USD.
+// Amounts are always whole minor units, the only operation that rounds is Percent
+// which rounds half away from zero to the closest minor unit.
+type Money struct {
+	Amount   int64  `json:"amount"`   // in minor units
+	Currency string `json:"currency"` // ISO 4217 code
+}
+
+// NewMoney converts an amount in major units, e.g. dollars, to Money rounding to the closest minor unit
+func NewMoney(major float64, currency string) Money {
+	scale := math.Pow10(Decimals(currency))
+	return Money{Amount: int64(math.Round(major * scale)), Currency: currency}
+}
+
+// Decimals returns the number of minor unit digits of a currency
+func Decimals(currency string) int {
+	if d, ok := minorUnits[strings.ToUpper(currency)]; ok {
+		return d
+	}
+	return 2
+}
+
+// Add returns m + o, both must be in the same currency
+func (m Money) Add(o Money) Money {
+	return Money{Amount: m.Amount + m.same(o).Amount, Currency: m.currency(o)}
+}
+
+// Sub returns m - o, both must be in the same currency
+func (m Money) Sub(o Money) Money {
+	return Money{Amount: m.Amount - m.same(o).Amount, Currency: m.currency(o)}
+}
+
+// Mul returns m multiplied by n
+func (m Money) Mul(n int64) Money {
+	return Money{Amount: m.Amount * n, Currency: m.Currency}
+}
+
+// Percent returns pct percent of m rounded half away from zero, e.g. 15% of 0.05 is 0.01
+func (m Money) Percent(pct float64) Money {
+	basisPoints := int64(math.Round(pct * 100))
+	return Money{Amount: divRound(m.Amount*basisPoints, 10000), Currency: m.Currency}
+}
+
+// IsZero reports if the amount is 0
+func (m Money) IsZero() bool {
+	return m.Amount == 0
+}
+
+// String formats the amount in major units followed by the currency, e.g. 20.50 USD
+func (m Money) String() string {
+	decimals := Decimals(m.Currency)
+	sign := ""
+	amount := m.Amount
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	if decimals == 0 {
+		return fmt.Sprintf("%s%d %s", sign, amount, m.Currency)
+	}
+	scale := int64(math.Pow10(decimals))
+	return fmt.Sprintf("%s%d.%0*d %s", sign, amount/scale, decimals, amount%scale, m.Currency)
+}
+
+// UnmarshalJSON accepts a Money object or a plain number in major units of the DefaultCurrency
+func (m *Money) UnmarshalJSON(data []byte) error {
+	var major float64
+	if err := json.Unmarshal(data, &major); err == nil {
+		*m = NewMoney(major, DefaultCurrency)
+		return nil
+	}
+	type money Money // avoids calling UnmarshalJSON recursively
+	v := money{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*m = Money(v)
+	if m.Currency == "" {
+		m.Currency = DefaultCurrency
+	}
+	m.Currency = strings.ToUpper(m.Currency)
+	return nil
+}
+
+// same panics if o is in a different currency, a zero amount without currency can be used with any currency
+func (m Money) same(o Money) Money {
+	if m.Currency != o.Currency && m.Currency != "" && o.Currency != "" {
+		panic(fmt.Sprintf("money: can't mix %s and %s", m.Currency, o.Currency))
+	}
+	return o
+}
+
+func (m Money) currency(o Money) string {
+	if m.Currency != "" {
+		return m.Currency
+	}
+	return o.Currency
+}
+
+// divRound divides a by b rounding half away from zero, b must be positive
+func divRound(a, b int64) int64 {
+	if a < 0 {
+		return -((-a + b/2) / b)
+	}
+	return (a + b/2) / b
+}
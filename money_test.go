@@ -0,0 +1,85 @@
+package shopping
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMoneyPercent(t *testing.T) {
+	tests := []struct {
+		amount  int64
+		percent float64
+		want    int64
+	}{
+		{amount: 5, percent: 15, want: 1},        // 0.75 cents rounds up
+		{amount: 2000, percent: 15, want: 300},   // 15% off a belt
+		{amount: 1999, percent: 15, want: 300},   // 299.85 cents
+		{amount: 1990, percent: 15, want: 299},   // 298.5 cents rounds half away from zero
+		{amount: -1990, percent: 15, want: -299}, // and so do negative amounts
+		{amount: 12000, percent: 12.5, want: 1500},
+		{amount: 3, percent: 50, want: 2},
+		{amount: 1, percent: 10, want: 0},
+	}
+	for _, tt := range tests {
+		got := Money{Amount: tt.amount, Currency: "USD"}.Percent(tt.percent)
+		if got.Amount != tt.want || got.Currency != "USD" {
+			t.Errorf("%d.Percent(%g) = %v, want %d", tt.amount, tt.percent, got, tt.want)
+		}
+	}
+}
+
+func TestNewMoney(t *testing.T) {
+	tests := []struct {
+		major    float64
+		currency string
+		want     int64
+	}{
+		{major: 20.5, currency: "USD", want: 2050},
+		{major: 0.1 + 0.2, currency: "USD", want: 30}, // not 30.000000000000004
+		{major: 149.5, currency: "JPY", want: 150},
+		{major: 1.2345, currency: "KWD", want: 1235},
+	}
+	for _, tt := range tests {
+		if got := NewMoney(tt.major, tt.currency); got.Amount != tt.want || got.Currency != tt.currency {
+			t.Errorf("NewMoney(%g, %s) = %v, want %d", tt.major, tt.currency, got, tt.want)
+		}
+	}
+}
+
+func TestMoneyString(t *testing.T) {
+	tests := []struct {
+		money Money
+		want  string
+	}{
+		{money: Money{Amount: 2050, Currency: "USD"}, want: "20.50 USD"},
+		{money: Money{Amount: -5, Currency: "USD"}, want: "-0.05 USD"},
+		{money: Money{Amount: 150, Currency: "JPY"}, want: "150 JPY"},
+		{money: Money{Amount: 1235, Currency: "KWD"}, want: "1.235 KWD"},
+	}
+	for _, tt := range tests {
+		if got := tt.money.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestMoneyUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Money
+	}{
+		{in: `20.5`, want: Money{Amount: 2050, Currency: DefaultCurrency}},
+		{in: `{"amount": 2050, "currency": "eur"}`, want: Money{Amount: 2050, Currency: "EUR"}},
+		{in: `{"amount": 2050}`, want: Money{Amount: 2050, Currency: DefaultCurrency}},
+	}
+	for _, tt := range tests {
+		var got Money
+		if err := json.Unmarshal([]byte(tt.in), &got); err != nil {
+			t.Errorf("Unmarshal(%s): %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Unmarshal(%s) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,476 @@
+package shopping
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// oidcLoginCookie keeps the state, nonce and PKCE verifier of a login between the redirect and the callback
+	oidcLoginCookie = "oidc_login"
+	oidcLoginTTL    = 10 * time.Minute
+	oidcHTTPTimeout = 10 * time.Second
+	// oidcClockSkew is how far the clock of the identity provider may be ahead of ours
+	oidcClockSkew = time.Minute
+	// oidcMaxResponseBytes caps what's read from the identity provider
+	oidcMaxResponseBytes = 1 << 20
+)
+
+// OIDCConfig lets users sign in with an OpenID Connect identity provider using the authorization code flow,
+// users are created the first time they sign in and found by the subject the provider gives them afterwards
+type OIDCConfig struct {
+	Issuer       string   `json:"issuer"`                  // URL the discovery document is read from, it must match the iss claim
+	ClientID     string   `json:"client_id"`               // ID of the service registered with the provider
+	ClientSecret string   `json:"client_secret,omitempty"` // sent with HTTP Basic to the token endpoint
+	RedirectURL  string   `json:"redirect_url"`            // URL of the callback handler registered with the provider
+	Scopes       []string `json:"scopes,omitempty"`        // openid and profile by default, openid is always asked for
+}
+
+// oidcDiscovery is the part of the discovery document the login flow needs
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcClaims are the claims of an ID token the service looks at
+type oidcClaims struct {
+	Issuer            string          `json:"iss"`
+	Subject           string          `json:"sub"`
+	Audience          json.RawMessage `json:"aud"` // a string or a list of strings
+	AuthorizedParty   string          `json:"azp,omitempty"`
+	ExpiresAt         int64           `json:"exp"`
+	IssuedAt          int64           `json:"iat"`
+	Nonce             string          `json:"nonce,omitempty"`
+	PreferredUsername string          `json:"preferred_username,omitempty"`
+	Email             string          `json:"email,omitempty"`
+}
+
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use,omitempty"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+}
+
+// oidcProvider talks to the identity provider, the discovery document and signing keys are fetched the first time
+// they're needed and kept, keys are fetched again when an ID token is signed with one that isn't known yet
+type oidcProvider struct {
+	config OIDCConfig
+	client *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]*rsa.PublicKey
+}
+
+func newOIDCProvider(c *OIDCConfig) (*oidcProvider, error) {
+	config := *c
+	config.Issuer = strings.TrimSuffix(config.Issuer, "/")
+	issuer, err := url.Parse(config.Issuer)
+	if err != nil || issuer.Host == "" || (issuer.Scheme != "https" && issuer.Scheme != "http") {
+		return nil, fmt.Errorf("invalid oidc issuer %q", c.Issuer)
+	}
+	if config.ClientID == "" {
+		return nil, errors.New("oidc client id is missing")
+	}
+	if _, err := url.ParseRequestURI(config.RedirectURL); err != nil {
+		return nil, fmt.Errorf("invalid oidc redirect url %q", config.RedirectURL)
+	}
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "profile"}
+	}
+	openid := false
+	for _, scope := range config.Scopes {
+		openid = openid || scope == "openid"
+	}
+	if !openid {
+		config.Scopes = append([]string{"openid"}, config.Scopes...)
+	}
+	return &oidcProvider{config: config, client: &http.Client{Timeout: oidcHTTPTimeout}}, nil
+}
+
+// discover returns the discovery document of the issuer
+func (p *oidcProvider) discover() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	d := &oidcDiscovery{}
+	if err := p.getJSON(p.config.Issuer+"/.well-known/openid-configuration", d); err != nil {
+		return nil, fmt.Errorf("discovery: %v", err)
+	}
+	// a document claiming another issuer could hand out tokens we'd trust for this one
+	if strings.TrimSuffix(d.Issuer, "/") != p.config.Issuer {
+		return nil, fmt.Errorf("discovery is for issuer %q instead of %q", d.Issuer, p.config.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("discovery is missing the authorization, token or jwks endpoint")
+	}
+	p.discovery = d
+	return d, nil
+}
+
+// key returns the RSA key the issuer signs ID tokens with under kid
+func (p *oidcProvider) key(kid string) (*rsa.PublicKey, error) {
+	d, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	set := struct {
+		Keys []*jsonWebKey `json:"keys"`
+	}{}
+	if err := p.getJSON(d.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("jwks: %v", err)
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.KeyType != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		key, err := k.rsaPublicKey()
+		if err != nil {
+			return nil, fmt.Errorf("jwks key %q: %v", k.KeyID, err)
+		}
+		keys[k.KeyID] = key
+	}
+	p.keys = keys // keys the issuer stopped publishing are dropped
+	key, ok := keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("no signing key %q in jwks", kid)
+	}
+	return key, nil
+}
+
+func (k *jsonWebKey) rsaPublicKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, fmt.Errorf("invalid modulus: %v", err)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exponent: %v", err)
+	}
+	exponent := new(big.Int).SetBytes(e)
+	if len(n) < 256 || !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+		return nil, errors.New("unsupported rsa key, it must be at least 2048 bits")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+}
+
+// authCodeURL returns where to send the user to sign in
+func (p *oidcProvider) authCodeURL(state, nonce, verifier string) (string, error) {
+	d, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+	authorize, err := url.Parse(d.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid authorization endpoint: %v", err)
+	}
+	query := authorize.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", p.config.ClientID)
+	query.Set("redirect_uri", p.config.RedirectURL)
+	query.Set("scope", strings.Join(p.config.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", pkceChallenge(verifier))
+	query.Set("code_challenge_method", "S256")
+	authorize.RawQuery = query.Encode()
+	return authorize.String(), nil
+}
+
+// exchange trades an authorization code for the ID token of the user who signed in
+func (p *oidcProvider) exchange(code, verifier string) (string, error) {
+	d, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest(http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	res, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	tokens := struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}{}
+	if err := json.NewDecoder(io.LimitReader(res.Body, oidcMaxResponseBytes)).Decode(&tokens); err != nil {
+		return "", fmt.Errorf("token endpoint answered %s: %v", res.Status, err)
+	}
+	if tokens.Error != "" {
+		return "", &oidcError{code: tokens.Error, description: tokens.ErrorDescription}
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint answered %s", res.Status)
+	}
+	if tokens.IDToken == "" {
+		return "", errors.New("token endpoint didn't return an id token")
+	}
+	return tokens.IDToken, nil
+}
+
+// verify checks the ID token was signed by the issuer for this client and the login with nonce, and hasn't expired
+func (p *oidcProvider) verify(token, nonce string, now time.Time) (*oidcClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed id token")
+	}
+	header := struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}{}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed id token header: %v", err)
+	}
+	if header.Algorithm != "RS256" {
+		return nil, fmt.Errorf("id token signed with %q instead of RS256", header.Algorithm)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed id token signature: %v", err)
+	}
+	key, err := p.key(header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, errors.New("invalid id token signature")
+	}
+
+	claims := &oidcClaims{}
+	if err := decodeJWTPart(parts[1], claims); err != nil {
+		return nil, fmt.Errorf("malformed id token claims: %v", err)
+	}
+	if strings.TrimSuffix(claims.Issuer, "/") != p.config.Issuer {
+		return nil, fmt.Errorf("id token issued by %q instead of %q", claims.Issuer, p.config.Issuer)
+	}
+	audience, err := claims.audience()
+	if err != nil {
+		return nil, err
+	}
+	if !containsString(audience, p.config.ClientID) {
+		return nil, fmt.Errorf("id token is for %v instead of %q", audience, p.config.ClientID)
+	}
+	if len(audience) > 1 && claims.AuthorizedParty != p.config.ClientID {
+		return nil, fmt.Errorf("id token was handed to %q instead of %q", claims.AuthorizedParty, p.config.ClientID)
+	}
+	if !now.Before(time.Unix(claims.ExpiresAt, 0)) {
+		return nil, fmt.Errorf("id token expired at %s", time.Unix(claims.ExpiresAt, 0).UTC().Format(time.RFC3339))
+	}
+	if time.Unix(claims.IssuedAt, 0).After(now.Add(oidcClockSkew)) {
+		return nil, errors.New("id token issued in the future")
+	}
+	if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		return nil, errors.New("id token nonce doesn't match the login")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("id token has no subject")
+	}
+	return claims, nil
+}
+
+func (c *oidcClaims) audience() ([]string, error) {
+	var one string
+	if err := json.Unmarshal(c.Audience, &one); err == nil {
+		return []string{one}, nil
+	}
+	many := []string{}
+	if err := json.Unmarshal(c.Audience, &many); err != nil {
+		return nil, errors.New("id token audience must be a string or a list of strings")
+	}
+	return many, nil
+}
+
+func (p *oidcProvider) getJSON(location string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, location, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, io.LimitReader(res.Body, oidcMaxResponseBytes))
+		return fmt.Errorf("%s answered %s", location, res.Status)
+	}
+	return json.NewDecoder(io.LimitReader(res.Body, oidcMaxResponseBytes)).Decode(v)
+}
+
+// oidcError is an error the identity provider answered with, e.g. an authorization code that was already used
+type oidcError struct {
+	code        string
+	description string
+}
+
+func (e *oidcError) Error() string {
+	if e.description == "" {
+		return e.code
+	}
+	return e.code + ": " + e.description
+}
+
+// pkceChallenge returns the S256 code challenge of a PKCE verifier
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// oidcLogin is what's kept in the login cookie, all three values are random and can't contain dots
+type oidcLogin struct {
+	state    string
+	nonce    string
+	verifier string
+}
+
+func newOIDCLogin() (*oidcLogin, error) {
+	values := make([]string, 3)
+	for i := range values {
+		v, err := newAccessToken()
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+	}
+	return &oidcLogin{state: values[0], nonce: values[1], verifier: values[2]}, nil
+}
+
+func (l *oidcLogin) String() string {
+	return l.state + "." + l.nonce + "." + l.verifier
+}
+
+func parseOIDCLogin(cookie string) (*oidcLogin, bool) {
+	parts := strings.Split(cookie, ".")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return nil, false
+	}
+	return &oidcLogin{state: parts[0], nonce: parts[1], verifier: parts[2]}, true
+}
+
+// oidcCookie returns the login cookie, an empty value deletes it. It's only sent back to the callback.
+func (s *Service) oidcCookie(value string, secure bool) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     oidcLoginCookie,
+		Value:    value,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   secure,
+		MaxAge:   int(oidcLoginTTL / time.Second),
+	}
+	if callback, err := url.Parse(s.oidc.config.RedirectURL); err == nil && callback.Path != "" {
+		cookie.Path = callback.Path
+	}
+	if value == "" {
+		cookie.MaxAge = -1
+	}
+	return cookie
+}
+
+// oidcUser returns the user signed in with the ID token claims, creating one the first time the subject signs in.
+// The username comes from preferred_username, or the email, and gets a number added when it's taken.
+func (s *Service) oidcUser(claims *oidcClaims) (*User, error) {
+	subject := s.oidc.config.Issuer + "#" + claims.Subject
+	user, err := s.dao.GetUserBySubject(subject)
+	if err != errUserNotFound {
+		return user, err
+	}
+
+	username := claims.PreferredUsername
+	if username == "" {
+		username = strings.SplitN(claims.Email, "@", 2)[0]
+	}
+	username = oidcUsername(username)
+	for i := 1; ; i++ {
+		candidate := username
+		if i > 1 {
+			suffix := fmt.Sprintf("-%d", i)
+			if len(candidate)+len(suffix) > 32 {
+				candidate = candidate[:32-len(suffix)]
+			}
+			candidate += suffix
+		}
+		user = &User{Username: candidate, Subject: subject}
+		err := s.dao.CreateUser(user)
+		if err == nil {
+			return user, nil
+		}
+		if errors.Is(err, errConflictSubjectTaken) {
+			// signed in twice at the same time, the other login created the user
+			return s.dao.GetUserBySubject(subject)
+		}
+		if !errors.Is(err, errConflictUsernameTaken) || i == 100 {
+			return nil, err
+		}
+	}
+}
+
+// oidcUsername drops the characters usernames can't have and makes sure it's long enough
+func oidcUsername(name string) string {
+	username := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '_', r == '-':
+			return r
+		}
+		return -1
+	}, name)
+	if len(username) > 32 {
+		username = username[:32]
+	}
+	if len(username) < 3 {
+		username = "user" + username
+	}
+	return username
+}
@@ -0,0 +1,237 @@
+package shopping
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jaimemartinez88/api.shopping/fakeidp"
+)
+
+const testOIDCCallback = "http://shop.test/v1/oidc/callback"
+
+// newTestOIDC returns a service signing users in with a fake identity provider served by an httptest server
+func newTestOIDC(t *testing.T) (*Service, *Memory, *httptest.Server) {
+	t.Helper()
+	var idp http.Handler
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { idp.ServeHTTP(w, r) }))
+	t.Cleanup(server.Close)
+	provider, err := fakeidp.New(server.URL, "shop", "secret", testOIDCCallback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp = provider
+
+	dao := NewMemory()
+	s := newTestService(t, dao, SetOIDC(&OIDCConfig{Issuer: server.URL, ClientID: "shop", ClientSecret: "secret", RedirectURL: testOIDCCallback}))
+	return s, dao, server
+}
+
+// signIn sends the user to the authorization endpoint at location as username and returns where they're sent back to
+func signIn(t *testing.T, location, username string) *url.URL {
+	t.Helper()
+	authorize, err := url.Parse(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := authorize.Query()
+	query.Set("login_hint", username)
+	authorize.RawQuery = query.Encode()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	res, err := client.Get(authorize.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	back, err := res.Location()
+	if err != nil {
+		t.Fatalf("authorize: status %s without a redirect", res.Status)
+	}
+	return back
+}
+
+// oidcCallback starts a login with the service, signs in as username and returns the callback request the browser
+// makes with the login cookie
+func oidcCallback(t *testing.T, s *Service, username string) *http.Request {
+	t.Helper()
+	w := serve(s.HandleOIDCLogin, httptest.NewRequest(http.MethodGet, "/v1/oidc/login", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("login: status %d: %s", w.Code, w.Body)
+	}
+	back := signIn(t, w.Header().Get("Location"), username)
+	r := httptest.NewRequest(http.MethodGet, back.String(), nil)
+	for _, cookie := range w.Result().Cookies() {
+		r.AddCookie(cookie)
+	}
+	return r
+}
+
+func TestOIDCDiscovery(t *testing.T) {
+	s, _, server := newTestOIDC(t)
+	d, err := s.oidc.discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Issuer != server.URL || d.AuthorizationEndpoint != server.URL+"/authorize" || d.TokenEndpoint != server.URL+"/token" || d.JWKSURI != server.URL+"/jwks" {
+		t.Errorf("discovery = %+v, want the endpoints of %s", d, server.URL)
+	}
+
+	// a document for another issuer isn't trusted
+	other, err := newOIDCProvider(&OIDCConfig{Issuer: server.URL + "/other", ClientID: "shop", RedirectURL: testOIDCCallback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.discover(); err == nil {
+		t.Error("discovery of another issuer was accepted")
+	}
+}
+
+func TestOIDCLoginCreatesTheUserOnce(t *testing.T) {
+	s, dao, server := newTestOIDC(t)
+	login := func() {
+		w := serve(s.HandleOIDCCallback, oidcCallback(t, s, "alice"))
+		if w.Code != http.StatusOK {
+			t.Fatalf("callback: status %d: %s", w.Code, w.Body)
+		}
+		tokens := &tokenPair{}
+		if err := json.NewDecoder(w.Body).Decode(tokens); err != nil {
+			t.Fatal(err)
+		}
+		if tokens.Token == "" || tokens.RefreshToken == "" {
+			t.Errorf("callback handed out %+v", tokens)
+		}
+	}
+
+	login()
+	user, err := dao.GetUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(user.Subject, server.URL+"#") {
+		t.Errorf("alice has subject %q, want one of %s", user.Subject, server.URL)
+	}
+	login()
+	if again, err := dao.GetUserBySubject(user.Subject); err != nil || again.ID != user.ID {
+		t.Errorf("second login signed in user %+v (%v), want %d", again, err, user.ID)
+	}
+	if _, err := dao.GetUser("alice-2"); err != errUserNotFound {
+		t.Errorf("second login created another user: %v", err)
+	}
+}
+
+func TestOIDCCallbackRejectsStateAndNonce(t *testing.T) {
+	s, _, _ := newTestOIDC(t)
+	tests := []struct {
+		name   string
+		change func(r *http.Request) *http.Request
+		want   *Error
+	}{
+		{
+			name: "another state",
+			change: func(r *http.Request) *http.Request {
+				query := r.URL.Query()
+				query.Set("state", "another")
+				r.URL.RawQuery = query.Encode()
+				return r
+			},
+			want: errBadRequestInvalidOIDCState,
+		},
+		{
+			name: "no login cookie",
+			change: func(r *http.Request) *http.Request {
+				r.Header.Del("Cookie")
+				return r
+			},
+			want: errBadRequestInvalidOIDCState,
+		},
+		{
+			name: "another nonce",
+			change: func(r *http.Request) *http.Request {
+				cookie, err := r.Cookie(oidcLoginCookie)
+				if err != nil {
+					t.Fatal(err)
+				}
+				login, _ := parseOIDCLogin(cookie.Value)
+				login.nonce = "another"
+				r.Header.Set("Cookie", (&http.Cookie{Name: oidcLoginCookie, Value: login.String()}).String())
+				return r
+			},
+			want: errOIDCLoginFailed,
+		},
+	}
+	for _, tt := range tests {
+		w := serve(s.HandleOIDCCallback, tt.change(oidcCallback(t, s, "alice")))
+		if w.Code != tt.want.Code || !strings.Contains(w.Body.String(), tt.want.Message) {
+			t.Errorf("%s: status %d: %s, want %d %q", tt.name, w.Code, w.Body, tt.want.Code, tt.want.Message)
+		}
+	}
+	if _, err := s.dao.GetUser("alice"); err != errUserNotFound {
+		t.Errorf("a rejected login created alice: %v", err)
+	}
+}
+
+func TestOIDCVerifiesTheSignature(t *testing.T) {
+	s, _, _ := newTestOIDC(t)
+	idToken := func(username string) string {
+		t.Helper()
+		location, err := s.oidc.authCodeURL("state", "nonce", "verifier")
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := s.oidc.exchange(signIn(t, location, username).Query().Get("code"), "verifier")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	alice, bob := strings.Split(idToken("alice"), "."), strings.Split(idToken("bob"), ".")
+	if _, err := s.oidc.verify(strings.Join(alice, "."), "nonce", time.Now()); err != nil {
+		t.Fatalf("token signed by the issuer: %v", err)
+	}
+
+	claims := map[string]interface{}{}
+	payload, _ := base64.RawURLEncoding.DecodeString(alice[1])
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		t.Fatal(err)
+	}
+	claims["preferred_username"] = "admin"
+	payload, _ = json.Marshal(claims)
+	tampered := alice[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + alice[2]
+	unknownKey := `{"alg":"RS256","kid":"another"}`
+
+	for name, token := range map[string]string{
+		"changed claims":        tampered,
+		"signature of another":  alice[0] + "." + alice[1] + "." + bob[2],
+		"key missing from jwks": base64.RawURLEncoding.EncodeToString([]byte(unknownKey)) + "." + alice[1] + "." + alice[2],
+		"unsigned":              base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + alice[1] + ".",
+	} {
+		if _, err := s.oidc.verify(token, "nonce", time.Now()); err == nil {
+			t.Errorf("%s: id token was accepted", name)
+		}
+	}
+}
+
+func TestOIDCUsername(t *testing.T) {
+	for name, want := range map[string]string{
+		"alice":                 "alice",
+		"Ana María":             "AnaMara",
+		"jo":                    "userjo",
+		"名前":                    "user",
+		"a.b_c-d!":              "a.b_c-d",
+		strings.Repeat("x", 40): strings.Repeat("x", 32),
+	} {
+		if got := oidcUsername(name); got != want || !usernamePattern.MatchString(got) {
+			t.Errorf("oidcUsername(%q) = %q, want %q", name, got, want)
+		}
+	}
+	if err := errConflictUsernameTaken.msg("taken"); !errors.Is(err, errConflictUsernameTaken) || errors.Is(err, errConflictSubjectTaken) {
+		t.Errorf("copy %v isn't only %v", err, errConflictUsernameTaken)
+	}
+}
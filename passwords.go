@@ -0,0 +1,127 @@
+package shopping
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// passwordCost is the bcrypt work factor, each step doubles the time it takes to hash and check a password.
+// Passwords hashed with a lower cost are hashed again on login.
+const passwordCost = bcrypt.DefaultCost
+
+const (
+	minPasswordLength = 10
+	maxPasswordBytes  = 72 // bcrypt ignores anything longer
+)
+
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9._-]{3,32}$`)
+
+// commonPasswords are rejected on registration even though they're long enough
+var commonPasswords = map[string]bool{
+	"1234567890":    true,
+	"0123456789":    true,
+	"1111111111":    true,
+	"password1":     true,
+	"password12":    true,
+	"password123":   true,
+	"password1234":  true,
+	"qwertyuiop":    true,
+	"1q2w3e4r5t":    true,
+	"iloveyou123":   true,
+	"letmein123":    true,
+	"welcome123":    true,
+	"shopping123":   true,
+	"abcdefghij":    true,
+	"administrator": true,
+}
+
+// dummyHash is checked against when a user doesn't exist so logins take as long as with a wrong password
+const dummyHash = "$2a$10$Bb3yMzmPXoTFOvTfNxbPZum0yRpOdlZmSJyy7S9lX4i.0c.95e.W2"
+
+// hashPassword returns the bcrypt hash of password
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// isPasswordHash reports if password is already a bcrypt hash
+func isPasswordHash(password string) bool {
+	_, err := bcrypt.Cost([]byte(password))
+	return err == nil
+}
+
+// checkPassword reports if password is the user's, upgrade is true when the password is right but was hashed with a
+// lower cost. Passwords in plain text never match, they're hashed when users are loaded and when storage is opened.
+func checkPassword(user *User, password string) (ok, upgrade bool) {
+	if !isPasswordHash(user.Password) {
+		// users signing in with single sign-on have no password
+		checkPasswordWithoutUser(password)
+		return false, false
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+		return false, false
+	}
+	cost, _ := bcrypt.Cost([]byte(user.Password))
+	return true, cost < passwordCost
+}
+
+// checkPasswordWithoutUser takes as long as checking a password so failed logins don't tell if the user exists
+func checkPasswordWithoutUser(password string) {
+	bcrypt.CompareHashAndPassword([]byte(dummyHash), []byte(password))
+}
+
+// HashPasswords hashes the passwords of users that are still in plain text, e.g. in config files written before
+// passwords were hashed, and returns how many were hashed
+func HashPasswords(users []*User) (int, error) {
+	hashed := 0
+	for _, u := range users {
+		if u.Password == "" || isPasswordHash(u.Password) {
+			continue
+		}
+		hash, err := hashPassword(u.Password)
+		if err != nil {
+			return hashed, fmt.Errorf("user %s: %v", u.Username, err)
+		}
+		u.Password = hash
+		hashed++
+	}
+	return hashed, nil
+}
+
+// checkUsername returns why a username can't be registered, nil when it can
+func checkUsername(username string) error {
+	if !usernamePattern.MatchString(username) {
+		return errors.New("must be 3 to 32 letters, digits, dots, dashes or underscores")
+	}
+	return nil
+}
+
+// checkPasswordPolicy returns every reason the password isn't good enough, none when it is
+func checkPasswordPolicy(username, password string) []string {
+	reasons := []string{}
+	if utf8.RuneCountInString(password) < minPasswordLength {
+		reasons = append(reasons, fmt.Sprintf("must be at least %d characters long", minPasswordLength))
+	}
+	if len(password) > maxPasswordBytes {
+		reasons = append(reasons, fmt.Sprintf("must be at most %d bytes long", maxPasswordBytes))
+	}
+	lower := strings.ToLower(password)
+	if username != "" && strings.Contains(lower, strings.ToLower(username)) {
+		reasons = append(reasons, "must not contain the username")
+	}
+	if commonPasswords[lower] {
+		reasons = append(reasons, "is too common")
+	}
+	if password != "" && strings.Count(password, password[:1]) == len(password) {
+		reasons = append(reasons, "must not repeat a single character")
+	}
+	return reasons
+}
@@ -0,0 +1,169 @@
+package shopping
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestCheckPassword(t *testing.T) {
+	hash, err := hashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cheap, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		stored      string
+		password    string
+		ok, upgrade bool
+	}{
+		{name: "right password", stored: hash, password: "correct horse", ok: true},
+		{name: "wrong password", stored: hash, password: "battery staple"},
+		{name: "hash sent as the password", stored: hash, password: hash},
+		{name: "lower cost", stored: string(cheap), password: "correct horse", ok: true, upgrade: true},
+		{name: "plain text", stored: "correct horse", password: "correct horse"},
+		{name: "single sign-on user", stored: "", password: ""},
+	}
+	for _, tt := range tests {
+		ok, upgrade := checkPassword(&User{Password: tt.stored}, tt.password)
+		if ok != tt.ok || upgrade != tt.upgrade {
+			t.Errorf("%s: checkPassword = %v, %v, want %v, %v", tt.name, ok, upgrade, tt.ok, tt.upgrade)
+		}
+	}
+}
+
+func TestCheckPasswordPolicy(t *testing.T) {
+	tests := []struct {
+		password string
+		reasons  []string
+	}{
+		{password: "correct horse battery"},
+		{password: "short", reasons: []string{"must be at least 10 characters long"}},
+		{password: "ñandúñandú"},
+		{password: strings.Repeat("ab", 37), reasons: []string{"must be at most 72 bytes long"}},
+		{password: "I am Shopper!", reasons: []string{"must not contain the username"}},
+		{password: "Password123", reasons: []string{"is too common"}},
+		{password: "zzzzzzzzzzzz", reasons: []string{"must not repeat a single character"}},
+		{password: "aaa", reasons: []string{"must be at least 10 characters long", "must not repeat a single character"}},
+	}
+	for _, tt := range tests {
+		reasons := checkPasswordPolicy("shopper", tt.password)
+		if strings.Join(reasons, ", ") != strings.Join(tt.reasons, ", ") {
+			t.Errorf("%q: reasons %q, want %q", tt.password, reasons, tt.reasons)
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, tt := range testDAOs {
+		t.Run(tt.name, func(t *testing.T) {
+			dao := tt.new(t)
+			s := newTestService(t, dao)
+			register := func(username, password string) *httptest.ResponseRecorder {
+				body, _ := json.Marshal(map[string]string{"username": username, "password": password})
+				return serve(s.HandleRegister, httptest.NewRequest(http.MethodPost, "/v1/register", strings.NewReader(string(body))))
+			}
+
+			w := register("shopper", "correct horse")
+			if w.Code != http.StatusOK {
+				t.Fatalf("register: status %d: %s", w.Code, w.Body)
+			}
+			if strings.Contains(w.Body.String(), "password") {
+				t.Errorf("register answered with the password: %s", w.Body)
+			}
+			user, err := dao.GetUser("shopper")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !isPasswordHash(user.Password) || bcrypt.CompareHashAndPassword([]byte(user.Password), []byte("correct horse")) != nil {
+				t.Errorf("stored password %q isn't the bcrypt hash of the password", user.Password)
+			}
+			if w := serve(s.HandleLogin, loginRequest("shopper", "correct horse", "192.0.2.1:1234")); w.Code != http.StatusOK {
+				t.Errorf("login after registering: status %d: %s", w.Code, w.Body)
+			}
+
+			for _, reject := range []struct {
+				username, password string
+				want               *Error
+			}{
+				{"shopper", "another horse", errConflictUsernameTaken},
+				{"no", "correct horse", errBadRequestInvalidUsername},
+				{"shop keeper", "correct horse", errBadRequestInvalidUsername},
+				{"keeper", "password123", errBadRequestWeakPassword},
+				{"keeper", "keeper1234567", errBadRequestWeakPassword},
+			} {
+				w := register(reject.username, reject.password)
+				if w.Code != reject.want.Code || !strings.Contains(w.Body.String(), reject.want.Message) {
+					t.Errorf("register %q %q: status %d: %s, want %d %q", reject.username, reject.password, w.Code, w.Body, reject.want.Code, reject.want.Message)
+				}
+			}
+			if _, err := dao.GetUser("keeper"); err != errUserNotFound {
+				t.Errorf("a rejected registration created keeper: %v", err)
+			}
+		})
+	}
+}
+
+func TestInitUsersHashesPasswords(t *testing.T) {
+	dao := NewMemory()
+	s := newTestService(t, dao)
+	hash, err := hashPassword("battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.InitUsers([]*User{{ID: 1, Username: "plain", Password: "correct horse"}, {ID: 2, Username: "hashed", Password: hash}}); err != nil {
+		t.Fatal(err)
+	}
+	for username, password := range map[string]string{"plain": "correct horse", "hashed": "battery staple"} {
+		user, err := dao.GetUser(username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, _ := checkPassword(user, password); !ok || !isPasswordHash(user.Password) {
+			t.Errorf("%s has password %q, want the hash of %q", username, user.Password, password)
+		}
+	}
+	if user, _ := dao.GetUser("hashed"); user.Password != hash {
+		t.Errorf("a hashed password was hashed again")
+	}
+}
+
+func TestFileHashesPlainPasswords(t *testing.T) {
+	dir := tempDir(t)
+	f, err := NewFile(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// stored before passwords were hashed
+	if err := f.SetUser(&User{ID: 1, Username: "shopper", Password: "correct horse"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		f, err = NewFile(dir, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		user, err := f.GetUser("shopper")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, _ := checkPassword(user, "correct horse"); !ok {
+			t.Errorf("opening %d: password %q isn't the hash of the one stored in plain text", i+1, user.Password)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,545 @@
+package shopping
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ConditionType names a check made on the cart before a promotion applies
+type ConditionType string
+
+const (
+	// ConditionQuantity is met when the cart has at least MinQuantity items of ProductType
+	ConditionQuantity ConditionType = "quantity"
+	// ConditionSubtotal is met when the cart costs at least MinSubtotal before any discount
+	ConditionSubtotal ConditionType = "subtotal"
+	// ConditionSegment is met when the user belongs to Segment
+	ConditionSegment ConditionType = "segment"
+	// ConditionCoupon is met when the cart has the coupon Code
+	ConditionCoupon ConditionType = "coupon"
+)
+
+// ActionType names what a promotion does to the price of the items it applies to
+type ActionType string
+
+const (
+	// ActionPercentOff takes Percent off the price of each item
+	ActionPercentOff ActionType = "percent_off"
+	// ActionFixedOff takes Amount off the price of each item
+	ActionFixedOff ActionType = "fixed_off"
+	// ActionFixedPrice sells each item for Amount if that's cheaper
+	ActionFixedPrice ActionType = "fixed_price"
+	// ActionFreeItem gives items away, use Limit to say how many
+	ActionFreeItem ActionType = "free_item"
+	// ActionCartPercentOff takes Percent off the whole cart once item discounts are applied
+	ActionCartPercentOff ActionType = "cart_percent_off"
+	// ActionCartFixedOff takes Amount off the whole cart once item discounts are applied
+	ActionCartFixedOff ActionType = "cart_fixed_off"
+	// ActionFreeShipping waives the shipping fee
+	ActionFreeShipping ActionType = "free_shipping"
+)
+
+// StackingPolicy says how a promotion combines with others applied to the same item
+type StackingPolicy string
+
+const (
+	// StackingExclusive promotions don't combine with any other, the first one evaluated wins. It's the default
+	StackingExclusive StackingPolicy = "exclusive"
+	// StackingStackable promotions combine with other stackable ones, each working on the price left by the previous
+	StackingStackable StackingPolicy = "stackable"
+	// StackingBestForCustomer promotions replace the ones applied before them when they leave the item cheaper
+	StackingBestForCustomer StackingPolicy = "best_for_customer"
+)
+
+// SkippedPromotion explains why a promotion targeting an item wasn't applied to it
+type SkippedPromotion struct {
+	PromotionID int    `json:"promotion_id"`
+	Reason      string `json:"reason"`
+}
+
+// Condition is a check made on the cart, only the fields used by its type are set
+type Condition struct {
+	Type        ConditionType `json:"type"`
+	ProductType int           `json:"product_type,omitempty"` // quantity
+	MinQuantity int           `json:"min_quantity,omitempty"` // quantity
+	MinSubtotal *Money        `json:"min_subtotal,omitempty"` // subtotal, in the base currency
+	Segment     string        `json:"segment,omitempty"`      // segment
+	Code        string        `json:"code,omitempty"`         // coupon, case insensitive
+}
+
+// Action changes the price of the items in the cart of the given product types
+type Action struct {
+	Type         ActionType `json:"type"`
+	ProductTypes []int      `json:"product_types,omitempty"` // items the action applies to, every item when empty
+	Percent      float64    `json:"percent,omitempty"`       // percent_off and cart_percent_off, from 0 to 100
+	Amount       *Money     `json:"amount,omitempty"`        // fixed_off, fixed_price and cart_fixed_off, in the base currency
+	Skip         int        `json:"skip,omitempty"`          // items left at their price before the action applies
+	Limit        int        `json:"limit,omitempty"`         // most items the action applies to, 0 is no limit
+}
+
+// promotionContext is everything conditions are checked against
+type promotionContext struct {
+	now        time.Time
+	user       *User
+	coupon     string         // code of the coupon in the cart, in upper case
+	lines      []*CartProduct // split further as promotions apply to some of the units of a line
+	quantities map[int]int    // by product type
+	subtotal   Money          // before discounts
+	shipping   Money          // fee charged for the cart, zero when shipping is free
+}
+
+// conditionCheckers report if a condition is met, new kinds of conditions are added here
+var conditionCheckers = map[ConditionType]func(*Condition, *promotionContext) bool{
+	ConditionQuantity: func(c *Condition, ctx *promotionContext) bool {
+		return ctx.quantities[c.ProductType] >= c.MinQuantity
+	},
+	ConditionSubtotal: func(c *Condition, ctx *promotionContext) bool {
+		return ctx.subtotal.Amount >= c.MinSubtotal.Amount
+	},
+	ConditionSegment: func(c *Condition, ctx *promotionContext) bool {
+		return ctx.user != nil && ctx.user.inSegment(c.Segment)
+	},
+	ConditionCoupon: func(c *Condition, ctx *promotionContext) bool {
+		return ctx.coupon != "" && strings.EqualFold(c.Code, ctx.coupon)
+	},
+}
+
+// actionAppliers change the price of a single item and report if it changed, new kinds of actions are added here
+var actionAppliers = map[ActionType]func(*Action, *CartProduct) bool{
+	ActionPercentOff: func(a *Action, p *CartProduct) bool {
+		off := p.DiscountedPrice.Percent(a.Percent)
+		if off.IsZero() {
+			return false
+		}
+		p.DiscountedPrice = p.DiscountedPrice.Sub(off)
+		p.Discount = true
+		p.DiscountPercentage = a.Percent
+		return true
+	},
+	ActionFixedOff: func(a *Action, p *CartProduct) bool {
+		off := *a.Amount
+		if off.Amount > p.DiscountedPrice.Amount {
+			off.Amount = p.DiscountedPrice.Amount
+		}
+		if off.IsZero() {
+			return false
+		}
+		p.DiscountedPrice = p.DiscountedPrice.Sub(off)
+		p.Discount = true
+		return true
+	},
+	ActionFixedPrice: func(a *Action, p *CartProduct) bool {
+		if a.Amount.Amount >= p.DiscountedPrice.Amount {
+			return false
+		}
+		p.DiscountedPrice = Money{Amount: a.Amount.Amount, Currency: p.DiscountedPrice.Currency}
+		p.SpecialPrice = true
+		return true
+	},
+	ActionFreeItem: func(a *Action, p *CartProduct) bool {
+		if p.DiscountedPrice.IsZero() {
+			return false
+		}
+		p.DiscountedPrice = Money{Currency: p.DiscountedPrice.Currency}
+		p.SpecialPrice = true
+		return true
+	},
+}
+
+// cartActionAppliers return how much an action takes off a cart costing total with the given shipping fee,
+// new kinds of actions on the whole cart are added here
+var cartActionAppliers = map[ActionType]func(a *Action, total, shipping Money) Money{
+	ActionCartPercentOff: func(a *Action, total, shipping Money) Money {
+		return total.Percent(a.Percent)
+	},
+	ActionCartFixedOff: func(a *Action, total, shipping Money) Money {
+		if a.Amount.Amount > total.Amount {
+			return total
+		}
+		return Money{Amount: a.Amount.Amount, Currency: total.Currency}
+	},
+	ActionFreeShipping: func(a *Action, total, shipping Money) Money {
+		return shipping
+	},
+}
+
+// validate checks the promotion can be evaluated
+func (p *Promotion) validate() error {
+	if p.Action == nil {
+		return fmt.Errorf("promotion %d has no action", p.ID)
+	}
+	for _, c := range p.Conditions {
+		if _, ok := conditionCheckers[c.Type]; !ok {
+			return fmt.Errorf("promotion %d has an unknown condition %q", p.ID, c.Type)
+		}
+		if c.Type == ConditionSubtotal && c.MinSubtotal == nil {
+			return fmt.Errorf("promotion %d has a subtotal condition without min_subtotal", p.ID)
+		}
+		if c.Type == ConditionSegment && c.Segment == "" {
+			return fmt.Errorf("promotion %d has a segment condition without segment", p.ID)
+		}
+		if c.Type == ConditionCoupon && c.Code == "" {
+			return fmt.Errorf("promotion %d has a coupon condition without code", p.ID)
+		}
+	}
+	if p.Schedule != nil {
+		if err := p.Schedule.validate(); err != nil {
+			return fmt.Errorf("promotion %d has an invalid schedule: %v", p.ID, err)
+		}
+	}
+	switch p.Stacking {
+	case "", StackingExclusive, StackingStackable, StackingBestForCustomer:
+	default:
+		return fmt.Errorf("promotion %d has an unknown stacking policy %q", p.ID, p.Stacking)
+	}
+	a := p.Action
+	_, onItems := actionAppliers[a.Type]
+	if _, onCart := cartActionAppliers[a.Type]; !onItems && !onCart {
+		return fmt.Errorf("promotion %d has an unknown action %q", p.ID, a.Type)
+	}
+	if !onItems && (len(a.ProductTypes) > 0 || a.Skip > 0 || a.Limit > 0) {
+		return fmt.Errorf("promotion %d can't target items with %s", p.ID, a.Type)
+	}
+	if (a.Type == ActionFixedOff || a.Type == ActionCartFixedOff) && (a.Amount == nil || a.Amount.Amount <= 0) {
+		return fmt.Errorf("promotion %d needs a positive amount for %s", p.ID, a.Type)
+	}
+	if a.Type == ActionFixedPrice && (a.Amount == nil || a.Amount.Amount < 0) {
+		return fmt.Errorf("promotion %d needs an amount of 0 or more for %s", p.ID, a.Type)
+	}
+	if (a.Type == ActionPercentOff || a.Type == ActionCartPercentOff) && (a.Percent <= 0 || a.Percent > 100) {
+		return fmt.Errorf("promotion %d needs a percent between 0 and 100", p.ID)
+	}
+	if a.Skip < 0 || a.Limit < 0 {
+		return fmt.Errorf("promotion %d can't skip or limit a negative number of items", p.ID)
+	}
+	return nil
+}
+
+// met reports if the promotion is enabled and active and all the conditions of the promotion are met
+func (p *Promotion) met(ctx *promotionContext) bool {
+	if p.Disabled || !p.Schedule.activeAt(ctx.now) {
+		return false
+	}
+	for _, c := range p.Conditions {
+		check, ok := conditionCheckers[c.Type]
+		if !ok || !check(c, ctx) {
+			return false
+		}
+	}
+	return true
+}
+
+// apply runs the action of the promotion on the lines it targets following the stacking policies and returns the
+// lines, applied holds every promotion evaluated so far by ID. Every unit of a line is priced the same way so the
+// action is worked out once per line, a line is only split where Skip or Limit leave some of its units out.
+func (p *Promotion) apply(lines []*CartProduct, applied Promotions) []*CartProduct {
+	targets := map[int]bool{}
+	for _, t := range p.Action.ProductTypes {
+		targets[t] = true
+	}
+
+	result := make([]*CartProduct, 0, len(lines))
+	count, seen := 0, 0
+	for i, line := range lines {
+		if len(targets) > 0 && !targets[line.ProductType] {
+			result = append(result, line)
+			continue
+		}
+		if skip := p.Action.Skip - seen; skip > 0 {
+			if skip >= line.Quantity {
+				seen += line.Quantity
+				result = append(result, line)
+				continue
+			}
+			seen += skip
+			result = append(result, line.split(skip))
+		}
+		if p.Action.Limit > 0 && count >= p.Action.Limit {
+			return append(result, lines[i:]...)
+		}
+
+		var rest *CartProduct // units over the limit, left as they were
+		if left := p.Action.Limit - count; p.Action.Limit > 0 && line.Quantity > left {
+			rest = line.copy()
+			rest.Quantity -= left
+		}
+		if p.stack(line, applied) {
+			line.Promotions = append(line.Promotions, p.ID)
+			if rest != nil {
+				line.Quantity -= rest.Quantity
+			}
+			count += line.Quantity
+			result = append(result, line)
+			if rest != nil {
+				result = append(result, rest)
+			}
+			continue
+		}
+		result = append(result, line)
+	}
+	return result
+}
+
+// stack applies the promotion to a single line if the stacking policies allow it and reports if the price changed,
+// when it doesn't the reason is added to the skipped promotions of the line
+func (p *Promotion) stack(line *CartProduct, applied Promotions) bool {
+	apply, ok := actionAppliers[p.Action.Type]
+	if !ok {
+		return false
+	}
+	if len(line.Promotions) == 0 {
+		if !apply(p.Action, line) {
+			line.skip(p.ID, "it doesn't lower the price")
+			return false
+		}
+		return true
+	}
+
+	for _, id := range line.Promotions {
+		if applied[id].stacking() == StackingExclusive {
+			line.skip(p.ID, fmt.Sprintf("promotion %d is exclusive", id))
+			return false
+		}
+	}
+	switch p.stacking() {
+	case StackingStackable:
+		for _, id := range line.Promotions {
+			if applied[id].stacking() != StackingStackable {
+				line.skip(p.ID, fmt.Sprintf("promotion %d doesn't stack", id))
+				return false
+			}
+		}
+		if !apply(p.Action, line) {
+			line.skip(p.ID, "it doesn't lower the price")
+			return false
+		}
+		return true
+	case StackingBestForCustomer:
+		alone := line.copy()
+		alone.resetPrice()
+		if !apply(p.Action, alone) || alone.DiscountedPrice.Amount >= line.DiscountedPrice.Amount {
+			line.skip(p.ID, fmt.Sprintf("promotions %v are better for the customer", line.Promotions))
+			return false
+		}
+		alone.SkippedPromotions = line.SkippedPromotions
+		for _, id := range line.Promotions {
+			alone.skip(id, fmt.Sprintf("promotion %d is better for the customer", p.ID))
+		}
+		*line = *alone
+		return true
+	default:
+		line.skip(p.ID, fmt.Sprintf("it's exclusive and promotion %d was applied first", line.Promotions[0]))
+		return false
+	}
+}
+
+// stacking returns the stacking policy of the promotion, exclusive unless set
+func (p *Promotion) stacking() StackingPolicy {
+	if p == nil || p.Stacking == "" {
+		return StackingExclusive
+	}
+	return p.Stacking
+}
+
+// ordered returns the promotions in evaluation order, by ascending priority and then ID
+func (p Promotions) ordered() []*Promotion {
+	promotions := make([]*Promotion, 0, len(p))
+	for _, promo := range p {
+		promotions = append(promotions, promo)
+	}
+	sort.Slice(promotions, func(i, j int) bool {
+		if promotions[i].Priority != promotions[j].Priority {
+			return promotions[i].Priority < promotions[j].Priority
+		}
+		return promotions[i].ID < promotions[j].ID
+	})
+	return promotions
+}
+
+// newPromotionContext returns what the conditions of promotions are checked against for a cart with the given lines,
+// coupon is the code entered in the cart, empty when there's none, and shipping the fee charged for the cart
+func newPromotionContext(now time.Time, user *User, coupon string, lines []*CartProduct, shipping Money) *promotionContext {
+	ctx := &promotionContext{now: now, user: user, coupon: strings.ToUpper(coupon), lines: lines, quantities: map[int]int{}}
+	for _, line := range lines {
+		ctx.quantities[line.ProductType] += line.Quantity
+		ctx.subtotal = ctx.subtotal.Add(line.UnitPrice.Mul(int64(line.Quantity)))
+	}
+	if len(lines) > 0 {
+		ctx.shipping = shipping
+	}
+	return ctx
+}
+
+// applyPromotions evaluates every promotion in order against the lines of a cart, leaving the priced lines in
+// ctx.lines, and returns the promotions applied, in evaluation order, and the adjustment lines of the cart.
+// How promotions combine on the same item depends on their stacking policies.
+// Promotions on the whole cart are applied once every item is priced.
+func applyPromotions(promotions Promotions, ctx *promotionContext) ([]*Promotion, []*Adjustment) {
+	ordered := promotions.ordered()
+	for _, promo := range ordered {
+		if _, onItems := actionAppliers[promo.Action.Type]; onItems && promo.met(ctx) {
+			ctx.lines = promo.apply(ctx.lines, promotions)
+		}
+	}
+
+	used := map[int]bool{}
+	total := Money{Currency: ctx.subtotal.Currency}
+	for _, line := range ctx.lines {
+		line.DiscountAmount = line.UnitPrice.Sub(line.DiscountedPrice)
+		total = total.Add(line.DiscountedPrice.Mul(int64(line.Quantity)))
+		for _, id := range line.Promotions {
+			used[id] = true
+		}
+	}
+	adjustments := applyCartPromotions(ordered, ctx, total)
+	for _, a := range adjustments {
+		if a.PromotionID != 0 {
+			used[a.PromotionID] = true
+		}
+	}
+	applied := []*Promotion{}
+	for _, promo := range ordered {
+		if used[promo.ID] {
+			applied = append(applied, promo)
+		}
+	}
+	return applied, adjustments
+}
+
+// applyCartPromotions returns the shipping fee and the discounts of the promotions on the whole cart,
+// total is what the items cost once discounted. Cart discounts follow the same stacking policies as item
+// discounts among themselves, each working on the total left by the previous ones, shipping is waived once at most.
+func applyCartPromotions(ordered []*Promotion, ctx *promotionContext, total Money) []*Adjustment {
+	adjustments := []*Adjustment{}
+	if !ctx.shipping.IsZero() {
+		adjustments = append(adjustments, &Adjustment{Type: AdjustmentShipping, Description: "shipping", Amount: ctx.shipping})
+	}
+
+	var waiver *Adjustment
+	discounts := []*Adjustment{}
+	discounted := total
+	for _, promo := range ordered {
+		apply, ok := cartActionAppliers[promo.Action.Type]
+		if !ok || !promo.met(ctx) {
+			continue
+		}
+		if promo.Action.Type == ActionFreeShipping {
+			if waiver == nil && !ctx.shipping.IsZero() {
+				waiver = promo.discount(apply(promo.Action, discounted, ctx.shipping))
+			}
+			continue
+		}
+
+		off := apply(promo.Action, discounted, ctx.shipping)
+		if off.IsZero() {
+			continue
+		}
+		if len(discounts) > 0 {
+			if !promo.stacksWith(discounts, ordered) {
+				continue
+			}
+			if promo.stacking() == StackingBestForCustomer {
+				alone := apply(promo.Action, total, ctx.shipping)
+				if alone.Amount <= total.Sub(discounted).Amount {
+					continue
+				}
+				discounts, discounted, off = discounts[:0], total, alone
+			}
+		}
+		discounts = append(discounts, promo.discount(off))
+		discounted = discounted.Sub(off)
+	}
+
+	adjustments = append(adjustments, discounts...)
+	if waiver != nil {
+		adjustments = append(adjustments, waiver)
+	}
+	return adjustments
+}
+
+// stacksWith reports if the stacking policies allow a cart promotion to be applied after the given discounts
+func (p *Promotion) stacksWith(discounts []*Adjustment, ordered []*Promotion) bool {
+	policies := map[int]StackingPolicy{}
+	for _, promo := range ordered {
+		policies[promo.ID] = promo.stacking()
+	}
+	for _, d := range discounts {
+		if policies[d.PromotionID] == StackingExclusive {
+			return false
+		}
+		if p.stacking() == StackingStackable && policies[d.PromotionID] != StackingStackable {
+			return false
+		}
+	}
+	return p.stacking() != StackingExclusive
+}
+
+// discount returns the adjustment line taking off from the cart for the promotion
+func (p *Promotion) discount(off Money) *Adjustment {
+	return &Adjustment{Type: AdjustmentDiscount, PromotionID: p.ID, Description: p.Name, Amount: Money{Currency: off.Currency}.Sub(off)}
+}
+
+// upgradePromotions converts promotions written before rules existed into rules
+// and gives an ID to every promotion without one, IDs are handed out in a stable order
+// so the same input always gets the same IDs
+func upgradePromotions(promotions []*Promotion) []*Promotion {
+	nextID := 0
+	for _, p := range promotions {
+		if p.ID > nextID {
+			nextID = p.ID
+		}
+	}
+	legacy := []*Promotion{}
+	upgraded := []*Promotion{}
+	for _, p := range promotions {
+		if p.Action == nil {
+			legacy = append(legacy, p)
+			continue
+		}
+		upgraded = append(upgraded, p)
+	}
+	sort.SliceStable(legacy, func(i, j int) bool { return legacy[i].ProductType < legacy[j].ProductType })
+
+	for _, p := range legacy {
+		if p.SpecialPrice != nil {
+			// items after the first QuantityForSpecialPrice ones cost SpecialPrice
+			upgraded = append(upgraded, &Promotion{
+				Name:       fmt.Sprintf("special price for product type %d", p.ProductType),
+				Conditions: []*Condition{{Type: ConditionQuantity, ProductType: p.ProductType, MinQuantity: atLeastOne(p.QuantityForSpecialPrice)}},
+				Action: &Action{
+					Type:         ActionFixedPrice,
+					ProductTypes: []int{p.ProductType},
+					Amount:       &Money{Amount: p.SpecialPrice.Amount, Currency: p.SpecialPrice.Currency},
+					Skip:         p.QuantityForSpecialPrice,
+				},
+			})
+		}
+		if len(p.ProductsDiscounted) > 0 && p.Discount > 0 {
+			upgraded = append(upgraded, &Promotion{
+				Name:       fmt.Sprintf("%g%% off when buying product type %d", p.Discount, p.ProductType),
+				Conditions: []*Condition{{Type: ConditionQuantity, ProductType: p.ProductType, MinQuantity: atLeastOne(p.QuantityForDiscount)}},
+				Action: &Action{
+					Type:         ActionPercentOff,
+					ProductTypes: append([]int(nil), p.ProductsDiscounted...),
+					Percent:      p.Discount,
+				},
+			})
+		}
+	}
+	for _, p := range upgraded {
+		if p.ID == 0 {
+			nextID++
+			p.ID = nextID
+		}
+	}
+	return upgraded
+}
+
+func atLeastOne(n int) int {
+	if n < 1 {
+		return 1
+	}
+	return n
+}
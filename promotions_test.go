@@ -0,0 +1,392 @@
+package shopping
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// testCatalog is the catalog of the shop in the spec
+func testCatalog() []*Product {
+	usd := func(amount int64) Money { return Money{Amount: amount, Currency: "USD"} }
+	return []*Product{
+		{ID: 1, Type: 1, Name: "Belt", Stock: 10, Price: usd(2000)},
+		{ID: 2, Type: 2, Name: "Shirt", Stock: 5, Price: usd(6000)},
+		{ID: 3, Type: 3, Name: "Suit", Stock: 2, Price: usd(30000)},
+		{ID: 4, Type: 4, Name: "Trouser", Stock: 4, Price: usd(7000)},
+		{ID: 5, Type: 5, Name: "Shoe", Stock: 1, Price: usd(12000)},
+		{ID: 6, Type: 6, Name: "Tie", Stock: 8, Price: usd(2000)},
+	}
+}
+
+// testPromotions are the promotions of the shop in the spec
+func testPromotions() Promotions {
+	return Promotions{
+		1: {
+			ID:         1,
+			Conditions: []*Condition{{Type: ConditionQuantity, ProductType: 4, MinQuantity: 2}},
+			Action:     &Action{Type: ActionPercentOff, ProductTypes: []int{1, 5}, Percent: 15},
+		},
+		2: {
+			ID:         2,
+			Conditions: []*Condition{{Type: ConditionQuantity, ProductType: 2, MinQuantity: 2}},
+			Action:     &Action{Type: ActionFixedPrice, ProductTypes: []int{2}, Amount: &Money{Amount: 4500, Currency: "USD"}, Skip: 2},
+		},
+		3: {
+			ID:         3,
+			Conditions: []*Condition{{Type: ConditionQuantity, ProductType: 2, MinQuantity: 3}},
+			Action:     &Action{Type: ActionPercentOff, ProductTypes: []int{6}, Percent: 50},
+		},
+	}
+}
+
+// testCart returns a cart with the quantities of the catalog products by ID
+func testCart(quantities map[int]int) *Cart {
+	products := map[int]*Product{}
+	for _, p := range testCatalog() {
+		products[p.ID] = p
+	}
+	cart := &Cart{Products: CartLines{}}
+	for id, quantity := range quantities {
+		cart.Products[id] = newCartLine(products[id], quantity)
+	}
+	return cart
+}
+
+var knownScenarios = []struct {
+	name          string
+	quantities    map[int]int
+	totalPrice    int64
+	totalDiscount int64
+}{
+	{name: "no promotion", quantities: map[int]int{3: 1, 6: 1}, totalPrice: 32000},
+	{name: "2 trousers take 15% off belts and shoes", quantities: map[int]int{4: 2, 1: 1, 5: 1}, totalPrice: 14000 + 1700 + 10200, totalDiscount: 300 + 1800},
+	{name: "1 trouser isn't enough", quantities: map[int]int{4: 1, 1: 1}, totalPrice: 9000},
+	{name: "shirts after the second cost 45", quantities: map[int]int{2: 4}, totalPrice: 12000 + 9000, totalDiscount: 3000},
+	{name: "2 shirts cost full price", quantities: map[int]int{2: 2, 6: 1}, totalPrice: 14000},
+	{name: "3 shirts halve the ties", quantities: map[int]int{2: 3, 6: 2}, totalPrice: 12000 + 4500 + 2000, totalDiscount: 1500 + 2000},
+	{name: "every promotion", quantities: map[int]int{1: 1, 2: 3, 4: 2, 5: 1, 6: 1}, totalPrice: 1700 + 16500 + 14000 + 10200 + 1000, totalDiscount: 300 + 1500 + 1800 + 1000},
+}
+
+func TestKnownPromotionScenarios(t *testing.T) {
+	s := New()
+	for _, tt := range knownScenarios {
+		cart := testCart(tt.quantities)
+		s.calculatePromotions(cart, nil, testPromotions(), time.Now())
+		if cart.TotalPrice.Amount != tt.totalPrice || cart.TotalDiscount.Amount != tt.totalDiscount {
+			t.Errorf("%s: total %v discount %v, want %d and %d", tt.name, cart.TotalPrice, cart.TotalDiscount, tt.totalPrice, tt.totalDiscount)
+		}
+		if cart.TotalPrice.Currency != "USD" {
+			t.Errorf("%s: total in %q, want USD", tt.name, cart.TotalPrice.Currency)
+		}
+	}
+}
+
+func TestKnownPromotionScenariosLegacyShape(t *testing.T) {
+	legacy := []*Promotion{
+		{ProductType: 4, QuantityForDiscount: 2, ProductsDiscounted: []int{1, 5}, Discount: 15},
+		{ProductType: 2, QuantityForSpecialPrice: 2, SpecialPrice: &Money{Amount: 4500, Currency: "USD"}},
+		{ProductType: 2, QuantityForDiscount: 3, ProductsDiscounted: []int{6}, Discount: 50},
+	}
+	promotions := Promotions{}
+	for _, p := range upgradePromotions(legacy) {
+		if err := p.validate(); err != nil {
+			t.Fatal(err)
+		}
+		promotions[p.ID] = p
+	}
+
+	s := New()
+	for _, tt := range knownScenarios {
+		cart := testCart(tt.quantities)
+		s.calculatePromotions(cart, nil, promotions, time.Now())
+		if cart.TotalPrice.Amount != tt.totalPrice || cart.TotalDiscount.Amount != tt.totalDiscount {
+			t.Errorf("%s: total %v discount %v, want %d and %d", tt.name, cart.TotalPrice, cart.TotalDiscount, tt.totalPrice, tt.totalDiscount)
+		}
+	}
+}
+
+func TestPercentOffRoundsEachItem(t *testing.T) {
+	// 15% of 19.99 is 2.9985, each item is rounded to 3.00 off so three of them take 9.00 off rather than 8.9955
+	cart := &Cart{Products: CartLines{1: {ProductID: 1, ProductType: 1, Quantity: 3, UnitPrice: Money{Amount: 1999, Currency: "USD"}}}}
+	promotions := Promotions{1: {ID: 1, Action: &Action{Type: ActionPercentOff, Percent: 15}}}
+
+	New().calculatePromotions(cart, nil, promotions, time.Now())
+	if cart.TotalPrice.Amount != 3*1699 || cart.TotalDiscount.Amount != 900 {
+		t.Errorf("total %v discount %v, want 50.97 and 9.00", cart.TotalPrice, cart.TotalDiscount)
+	}
+}
+
+func TestCatalogCurrencyWithoutRates(t *testing.T) {
+	s := New(SetDAO(NewMemory()))
+	products := testCatalog()
+	products[0].Price = Money{Amount: 2000, Currency: "EUR"}
+	if err := s.InitInventory(products); err == nil {
+		t.Error("a product in EUR was added to a catalog in USD")
+	}
+	if err := s.InitCoupons([]*Coupon{{Code: "EUROS", MinSpend: &Money{Amount: 100, Currency: "EUR"}}}); err == nil {
+		t.Error("a coupon with a min_spend in EUR was added to a catalog in USD")
+	}
+	if err := SetShipping(Money{Amount: 500, Currency: "EUR"})(s); err == nil {
+		t.Error("shipping in EUR was set for a catalog in USD")
+	}
+}
+
+func TestPriceCartInAnotherCurrency(t *testing.T) {
+	dao := NewMemory()
+	s := New(SetDAO(dao))
+	if err := s.InitInventory(testCatalog()); err != nil {
+		t.Fatal(err)
+	}
+	cart := testCart(map[int]int{1: 1})
+	cart.Products[6] = &CartLine{ProductID: 6, ProductType: 6, Quantity: 1, UnitPrice: Money{Amount: 2000, Currency: "EUR"}}
+
+	_, err := s.priceCart(cart, nil)
+	if e, ok := err.(*Error); !ok || e.Code != errBadRequestUnsupportedCurrency.Code {
+		t.Errorf("priceCart = %v, want %v", err, errBadRequestUnsupportedCurrency)
+	}
+}
+
+func TestPromotionsSplitLinesAtSkipAndLimit(t *testing.T) {
+	halfOff := func(skip, limit int, types ...int) Promotions {
+		return Promotions{1: {ID: 1, Action: &Action{Type: ActionPercentOff, ProductTypes: types, Percent: 50, Skip: skip, Limit: limit}}}
+	}
+	tests := []struct {
+		name       string
+		quantities map[int]int
+		promotions Promotions
+		lines      []int // quantities of the checkout lines
+		totalPrice int64
+	}{
+		{name: "skip and limit in one line", quantities: map[int]int{2: 5}, promotions: halfOff(1, 2, 2), lines: []int{1, 2, 2}, totalPrice: 3*6000 + 2*3000},
+		{name: "skip across lines", quantities: map[int]int{1: 2, 6: 2}, promotions: halfOff(3, 0, 1, 6), lines: []int{2, 1, 1}, totalPrice: 3*2000 + 1000},
+		{name: "limit across lines", quantities: map[int]int{1: 2, 6: 2}, promotions: halfOff(0, 3, 1, 6), lines: []int{2, 1, 1}, totalPrice: 2*1000 + 1000 + 2000},
+		{name: "the most units a line can have", quantities: map[int]int{1: defaultMaxLineQuantity}, promotions: halfOff(1, defaultMaxLineQuantity-2, 1), lines: []int{1, defaultMaxLineQuantity - 2, 1}, totalPrice: 2*2000 + (defaultMaxLineQuantity-2)*1000},
+		{
+			name:       "a promotion that doesn't apply leaves the line whole",
+			quantities: map[int]int{2: 4},
+			promotions: Promotions{
+				1: {ID: 1, Action: &Action{Type: ActionPercentOff, ProductTypes: []int{2}, Percent: 10}},
+				2: {ID: 2, Action: &Action{Type: ActionPercentOff, ProductTypes: []int{2}, Percent: 50, Limit: 1}},
+			},
+			lines:      []int{4},
+			totalPrice: 4 * 5400,
+		},
+	}
+	for _, tt := range tests {
+		cart := testCart(tt.quantities)
+		New().calculatePromotions(cart, nil, tt.promotions, time.Now())
+		lines := []int{}
+		for _, line := range cart.Checkout {
+			lines = append(lines, line.Quantity)
+		}
+		if fmt.Sprint(lines) != fmt.Sprint(tt.lines) || cart.TotalPrice.Amount != tt.totalPrice {
+			t.Errorf("%s: lines %v total %v, want %v and %d", tt.name, lines, cart.TotalPrice, tt.lines, tt.totalPrice)
+		}
+	}
+}
+
+func TestPromotionStacking(t *testing.T) {
+	percentOff := func(id int, stacking StackingPolicy, percent float64) *Promotion {
+		return &Promotion{ID: id, Stacking: stacking, Action: &Action{Type: ActionPercentOff, Percent: percent}}
+	}
+	fixedPrice := func(id int, stacking StackingPolicy, amount int64) *Promotion {
+		return &Promotion{ID: id, Stacking: stacking, Action: &Action{Type: ActionFixedPrice, Amount: &Money{Amount: amount, Currency: "USD"}}}
+	}
+	tests := []struct {
+		name       string
+		promotions []*Promotion
+		price      int64
+		applied    []int
+		skipped    string
+	}{
+		{
+			name:       "the first exclusive promotion wins",
+			promotions: []*Promotion{percentOff(1, "", 10), percentOff(2, StackingStackable, 20)},
+			price:      5400,
+			applied:    []int{1},
+			skipped:    "[2: promotion 1 is exclusive]",
+		},
+		{
+			name:       "an exclusive promotion after another",
+			promotions: []*Promotion{percentOff(1, StackingStackable, 10), percentOff(2, StackingExclusive, 50)},
+			price:      5400,
+			applied:    []int{1},
+			skipped:    "[2: it's exclusive and promotion 1 was applied first]",
+		},
+		{
+			name:       "stackable promotions work on the price left",
+			promotions: []*Promotion{percentOff(1, StackingStackable, 10), percentOff(2, StackingStackable, 20)},
+			price:      4320,
+			applied:    []int{1, 2},
+			skipped:    "[]",
+		},
+		{
+			name:       "a stackable promotion after one that doesn't stack",
+			promotions: []*Promotion{percentOff(1, StackingBestForCustomer, 10), percentOff(2, StackingStackable, 20)},
+			price:      5400,
+			applied:    []int{1},
+			skipped:    "[2: promotion 1 doesn't stack]",
+		},
+		{
+			name:       "best for the customer replaces a worse discount",
+			promotions: []*Promotion{fixedPrice(1, StackingStackable, 5000), percentOff(2, StackingBestForCustomer, 20)},
+			price:      4800,
+			applied:    []int{2},
+			skipped:    "[1: promotion 2 is better for the customer]",
+		},
+		{
+			name:       "best for the customer is skipped when it's worse",
+			promotions: []*Promotion{percentOff(1, StackingStackable, 20), percentOff(2, StackingBestForCustomer, 10)},
+			price:      4800,
+			applied:    []int{1},
+			skipped:    "[2: promotions [1] are better for the customer]",
+		},
+		{
+			name:       "a promotion that doesn't lower the price",
+			promotions: []*Promotion{fixedPrice(1, "", 7000), percentOff(2, "", 10)},
+			price:      5400,
+			applied:    []int{2},
+			skipped:    "[1: it doesn't lower the price]",
+		},
+		{
+			name:       "priority comes before the ID",
+			promotions: []*Promotion{percentOff(1, "", 10), {ID: 2, Priority: -1, Action: &Action{Type: ActionPercentOff, Percent: 20}}},
+			price:      4800,
+			applied:    []int{2},
+			skipped:    "[1: promotion 2 is exclusive]",
+		},
+	}
+	for _, tt := range tests {
+		promotions := Promotions{}
+		for _, p := range tt.promotions {
+			if err := p.validate(); err != nil {
+				t.Fatal(err)
+			}
+			promotions[p.ID] = p
+		}
+		cart := testCart(map[int]int{2: 1})
+		New().calculatePromotions(cart, nil, promotions, time.Now())
+		if len(cart.Checkout) != 1 {
+			t.Fatalf("%s: %d checkout lines, want 1", tt.name, len(cart.Checkout))
+		}
+		line := cart.Checkout[0]
+		skipped := []string{}
+		for _, s := range line.SkippedPromotions {
+			skipped = append(skipped, fmt.Sprintf("%d: %s", s.PromotionID, s.Reason))
+		}
+		if line.DiscountedPrice.Amount != tt.price || fmt.Sprint(line.Promotions) != fmt.Sprint(tt.applied) || fmt.Sprint(skipped) != tt.skipped {
+			t.Errorf("%s: price %v applied %v skipped %v, want %d %v %s", tt.name, line.DiscountedPrice, line.Promotions, skipped, tt.price, tt.applied, tt.skipped)
+		}
+		if line.Discount && line.SpecialPrice {
+			t.Errorf("%s: line is both discounted and at a special price", tt.name)
+		}
+	}
+}
+
+func TestCartPromotions(t *testing.T) {
+	usd := func(amount int64) *Money { return &Money{Amount: amount, Currency: "USD"} }
+	over := func(amount int64) []*Condition {
+		return []*Condition{{Type: ConditionSubtotal, MinSubtotal: usd(amount)}}
+	}
+	percentOff := func(id int, stacking StackingPolicy, percent float64) *Promotion {
+		return &Promotion{ID: id, Stacking: stacking, Conditions: over(30000), Action: &Action{Type: ActionCartPercentOff, Percent: percent}}
+	}
+	fixedOff := func(id int, stacking StackingPolicy, amount int64) *Promotion {
+		return &Promotion{ID: id, Stacking: stacking, Conditions: over(50000), Action: &Action{Type: ActionCartFixedOff, Amount: usd(amount)}}
+	}
+	freeShipping := &Promotion{ID: 3, Conditions: over(25000), Action: &Action{Type: ActionFreeShipping}}
+	halfPriceSuits := &Promotion{ID: 4, Action: &Action{Type: ActionPercentOff, ProductTypes: []int{3}, Percent: 50}}
+
+	tests := []struct {
+		name          string
+		quantities    map[int]int
+		promotions    []*Promotion
+		adjustments   string
+		totalPrice    int64
+		totalDiscount int64
+	}{
+		{
+			name:        "10% off orders over 300",
+			quantities:  map[int]int{2: 2, 3: 1},
+			promotions:  []*Promotion{percentOff(1, "", 10)},
+			adjustments: "[shipping 0 500 discount 1 -4200]",
+			totalPrice:  42000 + 500 - 4200, totalDiscount: 4200,
+		},
+		{
+			name:        "under the minimum subtotal",
+			quantities:  map[int]int{2: 4},
+			promotions:  []*Promotion{percentOff(1, "", 10)},
+			adjustments: "[shipping 0 500]",
+			totalPrice:  24000 + 500,
+		},
+		{
+			name:        "after item discounts",
+			quantities:  map[int]int{2: 2, 3: 1},
+			promotions:  []*Promotion{percentOff(1, StackingStackable, 10), halfPriceSuits},
+			adjustments: "[shipping 0 500 discount 1 -2700]",
+			totalPrice:  42000 + 500 - 15000 - 2700, totalDiscount: 15000 + 2700,
+		},
+		{
+			name:        "free shipping over 250",
+			quantities:  map[int]int{2: 2, 3: 1},
+			promotions:  []*Promotion{freeShipping},
+			adjustments: "[shipping 0 500 discount 3 -500]",
+			totalPrice:  42000, totalDiscount: 500,
+		},
+		{
+			name:        "exclusive cart discounts",
+			quantities:  map[int]int{3: 2},
+			promotions:  []*Promotion{percentOff(1, "", 10), fixedOff(2, "", 5000), freeShipping},
+			adjustments: "[shipping 0 500 discount 1 -6000 discount 3 -500]",
+			totalPrice:  60000 - 6000, totalDiscount: 6000 + 500,
+		},
+		{
+			name:        "stackable cart discounts",
+			quantities:  map[int]int{3: 2},
+			promotions:  []*Promotion{percentOff(1, StackingStackable, 10), fixedOff(2, StackingStackable, 5000)},
+			adjustments: "[shipping 0 500 discount 1 -6000 discount 2 -5000]",
+			totalPrice:  60000 + 500 - 11000, totalDiscount: 11000,
+		},
+		{
+			name:        "best for the customer replaces a smaller discount",
+			quantities:  map[int]int{3: 2},
+			promotions:  []*Promotion{percentOff(1, StackingStackable, 10), fixedOff(2, StackingBestForCustomer, 8000)},
+			adjustments: "[shipping 0 500 discount 2 -8000]",
+			totalPrice:  60000 + 500 - 8000, totalDiscount: 8000,
+		},
+		{
+			name:        "best for the customer skipped when smaller",
+			quantities:  map[int]int{3: 2},
+			promotions:  []*Promotion{percentOff(1, StackingStackable, 10), fixedOff(2, StackingBestForCustomer, 5000)},
+			adjustments: "[shipping 0 500 discount 1 -6000]",
+			totalPrice:  60000 + 500 - 6000, totalDiscount: 6000,
+		},
+		{
+			name:        "fixed off takes the cart to 0 at most",
+			quantities:  map[int]int{3: 2},
+			promotions:  []*Promotion{fixedOff(2, "", 90000)},
+			adjustments: "[shipping 0 500 discount 2 -60000]",
+			totalPrice:  500, totalDiscount: 60000,
+		},
+	}
+	s := New(SetShipping(Money{Amount: 500, Currency: "USD"}))
+	for _, tt := range tests {
+		promotions := Promotions{}
+		for _, p := range tt.promotions {
+			if err := p.validate(); err != nil {
+				t.Fatal(err)
+			}
+			promotions[p.ID] = p
+		}
+		cart := testCart(tt.quantities)
+		s.calculatePromotions(cart, nil, promotions, time.Now())
+		adjustments := []string{}
+		for _, a := range cart.Adjustments {
+			adjustments = append(adjustments, fmt.Sprintf("%s %d %d", a.Type, a.PromotionID, a.Amount.Amount))
+		}
+		if fmt.Sprint(adjustments) != tt.adjustments || cart.TotalPrice.Amount != tt.totalPrice || cart.TotalDiscount.Amount != tt.totalDiscount {
+			t.Errorf("%s: adjustments %v total %v discount %v, want %s %d and %d", tt.name, adjustments, cart.TotalPrice, cart.TotalDiscount, tt.adjustments, tt.totalPrice, tt.totalDiscount)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package shopping
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Schedule limits when a promotion is active. Start and End bound the whole promotion,
+// Days and From/Until make it recur within those bounds, e.g. on weekends only or during happy hour.
+type Schedule struct {
+	Start    *time.Time `json:"start,omitempty"`     // inclusive
+	End      *time.Time `json:"end,omitempty"`       // exclusive
+	TimeZone string     `json:"time_zone,omitempty"` // IANA name Days, From and Until are in, UTC by default
+	Days     []string   `json:"days,omitempty"`      // e.g. "saturday", every day when empty
+	From     string     `json:"from,omitempty"`      // time of day as 15:04, from midnight when empty
+	Until    string     `json:"until,omitempty"`     // time of day as 15:04 exclusive, until midnight when empty, can be before From to cross midnight
+}
+
+// locations caches time zones as loading them reads the zoneinfo database
+var locations = struct {
+	sync.Mutex
+	byName map[string]*time.Location
+}{byName: map[string]*time.Location{}}
+
+func loadLocation(name string) (*time.Location, error) {
+	locations.Lock()
+	defer locations.Unlock()
+
+	if loc, ok := locations.byName[name]; ok {
+		return loc, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locations.byName[name] = loc
+	return loc, nil
+}
+
+// validate checks the schedule can be evaluated
+func (s *Schedule) validate() error {
+	if s.Start != nil && s.End != nil && !s.End.After(*s.Start) {
+		return fmt.Errorf("end %s isn't after start %s", s.End, s.Start)
+	}
+	if _, err := loadLocation(s.TimeZone); err != nil {
+		return fmt.Errorf("invalid time zone %q: %v", s.TimeZone, err)
+	}
+	for _, d := range s.Days {
+		if _, ok := weekdays[strings.ToLower(d)]; !ok {
+			return fmt.Errorf("invalid day %q", d)
+		}
+	}
+	if _, err := minuteOfDay(s.From, 0); err != nil {
+		return fmt.Errorf("invalid from %q: %v", s.From, err)
+	}
+	if _, err := minuteOfDay(s.Until, 24*60); err != nil {
+		return fmt.Errorf("invalid until %q: %v", s.Until, err)
+	}
+	if s.From != "" && s.From == s.Until {
+		return fmt.Errorf("from and until are both %s", s.From)
+	}
+	return nil
+}
+
+// activeAt reports if t falls within the schedule, a nil schedule is always active
+func (s *Schedule) activeAt(t time.Time) bool {
+	if s == nil {
+		return true
+	}
+	if s.Start != nil && t.Before(*s.Start) {
+		return false
+	}
+	if s.End != nil && !t.Before(*s.End) {
+		return false
+	}
+	if len(s.Days) == 0 && s.From == "" && s.Until == "" {
+		return true
+	}
+
+	loc, err := loadLocation(s.TimeZone)
+	if err != nil {
+		return false
+	}
+	local := t.In(loc)
+	from, errFrom := minuteOfDay(s.From, 0)
+	until, errUntil := minuteOfDay(s.Until, 24*60)
+	if errFrom != nil || errUntil != nil {
+		return false
+	}
+	now := local.Hour()*60 + local.Minute()
+	day := local.Weekday()
+	switch {
+	case from < until:
+		if now < from || now >= until {
+			return false
+		}
+	case now >= from:
+		// window started today and runs past midnight
+	case now < until:
+		// window started the day before
+		day = local.AddDate(0, 0, -1).Weekday()
+	default:
+		return false
+	}
+	return s.onDay(day)
+}
+
+// upcomingAt reports if the schedule isn't active at t but will be later
+func (s *Schedule) upcomingAt(t time.Time) bool {
+	if s == nil || s.activeAt(t) {
+		return false
+	}
+	return s.End == nil || t.Before(*s.End)
+}
+
+func (s *Schedule) onDay(day time.Weekday) bool {
+	if len(s.Days) == 0 {
+		return true
+	}
+	for _, d := range s.Days {
+		if weekdays[strings.ToLower(d)] == day {
+			return true
+		}
+	}
+	return false
+}
+
+var weekdays = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+// minuteOfDay parses a 15:04 time of day into minutes since midnight, empty returns def
+func minuteOfDay(clock string, def int) (int, error) {
+	if clock == "" {
+		return def, nil
+	}
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (s *Schedule) copy() *Schedule {
+	if s == nil {
+		return nil
+	}
+	c := *s
+	if s.Start != nil {
+		start := *s.Start
+		c.Start = &start
+	}
+	if s.End != nil {
+		end := *s.End
+		c.End = &end
+	}
+	c.Days = append([]string(nil), s.Days...)
+	return &c
+}
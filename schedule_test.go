@@ -0,0 +1,113 @@
+package shopping
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleActiveAt(t *testing.T) {
+	madrid, err := loadLocation("Europe/Madrid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newYork, err := loadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	utc := func(s string) time.Time {
+		t.Helper()
+		at, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return at
+	}
+	start, end := utc("2026-10-16T00:00:00Z"), utc("2026-10-17T00:00:00Z")
+	bounded := &Schedule{Start: &start, End: &end}
+	// Friday night in Madrid, 16 October 2026 is a Friday
+	fridayNight := &Schedule{TimeZone: "Europe/Madrid", Days: []string{"Friday"}, From: "22:00", Until: "02:00"}
+	// 8 March 2026 clocks go forward from 02:00 to 03:00 in New York, 1 November they go back from 02:00 to 01:00
+	earlyHours := &Schedule{TimeZone: "America/New_York", From: "01:00", Until: "02:00"}
+
+	tests := []struct {
+		name     string
+		schedule *Schedule
+		at       time.Time
+		want     bool
+	}{
+		{name: "no schedule", schedule: nil, at: start, want: true},
+		{name: "start is inclusive", schedule: bounded, at: start, want: true},
+		{name: "before start", schedule: bounded, at: start.Add(-time.Nanosecond), want: false},
+		{name: "just before end", schedule: bounded, at: end.Add(-time.Nanosecond), want: true},
+		{name: "end is exclusive", schedule: bounded, at: end, want: false},
+		{name: "friday before the window", schedule: fridayNight, at: time.Date(2026, 10, 16, 21, 59, 0, 0, madrid), want: false},
+		{name: "friday in the window", schedule: fridayNight, at: time.Date(2026, 10, 16, 22, 0, 0, 0, madrid), want: true},
+		{name: "saturday 01:00 is still friday night", schedule: fridayNight, at: time.Date(2026, 10, 17, 1, 0, 0, 0, madrid), want: true},
+		{name: "saturday 01:00 in utc", schedule: fridayNight, at: time.Date(2026, 10, 16, 23, 0, 0, 0, time.UTC), want: true},
+		{name: "until is exclusive", schedule: fridayNight, at: time.Date(2026, 10, 17, 2, 0, 0, 0, madrid), want: false},
+		{name: "saturday night", schedule: fridayNight, at: time.Date(2026, 10, 17, 23, 0, 0, 0, madrid), want: false},
+		{name: "friday 01:00 is thursday night", schedule: fridayNight, at: time.Date(2026, 10, 16, 1, 0, 0, 0, madrid), want: false},
+		{name: "before clocks go forward", schedule: earlyHours, at: time.Date(2026, 3, 8, 6, 59, 0, 0, time.UTC), want: true},
+		{name: "clocks gone forward", schedule: earlyHours, at: time.Date(2026, 3, 8, 7, 0, 0, 0, time.UTC), want: false},
+		{name: "first 01:30 when clocks go back", schedule: earlyHours, at: time.Date(2026, 11, 1, 5, 30, 0, 0, time.UTC), want: true},
+		{name: "second 01:30 when clocks go back", schedule: earlyHours, at: time.Date(2026, 11, 1, 6, 30, 0, 0, time.UTC), want: true},
+		{name: "02:00 after clocks go back", schedule: earlyHours, at: time.Date(2026, 11, 1, 7, 0, 0, 0, time.UTC), want: false},
+		{name: "local time zone", schedule: earlyHours, at: time.Date(2026, 6, 1, 1, 30, 0, 0, newYork), want: true},
+	}
+	for _, tt := range tests {
+		if tt.schedule != nil {
+			if err := tt.schedule.validate(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := tt.schedule.activeAt(tt.at); got != tt.want {
+			t.Errorf("%s: activeAt(%s) = %v, want %v", tt.name, tt.at, got, tt.want)
+		}
+	}
+}
+
+func TestScheduleUpcomingAt(t *testing.T) {
+	start := time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 0, 14)
+	weekends := &Schedule{Start: &start, End: &end, Days: []string{"saturday", "sunday"}}
+
+	tests := []struct {
+		name     string
+		schedule *Schedule
+		at       time.Time
+		want     bool
+	}{
+		{name: "no schedule", schedule: nil, at: start, want: false},
+		{name: "before start", schedule: weekends, at: start.Add(-time.Hour), want: true},
+		{name: "on a weekday before the weekend", schedule: weekends, at: start.Add(time.Hour), want: true},
+		{name: "active", schedule: weekends, at: start.AddDate(0, 0, 1), want: false},
+		{name: "between weekends", schedule: weekends, at: start.AddDate(0, 0, 3), want: true},
+		{name: "at the end", schedule: weekends, at: end, want: false},
+		{name: "after the end", schedule: weekends, at: end.AddDate(0, 0, 1), want: false},
+	}
+	for _, tt := range tests {
+		if got := tt.schedule.upcomingAt(tt.at); got != tt.want {
+			t.Errorf("%s: upcomingAt(%s) = %v, want %v", tt.name, tt.at, got, tt.want)
+		}
+	}
+}
+
+func TestScheduleValidate(t *testing.T) {
+	start := time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		schedule *Schedule
+	}{
+		{name: "end at start", schedule: &Schedule{Start: &start, End: &start}},
+		{name: "unknown time zone", schedule: &Schedule{TimeZone: "Mars/Olympus_Mons"}},
+		{name: "unknown day", schedule: &Schedule{Days: []string{"caturday"}}},
+		{name: "invalid from", schedule: &Schedule{From: "25:00"}},
+		{name: "invalid until", schedule: &Schedule{Until: "noon"}},
+		{name: "empty window", schedule: &Schedule{From: "10:00", Until: "10:00"}},
+	}
+	for _, tt := range tests {
+		if err := tt.schedule.validate(); err == nil {
+			t.Errorf("%s: schedule %+v is valid", tt.name, tt.schedule)
+		}
+	}
+}
@@ -1,13 +1,20 @@
 package shopping
 
-import log "github.com/sirupsen/logrus"
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
 
 // Option ...
 type Option func(*Service) error
 
 // New returns a new server instance
 func New(options ...Option) *Service {
-	s := &Service{}
+	s := &Service{now: time.Now, tokenTTL: defaultTokenTTL, refreshTTL: defaultRefreshTTL, guestTTL: defaultGuestCartTTL, lockout: defaultLockoutPolicy, maxLineQuantity: defaultMaxLineQuantity}
 
 	for _, option := range options {
 		if err := option(s); err != nil {
@@ -27,22 +34,309 @@ func SetDAO(d DAO) Option {
 	}
 }
 
+// SetClock replaces the clock used to decide which promotions are active and to timestamp holds and orders
+func SetClock(now func() time.Time) Option {
+	return func(s *Service) error {
+		if now == nil {
+			return errors.New("clock can't be nil")
+		}
+		s.now = now
+		return nil
+	}
+}
+
+// SetTokenTTL sets how long access tokens last after logging in
+func SetTokenTTL(d time.Duration) Option {
+	return func(s *Service) error {
+		if d <= 0 {
+			return errors.New("access tokens must last some time")
+		}
+		s.tokenTTL = d
+		return nil
+	}
+}
+
+// SetRefreshTokenTTL sets how long refresh tokens last after they're handed out
+func SetRefreshTokenTTL(d time.Duration) Option {
+	return func(s *Service) error {
+		if d <= 0 {
+			return errors.New("refresh tokens must last some time")
+		}
+		s.refreshTTL = d
+		return nil
+	}
+}
+
+// SetGuestCartTTL sets how long the carts of guests last, they're deleted after that unless the guest logs in
+func SetGuestCartTTL(d time.Duration) Option {
+	return func(s *Service) error {
+		if d <= 0 {
+			return errors.New("guest carts must last some time")
+		}
+		s.guestTTL = d
+		return nil
+	}
+}
+
+// SetJWT makes the service hand out access tokens as JWTs signed with the keys of c
+func SetJWT(c *JWTConfig) Option {
+	return func(s *Service) error {
+		signer, err := newJWTSigner(c)
+		if err != nil {
+			return err
+		}
+		s.jwt = signer
+		return nil
+	}
+}
+
+// SetOIDC lets users sign in with the OpenID Connect identity provider of c as well as with a password
+func SetOIDC(c *OIDCConfig) Option {
+	return func(s *Service) error {
+		provider, err := newOIDCProvider(c)
+		if err != nil {
+			return err
+		}
+		s.oidc = provider
+		return nil
+	}
+}
+
+// SetLockout changes how failed logins slow down and lock out further attempts, they're limited by default
+func SetLockout(c *LockoutConfig) Option {
+	return func(s *Service) error {
+		policy, err := newLockoutPolicy(c)
+		if err != nil {
+			return err
+		}
+		s.lockout = policy
+		return nil
+	}
+}
+
+// AddEventHook calls hook with every event, such as a product in a wishlist coming back in stock
+func AddEventHook(hook EventHook) Option {
+	return func(s *Service) error {
+		if hook == nil {
+			return errors.New("event hook can't be nil")
+		}
+		s.hooks = append(s.hooks, hook)
+		return nil
+	}
+}
+
+// SetStockHold enables holding stock for the given duration when items are added to a cart
+func SetStockHold(d time.Duration) Option {
+	return func(s *Service) error {
+		if d < 0 {
+			return errors.New("stock hold duration can't be negative")
+		}
+		s.holdDuration = d
+		return nil
+	}
+}
+
+// SetMaxLineQuantity sets how many units of a product a cart can have
+func SetMaxLineQuantity(n int) Option {
+	return func(s *Service) error {
+		if n < 1 {
+			return errors.New("carts must be able to have at least one unit of a product")
+		}
+		s.maxLineQuantity = n
+		return nil
+	}
+}
+
+// SetShipping charges fee for shipping every cart with items, it must be in the base currency
+func SetShipping(fee Money) Option {
+	return func(s *Service) error {
+		if fee.Amount < 0 {
+			return errors.New("shipping fee can't be negative")
+		}
+		if base := s.baseCurrency(); fee.Currency != base {
+			return fmt.Errorf("shipping fee is in %s instead of the base currency %s", fee.Currency, base)
+		}
+		s.shipping = fee
+		return nil
+	}
+}
+
+// SetCurrencies prices the catalog in the base currency of rates and allows showing prices in any currency of rates
+func SetCurrencies(rates *ExchangeRates) Option {
+	return func(s *Service) error {
+		return s.SetExchangeRates(rates)
+	}
+}
+
 // InitInventory calls DAO to load current stock from config
 func (s *Service) InitInventory(products []*Product) error {
+	ids := map[int]bool{}
+	for _, p := range products {
+		if ids[p.ID] {
+			return fmt.Errorf("product %d is listed more than once", p.ID)
+		}
+		ids[p.ID] = true
+		if err := s.checkProduct(p); err != nil {
+			return err
+		}
+	}
 	return s.dao.SetProductInventory(products)
 
 }
 
-// InitPromotions calls DAO to load current discounts from config
+// checkProduct makes sure a product can be sold, its price must be in the base currency
+func (s *Service) checkProduct(p *Product) error {
+	if p.ID < 0 {
+		return fmt.Errorf("product %d has a negative ID", p.ID)
+	}
+	if strings.TrimSpace(p.Name) == "" {
+		return fmt.Errorf("product %d has no name", p.ID)
+	}
+	if p.Stock < 0 {
+		return fmt.Errorf("product %d has negative stock", p.ID)
+	}
+	if p.Price.Amount < 0 {
+		return fmt.Errorf("product %d has a negative price", p.ID)
+	}
+	if base := s.baseCurrency(); p.Price.Currency != base {
+		return fmt.Errorf("product %d is priced in %s instead of the base currency %s", p.ID, p.Price.Currency, base)
+	}
+	return nil
+}
+
+// InitPromotions calls DAO to load current discounts from config,
+// discounts in the shape used before promotion rules are converted to rules
 func (s *Service) InitPromotions(discounts []*Promotion) error {
+	discounts, err := s.preparePromotions(discounts)
+	if err != nil {
+		return err
+	}
 	return s.dao.SetPromotions(discounts)
 }
 
-// InitUsers calls DAO to load current registered users from config
+// preparePromotions converts promotions in the legacy shape to rules and checks they can be evaluated
+func (s *Service) preparePromotions(promotions []*Promotion) ([]*Promotion, error) {
+	promotions = upgradePromotions(promotions)
+	for _, p := range promotions {
+		if err := p.validate(); err != nil {
+			return nil, err
+		}
+		if err := s.checkPromotionCurrency(p); err != nil {
+			return nil, err
+		}
+	}
+	return promotions, nil
+}
+
+// checkNewPromotion validates a promotion sent to the admin API, it has to be a rule
+// and every product type it refers to must be in the catalog
+func (s *Service) checkNewPromotion(p *Promotion) *Error {
+	if p.Action == nil {
+		return invalidPromotion(fmt.Errorf("promotion %d has no action, the deprecated shape is only read from config files and storage", p.ID))
+	}
+	if err := p.validate(); err != nil {
+		return invalidPromotion(err)
+	}
+	if err := s.checkPromotionCurrency(p); err != nil {
+		return invalidPromotion(err)
+	}
+
+	products, err := s.dao.GetProducts()
+	if err != nil {
+		return errInternalServerError.msg("dao.GetProducts: " + err.Error())
+	}
+	types := map[int]bool{}
+	for _, product := range products {
+		types[product.Type] = true
+	}
+	referenced := append([]int(nil), p.Action.ProductTypes...)
+	for _, c := range p.Conditions {
+		if c.Type == ConditionQuantity {
+			referenced = append(referenced, c.ProductType)
+		}
+	}
+	for _, t := range referenced {
+		if !types[t] {
+			return invalidPromotion(fmt.Errorf("promotion %d refers to product type %d which isn't in the catalog", p.ID, t))
+		}
+	}
+	return nil
+}
+
+// InitUsers calls DAO to load current registered users from config, passwords in plain text are hashed first
 func (s *Service) InitUsers(users []*User) error {
+	for _, u := range users {
+		for _, role := range u.Roles {
+			if !validRoles[role] {
+				return fmt.Errorf("user %s has an unknown role %q", u.Username, role)
+			}
+		}
+	}
+	hashed, err := HashPasswords(users)
+	if err != nil {
+		return err
+	}
+	if hashed > 0 {
+		log.WithField("users", hashed).Warnln("config has passwords in plain text, run the hash-passwords command to hash them")
+	}
 	return s.dao.SetUsers(users)
 }
 
+// checkPromotionCurrency makes sure the amounts of a promotion are in the base currency
+func (s *Service) checkPromotionCurrency(p *Promotion) error {
+	base := s.baseCurrency()
+	amounts := []*Money{p.Action.Amount}
+	for _, c := range p.Conditions {
+		amounts = append(amounts, c.MinSubtotal)
+	}
+	for _, amount := range amounts {
+		if amount != nil && amount.Currency != base {
+			return fmt.Errorf("promotion %d has an amount in %s instead of the base currency %s", p.ID, amount.Currency, base)
+		}
+	}
+	return nil
+}
+
+// SweepExpiredHolds releases stock holds that have expired every interval until stop is closed
+func (s *Service) SweepExpiredHolds(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			released, err := s.dao.ReleaseExpiredHolds(s.now().UTC())
+			if err != nil {
+				log.WithError(err).Errorln("failed to release expired stock holds")
+				continue
+			}
+			if released > 0 {
+				log.WithField("released", released).Infoln("released expired stock holds")
+			}
+		}
+	}
+}
+
+// holdStock sets aside quantity units of a product for the user through dao when holds are enabled,
+// a quantity of 0 removes the hold
+func (s *Service) holdStock(dao CartDAO, userID, productID, quantity int) error {
+	if s.holdDuration == 0 {
+		return nil
+	}
+	err := dao.HoldStock(&StockHold{
+		UserID:    userID,
+		ProductID: productID,
+		Quantity:  quantity,
+		ExpiresAt: s.now().UTC().Add(s.holdDuration),
+	})
+	if err != nil {
+		return toError(err, "dao.HoldStock")
+	}
+	return nil
+}
+
 // PrintDAO printing data in DAO
 func (s *Service) PrintDAO() {
 	products, _ := s.dao.GetProducts()
@@ -51,72 +345,60 @@ func (s *Service) PrintDAO() {
 
 	log.Infof("Products: %+v\nPromotions: %+v\nUser:%+v\n", products, promos, user)
 }
-func (s *Service) calculatePromotions(cart *Cart) ([]*CartProduct, error) {
 
+// priceCart applies promotions to the cart and updates its checkout, adjustments and totals,
+// it returns the promotions that were applied. It fails when the coupon in the cart can't be redeemed
+func (s *Service) priceCart(cart *Cart, user *User) ([]*Promotion, error) {
 	promotions, err := s.dao.GetPromotions()
 	if err != nil {
 		return nil, err
 	}
-	checkOut := []*CartProduct{}
-
-	checkPromos(promotions, cart.Products)
-
-	for _, productsArray := range cart.Products {
-		for _, product := range productsArray {
-			if product.Discount {
-				product.DiscountedPrice = (product.UnitPrice * product.DiscountPercentage) / 100
-				// product.DiscountPercentage = promo.Discount
-				product.DiscountAmount = product.UnitPrice - product.DiscountedPrice
-			}
-			if product.SpecialPrice {
-				product.DiscountAmount = product.UnitPrice - product.DiscountedPrice
-			}
-			checkOut = append(checkOut, product)
+	// carts keep the price products had when they were added, one in another currency can't be added up
+	base := s.baseCurrency()
+	for id, line := range cart.Products {
+		if line.UnitPrice.Currency != base {
+			return nil, errBadRequestUnsupportedCurrency.msg(fmt.Sprintf("product %d in the cart is priced in %s instead of the base currency %s", id, line.UnitPrice.Currency, base))
 		}
-
 	}
+	if cart.Coupon != "" {
+		if _, err := s.checkCoupon(cart.Coupon, cart.UserID, cart.subtotal()); err != nil {
+			return nil, err
+		}
+	}
+	return s.calculatePromotions(cart, user, promotions, s.now()), nil
+}
 
-	return checkOut, nil
+// calculatePromotions prices the cart with the given promotions as they are at now,
+// it's the part of pricing shared by real carts and simulations
+func (s *Service) calculatePromotions(cart *Cart, user *User, promotions Promotions, now time.Time) []*Promotion {
+	ctx := newPromotionContext(now, user, cart.Coupon, cart.lines(), s.shipping) // prices are worked out from scratch every time
+	applied, adjustments := applyPromotions(promotions, ctx)
+	checkOut := groupLines(ctx.lines)
+	total, discountedTotal := calculateTotalPrice(checkOut, adjustments)
+	cart.Checkout = checkOut
+	cart.Adjustments = adjustments
+	cart.TotalPrice = total
+	cart.TotalDiscount = discountedTotal
+	return applied
 }
 
-func calculateTotalPrice(allProducts []*CartProduct) (float64, float64) {
-	var total float64
-	var totalDiscount float64
+// calculateTotalPrice returns what the cart costs and how much was taken off,
+// discount adjustments are negative and count towards the discount
+func calculateTotalPrice(allProducts []*CartProduct, adjustments []*Adjustment) (Money, Money) {
+	var total Money
+	var totalDiscount Money
 
 	for _, p := range allProducts {
-		total += p.UnitPrice
-		totalDiscount += p.DiscountAmount
-	}
-
-	return total - totalDiscount, totalDiscount
-}
-
-func checkPromos(promotions Promotions, productsMap map[int][]*CartProduct) {
-	// productsForDiscount := []int{}
-	for productType, products := range productsMap {
-		itemsOfType := len(products)
-		promo, ok := promotions[productType]
-		if ok {
-			if promo.SpecialPrice != 0 && itemsOfType >= promo.QuantityForSpecialPrice { // promo
-				for k, p := range products {
-					if k+1 > promo.QuantityForSpecialPrice {
-						p.SpecialPrice = true
-						p.DiscountedPrice = promo.SpecialPrice
-					}
-				}
-			}
-			if itemsOfType >= promo.QuantityForDiscount {
-				for _, v := range promo.ProductsDiscounted {
-					for _, product := range productsMap[v] {
-
-						product.Discount = true
-						product.DiscountPercentage = promo.Discount
-
-					}
-				}
-			}
+		total = total.Add(p.UnitPrice.Mul(int64(p.Quantity)))
+		totalDiscount = totalDiscount.Add(p.DiscountAmount.Mul(int64(p.Quantity)))
+	}
+	for _, a := range adjustments {
+		if a.Amount.Amount < 0 {
+			totalDiscount = totalDiscount.Sub(a.Amount)
+		} else {
+			total = total.Add(a.Amount)
 		}
-
 	}
 
+	return total.Sub(totalDiscount), totalDiscount
 }
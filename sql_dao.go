@@ -0,0 +1,1330 @@
+package shopping
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SQL implements DAO interface on top of database/sql.
+// Queries use ? placeholders and have been written against SQLite,
+// the schema is created and upgraded with Migrate.
+type SQL struct {
+	db     *sql.DB
+	q      queryer // runs the statements, db or the transaction of a cart update
+	cartTx *sql.Tx // set on the DAO given to the fn of a cart update, every call joins its transaction
+}
+
+// queryer is implemented by both *sql.DB and *sql.Tx
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// NewSQL opens a connection to the database, the driver must be registered by the caller.
+// SQLite transactions always take the write lock when they begin, whatever _txlock the dsn asks for.
+func NewSQL(driver, dsn string) (*SQL, error) {
+	if driver == "sqlite3" {
+		dsn = immediateTxLock(dsn)
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQL{db: db, q: db}, nil
+}
+
+// immediateTxLock sets _txlock=immediate in a go-sqlite3 dsn. Transactions read before they write, two deferred ones
+// both reading would each wait for the other to let go of its read lock before writing until one of them fails.
+func immediateTxLock(dsn string) string {
+	name, query := dsn, ""
+	if i := strings.IndexByte(dsn, '?'); i >= 0 {
+		name, query = dsn[:i], dsn[i+1:]
+	}
+	params := []string{}
+	for _, param := range strings.Split(query, "&") {
+		if param != "" && !strings.HasPrefix(param, "_txlock=") {
+			params = append(params, param)
+		}
+	}
+	return name + "?" + strings.Join(append(params, "_txlock=immediate"), "&")
+}
+
+// inCartTx returns a DAO running every call in tx
+func (d *SQL) inCartTx(tx *sql.Tx) *SQL {
+	return &SQL{db: d.db, q: tx, cartTx: tx}
+}
+
+// Close the database connection
+func (d *SQL) Close() error {
+	return d.db.Close()
+}
+
+// Empty reports if there are no products stored yet
+func (d *SQL) Empty() (bool, error) {
+	var count int
+	if err := d.q.QueryRow(`SELECT COUNT(*) FROM products`).Scan(&count); err != nil {
+		return false, err
+	}
+	return count == 0, nil
+}
+
+// SetProductInventory saves every product
+func (d *SQL) SetProductInventory(products []*Product) error {
+	if len(products) == 0 {
+		return errors.New("product inventory is empty")
+	}
+	return d.tx(func(tx *sql.Tx) error {
+		for _, p := range products {
+			if err := upsertProduct(tx, p); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SetPromotions saves promotions by ID, promotions could be empty
+func (d *SQL) SetPromotions(promotions []*Promotion) error {
+	return d.tx(func(tx *sql.Tx) error {
+		for _, p := range promotions {
+			if err := upsertPromotion(tx, p); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SetUsers saves every user
+func (d *SQL) SetUsers(users []*User) error {
+	if len(users) == 0 {
+		return errors.New("user array is empty")
+	}
+	for _, u := range users {
+		if err := d.SetUser(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetProducts returns product inventory
+func (d *SQL) GetProducts() (Products, error) {
+	rows, err := d.q.Query(`SELECT id, type, name, stock, stock - COALESCE((SELECT SUM(quantity) FROM stock_holds WHERE product_id = products.id), 0), price_minor, currency FROM products`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	products := Products{}
+	for rows.Next() {
+		p := &Product{}
+		if err := rows.Scan(&p.ID, &p.Type, &p.Name, &p.Stock, &p.Available, &p.Price.Amount, &p.Price.Currency); err != nil {
+			return nil, err
+		}
+		products[p.ID] = p
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return products, nil
+}
+
+// UpdateProducts saves every product in the inventory
+func (d *SQL) UpdateProducts(products Products) error {
+	if len(products) == 0 {
+		return errors.New("products empty")
+	}
+	return d.tx(func(tx *sql.Tx) error {
+		for _, p := range products {
+			if err := upsertProduct(tx, p); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// CreateProduct adds a product, it gets the next free ID when it has none
+func (d *SQL) CreateProduct(product *Product) error {
+	return d.tx(func(tx *sql.Tx) error {
+		if product.ID == 0 {
+			if err := tx.QueryRow(`SELECT COALESCE(MAX(id), 0) + 1 FROM products`).Scan(&product.ID); err != nil {
+				return err
+			}
+		}
+		exists := 0
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM products WHERE id = ?`, product.ID).Scan(&exists); err != nil {
+			return err
+		}
+		if exists > 0 {
+			return errConflictProductExists.msg(fmt.Sprintf("product %d already exists", product.ID))
+		}
+		return upsertProduct(tx, product)
+	})
+}
+
+// UpdateProduct applies fn to the product and saves the result in the same transaction
+// unless it has less stock than is held
+func (d *SQL) UpdateProduct(id int, fn func(*Product) error) (*Product, error) {
+	var product *Product
+	err := d.tx(func(tx *sql.Tx) error {
+		p, err := getProduct(tx, id)
+		if err != nil {
+			return err
+		}
+		held := p.Stock - p.Available
+		if err := fn(p); err != nil {
+			return err
+		}
+		if p.Stock < held {
+			return stockBelowHeld(id, p.Stock, held)
+		}
+		p.ID = id
+		if err := upsertProduct(tx, p); err != nil {
+			return err
+		}
+		product, err = getProduct(tx, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return product, nil
+}
+
+// DeleteProduct removes a product and the stock held of it
+func (d *SQL) DeleteProduct(id int) error {
+	return d.tx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM stock_holds WHERE product_id = ?`, id); err != nil {
+			return err
+		}
+		res, err := tx.Exec(`DELETE FROM products WHERE id = ?`, id)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return errProductNotFound
+		}
+		return nil
+	})
+}
+
+// ReserveStock decrements the stock of all products or none of them,
+// each product is only decremented if it still has enough stock not held by other users
+func (d *SQL) ReserveStock(userID int, quantities map[int]int) error {
+	return d.tx(func(tx *sql.Tx) error {
+		shortages := []*StockShortage{}
+		for id, quantity := range quantities {
+			res, err := tx.Exec(`UPDATE products SET stock = stock - ? WHERE id = ? AND stock - `+heldByOthers+` >= ?`, quantity, id, id, userID, quantity)
+			if err != nil {
+				return err
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				if _, err := tx.Exec(`DELETE FROM stock_holds WHERE user_id = ? AND product_id = ?`, userID, id); err != nil {
+					return err
+				}
+				continue
+			}
+			available, err := availableStock(tx, userID, id)
+			if err != nil {
+				return err
+			}
+			shortages = append(shortages, &StockShortage{ProductID: id, Requested: quantity, Available: available})
+		}
+		if len(shortages) > 0 {
+			return notEnoughStock(shortages)
+		}
+		return nil
+	})
+}
+
+// HoldStock replaces the user's hold on a product
+func (d *SQL) HoldStock(hold *StockHold) error {
+	return d.tx(func(tx *sql.Tx) error {
+		if hold.Quantity <= 0 {
+			_, err := tx.Exec(`DELETE FROM stock_holds WHERE user_id = ? AND product_id = ?`, hold.UserID, hold.ProductID)
+			return err
+		}
+		available, err := availableStock(tx, hold.UserID, hold.ProductID)
+		if err != nil {
+			return err
+		}
+		if hold.Quantity > available {
+			return notEnoughStock([]*StockShortage{{ProductID: hold.ProductID, Requested: hold.Quantity, Available: available}})
+		}
+		return upsert(tx,
+			`UPDATE stock_holds SET quantity = ?, expires_at = ? WHERE user_id = ? AND product_id = ?`,
+			`INSERT INTO stock_holds (quantity, expires_at, user_id, product_id) VALUES (?, ?, ?, ?)`,
+			hold.Quantity, hold.ExpiresAt, hold.UserID, hold.ProductID,
+		)
+	})
+}
+
+// ReleaseHolds removes all the holds of a user
+func (d *SQL) ReleaseHolds(userID int) error {
+	_, err := d.q.Exec(`DELETE FROM stock_holds WHERE user_id = ?`, userID)
+	return err
+}
+
+// ReleaseExpiredHolds removes holds that expire before now
+func (d *SQL) ReleaseExpiredHolds(now time.Time) (int, error) {
+	res, err := d.q.Exec(`DELETE FROM stock_holds WHERE expires_at < ?`, now)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// ReleaseStock increments the stock of the products
+func (d *SQL) ReleaseStock(quantities map[int]int) error {
+	return d.tx(func(tx *sql.Tx) error {
+		for id, quantity := range quantities {
+			if _, err := tx.Exec(`UPDATE products SET stock = stock + ? WHERE id = ?`, quantity, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetPromotions returns all promotions by ID
+func (d *SQL) GetPromotions() (Promotions, error) {
+	return getPromotions(d.q, "1 = 1")
+}
+
+// CreatePromotion adds a promotion, it gets the next free ID when it has none
+func (d *SQL) CreatePromotion(promotion *Promotion) error {
+	return d.tx(func(tx *sql.Tx) error {
+		if promotion.ID == 0 {
+			if err := tx.QueryRow(`SELECT COALESCE(MAX(id), 0) + 1 FROM promotions`).Scan(&promotion.ID); err != nil {
+				return err
+			}
+		}
+		exists := 0
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM promotions WHERE id = ?`, promotion.ID).Scan(&exists); err != nil {
+			return err
+		}
+		if exists > 0 {
+			return errConflictPromotionExists.msg(fmt.Sprintf("promotion %d already exists", promotion.ID))
+		}
+		return upsertPromotion(tx, promotion)
+	})
+}
+
+// UpdatePromotion applies fn to the promotion and saves the result in the same transaction
+func (d *SQL) UpdatePromotion(id int, fn func(*Promotion) error) (*Promotion, error) {
+	var promotion *Promotion
+	err := d.tx(func(tx *sql.Tx) error {
+		promotions, err := getPromotions(tx, "id = ?", id)
+		if err != nil {
+			return err
+		}
+		p, ok := promotions[id]
+		if !ok {
+			return errPromotionNotFound
+		}
+		if err := fn(p); err != nil {
+			return err
+		}
+		p.ID = id
+		promotion = p
+		return upsertPromotion(tx, p)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return promotion, nil
+}
+
+// DeletePromotion removes a promotion
+func (d *SQL) DeletePromotion(id int) error {
+	res, err := d.q.Exec(`DELETE FROM promotions WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errPromotionNotFound
+	}
+	return nil
+}
+
+func getPromotions(q queryer, where string, args ...interface{}) (Promotions, error) {
+	rows, err := q.Query(`SELECT id, name, priority, stacking, disabled, conditions, action, schedule FROM promotions WHERE `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	promotions := Promotions{}
+	for rows.Next() {
+		p := &Promotion{}
+		var stacking, conditions, action, schedule string
+		if err := rows.Scan(&p.ID, &p.Name, &p.Priority, &stacking, &p.Disabled, &conditions, &action, &schedule); err != nil {
+			return nil, err
+		}
+		p.Stacking = StackingPolicy(stacking)
+		if err := json.Unmarshal([]byte(conditions), &p.Conditions); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(action), &p.Action); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(schedule), &p.Schedule); err != nil {
+			return nil, err
+		}
+		promotions[p.ID] = p
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return promotions, nil
+}
+
+// SetUser saves a user, a cart is created for the user if they don't have one yet
+func (d *SQL) SetUser(user *User) error {
+	return d.tx(func(tx *sql.Tx) error {
+		return upsertUser(tx, user)
+	})
+}
+
+// CreateUser adds a user with its cart unless the ID or username is taken
+func (d *SQL) CreateUser(user *User) error {
+	return d.tx(func(tx *sql.Tx) error {
+		return createUser(tx, user)
+	})
+}
+
+// CreateGuest adds a guest with its cart and the session of its cart token
+func (d *SQL) CreateGuest(user *User, token *AccessToken) error {
+	return d.tx(func(tx *sql.Tx) error {
+		user.Guest = true
+		if err := createUser(tx, user); err != nil {
+			return err
+		}
+		token.UserID = user.ID
+		_, err := tx.Exec(`INSERT INTO access_tokens (hash, user_id, issued_at, expires_at, revoked_at) VALUES (?, ?, ?, ?, ?)`,
+			token.Hash, token.UserID, token.IssuedAt, token.ExpiresAt, token.RevokedAt)
+		return err
+	})
+}
+
+// DeleteGuest removes a guest with its cart, stock holds and sessions
+func (d *SQL) DeleteGuest(id int) error {
+	return d.tx(func(tx *sql.Tx) error {
+		var guests int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM users WHERE id = ? AND guest`, id).Scan(&guests); err != nil {
+			return err
+		}
+		if guests == 0 {
+			return errUserNotFound
+		}
+		return deleteUser(tx, id)
+	})
+}
+
+// DeleteExpiredGuests removes the guests without sessions lasting until now
+func (d *SQL) DeleteExpiredGuests(now time.Time) (int, error) {
+	deleted := 0
+	err := d.tx(func(tx *sql.Tx) error {
+		rows, err := tx.Query(`SELECT id FROM users WHERE guest
+			AND NOT EXISTS (SELECT 1 FROM access_tokens WHERE user_id = users.id AND expires_at >= ?)`, now)
+		if err != nil {
+			return err
+		}
+		ids := []int{}
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if err := deleteUser(tx, id); err != nil {
+				return err
+			}
+		}
+		deleted = len(ids)
+		return nil
+	})
+	return deleted, err
+}
+
+// deleteUser removes a user with its carts, stock holds and sessions
+func deleteUser(tx *sql.Tx, id int) error {
+	for _, statement := range []string{
+		`DELETE FROM access_tokens WHERE user_id = ?`,
+		`DELETE FROM refresh_tokens WHERE user_id = ?`,
+		`DELETE FROM stock_holds WHERE user_id = ?`,
+		`DELETE FROM cart_lines WHERE cart_id IN (SELECT id FROM carts WHERE user_id = ?)`,
+		`DELETE FROM carts WHERE user_id = ?`,
+		`DELETE FROM users WHERE id = ?`,
+	} {
+		if _, err := tx.Exec(statement, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createUser adds a user with its cart unless the ID, username or subject is taken
+func createUser(tx *sql.Tx, user *User) error {
+	if user.ID == 0 {
+		if err := tx.QueryRow(`SELECT COALESCE(MAX(id), 0) + 1 FROM users`).Scan(&user.ID); err != nil {
+			return err
+		}
+	}
+	var idTaken, usernameTaken int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM users WHERE id = ?`, user.ID).Scan(&idTaken); err != nil {
+		return err
+	}
+	if idTaken > 0 {
+		return errConflictUsernameTaken.msg(fmt.Sprintf("user %d already exists", user.ID))
+	}
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM users WHERE username = ?`, user.Username).Scan(&usernameTaken); err != nil {
+		return err
+	}
+	if usernameTaken > 0 {
+		return errConflictUsernameTaken.msg("username taken: " + user.Username)
+	}
+	if user.Subject != "" {
+		var subjectTaken int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM users WHERE subject = ?`, user.Subject).Scan(&subjectTaken); err != nil {
+			return err
+		}
+		if subjectTaken > 0 {
+			return errConflictSubjectTaken.msg("subject taken: " + user.Subject)
+		}
+	}
+	return upsertUser(tx, user)
+}
+
+// upsertUser saves the user and gives it a cart if it has none
+func upsertUser(tx *sql.Tx, user *User) error {
+	segments, err := json.Marshal(user.Segments)
+	if err != nil {
+		return err
+	}
+	roles, err := json.Marshal(user.Roles)
+	if err != nil {
+		return err
+	}
+	if err := upsert(tx,
+		`UPDATE users SET username = ?, password = ?, subject = ?, segments = ?, roles = ?, guest = ? WHERE id = ?`,
+		`INSERT INTO users (username, password, subject, segments, roles, guest, id) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		user.Username, user.Password, user.Subject, string(segments), string(roles), user.Guest, user.ID,
+	); err != nil {
+		return err
+	}
+	var count int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM carts WHERE user_id = ? AND name = ?`, user.ID, CartNameActive).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	_, err = tx.Exec(`INSERT INTO carts (user_id, name) VALUES (?, ?)`, user.ID, CartNameActive)
+	return err
+}
+
+// GetUser by username
+func (d *SQL) GetUser(username string) (*User, error) {
+	return getUser(d.q, `username = ?`, username)
+}
+
+// GetUserByID finds a user by ID
+func (d *SQL) GetUserByID(id int) (*User, error) {
+	return getUser(d.q, `id = ?`, id)
+}
+
+// GetUserBySubject finds a user by the subject of the identity provider
+func (d *SQL) GetUserBySubject(subject string) (*User, error) {
+	if subject == "" {
+		return nil, errUserNotFound
+	}
+	return getUser(d.q, `subject = ?`, subject)
+}
+
+// CreateAccessToken saves a new session
+func (d *SQL) CreateAccessToken(token *AccessToken) error {
+	_, err := d.q.Exec(`INSERT INTO access_tokens (hash, user_id, issued_at, expires_at, revoked_at) VALUES (?, ?, ?, ?, ?)`,
+		token.Hash, token.UserID, token.IssuedAt, token.ExpiresAt, token.RevokedAt)
+	return err
+}
+
+// GetAccessToken finds a session by the hash of its token
+func (d *SQL) GetAccessToken(hash string) (*AccessToken, error) {
+	t := &AccessToken{}
+	err := d.q.QueryRow(`SELECT hash, user_id, issued_at, expires_at, revoked_at FROM access_tokens WHERE hash = ?`, hash).
+		Scan(&t.Hash, &t.UserID, &t.IssuedAt, &t.ExpiresAt, &t.RevokedAt)
+	if err == sql.ErrNoRows {
+		return nil, errAccessTokenNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// RevokeAccessToken marks a session as revoked, a session revoked before keeps its first revocation time
+func (d *SQL) RevokeAccessToken(hash string, at time.Time) error {
+	res, err := d.q.Exec(`UPDATE access_tokens SET revoked_at = COALESCE(revoked_at, ?) WHERE hash = ?`, at, hash)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errAccessTokenNotFound
+	}
+	return nil
+}
+
+// DeleteExpiredAccessTokens removes sessions that expire before now
+func (d *SQL) DeleteExpiredAccessTokens(now time.Time) (int, error) {
+	res, err := d.q.Exec(`DELETE FROM access_tokens WHERE expires_at < ?`, now)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// CreateRefreshToken saves a new refresh token
+func (d *SQL) CreateRefreshToken(token *RefreshToken) error {
+	_, err := d.q.Exec(`INSERT INTO refresh_tokens (hash, user_id, family, issued_at, expires_at, used_at, revoked_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		token.Hash, token.UserID, token.Family, token.IssuedAt, token.ExpiresAt, token.UsedAt, token.RevokedAt)
+	return err
+}
+
+// RotateRefreshToken marks the token as used and saves next in its family,
+// a token used twice revokes its family
+func (d *SQL) RotateRefreshToken(hash string, next *RefreshToken) error {
+	var rotateErr error // the revocation of a reused token's family has to be committed even though rotating fails
+	err := d.tx(func(tx *sql.Tx) error {
+		t := &RefreshToken{}
+		err := tx.QueryRow(`SELECT user_id, family, expires_at, used_at, revoked_at FROM refresh_tokens WHERE hash = ?`, hash).
+			Scan(&t.UserID, &t.Family, &t.ExpiresAt, &t.UsedAt, &t.RevokedAt)
+		if err == sql.ErrNoRows {
+			return errInvalidRefreshToken.msg("unknown refresh token")
+		}
+		if err != nil {
+			return err
+		}
+		reused, err := t.checkRotation(next.IssuedAt)
+		if reused {
+			if _, err := tx.Exec(`UPDATE refresh_tokens SET revoked_at = ? WHERE family = ? AND revoked_at IS NULL`, next.IssuedAt, t.Family); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			rotateErr = err
+			return nil
+		}
+		if _, err := tx.Exec(`UPDATE refresh_tokens SET used_at = ? WHERE hash = ?`, next.IssuedAt, hash); err != nil {
+			return err
+		}
+		next.UserID = t.UserID
+		next.Family = t.Family
+		_, err = tx.Exec(`INSERT INTO refresh_tokens (hash, user_id, family, issued_at, expires_at, used_at, revoked_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			next.Hash, next.UserID, next.Family, next.IssuedAt, next.ExpiresAt, next.UsedAt, next.RevokedAt)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return rotateErr
+}
+
+// RevokeRefreshTokens revokes the family of the token with the hash
+func (d *SQL) RevokeRefreshTokens(hash string, at time.Time) error {
+	res, err := d.q.Exec(`UPDATE refresh_tokens SET revoked_at = COALESCE(revoked_at, ?)
+		WHERE family = (SELECT family FROM refresh_tokens WHERE hash = ?)`, at, hash)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errInvalidRefreshToken.msg("unknown refresh token")
+	}
+	return nil
+}
+
+// DeleteExpiredRefreshTokens removes refresh tokens that expire before now
+func (d *SQL) DeleteExpiredRefreshTokens(now time.Time) (int, error) {
+	res, err := d.q.Exec(`DELETE FROM refresh_tokens WHERE expires_at < ?`, now)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// GetLoginFailures returns the failed logins counted under the key
+func (d *SQL) GetLoginFailures(key string) (*LoginFailures, error) {
+	return getLoginFailures(d.q, key)
+}
+
+// ReserveLoginAttempt counts a failed login under every key unless check fails with the failures so far
+func (d *SQL) ReserveLoginAttempt(keys []string, at time.Time, resetAfter time.Duration, check func([]*LoginFailures) error) ([]*LoginFailures, error) {
+	var failures []*LoginFailures
+	err := d.tx(func(tx *sql.Tx) error {
+		failures = []*LoginFailures{}
+		for _, key := range keys {
+			f, err := getLoginFailures(tx, key)
+			if err != nil {
+				return err
+			}
+			failures = append(failures, f)
+		}
+		if err := check(failures); err != nil {
+			return err
+		}
+		for _, f := range failures {
+			f.record(at, resetAfter)
+			err := upsert(tx,
+				`UPDATE login_failures SET count = ?, last_failure = ? WHERE lock_key = ?`,
+				`INSERT INTO login_failures (count, last_failure, lock_key) VALUES (?, ?, ?)`,
+				f.Count, f.Last, f.Key,
+			)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return failures, nil
+}
+
+// ReleaseLoginAttempt takes back a failed login under the key
+func (d *SQL) ReleaseLoginAttempt(key string) error {
+	return d.tx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`UPDATE login_failures SET count = count - 1 WHERE lock_key = ?`, key); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`DELETE FROM login_failures WHERE lock_key = ? AND count <= 0`, key)
+		return err
+	})
+}
+
+// ClearLoginFailures forgets the failed logins under the key
+func (d *SQL) ClearLoginFailures(key string) error {
+	_, err := d.q.Exec(`DELETE FROM login_failures WHERE lock_key = ?`, key)
+	return err
+}
+
+// DeleteStaleLoginFailures removes the failures whose last one was before the given time
+func (d *SQL) DeleteStaleLoginFailures(before time.Time) (int, error) {
+	res, err := d.q.Exec(`DELETE FROM login_failures WHERE last_failure < ?`, before)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func getLoginFailures(q queryer, key string) (*LoginFailures, error) {
+	f := &LoginFailures{Key: key}
+	err := q.QueryRow(`SELECT count, last_failure FROM login_failures WHERE lock_key = ?`, key).Scan(&f.Count, &f.Last)
+	if err == sql.ErrNoRows {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// GetCart using its id
+func (d *SQL) GetCart(id int) (*Cart, error) {
+	return getCart(d.q, `id = ?`, id)
+}
+
+// GetCartByUserID find the active cart corresponding to user ID
+func (d *SQL) GetCartByUserID(userID int) (*Cart, error) {
+	return getCart(d.q, `user_id = ? AND name = ?`, userID, CartNameActive)
+}
+
+// SetCart saves cart data, a new cart is created if it has no ID
+func (d *SQL) SetCart(cart *Cart) error {
+	return d.tx(func(tx *sql.Tx) error {
+		return setCart(tx, cart)
+	})
+}
+
+// UpdateCart reads the user's cart, applies fn and saves the result in one transaction.
+// The DAO fn is given runs its calls in the same transaction so they're undone if anything fails.
+func (d *SQL) UpdateCart(userID int, fn func(CartDAO, *Cart) error) (*Cart, error) {
+	var cart *Cart
+	err := d.tx(func(tx *sql.Tx) error {
+		var err error
+		cart, err = getCart(tx, `user_id = ? AND name = ?`, userID, CartNameActive)
+		if err != nil {
+			return err
+		}
+		if err := fn(d.inCartTx(tx), cart); err != nil {
+			return err
+		}
+		return setCart(tx, cart)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cart, nil
+}
+
+// GetCarts returns every cart of the user sorted by ID
+func (d *SQL) GetCarts(userID int) ([]*Cart, error) {
+	return getCarts(d.q, `SELECT id FROM carts WHERE user_id = ? ORDER BY id`, userID)
+}
+
+// UpdateCarts reads the user's carts by name, applies fn and saves all of them in one transaction like UpdateCart
+func (d *SQL) UpdateCarts(userID int, fn func(CartDAO, map[string]*Cart) error) (map[string]*Cart, error) {
+	var carts map[string]*Cart
+	err := d.tx(func(tx *sql.Tx) error {
+		list, err := getCarts(tx, `SELECT id FROM carts WHERE user_id = ? ORDER BY id`, userID)
+		if err != nil {
+			return err
+		}
+		carts = make(map[string]*Cart, len(list))
+		for _, c := range list {
+			carts[c.Name] = c
+		}
+		if err := fn(d.inCartTx(tx), carts); err != nil {
+			return err
+		}
+		for name, c := range carts {
+			c.UserID, c.Name = userID, name
+			if err := setCart(tx, c); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return carts, nil
+}
+
+// DeleteCart removes the user's cart with the name and its lines
+func (d *SQL) DeleteCart(userID int, name string) error {
+	return d.tx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM cart_lines WHERE cart_id IN (SELECT id FROM carts WHERE user_id = ? AND name = ?)`, userID, name); err != nil {
+			return err
+		}
+		res, err := tx.Exec(`DELETE FROM carts WHERE user_id = ? AND name = ?`, userID, name)
+		if err != nil {
+			return err
+		}
+		deleted, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if deleted == 0 {
+			return errCartNotFound
+		}
+		return nil
+	})
+}
+
+// GetCartsWithProduct returns the carts with the name that have the product sorted by ID
+func (d *SQL) GetCartsWithProduct(name string, productID int) ([]*Cart, error) {
+	return getCarts(d.q, `SELECT carts.id FROM carts JOIN cart_lines ON cart_lines.cart_id = carts.id
+		WHERE carts.name = ? AND cart_lines.product_id = ? ORDER BY carts.id`, name, productID)
+}
+
+// CreateOrder saves a new order with its lines and empties the user's active cart in the same transaction
+func (d *SQL) CreateOrder(order *Order) error {
+	promotions, err := json.Marshal(order.Promotions)
+	if err != nil {
+		return err
+	}
+	adjustments, err := json.Marshal(order.Adjustments)
+	if err != nil {
+		return err
+	}
+	code := strings.ToUpper(order.Coupon)
+	return d.tx(func(tx *sql.Tx) error {
+		// transactions take the write lock when they begin so the limits can't change before the redemption is saved
+		if err := checkRedemption(tx, code, order.UserID); err != nil {
+			return err
+		}
+		res, err := tx.Exec(`INSERT INTO orders (user_id, promotions, adjustments, coupon, total_price_minor, total_discount_minor, currency, status, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			order.UserID, string(promotions), string(adjustments), code, order.TotalPrice.Amount, order.TotalDiscount.Amount, order.TotalPrice.Currency, string(order.Status), order.CreatedAt, order.UpdatedAt,
+		)
+		if err != nil {
+			return err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		if code != "" {
+			if _, err := tx.Exec(`INSERT INTO coupon_redemptions (code, user_id, order_id, redeemed_at) VALUES (?, ?, ?, ?)`,
+				code, order.UserID, id, order.CreatedAt); err != nil {
+				return err
+			}
+		}
+		for i, p := range order.Lines {
+			linePromotions, skipped, err := marshalLinePromotions(p)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec(`INSERT INTO order_lines (order_id, position, product_id, quantity, product_type, product_name, unit_price_minor, discount, special_price, discount_percentage, discount_amount_minor, discounted_price_minor, currency, promotions, skipped_promotions)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				id, i, p.ProductID, p.Quantity, p.ProductType, p.ProductName, p.UnitPrice.Amount, p.Discount, p.SpecialPrice, p.DiscountPercentage, p.DiscountAmount.Amount, p.DiscountedPrice.Amount, p.UnitPrice.Currency, linePromotions, skipped,
+			); err != nil {
+				return err
+			}
+		}
+		order.ID = int(id)
+
+		cart, err := getCart(tx, `user_id = ? AND name = ?`, order.UserID, CartNameActive)
+		if err != nil {
+			return err
+		}
+		cart.clear()
+		return setCart(tx, cart)
+	})
+}
+
+// SetCoupons saves coupons by code
+func (d *SQL) SetCoupons(coupons []*Coupon) error {
+	return d.tx(func(tx *sql.Tx) error {
+		for _, c := range coupons {
+			minSpend, currency := sql.NullInt64{}, ""
+			if c.MinSpend != nil {
+				minSpend = sql.NullInt64{Int64: c.MinSpend.Amount, Valid: true}
+				currency = c.MinSpend.Currency
+			}
+			if err := upsert(tx,
+				`UPDATE coupons SET description = ?, max_redemptions = ?, max_per_user = ?, expires_at = ?, min_spend_minor = ?, currency = ? WHERE code = ?`,
+				`INSERT INTO coupons (description, max_redemptions, max_per_user, expires_at, min_spend_minor, currency, code) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+				c.Description, c.MaxRedemptions, c.MaxPerUser, c.ExpiresAt, minSpend, currency, strings.ToUpper(c.Code),
+			); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetCoupon by code
+func (d *SQL) GetCoupon(code string) (*Coupon, error) {
+	c := &Coupon{}
+	var minSpend sql.NullInt64
+	var currency string
+	err := d.q.QueryRow(`SELECT code, description, max_redemptions, max_per_user, expires_at, min_spend_minor, currency,
+		(SELECT COUNT(*) FROM coupon_redemptions WHERE code = coupons.code) FROM coupons WHERE code = ?`, strings.ToUpper(code)).
+		Scan(&c.Code, &c.Description, &c.MaxRedemptions, &c.MaxPerUser, &c.ExpiresAt, &minSpend, &currency, &c.Redeemed)
+	if err == sql.ErrNoRows {
+		return nil, errCouponNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if minSpend.Valid {
+		c.MinSpend = &Money{Amount: minSpend.Int64, Currency: currency}
+	}
+	return c, nil
+}
+
+// CountRedemptions of a coupon by a user
+func (d *SQL) CountRedemptions(code string, userID int) (int, error) {
+	count := 0
+	err := d.q.QueryRow(`SELECT COUNT(*) FROM coupon_redemptions WHERE code = ? AND user_id = ?`, strings.ToUpper(code), userID).Scan(&count)
+	return count, err
+}
+
+// GetOrder using its id
+func (d *SQL) GetOrder(id int) (*Order, error) {
+	orders, err := getOrders(d.q, `id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(orders) == 0 {
+		return nil, errOrderNotFound
+	}
+	return orders[0], nil
+}
+
+// GetOrdersByUserID finds all orders made by a user
+func (d *SQL) GetOrdersByUserID(userID int) ([]*Order, error) {
+	return getOrders(d.q, `user_id = ?`, userID)
+}
+
+// tx runs fn inside a transaction, committing only if fn succeeds. Within a cart update fn runs in a savepoint of
+// its transaction instead, so failing only undoes what fn did and the cart update can carry on.
+func (d *SQL) tx(fn func(*sql.Tx) error) error {
+	if d.cartTx != nil {
+		return savepoint(d.cartTx, fn)
+	}
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// savepoint runs fn in a savepoint of tx, rolling back to it if fn fails
+func savepoint(tx *sql.Tx, fn func(*sql.Tx) error) error {
+	if _, err := tx.Exec(`SAVEPOINT dao`); err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		// rolling back keeps the savepoint, it still has to be released
+		if _, rollbackErr := tx.Exec(`ROLLBACK TO dao`); rollbackErr == nil {
+			tx.Exec(`RELEASE dao`)
+		}
+		return err
+	}
+	_, err := tx.Exec(`RELEASE dao`)
+	return err
+}
+
+// upsert runs update and falls back to insert when no rows were updated,
+// both statements must take the same arguments in the same order
+func upsert(q queryer, update, insert string, args ...interface{}) error {
+	res, err := q.Exec(update, args...)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	_, err = q.Exec(insert, args...)
+	return err
+}
+
+// heldByOthers is the quantity of a product held by other users, it takes the product ID and user ID as arguments
+const heldByOthers = `COALESCE((SELECT SUM(quantity) FROM stock_holds WHERE product_id = ? AND user_id != ?), 0)`
+
+// availableStock returns the stock of a product that isn't held by other users
+func availableStock(q queryer, userID, productID int) (int, error) {
+	available := 0
+	err := q.QueryRow(`SELECT stock - `+heldByOthers+` FROM products WHERE id = ?`, productID, userID, productID).Scan(&available)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	return available, nil
+}
+
+func getProduct(q queryer, id int) (*Product, error) {
+	p := &Product{}
+	err := q.QueryRow(`SELECT id, type, name, stock, stock - COALESCE((SELECT SUM(quantity) FROM stock_holds WHERE product_id = products.id), 0), price_minor, currency FROM products WHERE id = ?`, id).
+		Scan(&p.ID, &p.Type, &p.Name, &p.Stock, &p.Available, &p.Price.Amount, &p.Price.Currency)
+	if err == sql.ErrNoRows {
+		return nil, errProductNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func upsertProduct(q queryer, p *Product) error {
+	return upsert(q,
+		`UPDATE products SET type = ?, name = ?, stock = ?, price_minor = ?, currency = ? WHERE id = ?`,
+		`INSERT INTO products (type, name, stock, price_minor, currency, id) VALUES (?, ?, ?, ?, ?, ?)`,
+		p.Type, p.Name, p.Stock, p.Price.Amount, p.Price.Currency, p.ID,
+	)
+}
+
+func upsertPromotion(q queryer, p *Promotion) error {
+	conditions, err := json.Marshal(p.Conditions)
+	if err != nil {
+		return err
+	}
+	action, err := json.Marshal(p.Action)
+	if err != nil {
+		return err
+	}
+	schedule, err := json.Marshal(p.Schedule)
+	if err != nil {
+		return err
+	}
+	return upsert(q,
+		`UPDATE promotions SET name = ?, priority = ?, stacking = ?, disabled = ?, conditions = ?, action = ?, schedule = ? WHERE id = ?`,
+		`INSERT INTO promotions (name, priority, stacking, disabled, conditions, action, schedule, id) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		p.Name, p.Priority, string(p.Stacking), p.Disabled, string(conditions), string(action), string(schedule), p.ID,
+	)
+}
+
+// checkRedemption fails if the coupon has reached any of its limits, an empty code has no limits
+func checkRedemption(q queryer, code string, userID int) error {
+	if code == "" {
+		return nil
+	}
+	var maxRedemptions, maxPerUser, redeemed, redeemedByUser int
+	err := q.QueryRow(`SELECT max_redemptions, max_per_user,
+		(SELECT COUNT(*) FROM coupon_redemptions WHERE code = coupons.code),
+		(SELECT COUNT(*) FROM coupon_redemptions WHERE code = coupons.code AND user_id = ?)
+		FROM coupons WHERE code = ?`, userID, code).Scan(&maxRedemptions, &maxPerUser, &redeemed, &redeemedByUser)
+	if err == sql.ErrNoRows {
+		return errCouponNotFound.msg("coupon " + code + " doesn't exist")
+	}
+	if err != nil {
+		return err
+	}
+	if maxRedemptions > 0 && redeemed >= maxRedemptions {
+		return errConflictCouponLimit.msg("coupon " + code + " reached its redemption limit")
+	}
+	if maxPerUser > 0 && redeemedByUser >= maxPerUser {
+		return errConflictCouponLimit.msg("coupon " + code + " reached its limit for the user")
+	}
+	return nil
+}
+
+func getUser(q queryer, where string, arg interface{}) (*User, error) {
+	u := &User{}
+	var segments, roles string
+	err := q.QueryRow(`SELECT id, username, password, subject, segments, roles, guest FROM users WHERE `+where, arg).
+		Scan(&u.ID, &u.Username, &u.Password, &u.Subject, &segments, &roles, &u.Guest)
+	if err == sql.ErrNoRows {
+		return nil, errUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(segments), &u.Segments); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(roles), &u.Roles); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func getCart(q queryer, where string, args ...interface{}) (*Cart, error) {
+	c := &Cart{Products: CartLines{}}
+	var checkout, adjustments string
+	var currency string
+	err := q.QueryRow(`SELECT id, user_id, name, coupon, checkout, adjustments, total_price_minor, total_discount_minor, currency FROM carts WHERE `+where, args...).
+		Scan(&c.ID, &c.UserID, &c.Name, &c.Coupon, &checkout, &adjustments, &c.TotalPrice.Amount, &c.TotalDiscount.Amount, &currency)
+	if err == sql.ErrNoRows {
+		return nil, errors.New("cart not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.TotalPrice.Currency, c.TotalDiscount.Currency = currency, currency
+	if err := json.Unmarshal([]byte(checkout), &c.Checkout); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(adjustments), &c.Adjustments); err != nil {
+		return nil, err
+	}
+
+	rows, err := q.Query(`SELECT product_id, product_type, product_name, quantity, unit_price_minor, currency FROM cart_lines WHERE cart_id = ? ORDER BY product_id`, c.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		l := &CartLine{}
+		if err := rows.Scan(&l.ProductID, &l.ProductType, &l.ProductName, &l.Quantity, &l.UnitPrice.Amount, &l.UnitPrice.Currency); err != nil {
+			return nil, err
+		}
+		c.Products[l.ProductID] = l
+	}
+	return c, rows.Err()
+}
+
+// getCarts returns the carts whose IDs the query selects
+func getCarts(q queryer, query string, args ...interface{}) ([]*Cart, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	carts := make([]*Cart, 0, len(ids))
+	for _, id := range ids {
+		c, err := getCart(q, `id = ?`, id)
+		if err != nil {
+			return nil, err
+		}
+		carts = append(carts, c)
+	}
+	return carts, nil
+}
+
+func getOrders(q queryer, where string, arg interface{}) ([]*Order, error) {
+	rows, err := q.Query(`SELECT id, user_id, promotions, adjustments, coupon, total_price_minor, total_discount_minor, currency, status, created_at, updated_at FROM orders WHERE `+where+` ORDER BY id`, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orders := []*Order{}
+	for rows.Next() {
+		o := &Order{Lines: []*CartProduct{}}
+		var promotions, adjustments, currency, status string
+		if err := rows.Scan(&o.ID, &o.UserID, &promotions, &adjustments, &o.Coupon, &o.TotalPrice.Amount, &o.TotalDiscount.Amount, &currency, &status, &o.CreatedAt, &o.UpdatedAt); err != nil {
+			return nil, err
+		}
+		o.TotalPrice.Currency, o.TotalDiscount.Currency = currency, currency
+		if err := json.Unmarshal([]byte(promotions), &o.Promotions); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(adjustments), &o.Adjustments); err != nil {
+			return nil, err
+		}
+		o.Status = OrderStatus(status)
+		orders = append(orders, o)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for _, o := range orders {
+		if err := getOrderLines(q, o); err != nil {
+			return nil, err
+		}
+	}
+	return orders, nil
+}
+
+func getOrderLines(q queryer, o *Order) error {
+	rows, err := q.Query(`SELECT product_id, quantity, product_type, product_name, unit_price_minor, discount, special_price, discount_percentage, discount_amount_minor, discounted_price_minor, currency, promotions, skipped_promotions
+		FROM order_lines WHERE order_id = ? ORDER BY position`, o.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		p := &CartProduct{}
+		var currency, promotions, skipped string
+		if err := rows.Scan(&p.ProductID, &p.Quantity, &p.ProductType, &p.ProductName, &p.UnitPrice.Amount, &p.Discount, &p.SpecialPrice, &p.DiscountPercentage, &p.DiscountAmount.Amount, &p.DiscountedPrice.Amount, &currency, &promotions, &skipped); err != nil {
+			return err
+		}
+		if err := unmarshalLinePromotions(p, promotions, skipped); err != nil {
+			return err
+		}
+		p.UnitPrice.Currency, p.DiscountAmount.Currency, p.DiscountedPrice.Currency = currency, currency, currency
+		o.Lines = append(o.Lines, p)
+	}
+	return rows.Err()
+}
+
+func setCart(tx *sql.Tx, cart *Cart) error {
+	checkout, err := json.Marshal(cart.Checkout)
+	if err != nil {
+		return err
+	}
+	adjustments, err := json.Marshal(cart.Adjustments)
+	if err != nil {
+		return err
+	}
+	if cart.Name == "" {
+		cart.Name = CartNameActive
+	}
+	if cart.ID == 0 {
+		res, err := tx.Exec(`INSERT INTO carts (user_id, name) VALUES (?, ?)`, cart.UserID, cart.Name)
+		if err != nil {
+			return err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		cart.ID = int(id)
+	}
+	if err := upsert(tx,
+		`UPDATE carts SET user_id = ?, name = ?, coupon = ?, checkout = ?, adjustments = ?, total_price_minor = ?, total_discount_minor = ?, currency = ? WHERE id = ?`,
+		`INSERT INTO carts (user_id, name, coupon, checkout, adjustments, total_price_minor, total_discount_minor, currency, id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		cart.UserID, cart.Name, cart.Coupon, string(checkout), string(adjustments), cart.TotalPrice.Amount, cart.TotalDiscount.Amount, cart.TotalPrice.Currency, cart.ID,
+	); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM cart_lines WHERE cart_id = ?`, cart.ID); err != nil {
+		return err
+	}
+	for productID, l := range cart.Products {
+		if _, err := tx.Exec(`INSERT INTO cart_lines (cart_id, product_id, product_type, product_name, quantity, unit_price_minor, currency) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			cart.ID, productID, l.ProductType, l.ProductName, l.Quantity, l.UnitPrice.Amount, l.UnitPrice.Currency,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// marshalLinePromotions returns the applied and skipped promotions of a line as JSON for the promotions columns
+func marshalLinePromotions(p *CartProduct) (string, string, error) {
+	promotions, err := json.Marshal(p.Promotions)
+	if err != nil {
+		return "", "", err
+	}
+	skipped, err := json.Marshal(p.SkippedPromotions)
+	if err != nil {
+		return "", "", err
+	}
+	return string(promotions), string(skipped), nil
+}
+
+func unmarshalLinePromotions(p *CartProduct, promotions, skipped string) error {
+	if err := json.Unmarshal([]byte(promotions), &p.Promotions); err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(skipped), &p.SkippedPromotions)
+}
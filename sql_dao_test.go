@@ -0,0 +1,114 @@
+package shopping
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// newTestSQL returns a migrated SQL DAO on a SQLite file in dir, its dsn asks for deferred transactions
+func newTestSQL(t *testing.T, dir string) *SQL {
+	t.Helper()
+	d, err := NewSQL("sqlite3", "file:"+filepath.Join(dir, "shopping.db")+"?_txlock=deferred&_busy_timeout=10000&_foreign_keys=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	if err := d.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestImmediateTxLock(t *testing.T) {
+	tests := []struct {
+		dsn  string
+		want string
+	}{
+		{dsn: "shopping.db", want: "shopping.db?_txlock=immediate"},
+		{dsn: "file:shopping.db?_busy_timeout=5000", want: "file:shopping.db?_busy_timeout=5000&_txlock=immediate"},
+		{dsn: "file:shopping.db?_txlock=deferred&_foreign_keys=1", want: "file:shopping.db?_foreign_keys=1&_txlock=immediate"},
+		{dsn: "file:shopping.db?_txlock=immediate", want: "file:shopping.db?_txlock=immediate"},
+	}
+	for _, tt := range tests {
+		if got := immediateTxLock(tt.dsn); got != tt.want {
+			t.Errorf("immediateTxLock(%q) = %q, want %q", tt.dsn, got, tt.want)
+		}
+	}
+}
+
+func TestSQLConcurrentUpdateCart(t *testing.T) {
+	dir := tempDir(t)
+	// two DAOs on the same file don't share anything in memory, like two instances of the API
+	daos := []*SQL{newTestSQL(t, dir), newTestSQL(t, dir)}
+	if err := daos[0].SetProductInventory(testCatalog()); err != nil {
+		t.Fatal(err)
+	}
+	user := &User{Username: "shopper"}
+	if err := daos[0].CreateUser(user); err != nil {
+		t.Fatal(err)
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(d *SQL) {
+			defer wg.Done()
+			_, err := d.UpdateCart(user.ID, func(dao CartDAO, cart *Cart) error {
+				line, err := cart.add(&CartLine{ProductID: 1, ProductType: 1, Quantity: 1, UnitPrice: Money{Amount: 2000, Currency: "USD"}}, defaultMaxLineQuantity)
+				if err != nil {
+					return err
+				}
+				return dao.HoldStock(&StockHold{UserID: user.ID, ProductID: 1, Quantity: line.Quantity, ExpiresAt: time.Now().Add(time.Hour)})
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}(daos[i%2])
+	}
+	wg.Wait()
+
+	cart, err := daos[0].GetCartByUserID(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line := cart.Products[1]; line == nil || line.Quantity != 10 {
+		t.Errorf("cart has %v belts, want 10", line)
+	}
+	products, err := daos[0].GetProducts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if products[1].Available != 0 {
+		t.Errorf("%d belts available, want 0", products[1].Available)
+	}
+}
+
+func TestSQLCreateOrderEmptiesTheCart(t *testing.T) {
+	d := newTestSQL(t, tempDir(t))
+	user := &User{Username: "shopper"}
+	if err := d.CreateUser(user); err != nil {
+		t.Fatal(err)
+	}
+	cart, err := d.GetCartByUserID(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cart.Products = testCart(map[int]int{1: 2}).Products
+	if err := d.SetCart(cart); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateOrder(&Order{UserID: user.ID, Lines: []*CartProduct{}, CreatedAt: time.Now(), UpdatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	cart, err = d.GetCartByUserID(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cart.empty() {
+		t.Errorf("cart has %d lines after the order, want none", len(cart.Products))
+	}
+}
@@ -0,0 +1,554 @@
+package shopping
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// migration is a versioned change to the SQL schema
+type migration struct {
+	version     int
+	description string
+	statements  []string
+	apply       func(tx *sql.Tx) error // optional, runs after statements for changes SQL alone can't make
+}
+
+// migrations are applied in order, once released a migration must never be edited, add a new one instead
+var migrations = []migration{
+	{
+		version:     1,
+		description: "initial schema",
+		statements: []string{
+			`CREATE TABLE products (
+				id    INTEGER PRIMARY KEY,
+				type  INTEGER NOT NULL,
+				name  TEXT NOT NULL,
+				stock INTEGER NOT NULL DEFAULT 0,
+				price REAL NOT NULL DEFAULT 0
+			)`,
+			`CREATE TABLE promotions (
+				product_type               INTEGER PRIMARY KEY,
+				quantity_for_discount      INTEGER NOT NULL DEFAULT 0,
+				products_discounted        TEXT NOT NULL DEFAULT '[]',
+				discount                   REAL NOT NULL DEFAULT 0,
+				quantity_for_special_price INTEGER NOT NULL DEFAULT 0,
+				special_price              REAL NOT NULL DEFAULT 0
+			)`,
+			`CREATE TABLE users (
+				id       INTEGER PRIMARY KEY,
+				username TEXT NOT NULL UNIQUE,
+				password TEXT NOT NULL,
+				token    TEXT NOT NULL DEFAULT ''
+			)`,
+			`CREATE INDEX users_token ON users (token)`,
+			`CREATE TABLE carts (
+				id             INTEGER PRIMARY KEY,
+				user_id        INTEGER NOT NULL UNIQUE REFERENCES users (id),
+				checkout       TEXT NOT NULL DEFAULT '[]',
+				total_price    REAL NOT NULL DEFAULT 0,
+				total_discount REAL NOT NULL DEFAULT 0
+			)`,
+			`CREATE TABLE cart_lines (
+				cart_id             INTEGER NOT NULL REFERENCES carts (id) ON DELETE CASCADE,
+				product_id          INTEGER NOT NULL,
+				position            INTEGER NOT NULL,
+				product_type        INTEGER NOT NULL,
+				product_name        TEXT NOT NULL,
+				unit_price          REAL NOT NULL,
+				discount            BOOLEAN NOT NULL DEFAULT FALSE,
+				special_price       BOOLEAN NOT NULL DEFAULT FALSE,
+				discount_percentage REAL NOT NULL DEFAULT 0,
+				discount_amount     REAL NOT NULL DEFAULT 0,
+				discounted_price    REAL NOT NULL DEFAULT 0,
+				PRIMARY KEY (cart_id, product_id, position)
+			)`,
+		},
+	},
+	{
+		version:     2,
+		description: "orders",
+		statements: []string{
+			`CREATE TABLE orders (
+				id             INTEGER PRIMARY KEY,
+				user_id        INTEGER NOT NULL REFERENCES users (id),
+				promotions     TEXT NOT NULL DEFAULT '[]',
+				total_price    REAL NOT NULL DEFAULT 0,
+				total_discount REAL NOT NULL DEFAULT 0,
+				status         TEXT NOT NULL,
+				created_at     TIMESTAMP NOT NULL,
+				updated_at     TIMESTAMP NOT NULL
+			)`,
+			`CREATE INDEX orders_user_id ON orders (user_id)`,
+			`CREATE TABLE order_lines (
+				order_id            INTEGER NOT NULL REFERENCES orders (id) ON DELETE CASCADE,
+				position            INTEGER NOT NULL,
+				product_type        INTEGER NOT NULL,
+				product_name        TEXT NOT NULL,
+				unit_price          REAL NOT NULL,
+				discount            BOOLEAN NOT NULL DEFAULT FALSE,
+				special_price       BOOLEAN NOT NULL DEFAULT FALSE,
+				discount_percentage REAL NOT NULL DEFAULT 0,
+				discount_amount     REAL NOT NULL DEFAULT 0,
+				discounted_price    REAL NOT NULL DEFAULT 0,
+				PRIMARY KEY (order_id, position)
+			)`,
+		},
+	},
+	{
+		version:     3,
+		description: "stock holds",
+		statements: []string{
+			`CREATE TABLE stock_holds (
+				user_id    INTEGER NOT NULL REFERENCES users (id),
+				product_id INTEGER NOT NULL REFERENCES products (id),
+				quantity   INTEGER NOT NULL,
+				expires_at TIMESTAMP NOT NULL,
+				PRIMARY KEY (user_id, product_id)
+			)`,
+			`CREATE INDEX stock_holds_product_id ON stock_holds (product_id)`,
+			`CREATE INDEX stock_holds_expires_at ON stock_holds (expires_at)`,
+		},
+	},
+	{
+		version:     4,
+		description: "money in minor units with currency",
+		// existing amounts were unitless dollars, the old REAL columns of the other tables
+		// are left in place as SQLite can't drop them
+		statements: []string{
+			`ALTER TABLE products ADD COLUMN price_minor INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE products ADD COLUMN currency TEXT NOT NULL DEFAULT 'USD'`,
+			`UPDATE products SET price_minor = CAST(ROUND(price * 100) AS INTEGER)`,
+
+			`ALTER TABLE promotions ADD COLUMN special_price_minor INTEGER`,
+			`ALTER TABLE promotions ADD COLUMN currency TEXT NOT NULL DEFAULT 'USD'`,
+			`UPDATE promotions SET special_price_minor = CAST(ROUND(special_price * 100) AS INTEGER) WHERE special_price != 0`,
+
+			`ALTER TABLE carts ADD COLUMN total_price_minor INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE carts ADD COLUMN total_discount_minor INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE carts ADD COLUMN currency TEXT NOT NULL DEFAULT 'USD'`,
+			`UPDATE carts SET total_price_minor = CAST(ROUND(total_price * 100) AS INTEGER), total_discount_minor = CAST(ROUND(total_discount * 100) AS INTEGER)`,
+
+			// lines have NOT NULL prices without a default so they are rebuilt instead
+			`CREATE TABLE cart_lines_minor (
+				cart_id                INTEGER NOT NULL REFERENCES carts (id) ON DELETE CASCADE,
+				product_id             INTEGER NOT NULL,
+				position               INTEGER NOT NULL,
+				product_type           INTEGER NOT NULL,
+				product_name           TEXT NOT NULL,
+				unit_price_minor       INTEGER NOT NULL,
+				discount               BOOLEAN NOT NULL DEFAULT FALSE,
+				special_price          BOOLEAN NOT NULL DEFAULT FALSE,
+				discount_percentage    REAL NOT NULL DEFAULT 0,
+				discount_amount_minor  INTEGER NOT NULL DEFAULT 0,
+				discounted_price_minor INTEGER NOT NULL DEFAULT 0,
+				currency               TEXT NOT NULL,
+				PRIMARY KEY (cart_id, product_id, position)
+			)`,
+			`INSERT INTO cart_lines_minor SELECT cart_id, product_id, position, product_type, product_name, CAST(ROUND(unit_price * 100) AS INTEGER),
+				discount, special_price, discount_percentage, CAST(ROUND(discount_amount * 100) AS INTEGER), CAST(ROUND(discounted_price * 100) AS INTEGER), 'USD'
+				FROM cart_lines`,
+			`DROP TABLE cart_lines`,
+			`ALTER TABLE cart_lines_minor RENAME TO cart_lines`,
+
+			`ALTER TABLE orders ADD COLUMN total_price_minor INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE orders ADD COLUMN total_discount_minor INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE orders ADD COLUMN currency TEXT NOT NULL DEFAULT 'USD'`,
+			`UPDATE orders SET total_price_minor = CAST(ROUND(total_price * 100) AS INTEGER), total_discount_minor = CAST(ROUND(total_discount * 100) AS INTEGER)`,
+
+			`CREATE TABLE order_lines_minor (
+				order_id               INTEGER NOT NULL REFERENCES orders (id) ON DELETE CASCADE,
+				position               INTEGER NOT NULL,
+				product_type           INTEGER NOT NULL,
+				product_name           TEXT NOT NULL,
+				unit_price_minor       INTEGER NOT NULL,
+				discount               BOOLEAN NOT NULL DEFAULT FALSE,
+				special_price          BOOLEAN NOT NULL DEFAULT FALSE,
+				discount_percentage    REAL NOT NULL DEFAULT 0,
+				discount_amount_minor  INTEGER NOT NULL DEFAULT 0,
+				discounted_price_minor INTEGER NOT NULL DEFAULT 0,
+				currency               TEXT NOT NULL,
+				PRIMARY KEY (order_id, position)
+			)`,
+			`INSERT INTO order_lines_minor SELECT order_id, position, product_type, product_name, CAST(ROUND(unit_price * 100) AS INTEGER),
+				discount, special_price, discount_percentage, CAST(ROUND(discount_amount * 100) AS INTEGER), CAST(ROUND(discounted_price * 100) AS INTEGER), 'USD'
+				FROM order_lines`,
+			`DROP TABLE order_lines`,
+			`ALTER TABLE order_lines_minor RENAME TO order_lines`,
+		},
+	},
+	{
+		version:     5,
+		description: "promotion rules and user segments",
+		statements: []string{
+			`CREATE TABLE promotion_rules (
+				id         INTEGER PRIMARY KEY,
+				name       TEXT NOT NULL DEFAULT '',
+				priority   INTEGER NOT NULL DEFAULT 0,
+				conditions TEXT NOT NULL DEFAULT '[]',
+				action     TEXT NOT NULL
+			)`,
+			`ALTER TABLE users ADD COLUMN segments TEXT NOT NULL DEFAULT '[]'`,
+			`ALTER TABLE cart_lines ADD COLUMN promotions TEXT NOT NULL DEFAULT '[]'`,
+			`ALTER TABLE order_lines ADD COLUMN promotions TEXT NOT NULL DEFAULT '[]'`,
+		},
+		apply: upgradeLegacyPromotions,
+	},
+	{
+		version:     6,
+		description: "promotion stacking policies",
+		statements: []string{
+			`ALTER TABLE promotions ADD COLUMN stacking TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE cart_lines ADD COLUMN skipped_promotions TEXT NOT NULL DEFAULT '[]'`,
+			`ALTER TABLE order_lines ADD COLUMN skipped_promotions TEXT NOT NULL DEFAULT '[]'`,
+		},
+	},
+	{
+		version:     7,
+		description: "promotion schedules",
+		statements: []string{
+			`ALTER TABLE promotions ADD COLUMN schedule TEXT NOT NULL DEFAULT 'null'`,
+		},
+	},
+	{
+		version:     8,
+		description: "coupons",
+		statements: []string{
+			`CREATE TABLE coupons (
+				code            TEXT PRIMARY KEY,
+				description     TEXT NOT NULL DEFAULT '',
+				max_redemptions INTEGER NOT NULL DEFAULT 0,
+				max_per_user    INTEGER NOT NULL DEFAULT 0,
+				expires_at      TIMESTAMP,
+				min_spend_minor INTEGER,
+				currency        TEXT NOT NULL DEFAULT ''
+			)`,
+			`CREATE TABLE coupon_redemptions (
+				code        TEXT NOT NULL REFERENCES coupons (code),
+				user_id     INTEGER NOT NULL REFERENCES users (id),
+				order_id    INTEGER NOT NULL REFERENCES orders (id),
+				redeemed_at TIMESTAMP NOT NULL,
+				PRIMARY KEY (order_id)
+			)`,
+			`CREATE INDEX coupon_redemptions_code_user_id ON coupon_redemptions (code, user_id)`,
+			`ALTER TABLE carts ADD COLUMN coupon TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE orders ADD COLUMN coupon TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		version:     9,
+		description: "cart adjustments",
+		statements: []string{
+			`ALTER TABLE carts ADD COLUMN adjustments TEXT NOT NULL DEFAULT 'null'`,
+			`ALTER TABLE orders ADD COLUMN adjustments TEXT NOT NULL DEFAULT 'null'`,
+		},
+	},
+	{
+		version:     10,
+		description: "disabled promotions",
+		statements: []string{
+			`ALTER TABLE promotions ADD COLUMN disabled BOOLEAN NOT NULL DEFAULT 0`,
+		},
+	},
+	{
+		version:     11,
+		description: "user roles",
+		statements: []string{
+			`ALTER TABLE users ADD COLUMN roles TEXT NOT NULL DEFAULT 'null'`,
+		},
+	},
+	{
+		version:     12,
+		description: "hashed passwords",
+		apply:       hashPlaintextPasswords,
+	},
+	{
+		version:     13,
+		description: "access tokens",
+		statements: []string{
+			`CREATE TABLE access_tokens (
+				hash       TEXT PRIMARY KEY,
+				user_id    INTEGER NOT NULL REFERENCES users (id),
+				issued_at  TIMESTAMP NOT NULL,
+				expires_at TIMESTAMP NOT NULL,
+				revoked_at TIMESTAMP
+			)`,
+			`CREATE INDEX access_tokens_expires_at ON access_tokens (expires_at)`,
+			// tokens stored with the user never expire, their users have to log in again
+			`DROP INDEX users_token`,
+			`UPDATE users SET token = ''`,
+		},
+	},
+	{
+		version:     14,
+		description: "refresh tokens",
+		statements: []string{
+			`CREATE TABLE refresh_tokens (
+				hash       TEXT PRIMARY KEY,
+				user_id    INTEGER NOT NULL REFERENCES users (id),
+				family     TEXT NOT NULL,
+				issued_at  TIMESTAMP NOT NULL,
+				expires_at TIMESTAMP NOT NULL,
+				used_at    TIMESTAMP,
+				revoked_at TIMESTAMP
+			)`,
+			`CREATE INDEX refresh_tokens_family ON refresh_tokens (family)`,
+			`CREATE INDEX refresh_tokens_expires_at ON refresh_tokens (expires_at)`,
+		},
+	},
+	{
+		version:     15,
+		description: "single sign-on subjects",
+		statements: []string{
+			`ALTER TABLE users ADD COLUMN subject TEXT NOT NULL DEFAULT ''`,
+			`CREATE UNIQUE INDEX users_subject ON users (subject) WHERE subject != ''`,
+		},
+	},
+	{
+		version:     16,
+		description: "failed logins",
+		statements: []string{
+			`CREATE TABLE login_failures (
+				lock_key     TEXT PRIMARY KEY,
+				count        INTEGER NOT NULL,
+				last_failure TIMESTAMP NOT NULL
+			)`,
+			`CREATE INDEX login_failures_last_failure ON login_failures (last_failure)`,
+		},
+	},
+	{
+		version:     17,
+		description: "guest carts",
+		statements: []string{
+			`ALTER TABLE users ADD COLUMN guest BOOLEAN NOT NULL DEFAULT FALSE`,
+			`CREATE INDEX access_tokens_user_id ON access_tokens (user_id)`,
+		},
+	},
+	{
+		version:     18,
+		description: "named carts",
+		statements: []string{
+			// carts had a unique user_id, SQLite can't drop that so both tables are rebuilt. The old carts are renamed
+			// first so the new lines reference the new carts whether foreign keys are enforced or not.
+			`ALTER TABLE carts RENAME TO carts_single`,
+			`CREATE TABLE carts (
+				id                   INTEGER PRIMARY KEY,
+				user_id              INTEGER NOT NULL REFERENCES users (id),
+				name                 TEXT NOT NULL DEFAULT 'cart',
+				coupon               TEXT NOT NULL DEFAULT '',
+				checkout             TEXT NOT NULL DEFAULT '[]',
+				adjustments          TEXT NOT NULL DEFAULT 'null',
+				total_price_minor    INTEGER NOT NULL DEFAULT 0,
+				total_discount_minor INTEGER NOT NULL DEFAULT 0,
+				currency             TEXT NOT NULL DEFAULT 'USD',
+				UNIQUE (user_id, name)
+			)`,
+			`INSERT INTO carts (id, user_id, coupon, checkout, adjustments, total_price_minor, total_discount_minor, currency)
+				SELECT id, user_id, coupon, checkout, adjustments, total_price_minor, total_discount_minor, currency FROM carts_single`,
+			`CREATE TABLE cart_lines_named (
+				cart_id                INTEGER NOT NULL REFERENCES carts (id) ON DELETE CASCADE,
+				product_id             INTEGER NOT NULL,
+				position               INTEGER NOT NULL,
+				product_type           INTEGER NOT NULL,
+				product_name           TEXT NOT NULL,
+				unit_price_minor       INTEGER NOT NULL,
+				discount               BOOLEAN NOT NULL DEFAULT FALSE,
+				special_price          BOOLEAN NOT NULL DEFAULT FALSE,
+				discount_percentage    REAL NOT NULL DEFAULT 0,
+				discount_amount_minor  INTEGER NOT NULL DEFAULT 0,
+				discounted_price_minor INTEGER NOT NULL DEFAULT 0,
+				currency               TEXT NOT NULL,
+				promotions             TEXT NOT NULL DEFAULT '[]',
+				skipped_promotions     TEXT NOT NULL DEFAULT '[]',
+				PRIMARY KEY (cart_id, product_id, position)
+			)`,
+			`INSERT INTO cart_lines_named (cart_id, product_id, position, product_type, product_name, unit_price_minor, discount, special_price, discount_percentage, discount_amount_minor, discounted_price_minor, currency, promotions, skipped_promotions)
+				SELECT cart_id, product_id, position, product_type, product_name, unit_price_minor, discount, special_price, discount_percentage, discount_amount_minor, discounted_price_minor, currency, promotions, skipped_promotions
+				FROM cart_lines`,
+			`DROP TABLE cart_lines`,
+			`DROP TABLE carts_single`,
+			`ALTER TABLE cart_lines_named RENAME TO cart_lines`,
+			`CREATE INDEX cart_lines_product_id ON cart_lines (product_id)`,
+		},
+	},
+	{
+		version:     19,
+		description: "cart lines with quantities",
+		statements: []string{
+			// carts had a line for every unit, they're grouped by product taking the name and price of the first unit.
+			// Promotions are in the checkout of the cart so the columns for them go.
+			`CREATE TABLE cart_lines_grouped (
+				cart_id          INTEGER NOT NULL REFERENCES carts (id) ON DELETE CASCADE,
+				product_id       INTEGER NOT NULL,
+				product_type     INTEGER NOT NULL,
+				product_name     TEXT NOT NULL,
+				quantity         INTEGER NOT NULL,
+				unit_price_minor INTEGER NOT NULL,
+				currency         TEXT NOT NULL,
+				PRIMARY KEY (cart_id, product_id)
+			)`,
+			`INSERT INTO cart_lines_grouped (cart_id, product_id, product_type, product_name, quantity, unit_price_minor, currency)
+				SELECT l.cart_id, l.product_id, l.product_type, l.product_name, units.quantity, l.unit_price_minor, l.currency
+				FROM cart_lines l JOIN (
+					SELECT cart_id, product_id, MIN(position) AS position, COUNT(*) AS quantity FROM cart_lines GROUP BY cart_id, product_id
+				) units ON units.cart_id = l.cart_id AND units.product_id = l.product_id AND units.position = l.position`,
+			`DROP TABLE cart_lines`,
+			`ALTER TABLE cart_lines_grouped RENAME TO cart_lines`,
+			`CREATE INDEX cart_lines_product_id ON cart_lines (product_id)`,
+			// order lines were single units and didn't record the product
+			`ALTER TABLE order_lines ADD COLUMN product_id INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE order_lines ADD COLUMN quantity INTEGER NOT NULL DEFAULT 1`,
+		},
+	},
+}
+
+// Migrate applies every pending migration, each one in its own transaction
+func (d *SQL) Migrate() error {
+	if _, err := d.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at TIMESTAMP NOT NULL
+	)`); err != nil {
+		return err
+	}
+
+	current, err := d.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := d.tx(func(tx *sql.Tx) error {
+			for _, stmt := range m.statements {
+				if _, err := tx.Exec(stmt); err != nil {
+					return err
+				}
+			}
+			if m.apply != nil {
+				if err := m.apply(tx); err != nil {
+					return err
+				}
+			}
+			_, err := tx.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`, m.version, time.Now().UTC())
+			return err
+		}); err != nil {
+			return err
+		}
+		log.WithField("version", m.version).Infoln("SQL DAO: applied migration -", m.description)
+	}
+	return nil
+}
+
+// SchemaVersion returns the last migration applied to the database, 0 if none
+func (d *SQL) SchemaVersion() (int, error) {
+	var version sql.NullInt64
+	err := d.db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version)
+	if err != nil {
+		// the table is created by the first call to Migrate
+		return 0, nil
+	}
+	return int(version.Int64), nil
+}
+
+// PendingMigrations reports if the database schema is behind the code
+func (d *SQL) PendingMigrations() (bool, error) {
+	version, err := d.SchemaVersion()
+	if err != nil {
+		return false, err
+	}
+	return version < migrations[len(migrations)-1].version, nil
+}
+
+// upgradeLegacyPromotions converts the promotions keyed by product type into promotion rules
+// and replaces the promotions table with the promotion_rules one
+func upgradeLegacyPromotions(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT product_type, quantity_for_discount, products_discounted, discount, quantity_for_special_price, special_price_minor, currency FROM promotions`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	legacy := []*Promotion{}
+	for rows.Next() {
+		p := &Promotion{}
+		var discounted, currency string
+		var specialPrice sql.NullInt64
+		if err := rows.Scan(&p.ProductType, &p.QuantityForDiscount, &discounted, &p.Discount, &p.QuantityForSpecialPrice, &specialPrice, &currency); err != nil {
+			return err
+		}
+		if specialPrice.Valid {
+			p.SpecialPrice = &Money{Amount: specialPrice.Int64, Currency: currency}
+		}
+		if err := json.Unmarshal([]byte(discounted), &p.ProductsDiscounted); err != nil {
+			return err
+		}
+		legacy = append(legacy, p)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	if _, err := tx.Exec(`DROP TABLE promotions`); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`ALTER TABLE promotion_rules RENAME TO promotions`); err != nil {
+		return err
+	}
+	// the DAO helpers follow the latest schema so rows are written as the schema is at this version
+	for _, p := range upgradePromotions(legacy) {
+		conditions, err := json.Marshal(p.Conditions)
+		if err != nil {
+			return err
+		}
+		action, err := json.Marshal(p.Action)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO promotions (id, name, priority, conditions, action) VALUES (?, ?, ?, ?, ?)`,
+			p.ID, p.Name, p.Priority, string(conditions), string(action)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hashPlaintextPasswords replaces the passwords stored in plain text with their hash
+func hashPlaintextPasswords(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT id, username, password FROM users`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	users := []*User{}
+	for rows.Next() {
+		u := &User{}
+		if err := rows.Scan(&u.ID, &u.Username, &u.Password); err != nil {
+			return err
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	for _, u := range users {
+		if isPasswordHash(u.Password) {
+			continue
+		}
+		hash, err := hashPassword(u.Password)
+		if err != nil {
+			return fmt.Errorf("user %s: %v", u.Username, err)
+		}
+		if _, err := tx.Exec(`UPDATE users SET password = ? WHERE id = ?`, hash, u.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package shopping
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// accessTokenBytes of randomness go into every access token
+const accessTokenBytes = 32
+
+const (
+	// defaultTokenTTL is how long access tokens last unless the service is given another duration
+	defaultTokenTTL = 24 * time.Hour
+	// defaultRefreshTTL is how long refresh tokens last unless the service is given another duration
+	defaultRefreshTTL = 30 * 24 * time.Hour
+)
+
+// tokenPair is handed out on login and when refreshing tokens
+type tokenPair struct {
+	Token            string    `json:"token"`
+	ExpiresAt        time.Time `json:"expires_at"`
+	RefreshToken     string    `json:"refresh_token"`
+	RefreshExpiresAt time.Time `json:"refresh_expires_at"`
+}
+
+// newAccessToken returns a random token that can be handed out to a user
+func newAccessToken() (string, error) {
+	b := make([]byte, accessTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashAccessToken returns the hash access tokens are stored by, so a copy of the storage can't be used to log in
+func hashAccessToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueTokens hands out an access token and a refresh token starting a new family to the user
+func (s *Service) issueTokens(user *User) (*tokenPair, error) {
+	refresh, record, err := s.newRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	family, err := newAccessToken()
+	if err != nil {
+		return nil, err
+	}
+	record.UserID = user.ID
+	record.Family = hashAccessToken(family)
+	if err := s.dao.CreateRefreshToken(record); err != nil {
+		return nil, err
+	}
+	return s.pairTokens(user, refresh, record)
+}
+
+// refreshTokens exchanges a refresh token for a new access token and the next refresh token of its family
+func (s *Service) refreshTokens(refresh string) (*tokenPair, *Error) {
+	next, record, err := s.newRefreshToken()
+	if err != nil {
+		return nil, errInternalServerError.msg("newRefreshToken: " + err.Error())
+	}
+	if err := s.dao.RotateRefreshToken(hashAccessToken(refresh), record); err != nil {
+		return nil, toError(err, "dao.RotateRefreshToken")
+	}
+	user, err := s.dao.GetUserByID(record.UserID)
+	if err == errUserNotFound {
+		return nil, errInvalidRefreshToken.msg(fmt.Sprintf("user %d of the refresh token doesn't exist", record.UserID))
+	}
+	if err != nil {
+		return nil, errInternalServerError.msg("dao.GetUserByID: " + err.Error())
+	}
+	pair, err := s.pairTokens(user, next, record)
+	if err != nil {
+		return nil, errInternalServerError.msg("pairTokens: " + err.Error())
+	}
+	return pair, nil
+}
+
+// pairTokens hands out a new access token, a JWT when the service signs them, along with the refresh token
+func (s *Service) pairTokens(user *User, refresh string, record *RefreshToken) (*tokenPair, error) {
+	pair := &tokenPair{RefreshToken: refresh, RefreshExpiresAt: record.ExpiresAt}
+	if s.jwt != nil {
+		token, expiresAt, err := s.jwt.sign(user, s.now().UTC())
+		if err != nil {
+			return nil, err
+		}
+		pair.Token, pair.ExpiresAt = token, expiresAt
+		return pair, nil
+	}
+	token, session, err := s.issueAccessToken(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	pair.Token, pair.ExpiresAt = token, session.ExpiresAt
+	return pair, nil
+}
+
+// newRefreshToken returns a refresh token to hand out and the record to store of it without user or family
+func (s *Service) newRefreshToken() (string, *RefreshToken, error) {
+	token, err := newAccessToken()
+	if err != nil {
+		return "", nil, err
+	}
+	now := s.now().UTC()
+	return token, &RefreshToken{Hash: hashAccessToken(token), IssuedAt: now, ExpiresAt: now.Add(s.refreshTTL)}, nil
+}
+
+// issueAccessToken stores a new session for the user and returns the token to hand out
+func (s *Service) issueAccessToken(userID int) (string, *AccessToken, error) {
+	token, err := newAccessToken()
+	if err != nil {
+		return "", nil, err
+	}
+	now := s.now().UTC()
+	session := &AccessToken{
+		Hash:      hashAccessToken(token),
+		UserID:    userID,
+		IssuedAt:  now,
+		ExpiresAt: now.Add(s.tokenTTL),
+	}
+	if err := s.dao.CreateAccessToken(session); err != nil {
+		return "", nil, err
+	}
+	return token, session, nil
+}
+
+// authenticate returns the user of an access token, either a JWT or an opaque token. The session is only returned for
+// opaque tokens as JWTs aren't stored.
+func (s *Service) authenticate(token string) (*User, *AccessToken, *Error) {
+	var userID int
+	var session *AccessToken
+	if s.jwt != nil && isJWT(token) {
+		id, err := s.jwt.verify(token, s.now())
+		if err != nil {
+			return nil, nil, errInvalidAccessToken.msg(err.Error())
+		}
+		userID = id
+	} else {
+		var tokenErr *Error
+		session, tokenErr = s.checkAccessToken(token)
+		if tokenErr != nil {
+			return nil, nil, tokenErr
+		}
+		userID = session.UserID
+	}
+
+	user, err := s.dao.GetUserByID(userID)
+	if err == errUserNotFound {
+		return nil, nil, errInvalidAccessToken.msg(fmt.Sprintf("user %d of the access token doesn't exist", userID))
+	}
+	if err != nil {
+		return nil, nil, errInternalServerError.msg("dao.GetUserByID: " + err.Error())
+	}
+	return user, session, nil
+}
+
+// checkAccessToken returns the session of token, failing if it doesn't exist, has expired or has been revoked
+func (s *Service) checkAccessToken(token string) (*AccessToken, *Error) {
+	session, err := s.dao.GetAccessToken(hashAccessToken(token))
+	if err == errAccessTokenNotFound {
+		return nil, errInvalidAccessToken.msg("unknown access token")
+	}
+	if err != nil {
+		return nil, toError(err, "dao.GetAccessToken")
+	}
+	if session.RevokedAt != nil {
+		return nil, errInvalidAccessToken.msg("access token revoked at " + session.RevokedAt.Format(time.RFC3339))
+	}
+	if !s.now().Before(session.ExpiresAt) {
+		return nil, errInvalidAccessToken.msg("access token expired at " + session.ExpiresAt.Format(time.RFC3339))
+	}
+	return session, nil
+}
+
+// SweepExpiredTokens deletes access and refresh tokens that have expired, and guests whose cart tokens have, every
+// interval until stop is closed
+func (s *Service) SweepExpiredTokens(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			deleted, err := s.dao.DeleteExpiredAccessTokens(s.now().UTC())
+			if err != nil {
+				log.WithError(err).Errorln("failed to delete expired access tokens")
+				continue
+			}
+			if deleted > 0 {
+				log.WithField("deleted", deleted).Infoln("deleted expired access tokens")
+			}
+			deleted, err = s.dao.DeleteExpiredRefreshTokens(s.now().UTC())
+			if err != nil {
+				log.WithError(err).Errorln("failed to delete expired refresh tokens")
+				continue
+			}
+			if deleted > 0 {
+				log.WithField("deleted", deleted).Infoln("deleted expired refresh tokens")
+			}
+			deleted, err = s.dao.DeleteExpiredGuests(s.now().UTC())
+			if err != nil {
+				log.WithError(err).Errorln("failed to delete expired guests")
+				continue
+			}
+			if deleted > 0 {
+				log.WithField("deleted", deleted).Infoln("deleted expired guests and their carts")
+			}
+		}
+	}
+}
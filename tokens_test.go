@@ -0,0 +1,76 @@
+package shopping
+
+import (
+	"testing"
+)
+
+func TestRefreshTokenReuseRevokesFamily(t *testing.T) {
+	// each storage is opened again from the same directory, a memory one is kept as it is
+	for name, open := range map[string]func(t *testing.T, dir string, previous DAO) DAO{
+		"memory": func(t *testing.T, dir string, previous DAO) DAO {
+			if previous != nil {
+				return previous
+			}
+			return NewMemory()
+		},
+		"file": func(t *testing.T, dir string, previous DAO) DAO {
+			if previous != nil {
+				if err := previous.(*File).Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			f, err := NewFile(dir, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { f.Close() })
+			return f
+		},
+		"sql": func(t *testing.T, dir string, previous DAO) DAO {
+			if previous != nil {
+				if err := previous.(*SQL).Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			return newTestSQL(t, dir)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := tempDir(t)
+			dao := open(t, dir, nil)
+			s := newTestService(t, dao)
+			user := &User{Username: "shopper"}
+			if err := dao.CreateUser(user); err != nil {
+				t.Fatal(err)
+			}
+			stolen, err := s.issueTokens(user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			other, err := s.issueTokens(user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rotated, refreshErr := s.refreshTokens(stolen.RefreshToken)
+			if refreshErr != nil {
+				t.Fatal(refreshErr)
+			}
+			// whoever stole the first refresh token uses it after the user did
+			if _, err := s.refreshTokens(stolen.RefreshToken); !hasCode(err, errInvalidRefreshToken) {
+				t.Errorf("reused refresh token: %v, want %v", err, errInvalidRefreshToken)
+			}
+
+			dao = open(t, dir, dao)
+			s = newTestService(t, dao)
+			if _, err := s.refreshTokens(rotated.RefreshToken); !hasCode(err, errInvalidRefreshToken) {
+				t.Errorf("token rotated before the reuse: %v, want %v", err, errInvalidRefreshToken)
+			}
+			if _, err := s.refreshTokens(stolen.RefreshToken); !hasCode(err, errInvalidRefreshToken) {
+				t.Errorf("reused refresh token after opening the storage again: %v, want %v", err, errInvalidRefreshToken)
+			}
+			if _, err := s.refreshTokens(other.RefreshToken); err != nil {
+				t.Errorf("refresh token of another login: %v", err)
+			}
+		})
+	}
+}
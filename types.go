@@ -1,68 +1,619 @@
 package shopping
 
-const ()
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// OrderStatus describes the state of an order
+type OrderStatus string
+
+const (
+	// OrderStatusCompleted is an order that has been paid and removed from stock
+	OrderStatusCompleted OrderStatus = "completed"
+)
 
 // Service config for the API, different components can be attached to it
 type Service struct {
-	environment string
-	dao         DAO
+	environment     string
+	dao             DAO
+	holdDuration    time.Duration // how long stock is held for items added to a cart, 0 disables holds
+	shipping        Money         // fee charged for every cart with items, zero when shipping is free
+	tokenTTL        time.Duration // how long access tokens last
+	refreshTTL      time.Duration // how long refresh tokens last
+	guestTTL        time.Duration // how long the carts of guests last
+	jwt             *jwtSigner    // signs access tokens as JWTs, nil hands out opaque tokens
+	hooks           []EventHook   // told about events such as products coming back in stock
+	oidc            *oidcProvider // lets users sign in with single sign-on, nil when it's disabled
+	lockout         lockoutPolicy // how failed logins slow down and lock out further attempts
+	maxLineQuantity int           // most units of a product a cart can have
+	now             func() time.Time
+
+	ratesMu sync.RWMutex
+	rates   *ExchangeRates // nil when prices are only shown in the currency they're stored in
 }
 
 // Product describes the representation of products to be available in the shop
 type Product struct {
-	ID    int     `json:"id,omitempty"` // a number works now but it may be better to use UUIDs
-	Type  int     `json:"type,omitempty"`
-	Name  string  `json:"name,omitempty"`
-	Stock int     `json:"stock,omitempty"`
-	Price float64 `json:"price,omitempty"` //float64 can be used safely assuming the precision in the nnumber representation is not crucial
+	ID        int    `json:"id,omitempty"` // a number works now but it may be better to use UUIDs
+	Type      int    `json:"type,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Stock     int    `json:"stock,omitempty"` // on hand
+	Available int    `json:"available"`       // on hand minus stock held in carts, only set when reading products
+	Price     Money  `json:"price"`
 }
 
-// Promotion describes model to have different promotions with discounts/special price
+// StockHold is stock set aside for a user who has the product in their cart
+type StockHold struct {
+	UserID    int       `json:"user_id"`
+	ProductID int       `json:"product_id"`
+	Quantity  int       `json:"quantity"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Promotion is a rule made of conditions on the cart and an action on the items in it,
+// a product can be targeted by any number of promotions
 type Promotion struct {
+	ID         int            `json:"id,omitempty"`
+	Name       string         `json:"name,omitempty"`
+	Priority   int            `json:"priority,omitempty"`   // promotions are evaluated by ascending priority and then ID
+	Stacking   StackingPolicy `json:"stacking,omitempty"`   // how it combines with other promotions on the same item
+	Schedule   *Schedule      `json:"schedule,omitempty"`   // when the promotion is active, always when nil
+	Conditions []*Condition   `json:"conditions,omitempty"` // all must be met, a promotion without conditions always applies
+	Action     *Action        `json:"action,omitempty"`
+	Disabled   bool           `json:"disabled,omitempty"` // disabled promotions are kept but never applied
+
+	// Deprecated: promotions used to be keyed by product type with the fields below,
+	// they are still read from old config files and storage and converted by upgradePromotions
 	ProductType             int     `json:"product_type,omitempty"`
 	QuantityForDiscount     int     `json:"quantity_needed,omitempty"`
 	ProductsDiscounted      []int   `json:"products_discounted,omitempty"` // array of product types
 	Discount                float64 `json:"discount,omitempty"`            // from 0 to 100
 	QuantityForSpecialPrice int     `json:"quantity_for_special_price,omitempty"`
-	SpecialPrice            float64 `json:"special_price,omitempty"` // for cases where extra items cost less
+	SpecialPrice            *Money  `json:"special_price,omitempty"` // for cases where extra items cost less
 }
 
-// Cart describes the shopping cart of a user
+// Coupon is a code users enter in their cart, promotions with a coupon condition only apply to carts with the code
+type Coupon struct {
+	Code           string     `json:"code"` // stored in upper case, codes are case insensitive
+	Description    string     `json:"description,omitempty"`
+	MaxRedemptions int        `json:"max_redemptions,omitempty"` // across all users, 0 is no limit
+	MaxPerUser     int        `json:"max_per_user,omitempty"`    // 0 is no limit
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	MinSpend       *Money     `json:"min_spend,omitempty"` // cart subtotal before discounts, in the base currency
+	Redeemed       int        `json:"redeemed"`            // times redeemed so far, only set when reading
+}
+
+// CouponRedemption records a coupon used to buy an order
+type CouponRedemption struct {
+	Code       string    `json:"code"`
+	UserID     int       `json:"user_id"`
+	OrderID    int       `json:"order_id"`
+	RedeemedAt time.Time `json:"redeemed_at"`
+}
+
+// Cart describes the shopping cart of a user, users also keep named carts such as their wishlist
+// that can't be bought until their items are moved to the active cart
 type Cart struct {
-	ID            int                    `json:"id"`
-	UserID        int                    `json:"user_id"`
-	Products      map[int][]*CartProduct `json:"products"`
-	Checkout      []*CartProduct         `json:"checkout,omitempty"`
-	TotalPrice    float64                `json:"total_price,omitempty"`
-	TotalDiscount float64                `json:"total_discount,omitempty"`
+	ID            int            `json:"id"`
+	UserID        int            `json:"user_id"`
+	Name          string         `json:"name"` // CartNameActive for the cart that's checked out and bought
+	Coupon        string         `json:"coupon,omitempty"`
+	Products      CartLines      `json:"products"`
+	Checkout      []*CartProduct `json:"checkout,omitempty"`
+	Adjustments   []*Adjustment  `json:"adjustments,omitempty"` // shipping and discounts on the whole cart, after the checkout lines
+	TotalPrice    Money          `json:"total_price"`
+	TotalDiscount Money          `json:"total_discount"`
+}
+
+// CartLine is a product in a cart and how many units of it there are, the name and price are the ones the product had
+// when it was last added
+type CartLine struct {
+	ProductID   int    `json:"product_id"`
+	ProductType int    `json:"product_type,omitempty"`
+	ProductName string `json:"product_name,omitempty"`
+	Quantity    int    `json:"quantity"`
+	UnitPrice   Money  `json:"unit_price"`
+}
+
+// CartLines holds the lines of a cart by product ID
+type CartLines map[int]*CartLine
+
+// Order is the receipt of a bought cart, lines and promotions are copied at the time of buying
+type Order struct {
+	ID            int            `json:"id"`
+	UserID        int            `json:"user_id"`
+	Lines         []*CartProduct `json:"lines"`
+	Adjustments   []*Adjustment  `json:"adjustments,omitempty"`
+	Promotions    []*Promotion   `json:"promotions,omitempty"` // promotions applied to the lines
+	Coupon        string         `json:"coupon,omitempty"`     // redeemed when the order was created
+	TotalPrice    Money          `json:"total_price"`
+	TotalDiscount Money          `json:"total_discount"`
+	Status        OrderStatus    `json:"status"`
+	CreatedAt     time.Time      `json:"created_at"`
+	UpdatedAt     time.Time      `json:"updated_at"`
+}
+
+const (
+	// CartNameActive is the name of the cart that's checked out and bought, every user has one
+	CartNameActive = "cart"
+	// CartNameWishlist is the named cart of the products a user wants, they're told when one comes back in stock
+	CartNameWishlist = "wishlist"
+)
+
+// AdjustmentType names what an adjustment line is for
+type AdjustmentType string
+
+const (
+	// AdjustmentShipping is the shipping fee of the cart
+	AdjustmentShipping AdjustmentType = "shipping"
+	// AdjustmentDiscount is a promotion taking money off the whole cart or waiving shipping
+	AdjustmentDiscount AdjustmentType = "discount"
+)
+
+// Adjustment is a checkout line that applies to the whole cart rather than to an item
+type Adjustment struct {
+	Type        AdjustmentType `json:"type"`
+	PromotionID int            `json:"promotion_id,omitempty"` // discount
+	Description string         `json:"description,omitempty"`
+	Amount      Money          `json:"amount"` // negative for discounts
 }
 
 // User model
 type User struct {
-	ID       int    `json:"id,omitempty"`
-	Username string `json:"username,omitempty"`
-	Password string `json:"password,omitempty"`
-	Token    string `json:"token,omitempty"`
+	ID       int      `json:"id,omitempty"`
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+	Subject  string   `json:"subject,omitempty"`  // ID given by the identity provider to users signing in with single sign-on
+	Segments []string `json:"segments,omitempty"` // groups of customers promotions can target
+	Roles    []Role   `json:"roles,omitempty"`    // what the user is allowed to do, customer when empty
+	Guest    bool     `json:"guest,omitempty"`    // shopper who hasn't logged in, they can only use their cart
 }
 
-// CartProduct describes the products in a cart
-// where the key is the product ID and the value is the quantity
+// AccessToken is a session of a user, only the SHA-256 hash of the token handed out is stored
+type AccessToken struct {
+	Hash      string     `json:"hash"`
+	UserID    int        `json:"user_id"`
+	IssuedAt  time.Time  `json:"issued_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"` // set on logout
+}
+
+// RefreshToken is exchanged for a new access token and a new refresh token, each one can be used only once.
+// Tokens rotated from the same login share a family, when a used token is presented again the whole family is revoked
+// as either the user or whoever stole the token has a newer one.
+type RefreshToken struct {
+	Hash      string     `json:"hash"` // SHA-256 of the token handed out
+	UserID    int        `json:"user_id"`
+	Family    string     `json:"family"`
+	IssuedAt  time.Time  `json:"issued_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// LoginFailures counts the failed logins of a username or from an IP address, they're forgotten some time after the
+// last one
+type LoginFailures struct {
+	Key   string    `json:"key"` // user:<username> or ip:<address>
+	Count int       `json:"count"`
+	Last  time.Time `json:"last"`
+}
+
+// record counts a failure at the given time, starting over when the last one was resetAfter ago or longer
+func (f *LoginFailures) record(at time.Time, resetAfter time.Duration) {
+	if f.Count > 0 && at.Sub(f.Last) >= resetAfter {
+		f.Count = 0
+	}
+	f.Count++
+	f.Last = at
+}
+
+// Role grants access to a group of endpoints
+type Role string
+
+const (
+	// RoleCustomer can shop, it's the role of users without roles
+	RoleCustomer Role = "customer"
+	// RoleMerchandiser can manage and simulate promotions
+	RoleMerchandiser Role = "merchandiser"
+	// RoleAdmin can do anything
+	RoleAdmin Role = "admin"
+)
+
+// validRoles are the roles users can have
+var validRoles = map[Role]bool{RoleCustomer: true, RoleMerchandiser: true, RoleAdmin: true}
+
+// CartProduct is a checkout or order line, units of a product priced the same way are grouped in one line and prices
+// are per unit
 type CartProduct struct {
-	ProductType        int     `json:"product_type,omitempty"`
-	ProductName        string  `json:"product_name,omitempty"`
-	UnitPrice          float64 `json:"unit_price,omitempty"`
-	Discount           bool    `json:"discount,omitempty"`
-	SpecialPrice       bool    `json:"special_price,omitempty"`
-	DiscountPercentage float64 `json:"discount_percentage,omitempty"`
-	DiscountAmount     float64 `json:"discount_amount,omitempty"`
-	DiscountedPrice    float64 `json:"discounted_price,omitempty"`
+	ProductID          int                 `json:"product_id,omitempty"`
+	Quantity           int                 `json:"quantity"`
+	ProductType        int                 `json:"product_type,omitempty"`
+	ProductName        string              `json:"product_name,omitempty"`
+	UnitPrice          Money               `json:"unit_price"`
+	Discount           bool                `json:"discount,omitempty"`
+	SpecialPrice       bool                `json:"special_price,omitempty"`
+	DiscountPercentage float64             `json:"discount_percentage,omitempty"`
+	DiscountAmount     Money               `json:"discount_amount"`
+	DiscountedPrice    Money               `json:"discounted_price"`
+	Promotions         []int               `json:"promotions,omitempty"`         // IDs of the promotions applied, in order
+	SkippedPromotions  []*SkippedPromotion `json:"skipped_promotions,omitempty"` // promotions that targeted the item but weren't applied
 }
 
 // Products map to hold all products by id
 type Products map[int]*Product
 
-// Promotions map to hold all promotions by product type
+// Promotions map to hold all promotions by ID
 type Promotions map[int]*Promotion
 
 // Users map to hold all users by id
 type Users map[int]*User
+
+func (c *Cart) empty() bool {
+	for _, line := range c.Products {
+		if line.Quantity > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// quantities returns the number of units in the cart by product ID
+func (c *Cart) quantities() map[int]int {
+	quantities := map[int]int{}
+	for id, line := range c.Products {
+		if line.Quantity > 0 {
+			quantities[id] = line.Quantity
+		}
+	}
+	return quantities
+}
+
+// lines returns a checkout line for every line in the cart ordered by product ID so promotions always see the units
+// in the same order, promotions split them when they only apply to some of the units
+func (c *Cart) lines() []*CartProduct {
+	ids := make([]int, 0, len(c.Products))
+	for id := range c.Products {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	lines := []*CartProduct{}
+	for _, id := range ids {
+		line := c.Products[id]
+		if line.Quantity < 1 {
+			continue
+		}
+		checkout := &CartProduct{ProductID: id, Quantity: line.Quantity, ProductType: line.ProductType, ProductName: line.ProductName, UnitPrice: line.UnitPrice}
+		checkout.resetPrice()
+		lines = append(lines, checkout)
+	}
+	return lines
+}
+
+// subtotal returns the price of the items in the cart before any discount
+func (c *Cart) subtotal() Money {
+	var subtotal Money
+	for _, line := range c.Products {
+		subtotal = subtotal.Add(line.UnitPrice.Mul(int64(line.Quantity)))
+	}
+	return subtotal
+}
+
+// clear removes all products, the coupon and any previous checkout from the cart
+func (c *Cart) clear() {
+	c.Coupon = ""
+	c.Products = CartLines{}
+	c.Checkout = []*CartProduct{}
+	c.Adjustments = nil
+	c.TotalPrice = Money{}
+	c.TotalDiscount = Money{}
+}
+
+// groupLines merges consecutive lines of the same product priced the same way, such as those split by a promotion
+// that didn't lower their price
+func groupLines(split []*CartProduct) []*CartProduct {
+	lines := []*CartProduct{}
+	for _, line := range split {
+		if n := len(lines); n > 0 && lines[n-1].pricedAs(line) {
+			lines[n-1].Quantity += line.Quantity
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// pricedAs reports if o is the same product as p with the same price and promotions
+func (p *CartProduct) pricedAs(o *CartProduct) bool {
+	if p.ProductID != o.ProductID || p.ProductType != o.ProductType || p.ProductName != o.ProductName ||
+		p.UnitPrice != o.UnitPrice || p.DiscountedPrice != o.DiscountedPrice || p.DiscountAmount != o.DiscountAmount ||
+		p.Discount != o.Discount || p.SpecialPrice != o.SpecialPrice || p.DiscountPercentage != o.DiscountPercentage ||
+		len(p.Promotions) != len(o.Promotions) || len(p.SkippedPromotions) != len(o.SkippedPromotions) {
+		return false
+	}
+	for i, id := range p.Promotions {
+		if o.Promotions[i] != id {
+			return false
+		}
+	}
+	for i, skipped := range p.SkippedPromotions {
+		if *o.SkippedPromotions[i] != *skipped {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *Product) copy() *Product {
+	if p == nil {
+		return nil
+	}
+	c := *p
+	return &c
+}
+
+func (p *Promotion) copy() *Promotion {
+	if p == nil {
+		return nil
+	}
+	c := *p
+	c.ProductsDiscounted = append([]int(nil), p.ProductsDiscounted...)
+	if p.SpecialPrice != nil {
+		price := *p.SpecialPrice
+		c.SpecialPrice = &price
+	}
+	if p.Conditions != nil {
+		c.Conditions = make([]*Condition, len(p.Conditions))
+		for i, condition := range p.Conditions {
+			c.Conditions[i] = condition.copy()
+		}
+	}
+	c.Action = p.Action.copy()
+	c.Schedule = p.Schedule.copy()
+	return &c
+}
+
+func (c *Condition) copy() *Condition {
+	if c == nil {
+		return nil
+	}
+	condition := *c
+	if c.MinSubtotal != nil {
+		subtotal := *c.MinSubtotal
+		condition.MinSubtotal = &subtotal
+	}
+	return &condition
+}
+
+func (a *Action) copy() *Action {
+	if a == nil {
+		return nil
+	}
+	action := *a
+	action.ProductTypes = append([]int(nil), a.ProductTypes...)
+	if a.Amount != nil {
+		amount := *a.Amount
+		action.Amount = &amount
+	}
+	return &action
+}
+
+func (c *Coupon) copy() *Coupon {
+	if c == nil {
+		return nil
+	}
+	coupon := *c
+	if c.ExpiresAt != nil {
+		expiresAt := *c.ExpiresAt
+		coupon.ExpiresAt = &expiresAt
+	}
+	if c.MinSpend != nil {
+		minSpend := *c.MinSpend
+		coupon.MinSpend = &minSpend
+	}
+	return &coupon
+}
+
+func (t *AccessToken) copy() *AccessToken {
+	if t == nil {
+		return nil
+	}
+	c := *t
+	if t.RevokedAt != nil {
+		revokedAt := *t.RevokedAt
+		c.RevokedAt = &revokedAt
+	}
+	return &c
+}
+
+func (t *RefreshToken) copy() *RefreshToken {
+	if t == nil {
+		return nil
+	}
+	c := *t
+	if t.UsedAt != nil {
+		usedAt := *t.UsedAt
+		c.UsedAt = &usedAt
+	}
+	if t.RevokedAt != nil {
+		revokedAt := *t.RevokedAt
+		c.RevokedAt = &revokedAt
+	}
+	return &c
+}
+
+// checkRotation returns why the token can't be exchanged at now, nil when it can. reused is true when the token has
+// been exchanged before and its family has to be revoked.
+func (t *RefreshToken) checkRotation(now time.Time) (reused bool, err error) {
+	switch {
+	case t.RevokedAt != nil:
+		return false, errInvalidRefreshToken.msg("refresh token revoked at " + t.RevokedAt.Format(time.RFC3339))
+	case t.UsedAt != nil:
+		return true, errInvalidRefreshToken.msg("refresh token used before at " + t.UsedAt.Format(time.RFC3339) + ", revoking its family")
+	case !now.Before(t.ExpiresAt):
+		return false, errInvalidRefreshToken.msg("refresh token expired at " + t.ExpiresAt.Format(time.RFC3339))
+	}
+	return false, nil
+}
+
+func (u *User) copy() *User {
+	if u == nil {
+		return nil
+	}
+	c := *u
+	c.Segments = append([]string(nil), u.Segments...)
+	c.Roles = append([]Role(nil), u.Roles...)
+	return &c
+}
+
+// hasRole reports if the user has any of roles, admins have every role and users without roles are customers
+func (u *User) hasRole(roles ...Role) bool {
+	granted := u.Roles
+	if len(granted) == 0 {
+		granted = []Role{RoleCustomer}
+	}
+	for _, g := range granted {
+		if g == RoleAdmin {
+			return true
+		}
+		for _, r := range roles {
+			if g == r {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// inSegment reports if the user belongs to segment
+func (u *User) inSegment(segment string) bool {
+	for _, s := range u.Segments {
+		if s == segment {
+			return true
+		}
+	}
+	return false
+}
+
+// split takes the first n units out of the line and returns them as a line of their own
+func (p *CartProduct) split(n int) *CartProduct {
+	head := p.copy()
+	head.Quantity = n
+	p.Quantity -= n
+	return head
+}
+
+func (p *CartProduct) copy() *CartProduct {
+	if p == nil {
+		return nil
+	}
+	c := *p
+	c.Promotions = append([]int(nil), p.Promotions...)
+	if p.SkippedPromotions != nil {
+		c.SkippedPromotions = make([]*SkippedPromotion, len(p.SkippedPromotions))
+		for i, skipped := range p.SkippedPromotions {
+			s := *skipped
+			c.SkippedPromotions[i] = &s
+		}
+	}
+	return &c
+}
+
+// resetPrice removes every promotion applied to the item
+func (p *CartProduct) resetPrice() {
+	p.Discount = false
+	p.SpecialPrice = false
+	p.DiscountPercentage = 0
+	p.DiscountAmount = Money{Currency: p.UnitPrice.Currency}
+	p.DiscountedPrice = p.UnitPrice
+	p.Promotions = nil
+	p.SkippedPromotions = nil
+}
+
+// skip records why a promotion wasn't applied to the item
+func (p *CartProduct) skip(promotionID int, reason string) {
+	p.SkippedPromotions = append(p.SkippedPromotions, &SkippedPromotion{PromotionID: promotionID, Reason: reason})
+}
+
+func (c *Cart) copy() *Cart {
+	if c == nil {
+		return nil
+	}
+	cart := *c
+	cart.Products = make(CartLines, len(c.Products))
+	for id, line := range c.Products {
+		l := *line
+		cart.Products[id] = &l
+	}
+	if c.Checkout != nil {
+		cart.Checkout = make([]*CartProduct, len(c.Checkout))
+		for i, p := range c.Checkout {
+			cart.Checkout[i] = p.copy()
+		}
+	}
+	cart.Adjustments = copyAdjustments(c.Adjustments)
+	return &cart
+}
+
+func (o *Order) copy() *Order {
+	if o == nil {
+		return nil
+	}
+	order := *o
+	order.Lines = make([]*CartProduct, len(o.Lines))
+	for i, p := range o.Lines {
+		order.Lines[i] = p.copy()
+	}
+	order.Adjustments = copyAdjustments(o.Adjustments)
+	order.Promotions = make([]*Promotion, len(o.Promotions))
+	for i, p := range o.Promotions {
+		order.Promotions[i] = p.copy()
+	}
+	return &order
+}
+
+// replaceProduct returns an update that overwrites a product with p
+func replaceProduct(p *Product) func(*Product) error {
+	return func(product *Product) error {
+		*product = *p.copy()
+		return nil
+	}
+}
+
+// replacePromotion returns an update that overwrites a promotion with p
+func replacePromotion(p *Promotion) func(*Promotion) error {
+	return func(promotion *Promotion) error {
+		*promotion = *p.copy()
+		return nil
+	}
+}
+
+func copyAdjustments(adjustments []*Adjustment) []*Adjustment {
+	if adjustments == nil {
+		return nil
+	}
+	c := make([]*Adjustment, len(adjustments))
+	for i, a := range adjustments {
+		adjustment := *a
+		c[i] = &adjustment
+	}
+	return c
+}
+
+func (p Products) copy() Products {
+	c := make(Products, len(p))
+	for id, product := range p {
+		c[id] = product.copy()
+	}
+	return c
+}
+
+func (p Promotions) copy() Promotions {
+	c := make(Promotions, len(p))
+	for id, promotion := range p {
+		c[id] = promotion.copy()
+	}
+	return c
+}